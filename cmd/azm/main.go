@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/google/uuid"
@@ -116,16 +119,39 @@ func printUsage(extended bool) {
 		"  -id                              Display the currently configured login values\n"+
 		"  -id TenantId Username            Set up user credentials for interactive login\n"+
 		"  -id TenantId ClientId Secret     Configure ID for automated login\n"+
+		"  -id TenantId ClientId -cert CertFile [Password]\n"+
+		"                                   Configure ID for automated login with a PEM or PFX certificate\n"+
+		"  -id TenantId ClientId TokenFile  Configure ID for automated login with a federated OIDC token file\n"+
+		"  -idc                             Log in through the credential chain, and show the links that\n"+
+		"                                   produced the tokens\n"+
+		"  -idl                             List the credentials file profiles, marking the default one\n"+
+		"  -idd NAME                        Make profile NAME the default one\n"+
+		"  -idrm NAME                       Remove profile NAME and its token cache\n"+
+		"  -p NAME ...                      Use profile NAME for the rest of the command, e.g. to set it up\n"+
+		"                                   with '-p NAME -id ...', or to query it with '-p NAME -ap'\n"+
 		"  -tx                              Delete the current token and other configured login values\n"+
+		"  -encrypt                         Encrypt existing token caches and credentials file in place, with\n"+
+		"                                   the MAZ_CACHE_KEY passphrase or MAZ_CACHE_KEYFILE key file\n"+
+		"  -decrypt                         Decrypt all encrypted files in place\n"+
+		"  -keygen FILE                     Create a new random key file for MAZ_CACHE_KEYFILE\n"+
 		"  -xx                              Delete ALL local file cache\n"+
 		"  -%sx                              Delete %s object local file cache\n"+
 		"  -tmg                             Display current Microsoft Graph API access token\n"+
 		"  -taz                             Display current Azure Resource API access token\n"+
-		"  -td \"TokenString\"                Decode given JWT token string\n"+
+		"  -tmga, -taza                     Analyze current MS Graph or Azure Resource API access token: identity,\n"+
+		"                                   scopes, roles, active directory roles and time left\n"+
+		"  -td \"TokenString\"                Decode given JWT token string, and analyze it like -tmga\n"+
+		"  -td \"TokenString\" JWKSFILE       Decode given JWT token string, verifying it offline against\n"+
+		"                                   the signing keys in JWKSFILE\n"+
 		"  -uuid                            Generate a random UUID\n"+
 		"  -sfn SPECFILE|ID                 Generate specfile from another specfile or object ID\n"+
 		"  -?, -h, --help                   Display the full list of options\n"+
-		"  LOGGING NOTE                     Use MAZLOG=1 to see extended logging\n",
+		"  LOGGING NOTE                     Use MAZLOG=1 to see extended logging\n"+
+		"  PROFILE NOTE                     Use MAZ_PROFILE=NAME to select a profile, like the -p option\n"+
+		"  CHAIN NOTE                       Use MAZ_CREDENTIAL_CHAIN=default to reuse Azure CLI or managed\n"+
+		"                                   identity tokens, see -idc for the links that produced them\n"+
+		"  RECORDING NOTE                   Use MAZ_RECORD=NAME to record all API calls to a cassette, and\n"+
+		"                                   MAZ_REPLAY=NAME to replay them offline\n",
 		utl.Whi2("Other Options"), X, X)
 
 	fmt.Print(usageHeader)
@@ -142,17 +168,64 @@ func printUnknownCommandError() {
 	utl.Die("Unsupported command: %s. Run %s for more info.\n", args, help)
 }
 
+// Runs fn under a context that the first Ctrl-C cancels, which stops its in-flight API calls
+// and login, and saves partial work such as delta sets. A second Ctrl-C quits right away.
+// Outside of fn, Ctrl-C quits as usual.
+func interruptible(fn func(ctx context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return fn(ctx)
+}
+
+// Prints the given library error and exits with a non-zero code. Does nothing if err is nil.
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, maz.ErrAborted) || errors.Is(err, context.Canceled) {
+		utl.Die("Aborted.\n")
+	}
+	utl.Die("%s %v\n", utl.Red("Error:"), err)
+}
+
+// Reports whether the given string is a JWT token, ignoring surrounding whitespace.
+func isJwt(s string) bool {
+	_, err := maz.SplitJWT(strings.TrimSpace(s))
+	return err == nil
+}
+
+// Exits the program, either successfully or with the given library error.
+func exit(err error) {
+	exitOnError(err)
+	os.Exit(0)
+}
+
 func main() {
 	maz.PrintRuntimeInfo()
+
+	// A leading '-p NAME' selects the credentials file profile for the rest of the arguments
+	profile := ""
+	if len(os.Args) > 3 && os.Args[1] == "-p" {
+		profile = os.Args[2]
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	numberOfArguments := len(os.Args[1:]) // Exclude the program itself
-	if numberOfArguments < 1 || numberOfArguments > 4 {
-		// Don't accept less than 1, or more than 4 arguments
+	if numberOfArguments < 1 || numberOfArguments > 4 && !(numberOfArguments <= 6 && os.Args[1] == "-id") {
+		// Don't accept less than 1, or more than 4 arguments, except for '-id' with a certificate
 		printUsage(false) // false = display short usage
 	}
 
 	// Set up required global configuration pointer variable
 	// For more info see https://github.com/queone/azm/blob/main/pkg/maz/maz_core.go
-	z := maz.NewConfig()
+	z := maz.NewConfig().SetProfile(profile)
+
+	// MAZ_RECORD or MAZ_REPLAY record the API calls to, or replay them from, a cassette
+	exitOnError(z.UseCassetteFromEnv())
 
 	switch numberOfArguments {
 	case 1: // 1 argument
@@ -160,44 +233,60 @@ func main() {
 		// Below cases don't need API access
 		switch arg1 {
 		case "-id":
-			maz.DumpLoginValues(z)
+			exit(maz.DumpLoginValues(z))
+		case "-idc":
+			exit(maz.PrintCredentialChainSources(z))
+		case "-idl":
+			exit(maz.ListProfiles(z))
 		case "-?", "-h", "--help":
 			printUsage(true) // true = display long usage
 		case "-uuid":
-			utl.Die("%s\n", uuid.New().String())
+			fmt.Println(uuid.New().String())
+			exit(nil)
 		case "-tx":
-			maz.DeleteCurrentCredentials()
+			exit(maz.DeleteCurrentCredentials())
+		case "-encrypt", "-decrypt":
+			exit(maz.MigrateMazFiles(arg1 == "-encrypt"))
 		}
-		maz.SetupApiTokens(z) // Remaining cases need API access
+		// Remaining cases need API access
+		exitOnError(interruptible(func(ctx context.Context) error {
+			return maz.SetupApiTokensContext(ctx, z)
+		}))
 		switch arg1 {
 		case "-ax", "-dx", "-sx", "-mx", "-ux", "-gx", "-apx", "-spx", "-drx", "-dax", "-xx":
 			mazType := arg1[1 : len(arg1)-1]
-			maz.PurgeMazObjectCacheFiles(mazType, z)
+			exitOnError(maz.PurgeMazObjectCacheFiles(mazType, z))
 		case "-d", "-a", "-s", "-m", "-u", "-g", "-ap", "-sp", "-dr", "-da",
 			"-dj", "-aj", "-sj", "-mj", "-uj", "-gj", "-apj", "-spj", "-drj", "-daj":
 			specifier := arg1[1:] // Remove arg1 leading hyphen
-			maz.PrintMatchingObjects(specifier, "", z)
+			exitOnError(interruptible(func(ctx context.Context) error {
+				return maz.PrintMatchingObjectsContext(ctx, specifier, "", z)
+			}))
 		case "-dk", "-ak", "-gk", "-apk":
 			mazType := arg1[1 : len(arg1)-1]
-			maz.CreateSkeletonFile(mazType, "")
+			exitOnError(maz.CreateSkeletonFile(mazType, ""))
 		case "-ar":
-			maz.PrintResRoleAssignmentReport(z)
+			exitOnError(maz.PrintResRoleAssignmentReport(z))
 		case "-apr", "-aprc":
 			csvMode := arg1 == "-aprc" // flag ending in 'c' triggers CSV mode
-			maz.PrintPasswordExpiryReport(csvMode, "", z)
+			exitOnError(maz.PrintPasswordExpiryReport(csvMode, "", z))
 		case "-mt":
-			maz.PrintAzureMgmtGroupTree(z)
+			exitOnError(maz.PrintAzureMgmtGroupTree(z))
 		case "-pags":
-			maz.PrintPags(z)
+			exitOnError(maz.PrintPags(z))
 		case "-st":
-			maz.PrintCountStatus(z)
+			exitOnError(maz.PrintCountStatus(z))
 		case "-tmg":
 			fmt.Println(z.MgToken)
 		case "-taz":
 			fmt.Println(z.AzToken)
+		case "-tmga":
+			exitOnError(maz.PrintTokenReport(z.MgToken, z))
+		case "-taza":
+			exitOnError(maz.PrintTokenReport(z.AzToken, z))
 		default:
 			if utl.ValidUuid(arg1) {
-				maz.PrintObjectById(arg1, z)
+				exitOnError(maz.PrintObjectById(arg1, z))
 			} else {
 				printUnknownCommandError()
 			}
@@ -207,44 +296,55 @@ func main() {
 		arg2 := os.Args[2]
 		switch arg1 {
 		case "-td":
-			maz.DecodeAndValidateToken(arg2)
+			exit(maz.DecodeAndValidateToken(arg2))
+		case "-idd":
+			exit(maz.SetDefaultProfile(arg2))
+		case "-idrm":
+			exit(maz.RemoveProfile(arg2))
+		case "-keygen":
+			exit(maz.GenerateKeyFile(arg2))
 		}
-		maz.SetupApiTokens(z) // Remaining cases need API access
+		// Remaining cases need API access
+		exitOnError(interruptible(func(ctx context.Context) error {
+			return maz.SetupApiTokensContext(ctx, z)
+		}))
 		switch arg1 {
 		case "-lc":
-			maz.PrintCachedObjectsWithId(arg2, z)
+			exitOnError(maz.PrintCachedObjectsWithId(arg2, z))
 		case "-kd", "-ka", "-kg", "-kap":
 			mazType := arg1[2:]
-			maz.CreateSkeletonFile(mazType, arg2)
+			exitOnError(maz.CreateSkeletonFile(mazType, arg2))
 		case "-d", "-a", "-s", "-m", "-u", "-g", "-ap", "-sp", "-dr", "-da",
 			"-dj", "-aj", "-sj", "-mj", "-uj", "-gj", "-apj", "-spj", "-drj", "-daj":
 			specifier := arg1[1:] // Remove the leading '-'
-			maz.PrintMatchingObjects(specifier, arg2, z)
+			exitOnError(interruptible(func(ctx context.Context) error {
+				return maz.PrintMatchingObjectsContext(ctx, specifier, arg2, z)
+			}))
 		case "-sfn":
-			maz.GenerateAndPrintSpecfileName(arg2, z)
+			exitOnError(maz.GenerateAndPrintSpecfileName(arg2, z))
 		case "-rm", "-rmf":
 			force := arg1 == "-rmf" // flag ending in 'f' triggers force mode
 			if utl.FileUsable(arg2) {
-				maz.DeleteObjectBySpecfile(force, arg2, z)
+				exitOnError(maz.DeleteObjectBySpecfile(force, arg2, z))
 			} else if utl.ValidUuid(arg2) {
-				maz.DeleteObjectById(force, arg2, z)
+				exitOnError(maz.DeleteObjectById(force, arg2, z))
 			} else {
-				maz.DeleteObjectByName(force, arg2, z)
+				exitOnError(maz.DeleteObjectByName(force, arg2, z))
 			}
 		case "-up", "-upf":
 			force := arg1 == "-upf"
-			maz.ApplyObjectBySpecfile(force, arg2, z)
+			exitOnError(maz.ApplyObjectBySpecfile(force, arg2, z))
 		case "-upap", "-upsp":
 			// Create AppSp pair with given name (no prompt, safe to force)
-			maz.CreateAppSpByName(true, arg2, z)
+			exitOnError(maz.CreateAppSpByName(true, arg2, z))
 		case "-upg":
 			// Create group with given name (no prompt), not assignable to role; description = name
-			maz.CreateDirGroupFromArgs(true, false, arg2, arg2, z)
+			exitOnError(maz.CreateDirGroupFromArgs(true, false, arg2, arg2, z))
 		case "-vs":
-			maz.CompareSpecfileToAzure(arg2, z)
+			exitOnError(maz.CompareSpecfileToAzure(arg2, z))
 		case "-apr", "-aprc":
 			csvMode := arg1 == "-aprc" // flag ending in 'c' triggers CSV mode
-			maz.PrintPasswordExpiryReport(csvMode, arg2, z)
+			exitOnError(maz.PrintPasswordExpiryReport(csvMode, arg2, z))
 		default:
 			printUnknownCommandError()
 		}
@@ -256,32 +356,37 @@ func main() {
 		case "-id":
 			z.TenantId = arg2
 			z.Username = arg3
-			maz.ConfigureCredsFileForInterativeLogin(z)
+			exit(maz.ConfigureCredsFileForInterativeLogin(z))
+		case "-td":
+			exit(maz.DecodeAndValidateTokenOffline(arg2, arg3))
 		}
-		maz.SetupApiTokens(z) // Remaining cases need API access
+		// Remaining cases need API access
+		exitOnError(interruptible(func(ctx context.Context) error {
+			return maz.SetupApiTokensContext(ctx, z)
+		}))
 		switch arg1 {
 		case "-rnd", "-rng", "-rnap", "-rnsp", "-rndr",
 			"-rndf", "-rngf", "-rnapf", "-rnspf", "-rndrf":
 			flagBody := arg1[3:] // e.g. "gf"
 			force := strings.HasSuffix(flagBody, "f")
 			mazType := strings.TrimSuffix(flagBody, "f")
-			maz.RenameAzureObject(force, mazType, arg2, arg3, z)
+			exitOnError(maz.RenameAzureObject(force, mazType, arg2, arg3, z))
 		case "-upg":
 			force := true // safe, no prompt needed
 			isAssignableToRole := false
 			name := arg2
 			description := arg3
-			maz.CreateDirGroupFromArgs(force, isAssignableToRole, name, description, z)
+			exitOnError(maz.CreateDirGroupFromArgs(force, isAssignableToRole, name, description, z))
 		case "-apas":
-			maz.AddAppSpSecret(maz.Application, arg2, arg3, "", z)
+			exitOnError(maz.AddAppSpSecret(maz.Application, arg2, arg3, "", z))
 		case "-aprs", "-aprsf":
 			force := arg1 == "-aprsf" // flag ending in 'f' triggers force mode
-			maz.RemoveAppSpSecret(maz.Application, arg2, arg3, force, z)
+			exitOnError(maz.RemoveAppSpSecret(maz.Application, arg2, arg3, force, z))
 		case "-spas":
-			maz.AddAppSpSecret(maz.ServicePrincipal, arg2, arg3, "", z)
+			exitOnError(maz.AddAppSpSecret(maz.ServicePrincipal, arg2, arg3, "", z))
 		case "-sprs", "-sprsf":
 			force := arg1 == "-sprsf"
-			maz.RemoveAppSpSecret(maz.ServicePrincipal, arg2, arg3, force, z)
+			exitOnError(maz.RemoveAppSpSecret(maz.ServicePrincipal, arg2, arg3, force, z))
 		default:
 			printUnknownCommandError()
 		}
@@ -294,23 +399,44 @@ func main() {
 		case "-id":
 			z.TenantId = arg2
 			z.ClientId = arg3
-			z.ClientSecret = arg4
-			maz.ConfigureCredsFileForAutomatedLogin(z)
+			if data, err := os.ReadFile(arg4); err == nil && isJwt(string(data)) {
+				z.FederatedTokenFile = arg4 // A federated token file, rather than a secret
+			} else if utl.FileUsable(arg4) {
+				utl.Die("%s is a file, but not a federated token file. For a certificate, use %s\n",
+					utl.Yel(arg4), utl.Yel(program_name+" -id TenantId ClientId -cert CertFile [Password]"))
+			} else {
+				z.ClientSecret = arg4
+			}
+			exit(maz.ConfigureCredsFileForAutomatedLogin(z))
 		}
-		maz.SetupApiTokens(z) // Remaining cases need API access
+		// Remaining cases need API access
+		exitOnError(interruptible(func(ctx context.Context) error {
+			return maz.SetupApiTokensContext(ctx, z)
+		}))
 		switch arg1 {
 		case "-upg":
 			force := true // safe, no prompt needed
 			isAssignableToRole := utl.Bool(arg4)
 			name := arg2
 			description := arg3
-			maz.CreateDirGroupFromArgs(force, isAssignableToRole, name, description, z)
+			exitOnError(maz.CreateDirGroupFromArgs(force, isAssignableToRole, name, description, z))
 		case "-apas":
-			maz.AddAppSpSecret(maz.Application, arg2, arg3, arg4, z)
+			exitOnError(maz.AddAppSpSecret(maz.Application, arg2, arg3, arg4, z))
 		case "-spas":
-			maz.AddAppSpSecret(maz.ServicePrincipal, arg2, arg3, arg4, z)
+			exitOnError(maz.AddAppSpSecret(maz.ServicePrincipal, arg2, arg3, arg4, z))
 		default:
 			printUnknownCommandError()
 		}
+	case 5, 6: // 5 or 6 arguments, only for '-id' with a certificate, and its password
+		if os.Args[4] != "-cert" {
+			printUnknownCommandError()
+		}
+		z.TenantId = os.Args[2]
+		z.ClientId = os.Args[3]
+		z.ClientCert = os.Args[5]
+		if numberOfArguments == 6 {
+			z.ClientCertPassword = os.Args[6]
+		}
+		exit(maz.ConfigureCredsFileForAutomatedLogin(z))
 	}
 }
@@ -0,0 +1,102 @@
+package maz
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/queone/utl"
+)
+
+// Token and headers of an add-on API scope. APIs sharing a scope, such as several key vaults,
+// share its token.
+type addOnToken struct {
+	token   string
+	headers map[string]string
+}
+
+// Registers an add-on API, beyond MS Graph and ARM, so it can be called through ApiCall with
+// the same auth handling. Calls to URLs starting with baseUrl get a token for the given scope,
+// such as "https://vault.azure.net/.default", or "api://my-api/.default" for an API of your
+// own. The token is acquired on first use, the same way as the MS Graph token, and refreshed
+// like it, see SetupApiTokens(). When base URLs overlap, the longest one applies.
+func (m *Config) AddApi(baseUrl, scope string) *Config {
+	baseUrl = strings.TrimRight(baseUrl, "/")
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	if m.addOnApis == nil {
+		m.addOnApis = make(map[string]string)
+		m.addOnTokens = make(map[string]*addOnToken)
+	}
+	m.addOnApis[baseUrl] = scope
+	if m.addOnTokens[scope] == nil {
+		m.addOnTokens[scope] = &addOnToken{headers: map[string]string{"Content-Type": "application/json"}}
+	}
+	Logf("Added API %s with scope %s\n", utl.Cya(baseUrl), utl.Cya(scope))
+	return m
+}
+
+// Adds a header to the calls of the add-on API registered with the given base URL, see AddApi().
+func (m *Config) AddApiHeader(baseUrl, key, value string) *Config {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	if scope, ok := m.addOnApis[strings.TrimRight(baseUrl, "/")]; ok {
+		m.addOnTokens[scope].headers[key] = value
+	}
+	return m
+}
+
+// Registers the Key Vault data-plane API of the named vault in the configured cloud, for
+// calls like ApiGet("https://myvault.vault.azure.net/secrets/mysecret?api-version=7.4", z, nil).
+func (m *Config) AddKeyVaultApi(vaultName string) *Config {
+	resource := m.CloudEnv().KeyVaultUrl
+	u, err := url.Parse(resource)
+	if err != nil || resource == "" {
+		Logf("No Key Vault endpoint in cloud %s\n", utl.Red(m.Cloud))
+		return m
+	}
+	return m.AddApi("https://"+vaultName+"."+u.Host, resource+"/.default")
+}
+
+// Registers the Log Analytics query API of the configured cloud, for calls like
+// ApiPost(z.CloudEnv().LogsUrl+"/v1/workspaces/"+workspaceId+"/query", z, query, nil).
+func (m *Config) AddLogAnalyticsApi() *Config {
+	logsUrl := m.CloudEnv().LogsUrl
+	if logsUrl == "" {
+		Logf("No Log Analytics endpoint in cloud %s\n", utl.Red(m.Cloud))
+		return m
+	}
+	return m.AddApi(logsUrl, logsUrl+"/.default")
+}
+
+// Returns the current token for the given API URL, acquiring it first if it is an add-on API
+// whose token has not been acquired yet, or refreshing it if it is about to expire. This is
+// for making calls with other HTTP clients; ApiCall does the same by itself.
+func (m *Config) ApiToken(apiUrl string) (string, error) {
+	tokenType := m.apiTokenType(apiUrl)
+	if tokenType == "" {
+		return "", newError(ErrConfig, "no token for %s, register the API with AddApi()", apiUrl)
+	}
+	if _, err := m.refreshApiToken(tokenType, "", ""); err != nil {
+		return "", err
+	}
+	return m.apiToken(tokenType), nil
+}
+
+// Helper function that returns the scope of the longest add-on API base URL that the given
+// URL starts with, or "" if none does. The caller must hold tokenMu.
+func (m *Config) addOnScope(apiUrl string) string {
+	match, scope := "", ""
+	for baseUrl, s := range m.addOnApis {
+		if len(baseUrl) > len(match) && (apiUrl == baseUrl || strings.HasPrefix(apiUrl, baseUrl+"/") ||
+			strings.HasPrefix(apiUrl, baseUrl+"?")) {
+			match, scope = baseUrl, s
+		}
+	}
+	return scope
+}
+
+// Reports whether the given token type is the scope of an add-on API, rather than
+// AzApiToken or MgApiToken.
+func isAddOnTokenType(tokenType string) bool {
+	return tokenType != "" && tokenType != AzApiToken && tokenType != MgApiToken
+}
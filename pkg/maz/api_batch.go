@@ -0,0 +1,217 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// MS Graph JSON batching limit, see learn.microsoft.com/en-us/graph/json-batching
+const ConstMaxBatchSize = 20
+
+// BatchRequest is a single MS Graph sub-request of a JSON $batch call.
+type BatchRequest struct {
+	Id      string                 // Must be unique across the requests given to ApiBatch()
+	Method  string                 // Defaults to GET
+	Url     string                 // Path with API version prefix, as in ApiEndpoint, e.g. "/v1.0/users/<id>"
+	Params  map[string]string      // Query parameters
+	Headers map[string]string      // Sub-request headers, Content-Type is added for a Body
+	Body    map[string]interface{} // Payload for POST, PATCH and PUT
+}
+
+// BatchResponse is the response to a single BatchRequest. A Status of 0 means the
+// sub-request never got a response, because the $batch call itself failed.
+type BatchResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    map[string]interface{}
+}
+
+// Returns the 'value' list of the response body, logging any error status.
+func (r BatchResponse) Value() []interface{} {
+	if r.Status < 200 || r.Status > 299 {
+		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", r.Status, ApiErrorMsg(r.Body))))
+	}
+	return utl.Slice(r.Body["value"])
+}
+
+// Returns the sub-request's *ApiError, or nil if it succeeded.
+func (r BatchResponse) Err() error {
+	if r.Status >= 200 && r.Status <= 299 {
+		return nil
+	}
+	header := http.Header{}
+	for k, v := range r.Headers {
+		header.Set(k, v)
+	}
+	return NewApiError(r.Status, r.Body, header)
+}
+
+// Returns the 'value' list of the response body, plus the items of all remaining pages.
+func (r BatchResponse) AllPages(z *Config) []interface{} {
+	list := r.Value()
+	if nextLink := nextPageLink(r.Body); nextLink != "" {
+		list = append(list, GetAzureAllPages(nextLink, z)...)
+	}
+	return list
+}
+
+// Sends the given MS Graph requests using JSON batching, up to ConstMaxBatchSize per
+// $batch call, and returns the responses mapped by request Id. Idempotent sub-requests that
+// were throttled or failed with a server error are sent again, according to z.Retry, as are
+// all the sub-requests of a $batch call that was itself throttled.
+func ApiBatch(requests []BatchRequest, z *Config) map[string]BatchResponse {
+	return ApiBatchContext(context.Background(), requests, z)
+}
+
+// Same as ApiBatch, but sends the $batch calls, and waits between retries, under the given
+// context. Requests that didn't get a response before it ended have a Status of 0.
+func ApiBatchContext(ctx context.Context, requests []BatchRequest, z *Config) map[string]BatchResponse {
+	results := make(map[string]BatchResponse, len(requests))
+
+	// Each $batch call targets a single API version, so group the requests by version
+	var versions []string
+	byVersion := make(map[string][]BatchRequest)
+	for _, req := range requests {
+		version, _ := splitApiVersion(req.Url)
+		if _, ok := byVersion[version]; !ok {
+			versions = append(versions, version)
+		}
+		byVersion[version] = append(byVersion[version], req)
+	}
+
+	for _, version := range versions {
+		pending := byVersion[version]
+		for attempt := 0; len(pending) > 0; attempt++ {
+			var failed []BatchRequest
+			var wait time.Duration
+			for chunk := range slices.Chunk(pending, ConstMaxBatchSize) {
+				f, w := sendBatch(ctx, version, chunk, attempt, results, z)
+				failed = append(failed, f...)
+				wait = max(wait, w)
+			}
+			if len(failed) == 0 || attempt >= z.Retry.MaxRetries {
+				break
+			}
+			Logf("Retrying %s failed batch sub-requests in %s (Retry %d/%d)\n", utl.Yel(len(failed)),
+				utl.Yel(wait.Round(time.Millisecond)), attempt+1, z.Retry.MaxRetries)
+			if sleepContext(ctx, wait) != nil {
+				break // The failed sub-requests keep their last response
+			}
+			pending = failed
+		}
+	}
+	return results
+}
+
+// Helper function to send one $batch call of up to ConstMaxBatchSize requests. Stores
+// the responses in results, and returns the requests worth retrying with the longest
+// wait any of them asked for. A throttled or unavailable $batch call wasn't processed at all,
+// so all its requests are safe to send again, whereas of the sub-requests that failed, only
+// those with an idempotent method are.
+func sendBatch(
+	ctx context.Context,
+	version string,
+	chunk []BatchRequest,
+	attempt int,
+	results map[string]BatchResponse,
+	z *Config,
+) (failed []BatchRequest, wait time.Duration) {
+	byId := make(map[string]BatchRequest, len(chunk))
+	subRequests := make([]interface{}, 0, len(chunk))
+	for _, req := range chunk {
+		byId[req.Id] = req
+		method := strings.ToUpper(req.Method)
+		if method == "" {
+			method = "GET"
+		}
+		_, path := splitApiVersion(req.Url)
+		if len(req.Params) > 0 {
+			query := url.Values{}
+			for k, v := range req.Params {
+				query.Set(k, v)
+			}
+			path += "?" + query.Encode()
+		}
+		sub := map[string]interface{}{"id": req.Id, "method": method, "url": path}
+		headers := make(map[string]interface{})
+		for k, v := range req.Headers {
+			headers[k] = v
+		}
+		if req.Body != nil {
+			sub["body"] = req.Body
+			if _, ok := headers["Content-Type"]; !ok {
+				headers["Content-Type"] = "application/json"
+			}
+		}
+		if len(headers) > 0 {
+			sub["headers"] = headers
+		}
+		subRequests = append(subRequests, sub)
+	}
+
+	apiUrl := z.MgUrl + "/" + version + "/$batch"
+	payload := map[string]interface{}{"requests": subRequests}
+	resp, statCode, header, _ := apiCallWithHeader(ctx, "POST", apiUrl, z, payload, nil, false)
+	if statCode != 200 {
+		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		for _, req := range chunk {
+			results[req.Id] = BatchResponse{Status: 0, Body: resp}
+		}
+		if isThrottled(statCode) {
+			return chunk, retryDelay(header, attempt, z.Retry)
+		}
+		return nil, 0
+	}
+
+	for _, item := range utl.Slice(resp["responses"]) {
+		sub := utl.Map(item)
+		if sub == nil {
+			continue
+		}
+		id := utl.Str(sub["id"])
+		req, ok := byId[id]
+		if !ok {
+			continue // Not one of ours, should never happen
+		}
+		r := BatchResponse{
+			Status:  int(utl.Int64(sub["status"])),
+			Headers: make(map[string]string),
+			Body:    utl.Map(sub["body"]),
+		}
+		header := http.Header{}
+		for k, v := range utl.Map(sub["headers"]) {
+			r.Headers[k] = utl.Str(v)
+			header.Set(k, utl.Str(v))
+		}
+		results[id] = r
+
+		method := req.Method
+		if method == "" {
+			method = "GET"
+		}
+		if (isThrottled(r.Status) || r.Status >= 500) && isIdempotentMethod(method) {
+			failed = append(failed, req)
+			wait = max(wait, retryDelay(header, attempt, z.Retry))
+		}
+	}
+	return failed, wait
+}
+
+// Splits an API path such as "/v1.0/users/<id>" into its version and the remaining path.
+// Paths without a known version prefix are assumed to be v1.0.
+func splitApiVersion(apiPath string) (version, path string) {
+	trimmed := strings.TrimPrefix(apiPath, "/")
+	for _, v := range []string{"v1.0", "beta"} {
+		if rest, ok := strings.CutPrefix(trimmed, v+"/"); ok {
+			return v, "/" + rest
+		}
+	}
+	return "v1.0", "/" + trimmed
+}
@@ -0,0 +1,76 @@
+package maz
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/queone/utl"
+)
+
+func TestApiBatchRetries(t *testing.T) {
+	var mu sync.Mutex
+	batchCalls := 0
+	sent := map[string]int{} // Times each sub-request was sent
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graph/v1.0/$batch" {
+			t.Errorf("unexpected call to %s", r.URL.Path)
+			return
+		}
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		mu.Lock()
+		defer mu.Unlock()
+		batchCalls++
+		if batchCalls == 1 {
+			// The whole $batch call is throttled at first
+			w.Header().Set("x-ms-retry-after-ms", "10")
+			writeJson(w, 429, map[string]interface{}{})
+			return
+		}
+		responses := []interface{}{}
+		for _, item := range utl.Slice(payload["requests"]) {
+			req := utl.Map(item)
+			id := utl.Str(req["id"])
+			sent[id]++
+			status := 200
+			if sent[id] == 1 && id != "ok" {
+				status = 503 // Each sub-request but "ok" fails once
+			}
+			responses = append(responses, map[string]interface{}{
+				"id":      id,
+				"status":  status,
+				"headers": map[string]interface{}{"Retry-After": "0"},
+				"body":    map[string]interface{}{"id": id},
+			})
+		}
+		writeJson(w, 200, map[string]interface{}{"responses": responses})
+	})
+
+	results := ApiBatch([]BatchRequest{
+		{Id: "ok", Url: "/v1.0/users/a"},
+		{Id: "get", Url: "/v1.0/users/b"},
+		{Id: "patch", Method: "PATCH", Url: "/v1.0/users/c", Body: map[string]interface{}{"x": 1}},
+		{Id: "post", Method: "POST", Url: "/v1.0/groups", Body: map[string]interface{}{"x": 1}},
+	}, z)
+
+	want := map[string]struct{ status, sent int }{
+		"ok":    {200, 1},
+		"get":   {200, 2},
+		"patch": {200, 2},
+		"post":  {503, 1}, // Not idempotent, so never sent again
+	}
+	for id, w := range want {
+		if got := results[id].Status; got != w.status {
+			t.Errorf("%s: status %d, want %d", id, got, w.status)
+		}
+		if sent[id] != w.sent {
+			t.Errorf("%s: sent %d times, want %d", id, sent[id], w.sent)
+		}
+	}
+	if batchCalls != 3 {
+		t.Errorf("got %d $batch calls, want 3", batchCalls)
+	}
+}
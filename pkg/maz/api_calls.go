@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -45,6 +46,17 @@ func ApiPost(
 	return ApiCall("POST", apiUrl, z, payload, params)
 }
 
+// ApiCall alias to do a POST that has no side effects, such as a query, and can therefore
+// be retried when throttled.
+func ApiPostIdempotent(
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	return apiCall(context.Background(), "POST", apiUrl, z, payload, params, true)
+}
+
 // ApiCall alias to do a PUT
 func ApiPut(
 	apiUrl string,
@@ -64,7 +76,10 @@ func ApiDelete(
 	return ApiCall("DELETE", apiUrl, z, nil, params)
 }
 
-// Makes an API call and returns the result object, statusCode, and error.
+// Makes an API call and returns the result object, statusCode, and error. The error is an
+// *ApiError for HTTP 4xx and 5xx responses. Throttled calls are retried according to
+// z.Retry, except for POST calls, see ApiPostIdempotent. See ApiCallContext to make the
+// call under a context, so it can be cancelled or given a deadline.
 func ApiCall(
 	method string,
 	apiUrl string,
@@ -72,70 +87,167 @@ func ApiCall(
 	payload map[string]interface{},
 	params map[string]string,
 ) (map[string]interface{}, int, error) {
+	return apiCall(context.Background(), method, apiUrl, z, payload, params, isIdempotentMethod(method))
+}
+
+// Same as ApiCall, but made under the given context. Cancelling it, or reaching its
+// deadline, stops the request, as well as any wait for a retry.
+func ApiCallContext(
+	ctx context.Context,
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	return apiCall(ctx, method, apiUrl, z, payload, params, isIdempotentMethod(method))
+}
+
+// Same as ApiCall, but also returns the response headers, such as the ARM long-running
+// operation headers or the request IDs. The headers are nil if the call got no response.
+func ApiCallWithHeader(
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, http.Header, error) {
+	return apiCallWithHeader(context.Background(), method, apiUrl, z, payload, params, isIdempotentMethod(method))
+}
+
+// Helper function that does the actual API call, retrying throttled responses if the
+// call is retryable.
+func apiCall(
+	ctx context.Context,
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+	retryable bool,
+) (map[string]interface{}, int, error) {
+	result, statCode, _, err := apiCallWithHeader(ctx, method, apiUrl, z, payload, params, retryable)
+	return result, statCode, err
+}
+
+// Same as apiCall, but also returns the response headers.
+func apiCallWithHeader(
+	ctx context.Context,
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+	retryable bool,
+) (map[string]interface{}, int, http.Header, error) {
 	// Validate URL
 	if !strings.HasPrefix(apiUrl, "http") {
 		Logf("%s\n", utl.Red2("Error: Bad URL"))
-		return nil, 0, fmt.Errorf("%s error: Bad URL, %s", utl.Trace(), apiUrl)
+		return nil, 0, nil, fmt.Errorf("%s error: Bad URL, %s", utl.Trace(), apiUrl)
 	}
 
-	// Set headers based on the API URL
+	// Refresh the token if it is about to expire, as in long runs, then set headers based on
+	// the API URL. A failed refresh leaves the current token, for the API to accept or reject.
+	// Concurrent callers share a single refresh, so it doesn't run under ctx, which would
+	// otherwise fail it for all of them when this call ends.
+	tokenType := z.apiTokenType(apiUrl)
+	if _, err := z.refreshApiToken(tokenType, "", ""); err != nil {
+		if z.apiToken(tokenType) == "" {
+			return nil, 0, nil, err // An add-on API without a token
+		}
+		Logf("%s\n", utl.Red2(err.Error()))
+	}
 	headers := getHeadersForApi(apiUrl, z)
+	refreshed := false
 
-	// Create HTTP request
-	req, err := createHttpRequest(method, apiUrl, payload)
-	if err != nil {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to create HTTP request: %s", err)))
-		return nil, 0, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
+	for attempt := 0; ; attempt++ {
+		// Create HTTP request, anew on every attempt since the payload reader is consumed
+		req, err := createHttpRequest(ctx, method, apiUrl, payload)
+		if err != nil {
+			Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to create HTTP request: %s", err)))
+			return nil, 0, nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
 
-	// Add headers and query parameters to the request
-	setRequestHeaders(req, headers)
-	setQueryParameters(req, params)
+		// Add headers and query parameters to the request
+		setRequestHeaders(req, headers)
+		setQueryParameters(req, params)
 
-	logRequestDetails(req, payload, params)
+		logRequestDetails(req, payload, params)
 
-	client := &http.Client{Timeout: time.Second * 30} // Thirty second timeout
-	resp, err := client.Do(req)
-	if err != nil {
-		// Note, this only captures network HTTP errors making the request, NOT errors
-		// related to the actual API request itself. See next step for such details.
-		Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to execute API HTTP request: %s", err)))
-		return nil, 0, fmt.Errorf("failed to execute API HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
+		resp, err := z.httpClient().Do(req) // Shared client, so connections are reused across calls
+		if err != nil {
+			// Note, this only captures network HTTP errors making the request, NOT errors
+			// related to the actual API request itself. See next step for such details.
+			Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to execute API HTTP request: %s", err)))
+			return nil, 0, nil, fmt.Errorf("failed to execute API HTTP request: %w", err)
+		}
 
-	result, err := processResponse(resp)
-	if err != nil {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to process API response: %s", err)))
-		return nil, 0, fmt.Errorf("failed to process API response: %w", err)
-	}
+		// Wait and retry throttled calls, while retries remain
+		if retryable && isThrottled(resp.StatusCode) && attempt < z.Retry.MaxRetries {
+			wait := retryDelay(resp.Header, attempt, z.Retry)
+			drainResponse(resp)
+			Logf("HTTP %s - Throttled, retrying in %s (Retry %d/%d)\n", colorStatus(resp.StatusCode),
+				utl.Yel(wait.Round(time.Millisecond)), attempt+1, z.Retry.MaxRetries)
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, 0, nil, err
+			}
+			continue
+		}
+
+		result, err := processResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			Logf("%s\n", utl.Red2(fmt.Sprintf("Failed to process API response: %s", err)))
+			return nil, 0, nil, fmt.Errorf("failed to process API response: %w", err)
+		}
 
-	return result, resp.StatusCode, nil
+		// Slow down before the service starts throttling us
+		if pause := quotaPause(resp.Header, z.Retry); pause > 0 {
+			Logf("Remaining API quota is low, pausing for %s\n", utl.Yel(pause.Round(time.Millisecond)))
+			sleepContext(ctx, pause) // The response is still good, even if the context ends here
+		}
+
+		if resp.StatusCode >= 400 {
+			apiErr := NewApiError(resp.StatusCode, result, resp.Header)
+			// Retry once with a refreshed token, if the token was rejected as expired or revoked
+			if resp.StatusCode == http.StatusUnauthorized && !refreshed && tokenType != "" &&
+				slices.ContainsFunc(invalidTokenCodes, apiErr.HasCode) {
+				refreshed = true
+				rejected := strings.TrimPrefix(headers["Authorization"], "Bearer ")
+				claims := claimsChallenge(resp.Header.Get("WWW-Authenticate"))
+				if ok, err := z.refreshApiToken(tokenType, rejected, claims); ok {
+					Logf("HTTP %s - %s, retrying with refreshed token\n", colorStatus(resp.StatusCode), apiErr.Code)
+					headers = getHeadersForApi(apiUrl, z)
+					continue
+				} else if err != nil {
+					Logf("%s\n", utl.Red2(err.Error()))
+				}
+			}
+			return result, resp.StatusCode, resp.Header, apiErr
+		}
+		return result, resp.StatusCode, resp.Header, nil
+	}
 }
 
-// Helper function to get headers based on the API URL
+// Helper function to get headers based on the API URL, see apiTokenType(). The headers are a
+// copy, since a token refresh may update them at any time.
 func getHeadersForApi(apiUrl string, z *Config) map[string]string {
-	if strings.HasPrefix(apiUrl, ConstMgUrl) {
-		return z.MgHeaders
-	} else if strings.HasPrefix(apiUrl, ConstAzUrl) {
-		return z.AzHeaders
-	}
-	return nil
+	return z.apiHeaders(z.apiTokenType(apiUrl))
 }
 
 // Helper function to create an HTTP request
-func createHttpRequest(method, apiUrl string, payload map[string]interface{}) (*http.Request, error) {
+func createHttpRequest(ctx context.Context, method, apiUrl string, payload map[string]interface{}) (*http.Request, error) {
 	switch strings.ToUpper(method) {
 	case "GET":
-		return http.NewRequest("GET", apiUrl, nil)
+		return http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
 	case "PATCH", "POST", "PUT":
 		jsonData, err := json.Marshal(payload)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal payload: %w", err)
 		}
-		return http.NewRequest(strings.ToUpper(method), apiUrl, bytes.NewBuffer(jsonData))
+		return http.NewRequestWithContext(ctx, strings.ToUpper(method), apiUrl, bytes.NewBuffer(jsonData))
 	case "DELETE":
-		return http.NewRequest("DELETE", apiUrl, nil)
+		return http.NewRequestWithContext(ctx, "DELETE", apiUrl, nil)
 	default:
 		return nil, fmt.Errorf("%s Error: Unsupported HTTP method", utl.Trace())
 	}
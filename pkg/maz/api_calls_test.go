@@ -0,0 +1,171 @@
+package maz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Helper function that starts a fake API server with the given handler, and returns a
+// configuration pointed at it: MS Graph under /graph and ARM under /arm. Retries wait far
+// longer than any test runs, unless the response says otherwise.
+func newTestConfig(t *testing.T, handler http.HandlerFunc) *Config {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	z := NewConfig().SetBaseUrls(srv.URL+"/auth", srv.URL+"/graph", srv.URL+"/arm")
+	z.TenantId = "00000000-0000-0000-0000-000000000001"
+	z.MgToken, z.AzToken = "mg-token", "az-token" // Not JWTs, so they are never refreshed
+	z.AddMgHeader("Authorization", "Bearer "+z.MgToken)
+	z.AddAzHeader("Authorization", "Bearer "+z.AzToken)
+	z.SetRetryPolicy(RetryPolicy{MaxRetries: 3, BaseDelay: time.Minute})
+	return z
+}
+
+// Helper function to write the given object as a JSON response with the given status.
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestApiCallFakeServer(t *testing.T) {
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/graph/v1.0/users/u1":
+			if got := r.Header.Get("Authorization"); got != "Bearer mg-token" {
+				t.Errorf("MS Graph call has Authorization %q", got)
+			}
+			writeJson(w, 200, map[string]interface{}{"id": "u1", "select": r.URL.Query().Get("$select")})
+		case "/arm/subscriptions":
+			if got := r.Header.Get("Authorization"); got != "Bearer az-token" {
+				t.Errorf("ARM call has Authorization %q", got)
+			}
+			writeJson(w, 200, map[string]interface{}{"value": []interface{}{}})
+		default:
+			writeJson(w, 404, map[string]interface{}{"error": map[string]interface{}{"code": "NotFound", "message": r.URL.Path}})
+		}
+	})
+
+	resp, statCode, err := ApiGet(z.MgUrl+"/v1.0/users/u1", z, map[string]string{"$select": "id"})
+	if err != nil || statCode != 200 {
+		t.Fatalf("ApiGet() = %d, %v", statCode, err)
+	}
+	if resp["id"] != "u1" || resp["select"] != "id" {
+		t.Errorf("ApiGet() returned %v", resp)
+	}
+
+	if _, statCode, err := ApiGet(z.AzUrl+"/subscriptions", z, nil); err != nil || statCode != 200 {
+		t.Fatalf("ApiGet() of ARM URL = %d, %v", statCode, err)
+	}
+
+	_, statCode, err = ApiGet(z.MgUrl+"/v1.0/missing", z, nil)
+	apiErr, ok := err.(*ApiError)
+	if statCode != 404 || !ok || !apiErr.HasCode("NotFound") {
+		t.Errorf("ApiGet() of missing object = %d, %v, want a 404 *ApiError", statCode, err)
+	}
+}
+
+func TestApiCallRetriesThrottled(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		header  string
+		value   string
+		minWait time.Duration
+	}{
+		{"429 with Retry-After", 429, "Retry-After", "1", time.Second},
+		{"503 with x-ms-retry-after-ms", 503, "x-ms-retry-after-ms", "50", 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set(tt.header, tt.value)
+					writeJson(w, tt.status, map[string]interface{}{})
+					return
+				}
+				writeJson(w, 200, map[string]interface{}{"id": "u1"})
+			})
+
+			start := time.Now()
+			resp, statCode, err := ApiGet(z.MgUrl+"/v1.0/users/u1", z, nil)
+			elapsed := time.Since(start)
+			if err != nil || statCode != 200 || resp["id"] != "u1" {
+				t.Fatalf("ApiGet() = %v, %d, %v", resp, statCode, err)
+			}
+			if n := calls.Load(); n != 2 {
+				t.Errorf("got %d calls, want 2", n)
+			}
+			if elapsed < tt.minWait || elapsed > 10*time.Second {
+				t.Errorf("retry took %s, want the %s the response asked for", elapsed, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestApiCallDoesNotRetryPost(t *testing.T) {
+	var calls atomic.Int32
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		writeJson(w, 429, map[string]interface{}{})
+	})
+
+	_, statCode, _ := ApiPost(z.MgUrl+"/v1.0/groups", z, map[string]interface{}{"displayName": "g"}, nil)
+	if statCode != 429 {
+		t.Errorf("ApiPost() status = %d, want 429", statCode)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+
+	calls.Store(0)
+	ApiPostIdempotent(z.MgUrl+"/v1.0/groups/delta", z, map[string]interface{}{}, nil)
+	if n := calls.Load(); n != 4 {
+		t.Errorf("ApiPostIdempotent() made %d calls, want 4", n)
+	}
+}
+
+func TestApiCallContextPerCall(t *testing.T) {
+	release := make(chan struct{})
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/graph/v1.0/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		writeJson(w, 200, map[string]interface{}{"id": "u1"})
+	})
+
+	// Two goroutines share z, and only the call with the deadline is stopped by it
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	call := func(ctx context.Context, done chan<- error) {
+		_, statCode, err := ApiCallContext(ctx, "GET", z.MgUrl+"/v1.0/slow", z, nil, nil)
+		if err == nil && statCode != 200 {
+			err = NewApiError(statCode, nil, nil)
+		}
+		done <- err
+	}
+	shortDone, longDone := make(chan error, 1), make(chan error, 1)
+	go call(short, shortDone)
+	go call(context.Background(), longDone)
+
+	if err := <-shortDone; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call with a deadline returned %v, want context.DeadlineExceeded", err)
+	}
+	close(release) // Only now, so the other call was still waiting past the deadline
+	if err := <-longDone; err != nil {
+		t.Errorf("call without a deadline returned %v", err)
+	}
+}
@@ -0,0 +1,434 @@
+package maz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Cassette modes, see UseCassette()
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+
+	cassetteDirName  = "cassettes"     // Under MazConfigDir
+	cassetteMetaFile = "cassette.json" // Recording details, needed for replaying
+	cassetteCacheDir = "cache"         // Object caches used while recording or replaying
+)
+
+// JSON keys whose values are always redacted in recorded request and response bodies
+var cassetteSecretKeys = []string{
+	"access_token", "refresh_token", "id_token", "client_secret", "client_assertion",
+	"secrettext", "password", "clientsecret",
+}
+
+// Query parameters, and JSON keys, holding paging and delta tokens, whose values are replaced
+// with a hash of them, see redactToken(). This keeps the pages of a list apart when replaying.
+var cassetteTokenKeys = []string{"$skiptoken", "$deltatoken", "skiptoken", "deltatoken"}
+
+// JSON keys whose values are URLs that may hold paging or delta tokens
+var cassetteLinkKeys = []string{"@odata.nextlink", "@odata.deltalink", "nextlink"}
+
+// Response headers kept in recordings, since replaying needs them: the content type, the
+// throttling and quota headers, and the long-running operation headers. Others, such as
+// request IDs and cookies, are dropped.
+var (
+	cassetteResponseHeaders = []string{
+		"Content-Type", "Retry-After", "X-Ms-Retry-After-Ms", "Location", "Azure-Asyncoperation",
+	}
+	cassetteResponseHeaderPrefixes = []string{"X-Ms-Ratelimit-Remaining-", "X-Ms-User-Quota-"}
+)
+
+// Recording details, saved as the cassette's meta file.
+type cassetteMeta struct {
+	TenantId string    `json:"tenant_id"`
+	MgUrl    string    `json:"mg_url"`
+	AzUrl    string    `json:"az_url"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// A single recorded request and its response, saved as one numbered JSON file.
+type cassetteInteraction struct {
+	Method         string      `json:"method"`
+	Url            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	StatusCode     int         `json:"status_code"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	// Sizes of bodies that are not JSON, which are left out, since they can't be redacted
+	RequestBodyOmitted  int  `json:"request_body_omitted,omitempty"`
+	ResponseBodyOmitted int  `json:"response_body_omitted,omitempty"`
+	used                bool // Already replayed
+}
+
+// HTTP transport that records API requests to, or replays them from, a cassette directory.
+type cassetteTransport struct {
+	mode         string
+	dir          string
+	next         http.RoundTripper // Transport of the real calls when recording
+	z            *Config
+	mu           sync.Mutex
+	count        int                    // Interactions recorded so far
+	interactions []*cassetteInteraction // Interactions available for replaying
+}
+
+// Records all MS Graph and ARM API calls to, or replays them from, the named cassette. The
+// cassette is a directory under MazConfigDir/cassettes, unless name is a path. Recording
+// starts a new cassette, clearing any earlier recording, but refuses to clear a directory
+// that holds anything other than a cassette's files, saving each request and response as a JSON file, with the
+// Authorization header and secrets in the bodies redacted. Replaying serves the calls from
+// those files, without any network access or login, so SetupApiTokens does nothing. While
+// recording or replaying, the object caches are kept in the cassette's own cache directory,
+// starting empty, so runs are repeatable. Call it before SetupApiTokens, and after any
+// SetHttpClient or SetHttpTransport call.
+func (m *Config) UseCassette(mode, name string) error {
+	dir := name
+	if !strings.ContainsAny(name, `/\`) {
+		if name == "" || name == "." || name == ".." {
+			return newError(ErrConfig, "invalid cassette name '%s'", name)
+		}
+		if err := ensureMazConfigDir(); err != nil {
+			return err
+		}
+		dir = filepath.Join(MazConfigDir, cassetteDirName, name)
+	}
+
+	t := &cassetteTransport{mode: mode, dir: dir, next: m.httpClient().Transport, z: m}
+	if t.next == nil {
+		t.next = http.DefaultTransport
+	}
+	switch mode {
+	case CassetteRecord:
+		if err := checkCassetteDir(dir); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return wrapError(ErrFile, err, "error clearing cassette %s", dir)
+		}
+	case CassetteReplay:
+		if err := t.load(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(dir, cassetteCacheDir)); err != nil {
+			return wrapError(ErrFile, err, "error clearing cassette cache %s", dir)
+		}
+	default:
+		return newError(ErrConfig, "invalid cassette mode '%s'", mode)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, cassetteCacheDir), 0700); err != nil {
+		return wrapError(ErrFile, err, "error creating cassette %s", dir)
+	}
+
+	m.httpClient().Transport = t
+	m.cassette = t
+	Logf("Cassette %s mode, using %s\n", utl.Yel(mode), utl.Yel(dir))
+	return nil
+}
+
+// Helper function that returns an error unless the given directory is missing, empty, or only
+// holds the files of a cassette: its meta file, numbered interaction files and cache
+// directory. Recording clears the directory, so a mistyped path must not lose anything else.
+func checkCassetteDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return wrapError(ErrFile, err, "error reading cassette %s", dir)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && name == cassetteCacheDir || !entry.IsDir() && isCassetteFile(name) {
+			continue
+		}
+		return newError(ErrConfig, "refusing to record to %s, which holds %s and is not a cassette", dir, name)
+	}
+	return nil
+}
+
+// Helper function that reports whether the given file name is that of a cassette's meta file
+// or of one of its interactions.
+func isCassetteFile(name string) bool {
+	if name == cassetteMetaFile {
+		return true
+	}
+	number, ok := strings.CutSuffix(name, ".json")
+	return ok && len(number) == 5 && strings.Trim(number, "0123456789") == ""
+}
+
+// Sets up cassette recording or replaying from the MAZ_RECORD or MAZ_REPLAY environment
+// variable, whose value is the cassette name. Does nothing if neither is set.
+func (m *Config) UseCassetteFromEnv() error {
+	if name := os.Getenv("MAZ_REPLAY"); name != "" {
+		return m.UseCassette(CassetteReplay, name)
+	} else if name := os.Getenv("MAZ_RECORD"); name != "" {
+		return m.UseCassette(CassetteRecord, name)
+	}
+	return nil
+}
+
+// Reports whether API calls are being replayed from a cassette.
+func (m *Config) Replaying() bool {
+	return m.cassette != nil && m.cassette.mode == CassetteReplay
+}
+
+// Returns the directory of the object cache files.
+func (m *Config) cacheDir() string {
+	if m.cassette != nil {
+		return filepath.Join(m.cassette.dir, cassetteCacheDir)
+	}
+	return MazConfigDir
+}
+
+// Loads the cassette's recorded interactions, and applies its tenant and base URLs to z.
+func (t *cassetteTransport) load() error {
+	var meta cassetteMeta
+	metaFile := filepath.Join(t.dir, cassetteMetaFile)
+	if err := readJsonFile(metaFile, &meta); err != nil {
+		return wrapError(ErrFile, err, "error loading cassette %s", t.dir)
+	}
+	t.z.TenantId = meta.TenantId
+	t.z.SetBaseUrls("", meta.MgUrl, meta.AzUrl)
+
+	files, err := filepath.Glob(filepath.Join(t.dir, "[0-9]*.json"))
+	if err != nil {
+		return wrapError(ErrFile, err, "error listing cassette %s", t.dir)
+	}
+	slices.Sort(files) // Zero padded, so in recording order
+	for _, file := range files {
+		var ia cassetteInteraction
+		if err := readJsonFile(file, &ia); err != nil {
+			return wrapError(ErrFile, err, "error loading cassette interaction %s", file)
+		}
+		t.interactions = append(t.interactions, &ia)
+	}
+	Logf("Loaded %d interactions recorded %s\n", len(t.interactions), meta.Recorded.Format(time.RFC3339))
+	return nil
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only the API calls are recorded, including add-on APIs, not the token requests
+	isApi := t.z.apiTokenType(req.URL.String()) != ""
+	if t.mode == CassetteReplay {
+		if !isApi {
+			return nil, fmt.Errorf("request to %s is not possible while replaying cassette %s", req.URL.Host, t.dir)
+		}
+		return t.replay(req)
+	}
+	if !isApi {
+		return t.next.RoundTrip(req)
+	}
+	return t.record(req)
+}
+
+// Serves the request from the first unused interaction with the same method and URL, with its
+// tokens redacted as they were when recording.
+func (t *cassetteTransport) replay(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reqUrl := redactUrlTokens(req.URL.String())
+	for _, ia := range t.interactions {
+		if ia.used || ia.Method != req.Method || ia.Url != reqUrl {
+			continue
+		}
+		ia.used = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", ia.StatusCode, http.StatusText(ia.StatusCode)),
+			StatusCode:    ia.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        ia.ResponseHeader.Clone(),
+			Body:          io.NopCloser(strings.NewReader(ia.ResponseBody)),
+			ContentLength: int64(len(ia.ResponseBody)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response for %s %s in cassette %s", req.Method, req.URL, t.dir)
+}
+
+// Makes the real request, and saves it along with its response as the next interaction.
+func (t *cassetteTransport) record(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err // Nothing to record
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	reqHeader := req.Header.Clone()
+	if auth := reqHeader.Get("Authorization"); auth != "" {
+		reqHeader.Set("Authorization", partiallyRedactToken(auth))
+	}
+	respHeader := http.Header{} // Without Content-Length, since the redacted body may be shorter
+	for key, values := range resp.Header {
+		key = http.CanonicalHeaderKey(key)
+		if slices.Contains(cassetteResponseHeaders, key) || slices.ContainsFunc(cassetteResponseHeaderPrefixes,
+			func(prefix string) bool { return strings.HasPrefix(key, prefix) }) {
+			respHeader[key] = slices.Clone(values)
+		}
+	}
+	ia := cassetteInteraction{
+		Method:         req.Method,
+		Url:            redactUrlTokens(req.URL.String()),
+		RequestHeader:  reqHeader,
+		StatusCode:     resp.StatusCode,
+		ResponseHeader: respHeader,
+	}
+	ia.RequestBody, ia.RequestBodyOmitted = redactBody(reqBody)
+	ia.ResponseBody, ia.ResponseBodyOmitted = redactBody(respBody)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == 0 {
+		meta := cassetteMeta{TenantId: t.z.TenantId, MgUrl: t.z.MgUrl, AzUrl: t.z.AzUrl, Recorded: time.Now()}
+		if err := writeJsonFile(filepath.Join(t.dir, cassetteMetaFile), meta); err != nil {
+			return nil, err
+		}
+	}
+	t.count++
+	if err := writeJsonFile(filepath.Join(t.dir, fmt.Sprintf("%05d.json", t.count)), ia); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Returns the given JSON body with its secrets and tokens redacted, see redactSecrets(). A
+// body that is not JSON can't be checked for secrets, so it is left out, and only its size
+// is returned.
+func redactBody(body []byte) (redacted string, omitted int) {
+	var v interface{}
+	if len(body) == 0 {
+		return "", 0
+	} else if json.Unmarshal(body, &v) != nil {
+		return "", len(body)
+	}
+	redactSecrets(v)
+	data, err := marshalJson(v, "")
+	if err != nil {
+		return "", len(body)
+	}
+	return string(data), 0
+}
+
+// Recursively redacts the string values of secret keys in the given JSON value. Unlike
+// the Authorization header, these are redacted entirely, since even part of a short
+// secret is too much to give away. Paging and delta tokens, also those in links, are
+// replaced with a hash, see redactToken().
+func redactSecrets(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, val := range x {
+			str, isStr := val.(string)
+			switch key := strings.ToLower(k); {
+			case isStr && slices.Contains(cassetteSecretKeys, key):
+				x[k] = partiallyRedactToken("")
+			case isStr && slices.Contains(cassetteTokenKeys, key):
+				x[k] = redactToken(str)
+			case isStr && slices.Contains(cassetteLinkKeys, key):
+				x[k] = redactUrlTokens(str)
+			default:
+				redactSecrets(val)
+			}
+		}
+	case []interface{}:
+		for _, val := range x {
+			redactSecrets(val)
+		}
+	}
+}
+
+// Returns the given URL with the values of its paging and delta token parameters redacted,
+// see redactToken(), or the URL as is if it has none.
+func redactUrlTokens(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	query := u.Query()
+	changed := false
+	for key, values := range query {
+		if !slices.Contains(cassetteTokenKeys, strings.ToLower(key)) {
+			continue
+		}
+		for i, value := range values {
+			if redacted := redactToken(value); redacted != value {
+				values[i], changed = redacted, true
+			}
+		}
+	}
+	if !changed {
+		return rawUrl
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Returns a redacted paging or delta token: a short hash of it, so that tokens stay apart,
+// but can't be used. Already redacted tokens, as in links served while replaying, are
+// returned as is.
+func redactToken(token string) string {
+	if token == "" || strings.HasPrefix(token, "redacted-") {
+		return token
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "redacted-" + hex.EncodeToString(sum[:6])
+}
+
+// Helper function to read a JSON file into v.
+func readJsonFile(filePath string, v interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Helper function to write v to a JSON file, readable by the owner only.
+func writeJsonFile(filePath string, v interface{}) error {
+	data, err := marshalJson(v, "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0600)
+}
+
+// Helper function to marshal v to JSON, without escaping HTML characters, so the cassette
+// files stay readable.
+func marshalJson(v interface{}, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,99 @@
+package maz
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUseCassetteRefusesToClearOtherDirs(t *testing.T) {
+	dir := t.TempDir()
+	precious := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(precious, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewConfig().UseCassette(CassetteRecord, dir); err == nil {
+		t.Error("UseCassette() recorded to a directory that is not a cassette")
+	}
+	if _, err := os.Stat(precious); err != nil {
+		t.Errorf("UseCassette() removed a file that is not part of a cassette: %v", err)
+	}
+
+	for _, name := range []string{"", ".", ".."} {
+		if err := NewConfig().UseCassette(CassetteRecord, name); err == nil {
+			t.Errorf("UseCassette() accepted cassette name %q", name)
+		}
+	}
+
+	// An earlier recording is cleared
+	cassette := filepath.Join(dir, "cassette")
+	for _, file := range []string{cassetteMetaFile, "00001.json", filepath.Join(cassetteCacheDir, "x.bin")} {
+		os.MkdirAll(filepath.Dir(filepath.Join(cassette, file)), 0700)
+		if err := os.WriteFile(filepath.Join(cassette, file), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewConfig().UseCassette(CassetteRecord, cassette); err != nil {
+		t.Fatalf("UseCassette() failed to clear an earlier recording: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cassette, "00001.json")); !os.IsNotExist(err) {
+		t.Errorf("UseCassette() kept the earlier recording")
+	}
+}
+
+func TestCassetteRecordsSanitizedCalls(t *testing.T) {
+	pages := [][]string{{"a", "b"}, {"c"}}
+	users := pagedUsersHandler(t, pages, "@odata.nextLink", -1)
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("request-id", "secret-request-id")
+		w.Header().Set("Set-Cookie", "session=secret-cookie")
+		w.Header().Set("x-ms-ratelimit-remaining-subscription-reads", "11999")
+		switch r.URL.Path {
+		case "/graph/v1.0/users":
+			users(w, r)
+		case "/graph/v1.0/applications/app/addPassword":
+			writeJson(w, 200, map[string]interface{}{"keyId": "k", "secretText": "secret-value"})
+		default:
+			w.Write([]byte("plain text with secret-text"))
+		}
+	})
+	dir := filepath.Join(t.TempDir(), "cassette")
+	if err := z.UseCassette(CassetteRecord, dir); err != nil {
+		t.Fatalf("UseCassette() failed: %v", err)
+	}
+	params := map[string]string{"$top": "2"}
+	recorded, err := ApiGetAll(z.MgUrl+"/v1.0/users", z, params)
+	if err != nil {
+		t.Fatalf("ApiGetAll() failed: %v", err)
+	}
+	ApiPost(z.MgUrl+"/v1.0/applications/app/addPassword", z, map[string]interface{}{}, nil)
+	ApiGet(z.MgUrl+"/v1.0/text", z, nil)
+
+	// Nothing secret ends up in the cassette
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, secret := range []string{"skiptoken=1", "secret-request-id", "secret-cookie", "secret-value", "secret-text"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s holds %q", filepath.Base(file), secret)
+			}
+		}
+	}
+
+	// Replaying follows the redacted next links
+	replay := NewConfig()
+	if err := replay.UseCassette(CassetteReplay, dir); err != nil {
+		t.Fatalf("UseCassette() failed to replay: %v", err)
+	}
+	replayed, err := ApiGetAll(replay.MgUrl+"/v1.0/users", replay, params)
+	if err != nil {
+		t.Fatalf("ApiGetAll() failed to replay: %v", err)
+	}
+	if fmt.Sprint(replayed) != fmt.Sprint(recorded) {
+		t.Errorf("replayed %v, want %v", replayed, recorded)
+	}
+}
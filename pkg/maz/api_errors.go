@@ -0,0 +1,135 @@
+package maz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// ApiError is an error response from the MS Graph or ARM API. ApiCall returns it, along
+// with the usual result object and status code, for any HTTP 4xx or 5xx response, and the
+// library's own errors wrap it, so it can always be retrieved with errors.As. For example:
+//
+//	var apiErr *maz.ApiError
+//	if errors.As(err, &apiErr) && apiErr.Code == "RoleAssignmentExists" { ... }
+type ApiError struct {
+	StatusCode      int                    // HTTP status code
+	Code            string                 // Error code, e.g. "Request_ResourceNotFound" or "RoleAssignmentExists"
+	Message         string                 // Error message
+	Target          string                 // Name of the offending property or argument, if any
+	Details         []ApiErrorDetail       // Additional errors, as returned by ARM and some Graph calls
+	InnerError      map[string]interface{} // Raw MS Graph 'innerError' object, if any
+	RequestId       string                 // Graph 'request-id', or the ARM 'x-ms-request-id' header
+	ClientRequestId string                 // Graph 'client-request-id', or the 'x-ms-client-request-id' header
+	CorrelationId   string                 // ARM 'x-ms-correlation-request-id' header
+	Timestamp       time.Time              // Graph innerError 'date', or the response Date header
+}
+
+// ApiErrorDetail is a single entry of an API error's 'details' list.
+type ApiErrorDetail struct {
+	Code    string
+	Message string
+	Target  string
+}
+
+func (e *ApiError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP %d", e.StatusCode)
+	if e.Code != "" || e.Message != "" {
+		fmt.Fprintf(&b, ": %s: %s", e.Code, e.Message)
+	}
+	if e.RequestId != "" {
+		fmt.Fprintf(&b, " (request-id %s)", e.RequestId)
+	}
+	return b.String()
+}
+
+// Makes errors.Is(err, ErrNotFound) and the other error kinds work on API errors, based
+// on their HTTP status code.
+func (e *ApiError) Is(target error) bool {
+	return target == apiErrorKind(e.StatusCode)
+}
+
+// Reports whether the error, or any of its details, has the given error code.
+func (e *ApiError) HasCode(code string) bool {
+	if strings.EqualFold(e.Code, code) {
+		return true
+	}
+	for _, d := range e.Details {
+		if strings.EqualFold(d.Code, code) {
+			return true
+		}
+	}
+	return strings.EqualFold(utl.Str(e.InnerError["code"]), code)
+}
+
+// Parses an ApiError from the given API error response body and headers. The header can
+// be nil. MS Graph returns the request IDs and timestamp in the body's 'innerError' object,
+// while ARM only returns them as response headers.
+func NewApiError(statCode int, body map[string]interface{}, header http.Header) *ApiError {
+	e := &ApiError{StatusCode: statCode}
+
+	switch errObj := body["error"].(type) {
+	case map[string]interface{}:
+		e.Code = utl.Str(errObj["code"])
+		e.Message = utl.Str(errObj["message"])
+		e.Target = utl.Str(errObj["target"])
+		for _, item := range utl.Slice(errObj["details"]) {
+			if d := utl.Map(item); d != nil {
+				e.Details = append(e.Details, ApiErrorDetail{
+					Code:    utl.Str(d["code"]),
+					Message: utl.Str(d["message"]),
+					Target:  utl.Str(d["target"]),
+				})
+			}
+		}
+		// MS Graph has used both spellings over time
+		e.InnerError = utl.Map(errObj["innerError"])
+		if e.InnerError == nil {
+			e.InnerError = utl.Map(errObj["innererror"])
+		}
+	case string:
+		// OAuth style error bodies, such as those from the token endpoints
+		e.Code = errObj
+		e.Message = utl.Str(body["error_description"])
+	}
+
+	e.RequestId = utl.Str(e.InnerError["request-id"])
+	e.ClientRequestId = utl.Str(e.InnerError["client-request-id"])
+	date := utl.Str(e.InnerError["date"])
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05"} { // Graph usually omits the zone
+		if t, err := time.Parse(layout, date); err == nil {
+			e.Timestamp = t
+			break
+		}
+	}
+
+	if header != nil {
+		if e.RequestId == "" {
+			e.RequestId = firstHeader(header, "x-ms-request-id", "request-id")
+		}
+		if e.ClientRequestId == "" {
+			e.ClientRequestId = firstHeader(header, "x-ms-client-request-id", "client-request-id")
+		}
+		e.CorrelationId = header.Get("x-ms-correlation-request-id")
+		if e.Timestamp.IsZero() {
+			if t, err := http.ParseTime(header.Get("Date")); err == nil {
+				e.Timestamp = t
+			}
+		}
+	}
+	return e
+}
+
+// Returns the value of the first of the given headers that is set.
+func firstHeader(header http.Header, keys ...string) string {
+	for _, key := range keys {
+		if v := header.Get(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
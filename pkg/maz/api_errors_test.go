@@ -0,0 +1,123 @@
+package maz
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewApiError(t *testing.T) {
+	graphBody := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    "Request_ResourceNotFound",
+			"message": "Resource 'x' does not exist",
+			"innerError": map[string]interface{}{
+				"date":              "2024-05-01T10:20:30",
+				"request-id":        "graph-request",
+				"client-request-id": "graph-client",
+			},
+		},
+	}
+	armBody := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    "InvalidTemplate",
+			"message": "Deployment failed",
+			"target":  "properties",
+			"details": []interface{}{
+				map[string]interface{}{"code": "RoleAssignmentExists", "message": "Already there"},
+			},
+		},
+	}
+	armHeader := http.Header{}
+	armHeader.Set("x-ms-request-id", "arm-request")
+	armHeader.Set("x-ms-correlation-request-id", "arm-correlation")
+	armHeader.Set("Date", "Wed, 01 May 2024 10:20:30 GMT")
+	oauthBody := map[string]interface{}{"error": "invalid_grant", "error_description": "AADSTS70008: expired"}
+	when := time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		statCode int
+		body     map[string]interface{}
+		header   http.Header
+		want     ApiError
+		code     string // A code HasCode() must find
+		kind     error
+	}{
+		{"MS Graph", 404, graphBody, nil, ApiError{
+			StatusCode: 404, Code: "Request_ResourceNotFound", Message: "Resource 'x' does not exist",
+			RequestId: "graph-request", ClientRequestId: "graph-client", Timestamp: when,
+		}, "Request_ResourceNotFound", ErrNotFound},
+		{"ARM", 409, armBody, armHeader, ApiError{
+			StatusCode: 409, Code: "InvalidTemplate", Message: "Deployment failed", Target: "properties",
+			Details:   []ApiErrorDetail{{Code: "RoleAssignmentExists", Message: "Already there"}},
+			RequestId: "arm-request", CorrelationId: "arm-correlation", Timestamp: when,
+		}, "roleassignmentexists", ErrValidation},
+		{"OAuth", 400, oauthBody, nil, ApiError{
+			StatusCode: 400, Code: "invalid_grant", Message: "AADSTS70008: expired",
+		}, "invalid_grant", ErrValidation},
+		{"throttled without a body", 429, nil, nil, ApiError{StatusCode: 429}, "", ErrThrottled},
+		{"server error", 500, map[string]interface{}{}, nil, ApiError{StatusCode: 500}, "", ErrApiCall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewApiError(tt.statCode, tt.body, tt.header)
+			got.InnerError = nil // Compared through the fields taken from it
+			if got.Error() == "" || !errors.Is(got, tt.kind) {
+				t.Errorf("NewApiError() = %v, want an error of kind %v", got, tt.kind)
+			}
+			if tt.code != "" && !got.HasCode(tt.code) {
+				t.Errorf("HasCode(%q) = false", tt.code)
+			}
+			if got.HasCode("SomethingElse") {
+				t.Error("HasCode() found a code the error doesn't have")
+			}
+			if got.StatusCode != tt.want.StatusCode || got.Code != tt.want.Code || got.Message != tt.want.Message ||
+				got.Target != tt.want.Target || got.RequestId != tt.want.RequestId ||
+				got.ClientRequestId != tt.want.ClientRequestId || got.CorrelationId != tt.want.CorrelationId ||
+				!got.Timestamp.Equal(tt.want.Timestamp) || len(got.Details) != len(tt.want.Details) {
+				t.Errorf("NewApiError() = %+v, want %+v", *got, tt.want)
+			}
+			for i := range tt.want.Details {
+				if got.Details[i] != tt.want.Details[i] {
+					t.Errorf("detail %d is %+v, want %+v", i, got.Details[i], tt.want.Details[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApiErrorWrapped(t *testing.T) {
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "arm-request")
+		writeJson(w, 403, map[string]interface{}{"error": map[string]interface{}{"code": "AuthorizationFailed"}})
+	})
+	resp, statCode, err := ApiGet(z.AzUrl+"/subscriptions/s", z, nil)
+	wrapped := apiError(err, statCode, resp, "error getting subscription %s", "s")
+
+	var apiErr *ApiError
+	if !errors.As(wrapped, &apiErr) || apiErr.Code != "AuthorizationFailed" || apiErr.RequestId != "arm-request" {
+		t.Errorf("apiError() = %v, want it to wrap the response's *ApiError", wrapped)
+	}
+	if !errors.Is(wrapped, ErrPermissionDenied) {
+		t.Errorf("apiError() = %v, want an ErrPermissionDenied", wrapped)
+	}
+}
+
+func TestPrintersReturnApiErrors(t *testing.T) {
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, 403, map[string]interface{}{"error": map[string]interface{}{"code": "AuthorizationFailed"}})
+	})
+	printers := map[string]func(*Config) error{
+		"PrintAzureMgmtGroupTree": PrintAzureMgmtGroupTree,
+		"PrintCountStatus":        PrintCountStatus,
+	}
+	for name, print := range printers {
+		var err error
+		captureStdout(t, func() { err = print(z) })
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("%s() = %v, want an ErrPermissionDenied", name, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package maz
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Default long-running operation polling values, see DefaultLroPolicy()
+const (
+	ConstLroTimeout      = 30 * time.Minute
+	ConstLroPollInterval = 5 * time.Second
+)
+
+// LroPolicy controls how ApiCallAndWait polls ARM long-running operations, see
+// learn.microsoft.com/en-us/azure/azure-resource-manager/management/async-operations
+type LroPolicy struct {
+	Timeout      time.Duration                              // Limit for the whole operation, 0 for none beyond the context
+	PollInterval time.Duration                              // Wait between polls when the response has no Retry-After
+	OnProgress   func(status string, elapsed time.Duration) // Called after every poll, if set
+}
+
+// Sets the policy used by ApiCallAndWait to poll long-running operations.
+func (m *Config) SetLroPolicy(policy LroPolicy) *Config {
+	m.Lro = policy
+	return m
+}
+
+// Returns the default long-running operation policy.
+func DefaultLroPolicy() LroPolicy {
+	return LroPolicy{
+		Timeout:      ConstLroTimeout,
+		PollInterval: ConstLroPollInterval,
+	}
+}
+
+// ApiCallAndWait alias to do a PUT
+func ApiPutAndWait(
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	return ApiCallAndWait("PUT", apiUrl, z, payload, params)
+}
+
+// ApiCallAndWait alias to do a DELETE
+func ApiDeleteAndWait(
+	apiUrl string,
+	z *Config,
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	return ApiCallAndWait("DELETE", apiUrl, z, nil, params)
+}
+
+// Makes an API call like ApiCall, but when ARM runs the request as a long-running operation,
+// it follows the Azure-AsyncOperation or Location header, or the resource's provisioningState,
+// until the operation succeeds, fails or is canceled. It then returns the final resource, as
+// fetched with a GET of apiUrl, and its status code. A completed DELETE returns HTTP 200.
+// A failed or canceled operation returns an ErrApiCall error wrapping the operation's
+// *ApiError, and running past z.Lro.Timeout returns an error wrapping
+// context.DeadlineExceeded.
+func ApiCallAndWait(
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	return ApiCallAndWaitContext(context.Background(), method, apiUrl, z, payload, params)
+}
+
+// Same as ApiCallAndWait, but makes the call, and waits for the operation, under the given
+// context, bounded by z.Lro.Timeout.
+func ApiCallAndWaitContext(
+	parent context.Context,
+	method string,
+	apiUrl string,
+	z *Config,
+	payload map[string]interface{},
+	params map[string]string,
+) (map[string]interface{}, int, error) {
+	ctx := parent
+	if z.Lro.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, z.Lro.Timeout)
+		defer cancel()
+	}
+	method = strings.ToUpper(method)
+	result, statCode, header, err := apiCallWithHeader(ctx, method, apiUrl, z, payload, params, isIdempotentMethod(method))
+	if err != nil {
+		return result, statCode, lroError(parent, err, z)
+	}
+	result, statCode, err = waitForOperation(ctx, method, apiUrl, params, result, statCode, header, z)
+	if err != nil {
+		return result, statCode, lroError(parent, err, z)
+	}
+	return result, statCode, nil
+}
+
+// Helper function that waits for the long-running operation started by a call, if any,
+// and returns the final result. See ApiCallAndWait.
+func waitForOperation(
+	ctx context.Context,
+	method, apiUrl string,
+	params map[string]string,
+	result map[string]interface{},
+	statCode int,
+	header http.Header,
+	z *Config,
+) (map[string]interface{}, int, error) {
+	start := time.Now()
+	isWrite := method == "PUT" || method == "PATCH"
+	asyncUrl := header.Get("Azure-AsyncOperation")
+	locationUrl := header.Get("Location")
+
+	switch {
+	case asyncUrl != "" && (statCode == 201 || statCode == 202 || isWrite && statCode == 200):
+		// Poll the operation status resource, which has a 'status' and, on failure, an 'error'
+		Logf("Polling long-running operation %s\n", asyncUrl)
+		_, _, err := pollOperation(ctx, asyncUrl, nil, header, start, z, func(resp map[string]interface{}, _ int) string {
+			return utl.Str(resp["status"])
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if method == "POST" && locationUrl != "" {
+			result, statCode, _, err = apiCallWithHeader(ctx, "GET", locationUrl, z, nil, nil, true)
+			return result, statCode, err
+		}
+	case locationUrl != "" && statCode == 202:
+		// Poll the Location URL, which returns HTTP 202 until the operation is done
+		Logf("Polling long-running operation %s\n", locationUrl)
+		result, statCode, err := pollOperation(ctx, locationUrl, nil, header, start, z, func(_ map[string]interface{}, statCode int) string {
+			if statCode == 202 {
+				return "InProgress"
+			}
+			return "Succeeded"
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if method == "POST" {
+			return result, statCode, nil
+		}
+	case isWrite && (statCode == 200 || statCode == 201) && !isTerminalState(provisioningState(result)):
+		// Some resources only report progress via their provisioningState
+		Logf("Polling provisioningState of %s\n", apiUrl)
+		result, statCode, err := pollOperation(ctx, apiUrl, params, header, start, z, func(resp map[string]interface{}, _ int) string {
+			return provisioningState(resp)
+		})
+		return result, statCode, err
+	default:
+		return result, statCode, nil // Not a long-running operation
+	}
+
+	// The operation is done, so get the final state of the resource
+	if method == "DELETE" {
+		return nil, 200, nil
+	}
+	result, statCode, _, err := apiCallWithHeader(ctx, "GET", apiUrl, z, nil, params, true)
+	return result, statCode, err
+}
+
+// Helper function that polls pollUrl, using status() to get the operation's state from each
+// response, until it reaches a terminal state. It honors the Retry-After header between polls,
+// and reports progress to z.Lro.OnProgress. The last response is returned on success. Note
+// that operation URLs already include the api-version, so params are only needed when
+// polling the resource itself.
+func pollOperation(
+	ctx context.Context,
+	pollUrl string,
+	params map[string]string,
+	header http.Header,
+	start time.Time,
+	z *Config,
+	status func(resp map[string]interface{}, statCode int) string,
+) (map[string]interface{}, int, error) {
+	for {
+		wait, ok := parseRetryAfter(header)
+		if !ok {
+			wait = z.Lro.PollInterval
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, 0, err
+		}
+
+		resp, statCode, respHeader, err := apiCallWithHeader(ctx, "GET", pollUrl, z, nil, params, true)
+		if err != nil {
+			return resp, statCode, err
+		}
+		header = respHeader
+
+		state := status(resp, statCode)
+		elapsed := time.Since(start)
+		Logf("Operation status %s after %s\n", utl.Yel(state), elapsed.Round(time.Second))
+		if z.Lro.OnProgress != nil {
+			z.Lro.OnProgress(state, elapsed)
+		}
+		if isTerminalState(state) {
+			if !strings.EqualFold(state, "Succeeded") {
+				return resp, statCode, wrapError(ErrApiCall, NewApiError(statCode, resp, header),
+					"long-running operation %s", strings.ToLower(state))
+			}
+			return resp, statCode, nil
+		}
+	}
+}
+
+// Returns the provisioningState of an ARM resource, or "" if it has none.
+func provisioningState(obj map[string]interface{}) string {
+	return utl.Str(utl.Map(obj["properties"])["provisioningState"])
+}
+
+// Reports whether the given ARM operation status or provisioningState is final. An empty
+// state is treated as final, since resources without a provisioningState are ready at once.
+func isTerminalState(state string) bool {
+	switch strings.ToLower(state) {
+	case "", "succeeded", "failed", "canceled", "cancelled":
+		return true
+	}
+	return false
+}
+
+// Helper function to turn a cancelled or timed out wait into a library error. It's a timeout
+// of the wait if the parent context of the call hasn't ended itself.
+func lroError(parent context.Context, err error, z *Config) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil:
+		return wrapError(ErrApiCall, err, "long-running operation did not finish within %s", z.Lro.Timeout)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return wrapError(ErrApiCall, err, "wait for long-running operation interrupted")
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package maz
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper function that returns a configuration for a fake ARM server, which polls quickly and
+// records the operation states reported to OnProgress.
+func newLroTestConfig(t *testing.T, timeout time.Duration, handler http.HandlerFunc) (*Config, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	states := []string{}
+	z := newTestConfig(t, handler)
+	z.SetLroPolicy(LroPolicy{
+		Timeout:      timeout,
+		PollInterval: 10 * time.Millisecond,
+		OnProgress: func(status string, _ time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, status)
+		},
+	})
+	return z, &states
+}
+
+func TestApiCallAndWaitAsyncOperation(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	var z *Config
+	z, states := newLroTestConfig(t, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/arm/resource":
+			w.Header().Set("Azure-AsyncOperation", z.AzUrl+"/operations/1")
+			writeJson(w, 201, map[string]interface{}{"id": "resource"})
+		case r.Method == "GET" && r.URL.Path == "/arm/operations/1":
+			polls++
+			status := "InProgress"
+			if polls == 2 {
+				status = "Succeeded"
+			}
+			writeJson(w, 200, map[string]interface{}{"status": status})
+		case r.Method == "GET" && r.URL.Path == "/arm/resource":
+			if r.URL.Query().Get("api-version") != "2024-01-01" {
+				t.Errorf("final GET has query %q, want the given params", r.URL.RawQuery)
+			}
+			writeJson(w, 200, map[string]interface{}{"id": "resource", "final": true})
+		default:
+			t.Errorf("unexpected call %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	result, statCode, err := ApiPutAndWait(z.AzUrl+"/resource", z, map[string]interface{}{},
+		map[string]string{"api-version": "2024-01-01"})
+	if err != nil || statCode != 200 || result["final"] != true {
+		t.Fatalf("ApiPutAndWait() = %v, %d, %v, want the final resource", result, statCode, err)
+	}
+	if got := len(*states); got != 2 || (*states)[0] != "InProgress" || (*states)[1] != "Succeeded" {
+		t.Errorf("OnProgress() got %v, want [InProgress Succeeded]", *states)
+	}
+}
+
+func TestApiCallAndWaitLocation(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	var z *Config
+	z, _ = newLroTestConfig(t, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "DELETE" && r.URL.Path == "/arm/resource":
+			w.Header().Set("Location", z.AzUrl+"/operations/1")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(202)
+		case r.Method == "GET" && r.URL.Path == "/arm/operations/1":
+			polls++
+			if polls < 3 {
+				w.WriteHeader(202)
+				return
+			}
+			w.WriteHeader(204)
+		default:
+			t.Errorf("unexpected call %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	result, statCode, err := ApiDeleteAndWait(z.AzUrl+"/resource", z, nil)
+	if err != nil || statCode != 200 || result != nil {
+		t.Fatalf("ApiDeleteAndWait() = %v, %d, %v, want nil, 200, nil", result, statCode, err)
+	}
+	if polls != 3 {
+		t.Errorf("polled %d times, want 3", polls)
+	}
+}
+
+func TestApiCallAndWaitProvisioningState(t *testing.T) {
+	var mu sync.Mutex
+	gets := 0
+	z, _ := newLroTestConfig(t, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		state := "Creating"
+		if r.Method == "GET" {
+			if gets++; gets == 2 {
+				state = "Succeeded"
+			}
+		}
+		writeJson(w, 200, map[string]interface{}{"id": "resource", "properties": map[string]interface{}{"provisioningState": state}})
+	})
+
+	result, statCode, err := ApiPutAndWait(z.AzUrl+"/resource", z, map[string]interface{}{}, nil)
+	if err != nil || statCode != 200 || provisioningState(result) != "Succeeded" {
+		t.Fatalf("ApiPutAndWait() = %v, %d, %v, want the succeeded resource", result, statCode, err)
+	}
+	if gets != 2 {
+		t.Errorf("polled %d times, want 2", gets)
+	}
+}
+
+func TestApiCallAndWaitFailed(t *testing.T) {
+	var z *Config
+	z, _ = newLroTestConfig(t, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			w.Header().Set("Azure-AsyncOperation", z.AzUrl+"/operations/1")
+			writeJson(w, 201, map[string]interface{}{})
+			return
+		}
+		writeJson(w, 200, map[string]interface{}{
+			"status": "Failed",
+			"error":  map[string]interface{}{"code": "QuotaExceeded", "message": "Not enough cores"},
+		})
+	})
+
+	_, _, err := ApiPutAndWait(z.AzUrl+"/resource", z, map[string]interface{}{}, nil)
+	var apiErr *ApiError
+	if !errors.Is(err, ErrApiCall) || !errors.As(err, &apiErr) || !apiErr.HasCode("QuotaExceeded") {
+		t.Errorf("ApiPutAndWait() error = %v, want an ErrApiCall wrapping the operation's error", err)
+	}
+}
+
+func TestApiCallAndWaitTimeout(t *testing.T) {
+	var z *Config
+	z, _ = newLroTestConfig(t, 100*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			w.Header().Set("Azure-AsyncOperation", z.AzUrl+"/operations/1")
+			writeJson(w, 201, map[string]interface{}{})
+			return
+		}
+		writeJson(w, 200, map[string]interface{}{"status": "InProgress"})
+	})
+
+	start := time.Now()
+	_, _, err := ApiPutAndWait(z.AzUrl+"/resource", z, map[string]interface{}{}, nil)
+	if !errors.Is(err, ErrApiCall) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ApiPutAndWait() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("ApiPutAndWait() gave up after %s, want about the 100ms timeout", elapsed)
+	}
+}
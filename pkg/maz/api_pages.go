@@ -0,0 +1,124 @@
+package maz
+
+import (
+	"context"
+	"iter"
+
+	"github.com/queone/utl"
+)
+
+// Function that fetches a single page of a paged list, see apiPages().
+type pageGetter func(ctx context.Context, apiUrl string, params map[string]string) (map[string]interface{}, error)
+
+// Returns an iterator over the pages of a paged MS Graph or ARM list response. It does a
+// GET of apiUrl with the given params, then follows the MS Graph '@odata.nextLink' or ARM
+// 'nextLink' of each page until there are none left. Pages are fetched via ApiCall, so
+// throttled calls are retried. On failure the error is yielded, with a nil page, as the
+// last value.
+func ApiPages(apiUrl string, z *Config, params map[string]string) iter.Seq2[map[string]interface{}, error] {
+	return ApiPagesContext(context.Background(), apiUrl, z, params)
+}
+
+// Same as ApiPages, but fetches the pages under the given context, and stops iterating
+// once it is cancelled.
+func ApiPagesContext(
+	ctx context.Context,
+	apiUrl string,
+	z *Config,
+	params map[string]string,
+) iter.Seq2[map[string]interface{}, error] {
+	get := func(ctx context.Context, apiUrl string, params map[string]string) (map[string]interface{}, error) {
+		resp, statCode, err := ApiCallContext(ctx, "GET", apiUrl, z, nil, params)
+		if err == nil && (statCode < 200 || statCode > 299) {
+			err = NewApiError(statCode, resp, nil) // E.g. a redirect the client didn't follow
+		}
+		return resp, err
+	}
+	return apiPages(ctx, apiUrl, params, get)
+}
+
+// Returns an iterator over the items in the 'value' lists of all the pages of a paged
+// MS Graph or ARM list response. See ApiPages.
+func ApiItems(apiUrl string, z *Config, params map[string]string) iter.Seq2[map[string]interface{}, error] {
+	return ApiItemsContext(context.Background(), apiUrl, z, params)
+}
+
+// Same as ApiItems, but fetches the pages under the given context.
+func ApiItemsContext(
+	ctx context.Context,
+	apiUrl string,
+	z *Config,
+	params map[string]string,
+) iter.Seq2[map[string]interface{}, error] {
+	return func(yield func(map[string]interface{}, error) bool) {
+		for page, err := range ApiPagesContext(ctx, apiUrl, z, params) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, item := range utl.Slice(page["value"]) {
+				if obj := utl.Map(item); obj != nil {
+					if !yield(obj, nil) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// Returns all the items of a paged MS Graph or ARM list response, along with the error that
+// stopped the listing early, if any. The items fetched before the error are still returned.
+func ApiGetAll(apiUrl string, z *Config, params map[string]string) (AzureObjectList, error) {
+	return ApiGetAllContext(context.Background(), apiUrl, z, params)
+}
+
+// Same as ApiGetAll, but fetches the pages under the given context.
+func ApiGetAllContext(ctx context.Context, apiUrl string, z *Config, params map[string]string) (AzureObjectList, error) {
+	list := AzureObjectList{}
+	for obj, err := range ApiItemsContext(ctx, apiUrl, z, params) {
+		if err != nil {
+			return list, err
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+// Helper function that iterates over the pages of a paged list response, using the given
+// function to fetch each page. Query params only apply to the first page, since the next
+// links already include them.
+func apiPages(
+	ctx context.Context,
+	apiUrl string,
+	params map[string]string,
+	get pageGetter,
+) iter.Seq2[map[string]interface{}, error] {
+	return func(yield func(map[string]interface{}, error) bool) {
+		// Work on copies, so that each range over the iterator starts at the first page
+		pageUrl, pageParams := apiUrl, params
+		for pageUrl != "" {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			page, err := get(ctx, pageUrl, pageParams)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(page, nil) {
+				return
+			}
+			pageUrl, pageParams = nextPageLink(page), nil
+		}
+	}
+}
+
+// Returns the link to the next page of a paged list response, or "" if it's the last page.
+func nextPageLink(page map[string]interface{}) string {
+	if nextLink := utl.Str(page["@odata.nextLink"]); nextLink != "" {
+		return nextLink // MS Graph
+	}
+	return utl.Str(page["nextLink"]) // ARM
+}
@@ -0,0 +1,71 @@
+package maz
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Helper function that returns a handler serving the given pages of user IDs at /graph/v1.0/users,
+// linking each to the next with the given next link attribute, or failing on the page given
+// by failPage, if any.
+func pagedUsersHandler(t *testing.T, pages [][]string, linkAttr string, failPage int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		if token := r.URL.Query().Get("$skiptoken"); token != "" {
+			fmt.Sscan(token, &page)
+		} else if top := r.URL.Query().Get("$top"); top != "2" {
+			t.Errorf("first page requested with $top %q, want the given params", top)
+		}
+		if page == failPage {
+			writeJson(w, 400, map[string]interface{}{"error": map[string]interface{}{"code": "BadRequest"}})
+			return
+		}
+		value := []interface{}{}
+		for _, id := range pages[page] {
+			value = append(value, map[string]interface{}{"id": id})
+		}
+		body := map[string]interface{}{"value": value}
+		if page+1 < len(pages) {
+			body[linkAttr] = fmt.Sprintf("http://%s%s?$skiptoken=%d", r.Host, r.URL.Path, page+1)
+		}
+		writeJson(w, 200, body)
+	}
+}
+
+func TestApiItemsMultiplePages(t *testing.T) {
+	pages := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	for _, linkAttr := range []string{"@odata.nextLink", "nextLink"} {
+		t.Run(linkAttr, func(t *testing.T) {
+			z := newTestConfig(t, pagedUsersHandler(t, pages, linkAttr, -1))
+			items := ApiItems(z.MgUrl+"/v1.0/users", z, map[string]string{"$top": "2"})
+
+			// Ranging over the same iterator again starts over at the first page
+			for round := 1; round <= 2; round++ {
+				var ids []string
+				for obj, err := range items {
+					if err != nil {
+						t.Fatalf("round %d: unexpected error: %v", round, err)
+					}
+					ids = append(ids, ExtractID(obj))
+				}
+				if got := fmt.Sprint(ids); got != "[a b c d e]" {
+					t.Errorf("round %d: got items %s, want [a b c d e]", round, got)
+				}
+			}
+		})
+	}
+}
+
+func TestApiGetAllStopsAtFailedPage(t *testing.T) {
+	pages := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	z := newTestConfig(t, pagedUsersHandler(t, pages, "@odata.nextLink", 1))
+
+	list, err := ApiGetAll(z.MgUrl+"/v1.0/users", z, map[string]string{"$top": "2"})
+	if err == nil {
+		t.Fatal("ApiGetAll() returned no error for a failed page")
+	}
+	if len(list) != 2 {
+		t.Errorf("ApiGetAll() returned %d items, want the 2 of the first page", len(list))
+	}
+}
@@ -0,0 +1,167 @@
+package maz
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Default retry policy values, see NewConfig()
+const (
+	ConstMaxRetries   = 5
+	ConstRetryBase    = time.Second
+	ConstRetryMaxWait = 60 * time.Second
+	ConstMinRemaining = 1
+)
+
+// RetryPolicy controls how ApiCall retries throttled (HTTP 429) and unavailable (HTTP 503)
+// responses. GET, PUT, PATCH and DELETE calls are always retried, but POST calls are only
+// retried when made via ApiPostIdempotent, since a repeated create could duplicate objects.
+type RetryPolicy struct {
+	MaxRetries   int           // Retries after the first attempt, 0 disables retrying
+	BaseDelay    time.Duration // Initial backoff when the response has no Retry-After, doubled on every retry
+	MaxDelay     time.Duration // Upper limit for any single wait, including a Retry-After value
+	MinRemaining int           // Pause pro-actively when a remaining-quota header drops to this value or below
+}
+
+// Sets the retry policy used by ApiCall for throttled responses.
+func (m *Config) SetRetryPolicy(policy RetryPolicy) *Config {
+	m.Retry = policy
+	return m
+}
+
+// Returns the default retry policy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:   ConstMaxRetries,
+		BaseDelay:    ConstRetryBase,
+		MaxDelay:     ConstRetryMaxWait,
+		MinRemaining: ConstMinRemaining,
+	}
+}
+
+// Reports whether the HTTP method may be safely retried.
+func isIdempotentMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Reports whether the status code signals throttling or a temporarily unavailable service.
+func isThrottled(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// Returns how long to wait before the given retry attempt (zero based). The Retry-After
+// header, in either seconds or HTTP date format, has precedence over exponential backoff.
+func retryDelay(header http.Header, attempt int, policy RetryPolicy) time.Duration {
+	wait, ok := parseRetryAfter(header)
+	if !ok {
+		wait = policy.BaseDelay << uint(attempt)
+		if wait > 0 {
+			wait += rand.N(wait/4 + 1) // Jitter, so parallel callers don't retry in lockstep
+		}
+	}
+	if policy.MaxDelay > 0 && wait > policy.MaxDelay {
+		wait = policy.MaxDelay
+	}
+	return wait
+}
+
+// Parses the Retry-After header, or the millisecond variant some Azure services return.
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	if v := header.Get("x-ms-retry-after-ms"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// Returns how long to pause after a successful response whose remaining-quota headers
+// show the caller is about to be throttled. ARM returns x-ms-ratelimit-remaining-* headers,
+// and Resource Graph returns x-ms-user-quota-remaining with x-ms-user-quota-resets-after.
+func quotaPause(header http.Header, policy RetryPolicy) time.Duration {
+	var pause time.Duration
+	for key, values := range header {
+		lower := strings.ToLower(key)
+		if !strings.HasPrefix(lower, "x-ms-ratelimit-remaining-") || len(values) == 0 {
+			continue
+		}
+		// Some of these have a "<name>;<count>" format, so only the last field is the count
+		fields := strings.Split(values[0], ";")
+		remaining, err := strconv.Atoi(strings.TrimSpace(fields[len(fields)-1]))
+		if err == nil && remaining <= policy.MinRemaining {
+			Logf("Header %s is down to %s\n", key, utl.Red(remaining))
+			pause = max(pause, policy.BaseDelay)
+		}
+	}
+	if v := header.Get("x-ms-user-quota-remaining"); v != "" {
+		remaining, err := strconv.Atoi(v)
+		if err == nil && remaining <= policy.MinRemaining {
+			Logf("Header x-ms-user-quota-remaining is down to %s\n", utl.Red(remaining))
+			pause = max(pause, policy.BaseDelay)
+			if reset, ok := parseQuotaResetsAfter(header.Get("x-ms-user-quota-resets-after")); ok {
+				pause = max(pause, reset)
+			}
+		}
+	}
+	if policy.MaxDelay > 0 && pause > policy.MaxDelay {
+		pause = policy.MaxDelay
+	}
+	return pause
+}
+
+// Parses the "hh:mm:ss" format of the Resource Graph x-ms-user-quota-resets-after header.
+func parseQuotaResetsAfter(v string) (time.Duration, bool) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var total time.Duration
+	units := []time.Duration{time.Hour, time.Minute, time.Second}
+	for i, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		total += time.Duration(n * float64(units[i]))
+	}
+	return total, true
+}
+
+// Waits for the given duration, returning early with the context's error if it ends first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Discards whatever is left of a response body, so its connection can be reused.
+func drainResponse(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
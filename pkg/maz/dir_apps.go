@@ -16,10 +16,10 @@ const (
 )
 
 // Prints application object in YAML-like format
-func PrintApp(x AzureObject, z *Config) {
+func PrintApp(x AzureObject, z *Config) error {
 	id := utl.Str(x["id"])
 	if id == "" {
-		return
+		return nil
 	}
 
 	// Print the most important attributes first
@@ -41,15 +41,9 @@ func PrintApp(x AzureObject, z *Config) {
 	PrintFederatedCredentials(id, z)
 
 	// Print any owners
-	apiUrl := ConstMgUrl + "/beta/applications/" + id + "/owners"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	owners := utl.Slice(resp["value"]) // Cast to a slice
-	if statCode == 200 {
-		PrintOwners(owners)
-	}
+	apiUrl := z.MgUrl + "/beta/applications/" + id + "/owners"
+	owners := GetAzureAllPages(apiUrl, z)
+	PrintOwners(owners)
 
 	// Print OAuth2 permission scopes
 	api := utl.Map(x["api"])
@@ -58,18 +52,14 @@ func PrintApp(x AzureObject, z *Config) {
 	// Print API permissions that have already been assigned to this application
 	// Just look under the object's 'requiredResourceAccess' attribute
 	requiredResourceAccess := utl.Slice(x["requiredResourceAccess"])
-	PrintAssignedApiPermissions(requiredResourceAccess, z)
+	return PrintAssignedApiPermissions(requiredResourceAccess, z)
 }
 
 // Prints federated credentials list stanza for App objects
 func PrintFederatedCredentials(id string, z *Config) {
-	apiUrl := ConstMgUrl + "/v1.0/applications/" + id + "/federatedIdentityCredentials"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	fedCreds := utl.Slice(resp["value"]) // Cast to a slice
-	if statCode == 200 && len(fedCreds) > 0 {
+	apiUrl := z.MgUrl + "/v1.0/applications/" + id + "/federatedIdentityCredentials"
+	fedCreds := GetAzureAllPages(apiUrl, z)
+	if len(fedCreds) > 0 {
 		fmt.Printf("%s:\n", utl.Blu("federated_credentials"))
 		for _, item := range fedCreds {
 			cred := utl.Map(item) // Try casting to a map
@@ -165,12 +155,26 @@ func PrintOAuth2PermissionScopes(api map[string]interface{}, displayName string)
 }
 
 // Prints API permissions that have already been assigned to this application
-func PrintAssignedApiPermissions(requiredResourceAccess interface{}, z *Config) {
+func PrintAssignedApiPermissions(requiredResourceAccess interface{}, z *Config) error {
 	// learn.microsoft.com/en-us/entra/identity-platform/app-objects-and-service-principals
 	// learn.microsoft.com/en-us/entra/identity-platform/permissions-consent-overview
 
 	APIs := utl.Slice(requiredResourceAccess) // Cast to a slice
 	if len(APIs) > 0 {
+		// Get all the API SP objects with all relevant attributes in a single batch
+		var requests []BatchRequest
+		seen := utl.StringSet{}
+		for _, item := range APIs {
+			resAppId := utl.Str(utl.Map(item)["resourceAppId"])
+			if resAppId == "" || seen.Exists(resAppId) {
+				continue
+			}
+			seen.Add(resAppId)
+			requests = append(requests, BatchRequest{Id: resAppId, Url: "/beta/servicePrincipals",
+				Params: map[string]string{"$filter": "appId eq '" + resAppId + "'"}})
+		}
+		batch := ApiBatch(requests, z)
+
 		fmt.Printf("%s:\n", utl.Blu("api_permissions_assigned"))
 		for _, item := range APIs {
 			api := utl.Map(item) // Try casting to a map
@@ -185,18 +189,12 @@ func PrintAssignedApiPermissions(requiredResourceAccess interface{}, z *Config)
 				continue // Skip this API, move to next one
 			}
 
-			// Get this API's SP object with all relevant attributes
-			params := map[string]string{"$filter": "appId eq '" + resAppId + "'"}
-			apiUrl := ConstMgUrl + "/beta/servicePrincipals"
-			resp, statCode, _ := ApiGet(apiUrl, z, params)
-			if statCode != 200 {
-				Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-			}
-			SPs := utl.Slice(resp["value"]) // Cast to a slice
+			// Get this API's SP object, from above batch
+			SPs := batch[resAppId].Value()
 			// It's a list because this could be a multi-tenant app, having multiple SPs
 			// TODO: Handle multiple SPs
 			if len(SPs) > 1 {
-				utl.Die("  %-50s %s\n", resAppId, "Error. Multiple SPs for this AppId. Aborting.")
+				return newError(ErrAmbiguousName, "multiple SPs for resource appId %s", resAppId)
 			} else if len(SPs) < 1 {
 				fmt.Printf("  %-50s %s\n", resAppId, "Unable to get Resource App object. Skipping this API.")
 				continue
@@ -256,43 +254,55 @@ func PrintAssignedApiPermissions(requiredResourceAccess interface{}, z *Config)
 			}
 		}
 	}
+	return nil
 }
 
 // Checks to see whether the App and SP objects exist. Another preprocessing helper function.
-func CheckAppSpExistence(identifier string, z *Config) (app, sp AzureObject, code int) {
+func CheckAppSpExistence(identifier string, z *Config) (app, sp AzureObject, code int, err error) {
 	// Check if the App exists
-	app = PreFetchAzureObject(Application, identifier, z)
+	if app, err = PreFetchAzureObject(Application, identifier, z); err != nil {
+		return nil, nil, NeitherExists, err
+	}
 	if app != nil {
 		// App exists
 		appId := utl.Str(app["appId"])
 
 		// Use appId/ClientID to check if the corresponding SP exists
-		sp = PreFetchAzureObject(ServicePrincipal, appId, z)
+		if sp, err = PreFetchAzureObject(ServicePrincipal, appId, z); err != nil {
+			return nil, nil, NeitherExists, err
+		}
 		if sp != nil {
-			return app, sp, BothExist // Both exist
+			return app, sp, BothExist, nil // Both exist
 		}
-		return app, nil, OnlyAppExists // Only App exists
+		return app, nil, OnlyAppExists, nil // Only App exists
 	}
 
 	// App does not exist, check if SP exists
-	sp = PreFetchAzureObject(ServicePrincipal, identifier, z)
+	if sp, err = PreFetchAzureObject(ServicePrincipal, identifier, z); err != nil {
+		return nil, nil, NeitherExists, err
+	}
 	if sp != nil {
 		// SP exists, check if its associated App exists using its appId/ClientID
 		appId := utl.Str(sp["appId"])
-		app = PreFetchAzureObject(Application, appId, z)
+		if app, err = PreFetchAzureObject(Application, appId, z); err != nil {
+			return nil, nil, NeitherExists, err
+		}
 		if app != nil {
-			return app, sp, BothExist // Both exist
+			return app, sp, BothExist, nil // Both exist
 		}
-		return nil, sp, OnlySPExists // Only SP exists
+		return nil, sp, OnlySPExists, nil // Only SP exists
 	}
 
 	// Neither exists
-	return nil, nil, NeitherExists
+	return nil, nil, NeitherExists, nil
 }
 
 // Creates an App/SP object pair by name, if they don't already exist.
-func CreateAppSpByName(force bool, displayName string, z *Config) {
-	app, sp, state := CheckAppSpExistence(displayName, z)
+func CreateAppSpByName(force bool, displayName string, z *Config) error {
+	app, sp, state, err := CheckAppSpExistence(displayName, z)
+	if err != nil {
+		return err
+	}
 	switch state {
 	case NeitherExists:
 		// Create both App and SP
@@ -305,28 +315,26 @@ func CreateAppSpByName(force bool, displayName string, z *Config) {
 		utl.PrintYamlColor(obj)
 		if !force {
 			msg := utl.Yel("Create App/SP pair with above parameters? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("%s\n", "Operation aborted by user")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Printf("Creating App/SP pair with above parameters...\n")
 		}
 
-		app := CreateDirObjectInAzure(Application, obj, z)
-		if app == nil {
-			utl.Die("%s creating the App object.\n", utl.Red("Error"))
+		app, err := CreateDirObjectInAzure(Application, obj, z)
+		if err != nil {
+			return err
 		}
 		appId := utl.Str(app["appId"])
 		spObj := AzureObject{"appId": appId}
-		sp := CreateDirObjectInAzure(ServicePrincipal, spObj, z)
-		if sp == nil {
-			utl.Die("%s creating the SP object.\n", utl.Red("Error"))
-		}
+		_, err = CreateDirObjectInAzure(ServicePrincipal, spObj, z)
+		return err
 	case OnlySPExists:
 		idSp := utl.Str(sp["id"])
 		appId := utl.Str(sp["appId"])
-		utl.Die("SP (%s) named '%s' exists, and the associated AppID/ClientID is %s.\n",
-			idSp, utl.Yel(displayName), appId)
+		return newError(ErrValidation, "SP (%s) named '%s' exists, and the associated AppID/ClientID is %s",
+			idSp, displayName, appId)
 	case OnlyAppExists:
 		idApp := utl.Str(app["id"])
 		appId := utl.Str(app["appId"])
@@ -334,68 +342,62 @@ func CreateAppSpByName(force bool, displayName string, z *Config) {
 			utl.Yel(displayName), appId)
 		if !force {
 			msg := utl.Yel("Create corresponding SP? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Operation aborted by user.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Creating corresponding SP...")
 		}
 		spObj := AzureObject{"appId": appId}
-		sp := CreateDirObjectInAzure(ServicePrincipal, spObj, z)
-		if sp == nil {
-			utl.Die("Error creating the SP\n")
-		}
+		_, err := CreateDirObjectInAzure(ServicePrincipal, spObj, z)
+		return err
 	case BothExist:
 		idApp := utl.Str(app["id"])
 		appId := utl.Str(app["appId"])
 		idSp := utl.Str(sp["id"])
-		utl.Die("Both App (%s) and SP (%s) named '%s' exist. They share appId '%s'.\n",
-			idApp, idSp, utl.Yel(displayName), appId)
-	default:
-		utl.Die("Unexpected app/sp existence state")
+		return newError(ErrValidation, "both App (%s) and SP (%s) named '%s' exist, they share appId '%s'",
+			idApp, idSp, displayName, appId)
 	}
+	return newError(ErrValidation, "unexpected App/SP existence state")
 }
 
 // Deletes Azure AppSP pair from given indentifier
-func DeleteAppSp(force bool, identifier string, z *Config) {
-	app, sp, state := CheckAppSpExistence(identifier, z)
+func DeleteAppSp(force bool, identifier string, z *Config) error {
+	app, sp, state, err := CheckAppSpExistence(identifier, z)
+	if err != nil {
+		return err
+	}
 	switch state {
 	case NeitherExists:
-		utl.Die("No App or SP found with identifier '%s'\n", identifier)
+		return newError(ErrNotFound, "no App or SP found with identifier '%s'", identifier)
 	case OnlySPExists:
 		// Delete SP only
 		// Confirmation prompt
 		utl.PrintYamlColor(sp.TrimForCache(ServicePrincipal))
 		if !force {
 			msg := utl.Yel("Delete above SP? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Operation aborted by user.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Deleting above SP...")
 		}
 		idSp := utl.Str(sp["id"])
-		err := DeleteDirObjectInAzure(ServicePrincipal, idSp, z)
-		if err != nil {
-			fmt.Println(err)
-		}
+		return DeleteDirObjectInAzure(ServicePrincipal, idSp, z)
 	case OnlyAppExists:
 		// Delete App only
 		// Confirmation prompt
 		utl.PrintYamlColor(app.TrimForCache(Application))
 		if !force {
 			msg := utl.Yel("Delete above App? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Operation aborted by user.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Deleting above App...")
 		}
 		idApp := utl.Str(app["id"])
-		err := DeleteDirObjectInAzure(Application, idApp, z)
-		if err != nil {
-			fmt.Println(err)
-		}
+		return DeleteDirObjectInAzure(Application, idApp, z)
 	case BothExist:
 		// Delete both
 		utl.PrintYamlColor(app.TrimForCache(Application))
@@ -403,33 +405,31 @@ func DeleteAppSp(force bool, identifier string, z *Config) {
 		utl.PrintYamlColor(sp.TrimForCache(ServicePrincipal))
 		if !force {
 			msg := utl.Yel("Delete above App/SP pair? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Operation aborted by user.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Deleting above App/SP pair...")
 		}
 		idSp := utl.Str(sp["id"])
 		idApp := utl.Str(app["id"])
-		err := DeleteDirObjectInAzure(ServicePrincipal, idSp, z)
-		if err != nil {
-			fmt.Println(err)
-		}
-		err = DeleteDirObjectInAzure(Application, idApp, z)
-		if err != nil {
-			fmt.Println(err)
+		if err := DeleteDirObjectInAzure(ServicePrincipal, idSp, z); err != nil {
+			return err
 		}
-	default:
-		utl.Die("Unexpected App/SP existence state.\n")
+		return DeleteDirObjectInAzure(Application, idApp, z)
 	}
+	return newError(ErrValidation, "unexpected App/SP existence state")
 }
 
 // Renames Azure App/SP pair
-func RenameAppSp(force bool, identifier, newName string, z *Config) {
-	app, sp, state := CheckAppSpExistence(identifier, z)
+func RenameAppSp(force bool, identifier, newName string, z *Config) error {
+	app, sp, state, err := CheckAppSpExistence(identifier, z)
+	if err != nil {
+		return err
+	}
 	switch state {
 	case NeitherExists:
-		utl.Die("No App or SP found with identifier '%s'\n", identifier)
+		return newError(ErrNotFound, "no App or SP found with identifier '%s'", identifier)
 	case OnlySPExists:
 		// Rename SP only
 		idSp := utl.Str(sp["id"])
@@ -438,17 +438,14 @@ func RenameAppSp(force bool, identifier, newName string, z *Config) {
 			displayName := utl.Str(sp["displayName"])
 			msg := utl.Yel("Rename SP "+idSp+"\n  from \"") + utl.Blu(displayName) +
 				utl.Yel("\"\n    to \"") + utl.Blu(newName) + utl.Yel("\"\n? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Aborted.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Renaming SP...")
 		}
 		obj := AzureObject{"displayName": newName}
-		err := UpdateDirObjectInAzure(ServicePrincipal, idSp, obj, z)
-		if err != nil {
-			fmt.Println(err)
-		}
+		return UpdateDirObjectInAzure(ServicePrincipal, idSp, obj, z)
 	case OnlyAppExists:
 		// Rename App only
 		idApp := utl.Str(app["id"])
@@ -456,17 +453,14 @@ func RenameAppSp(force bool, identifier, newName string, z *Config) {
 			displayName := utl.Str(app["displayName"])
 			msg := utl.Yel("Rename App "+idApp+"\n  from \"") + utl.Blu(displayName) +
 				utl.Yel("\"\n    to \"") + utl.Blu(newName) + utl.Yel("\"\n? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Aborted.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Renaming App...")
 		}
 		obj := AzureObject{"displayName": newName}
-		err := UpdateDirObjectInAzure(Application, idApp, obj, z)
-		if err != nil {
-			fmt.Println(err)
-		}
+		return UpdateDirObjectInAzure(Application, idApp, obj, z)
 	case BothExist:
 		// Rename both
 		idApp := utl.Str(app["id"])
@@ -476,83 +470,82 @@ func RenameAppSp(force bool, identifier, newName string, z *Config) {
 			displayName := utl.Str(app["displayName"])
 			msg := utl.Yel("Rename App/SP pair with appId "+appId+"\n  from \"") + utl.Blu(displayName) +
 				utl.Yel("\"\n    to \"") + utl.Blu(newName) + utl.Yel("\"\n? y/n ")
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Aborted.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Println("Renaming App/SP pair...")
 		}
 		obj := AzureObject{"displayName": newName}
-		err := UpdateDirObjectInAzure(Application, idApp, obj, z)
-		if err != nil {
-			fmt.Println(err)
+		if err := UpdateDirObjectInAzure(Application, idApp, obj, z); err != nil {
+			return err
 		}
-		err = UpdateDirObjectInAzure(ServicePrincipal, idSp, obj, z)
-		if err != nil {
-			fmt.Println(err)
-		}
-	default:
-		utl.Die("Unexpected App/SP existence state.\n")
+		return UpdateDirObjectInAzure(ServicePrincipal, idSp, obj, z)
 	}
+	return newError(ErrValidation, "unexpected App/SP existence state")
 }
 
 // Creates or updates an Azure App/SP pair from given object
-func UpsertAppSp(force bool, obj AzureObject, z *Config) {
+func UpsertAppSp(force bool, obj AzureObject, z *Config) error {
 	// For the moment, all attributes in this object apply to *both* the App and the SP,
 	// as long as they are consistent with the MS Graph API.
 
 	// Cannot continue without at least the displayName and signInAudience
 	displayName := utl.Str(obj["displayName"])
-	signInAudience := utl.Str(obj["displayName"])
+	signInAudience := utl.Str(obj["signInAudience"])
 	if displayName == "" {
-		utl.Die("Object is missing %s\n", utl.Red("displayName"))
+		return newError(ErrValidation, "object is missing displayName")
 	}
 	if signInAudience == "" {
-		utl.Die("Object is missing %s\n", utl.Red("signInAudience"))
+		return newError(ErrValidation, "object is missing signInAudience")
 	}
 
 	// Check if either the App or the SP exist and process accordingly
-	app, sp, state := CheckAppSpExistence(displayName, z)
+	app, sp, state, err := CheckAppSpExistence(displayName, z)
+	if err != nil {
+		return err
+	}
 	switch state {
 	case NeitherExists:
 		// So let's create them both
 		utl.PrintYamlColor(obj)
 		if !force {
 			msg := fmt.Sprintf("%s App/SP pair with above parameters? y/n", utl.Yel("Create"))
-			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Operation aborted by user.\n")
+			if err := confirmAction(msg); err != nil {
+				return err
 			}
 		} else {
 			fmt.Printf("Creating App/SP pair with above parameters...\n")
 		}
 
-		appObj := CreateDirObjectInAzure(Application, obj, z)
-		if appObj == nil {
-			utl.Die("Error creating App object\n")
+		appObj, err := CreateDirObjectInAzure(Application, obj, z)
+		if err != nil {
+			return err
 		}
-		appId := utl.Str(app["appId"])
+		appId := utl.Str(appObj["appId"])
 		spObj := AzureObject{"appId": appId}
-		spObj = CreateDirObjectInAzure(ServicePrincipal, spObj, z)
-		if spObj == nil {
-			utl.Die("Error creating SP object\n")
-		}
+		_, err = CreateDirObjectInAzure(ServicePrincipal, spObj, z)
+		return err
 	case OnlySPExists:
 		// So let's update the SP and create the App?
 		idSp := utl.Str(sp["id"])
-		fmt.Printf("There's an existing SP (%s) named '%s'.\n", idSp, utl.Yel(displayName))
-		utl.Die("This condition is not supported. Aborting.\n")
+		return newError(ErrValidation, "there's an existing SP (%s) named '%s', this condition is not supported",
+			idSp, displayName)
 	case OnlyAppExists:
 		// So let's update the App and create the SP
 		idApp := utl.Str(app["id"])
-		fmt.Printf("There's an existing App (%s) named '%s'.\n", idApp, utl.Yel(displayName))
-		utl.Die("This condition is not supported. Aborting.\n")
+		return newError(ErrValidation, "there's an existing App (%s) named '%s', this condition is not supported",
+			idApp, displayName)
 	case BothExist:
 		// So let's update them both
 		idApp := utl.Str(app["id"])
 		idSp := utl.Str(sp["id"])
-		UpdateDirObject(force, idApp, obj, Application, z)
-		UpdateDirObject(force, idSp, obj, ServicePrincipal, z)
+		if err := UpdateDirObject(force, idApp, obj, Application, z); err != nil {
+			return err
+		}
+		return UpdateDirObject(force, idSp, obj, ServicePrincipal, z)
 	}
+	return nil
 }
 
 // Helper function to check if the object is an App / Service Principal
@@ -572,19 +565,19 @@ func IsDirAppSp(obj AzureObject) bool {
 }
 
 // Adds a new secret to the given App or SP
-func AddAppSpSecret(mazType, id, displayName, expiry string, z *Config) {
+func AddAppSpSecret(mazType, id, displayName, expiry string, z *Config) error {
 	if mazType != Application && mazType != ServicePrincipal {
-		utl.Die("Error: Secrets can only be added to an App or SP object.\n")
+		return newError(ErrValidation, "secrets can only be added to an App or SP object")
 	}
 	x := GetObjectFromAzureById(mazType, id, z)
 	if x == nil {
-		utl.Die("No %s with that ID.\n", MazTypeNames[mazType])
+		return newError(ErrNotFound, "no %s with ID %s", MazTypeNames[mazType], id)
 	}
 
 	// Check if a password with the same displayName already exists
 	object_id := utl.Str(x["id"]) // NOTE: We call Azure with the OBJECT ID
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "/" + object_id + "/passwordCredentials"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
+	apiUrl := z.MgUrl + ApiEndpoint[mazType] + "/" + object_id + "/passwordCredentials"
+	resp, statCode, err := ApiGet(apiUrl, z, nil)
 	if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
 	}
@@ -594,7 +587,7 @@ func AddAppSpSecret(mazType, id, displayName, expiry string, z *Config) {
 			credentialMap := utl.Map(credential)
 			if credentialMap != nil {
 				if utl.Str(credentialMap["displayName"]) == displayName {
-					utl.Die("A password named %s already exists.\n", utl.Yel(displayName))
+					return newError(ErrValidation, "a password named '%s' already exists", displayName)
 				}
 			}
 		}
@@ -608,14 +601,14 @@ func AddAppSpSecret(mazType, id, displayName, expiry string, z *Config) {
 			var err error
 			endDateTime, err = utl.ConvertDateFormat(expiry, "2006-01-02", time.RFC3339Nano)
 			if err != nil {
-				utl.Die("Error converting %s Expiry to RFC3339Nano/ISO8601 format.\n", utl.Yel(expiry))
+				return wrapError(ErrValidation, err, "error converting expiry %s to RFC3339Nano/ISO8601 format", expiry)
 			}
 		} else if days, err := utl.StringToInt64(expiry); err == nil {
 			// If expiry not a valid date, see if it's a valid integer number
 			expiryTime := utl.GetDateInDays(utl.Int64ToString(days)) // Set expiryTime to 'days' from now
 			endDateTime = expiryTime.Format(time.RFC3339Nano)        // Convert to RFC3339Nano/ISO8601 format
 		} else {
-			utl.Die("Invalid expiry format. Please use YYYY-MM-DD or number of days.\n")
+			return newError(ErrValidation, "invalid expiry format '%s', please use YYYY-MM-DD or number of days", expiry)
 		}
 	} else {
 		// If expiry is blank, default to 365 days from now
@@ -629,45 +622,42 @@ func AddAppSpSecret(mazType, id, displayName, expiry string, z *Config) {
 			"endDateTime": endDateTime,
 		},
 	}
-	apiUrl = ConstMgUrl + ApiEndpoint[mazType] + "/" + object_id + "/addPassword"
-	resp, statCode, _ = ApiPost(apiUrl, z, payload, nil)
+	apiUrl = z.MgUrl + ApiEndpoint[mazType] + "/" + object_id + "/addPassword"
+	resp, statCode, err = ApiPost(apiUrl, z, payload, nil)
 	if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error adding secret to %s", MazTypeNames[mazType])
 	}
-	if statCode == 200 {
-		if mazType == Application {
-			fmt.Printf("%s: %s\n", utl.Blu("app_object_id"), utl.Gre(object_id))
-		} else {
-			fmt.Printf("%s: %s\n", utl.Blu("sp_object_id"), utl.Gre(object_id))
-		}
-		fmt.Printf("%s: %s\n", utl.Blu("new_secret_id"), utl.Gre(utl.Str(resp["keyId"])))
-		fmt.Printf("%s: %s\n", utl.Blu("new_secret_name"), utl.Gre(displayName))
-		fmt.Printf("%s: %s\n", utl.Blu("new_secret_expiry"), utl.Gre(expiry))
-		fmt.Printf("%s: %s\n", utl.Blu("new_secret_text"), utl.Gre(utl.Str(resp["secretText"])))
+	if mazType == Application {
+		fmt.Printf("%s: %s\n", utl.Blu("app_object_id"), utl.Gre(object_id))
 	} else {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		utl.Die("%s\n", utl.Red(msg))
+		fmt.Printf("%s: %s\n", utl.Blu("sp_object_id"), utl.Gre(object_id))
 	}
+	fmt.Printf("%s: %s\n", utl.Blu("new_secret_id"), utl.Gre(utl.Str(resp["keyId"])))
+	fmt.Printf("%s: %s\n", utl.Blu("new_secret_name"), utl.Gre(displayName))
+	fmt.Printf("%s: %s\n", utl.Blu("new_secret_expiry"), utl.Gre(expiry))
+	fmt.Printf("%s: %s\n", utl.Blu("new_secret_text"), utl.Gre(utl.Str(resp["secretText"])))
+	return nil
 }
 
 // Removes a secret from the given App or SP object
-func RemoveAppSpSecret(mazType, id, keyId string, force bool, z *Config) {
+func RemoveAppSpSecret(mazType, id, keyId string, force bool, z *Config) error {
 	// TODO: Needs a prompt/force option
 	if mazType != Application && mazType != ServicePrincipal {
-		utl.Die("Error: Secrets can only be removed from an App or SP object.\n")
+		return newError(ErrValidation, "secrets can only be removed from an App or SP object")
 	}
 	x := GetObjectFromAzureById(mazType, id, z)
 	if x == nil {
-		utl.Die("No %s with that ID.\n", MazTypeNames[mazType])
+		return newError(ErrNotFound, "no %s with ID %s", MazTypeNames[mazType], id)
 	}
 	if !utl.ValidUuid(keyId) {
-		utl.Die("Secret ID is not a valid UUID.\n")
+		return newError(ErrValidation, "secret ID %s is not a valid UUID", keyId)
 	}
 
 	// Display object secret details, and prompt for delete confirmation
 	pwdCreds := utl.Slice(x["passwordCredentials"]) // Try casting to a slice
 	if len(pwdCreds) < 1 {
-		utl.Die("App object has no secrets.\n")
+		return newError(ErrNotFound, "%s object has no secrets", MazTypeNames[mazType])
 	}
 	var a AzureObject = nil // Target keyId, Secret ID to be deleted
 	for _, item := range pwdCreds {
@@ -679,18 +669,18 @@ func RemoveAppSpSecret(mazType, id, keyId string, force bool, z *Config) {
 		}
 	}
 	if a == nil {
-		utl.Die("App object does not have this Secret ID.\n")
+		return newError(ErrNotFound, "%s object does not have secret ID %s", MazTypeNames[mazType], keyId)
 	}
 	cId := utl.Str(a["keyId"])
 	cName := utl.Str(a["displayName"])
 	cHint := utl.Str(a["hint"]) + "********"
 	cStart, err := utl.ConvertDateFormat(utl.Str(a["startDateTime"]), time.RFC3339Nano, "2006-01-02")
 	if err != nil {
-		utl.Die("%s %s\n", utl.Trace(), err.Error())
+		return wrapError(ErrValidation, err, "invalid secret startDateTime")
 	}
 	cExpiry, err := utl.ConvertDateFormat(utl.Str(a["endDateTime"]), time.RFC3339Nano, "2006-01-02")
 	if err != nil {
-		utl.Die("%s %s\n", utl.Trace(), err.Error())
+		return wrapError(ErrValidation, err, "invalid secret endDateTime")
 	}
 
 	// Prompt
@@ -700,21 +690,17 @@ func RemoveAppSpSecret(mazType, id, keyId string, force bool, z *Config) {
 	fmt.Printf("%s:\n", utl.Yel("secret_to_be_deleted"))
 	fmt.Printf("  %-36s  %-30s  %-16s  %-16s  %s\n", utl.Yel(cId), utl.Yel(cName),
 		utl.Yel(cHint), utl.Yel(cStart), utl.Yel(cExpiry))
-	if utl.PromptMsg(utl.Yel("DELETE above? y/n ")) == 'y' {
-		payload := AzureObject{"keyId": keyId}
-		object_id := utl.Str(x["id"]) // NOTE: We call Azure with the OBJECT ID
-		apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "/" + object_id + "/removePassword"
-		resp, statCode, _ := ApiPost(apiUrl, z, payload, nil)
-		if statCode != 204 {
-			Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-		}
-		if statCode == 204 {
-			utl.Die("Successfully deleted secret.\n")
-		} else {
-			msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-			utl.Die("%s\n", utl.Red(msg))
-		}
-	} else {
-		utl.Die("Aborted.\n")
+	if err := confirmAction(utl.Yel("DELETE above? y/n ")); err != nil {
+		return err
+	}
+	payload := AzureObject{"keyId": keyId}
+	object_id := utl.Str(x["id"]) // NOTE: We call Azure with the OBJECT ID
+	apiUrl := z.MgUrl + ApiEndpoint[mazType] + "/" + object_id + "/removePassword"
+	resp, statCode, err := ApiPost(apiUrl, z, payload, nil)
+	if statCode != 204 {
+		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error removing secret from %s", MazTypeNames[mazType])
 	}
+	fmt.Println("Successfully deleted secret.")
+	return nil
 }
@@ -26,13 +26,19 @@ func PrintGroup(x AzureObject, z *Config) {
 		fmt.Printf("%s: %s\n", utl.Blu("isAssignableToRole"), utl.Mag(isAssignableToRole))
 	}
 
+	// Fetch all related objects up front, using MS Graph JSON batch calls
+	groupPath := ApiEndpoint[DirectoryGroup] + "/" + id
+	batch := ApiBatch([]BatchRequest{
+		{Id: "owners", Url: groupPath + "/owners"},
+		{Id: "appRoleAssignments", Url: groupPath + "/appRoleAssignments"},
+		{Id: "transitiveMemberOf", Url: groupPath + "/transitiveMemberOf"},
+		// API v1.0 does not currently work for SP members
+		// See https://developer.microsoft.com/en-us/graph/known-issues/?search=25984
+		{Id: "members", Url: "/beta/groups/" + id + "/members"},
+	}, z)
+
 	// Print owners of this group
-	apiUrl := ConstMgUrl + "/v1.0/groups/" + id + "/owners"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	owners := utl.Slice(resp["value"])
+	owners := batch["owners"].AllPages(z)
 	if len(owners) > 0 {
 		fmt.Printf("%s:\n", utl.Blu("owners"))
 		for _, item := range owners {
@@ -44,31 +50,17 @@ func PrintGroup(x AzureObject, z *Config) {
 	}
 
 	// Print app role assignment members and the specific role assigned
-	apiUrl = ConstMgUrl + "/v1.0/groups/" + id + "/appRoleAssignments"
-	appRoleAssignments := GetAzureAllPages(apiUrl, z)
+	appRoleAssignments := batch["appRoleAssignments"].AllPages(z)
 	PrintAppRoleAssignmentsOthers(appRoleAssignments, z)
 
 	// Print all groups and roles it is a member of
-	apiUrl = ConstMgUrl + "/v1.0/groups/" + id + "/transitiveMemberOf"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	memberOfList := utl.Slice(resp["value"])
+	memberOfList := batch["transitiveMemberOf"].AllPages(z)
 	if len(memberOfList) > 0 {
 		PrintMemberOfs(memberOfList)
 	}
 
 	// Print members of this group
-	//apiUrl = ConstMgUrl + "/v1.0/groups/" + id + "/members"
-	apiUrl = ConstMgUrl + "/beta/groups/" + id + "/members"
-	// API v1.0 does not currently work for SP members
-	// See https://developer.microsoft.com/en-us/graph/known-issues/?search=25984
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	members := utl.Slice(resp["value"])
+	members := batch["members"].AllPages(z)
 	if len(members) > 0 {
 		fmt.Printf("%s:\n", utl.Blu("members"))
 		for _, item := range members {
@@ -89,8 +81,11 @@ func PrintGroup(x AzureObject, z *Config) {
 }
 
 // Lists all cached Privileged Access Groups (PAGs)
-func PrintPags(z *Config) {
-	groups := GetMatchingDirObjects(DirectoryGroup, "", false, z) // false = get from cache, not Azure
+func PrintPags(z *Config) error {
+	groups, err := GetMatchingDirObjects(DirectoryGroup, "", false, z) // false = get from cache, not Azure
+	if err != nil {
+		return err
+	}
 	for i := range groups {
 		group := groups[i]
 		isAssignableToRole := utl.Bool(group["isAssignableToRole"])
@@ -98,10 +93,11 @@ func PrintPags(z *Config) {
 			PrintTersely(DirectoryGroup, group)
 		}
 	}
+	return nil
 }
 
 // Creates an Azure directory group from given command-line arguments.
-func CreateDirGroupFromArgs(force, isAssignableToRole bool, name, description string, z *Config) {
+func CreateDirGroupFromArgs(force, isAssignableToRole bool, name, description string, z *Config) error {
 	// Note that id may be a UUID or a displayName
 
 	// Initialize obj variable, and add user-supplied attributes
@@ -114,42 +110,36 @@ func CreateDirGroupFromArgs(force, isAssignableToRole bool, name, description st
 	obj["mailNickname"] = "NotSet"
 	obj["securityEnabled"] = true
 
-	CreateDirObject(force, obj, DirectoryGroup, z)
+	_, err := CreateDirObject(force, obj, DirectoryGroup, z)
+	return err
 }
 
 // Creates or updates an Azure directory group from given object
-func UpsertGroup(force bool, obj AzureObject, z *Config) {
+func UpsertGroup(force bool, obj AzureObject, z *Config) error {
 	// Cannot continue without at least a displayName from that object
 	displayName := utl.Str(obj["displayName"])
 	if displayName == "" {
-		utl.Die("Object is missing %s\n", utl.Red("displayName"))
+		return newError(ErrValidation, "object is missing displayName")
 	}
 
-	x := PreFetchAzureObject(DirectoryGroup, displayName, z)
+	x, err := PreFetchAzureObject(DirectoryGroup, displayName, z)
+	if err != nil {
+		return err
+	}
 	if x != nil {
 		// Update if group exists
-		UpdateDirObject(force, utl.Str(x["id"]), obj, DirectoryGroup, z)
-		// TODO: Have above return obj and/or err or both?
-		// if azObj, err := UpdateDirObject(force, utl.Str(x["id"]), obj, DirectoryGroup, z); err :=1 nil {
-		// 	fmt.Printf("%s\n", err)
-		// 	if azObj == nil {
-		// 		fmt.Println("The object was still updated.")
-		// 	}
-		// }
-	} else {
-		// Create if group does not exist
-		// Set up obj with the minimally required attributes to create a group
-		if obj["mailEnabled"] == nil {
-			utl.Die("Object is missing %s\n", utl.Red("mailEnabled"))
-		}
-		if obj["mailNickname"] == nil {
-			utl.Die("Object is missing %s\n", utl.Red("mailNickname"))
-		}
-		if obj["securityEnabled"] == nil {
-			utl.Die("Object is missing %s\n", utl.Red("securityEnabled"))
+		return UpdateDirObject(force, utl.Str(x["id"]), obj, DirectoryGroup, z)
+	}
+
+	// Create if group does not exist
+	// Set up obj with the minimally required attributes to create a group
+	for _, key := range []string{"mailEnabled", "mailNickname", "securityEnabled"} {
+		if obj[key] == nil {
+			return newError(ErrValidation, "object is missing %s", key)
 		}
-		CreateDirObject(force, obj, DirectoryGroup, z)
 	}
+	_, err = CreateDirObject(force, obj, DirectoryGroup, z)
+	return err
 }
 
 // Helper function to check if the object is a directory group
@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -21,25 +22,25 @@ func ObjectCountLocal(mazType string, z *Config) int64 {
 }
 
 // Returns the number of objects of given type in the Azure tenant.
-func ObjectCountAzure(t string, z *Config) int64 {
+func ObjectCountAzure(t string, z *Config) (int64, error) {
 	z.AddMgHeader("ConsistencyLevel", "eventual")
 	// Above indicates that we are okay with receiving data that may not be the most
 	// up-to-date. For this function, performance is prioritized over immediate
 	// consistency. It allows the system to return data that might be slightly
 	// stale but can be retrieved more quickly.
-	apiUrl := ConstMgUrl + ApiEndpoint[t] + "/$count"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
+	apiUrl := z.MgUrl + ApiEndpoint[t] + "/$count"
+	resp, statCode, err := ApiGet(apiUrl, z, nil)
 	if statCode != 200 {
-		return 0
+		return 0, apiError(err, statCode, resp, "error counting %s objects", MazTypeNames[t])
 	}
 	count := utl.Int64(resp["value"]) // Try asserting response as a int64 value
-	return count
+	return count, nil
 }
 
 // Gets object of given type from Azure by id. Updates entry in local cache.
 func GetObjectFromAzureById(mazType, targetId string, z *Config) AzureObject {
 	obj := AzureObject{}
-	baseUrl := ConstMgUrl + ApiEndpoint[mazType]
+	baseUrl := z.MgUrl + ApiEndpoint[mazType]
 	apiUrl := baseUrl + "/" + targetId
 	resp, statCode, _ := ApiGet(apiUrl, z, nil)
 	if statCode != 200 {
@@ -95,42 +96,57 @@ func GetObjectFromAzureById(mazType, targetId string, z *Config) AzureObject {
 	return obj // Return the found object or nil
 }
 
+// Fetches directory objects of the given type from Azure by their object IDs, using MS Graph
+// JSON batching, and returns them mapped by ID. IDs that were not found are left out. Unlike
+// GetObjectFromAzureById, this does not update the local cache.
+func GetObjectsFromAzureByIds(mazType string, ids []string, z *Config) map[string]AzureObject {
+	objects := make(map[string]AzureObject)
+	var requests []BatchRequest
+	seen := utl.StringSet{}
+	for _, id := range ids {
+		if id == "" || seen.Exists(id) {
+			continue // Skip blanks and duplicates, batch request IDs must be unique
+		}
+		seen.Add(id)
+		requests = append(requests, BatchRequest{Id: id, Url: ApiEndpoint[mazType] + "/" + id})
+	}
+	for id, r := range ApiBatch(requests, z) {
+		if r.Status != 200 || utl.Str(r.Body["id"]) == "" {
+			Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", r.Status, ApiErrorMsg(r.Body))))
+			continue
+		}
+		obj := AzureObject(r.Body)
+		obj["maz_from_azure"] = true // Mark it as being from Azure
+		objects[id] = obj
+	}
+	return objects
+}
+
 // Fetches objects of the given type from Azure by displayName. It returns a list of
 // matching objects, accounting for the possibility of multiple objects with the
 // same displayName.
 func GetObjectFromAzureByName(mazType, displayName string, z *Config) AzureObjectList {
-	result := AzureObjectList{} // Initialize the result list
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "?$filter=displayName eq '" + displayName + "'"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	matchingObjects := utl.Slice(resp["value"]) // Try casting to a slice
-	if matchingObjects != nil {
-		// It is a slice, let's process it
-		for i := range matchingObjects {
-			obj := utl.Map(matchingObjects[i]) // Try casting to a map
-			if obj == nil {
-				continue // Skip if not a map
-			}
-			result = append(result, AzureObject(obj))
-		}
-		return result
+	apiUrl := z.MgUrl + ApiEndpoint[mazType]
+	params := map[string]string{"$filter": "displayName eq '" + displayName + "'"}
+	result, err := ApiGetAll(apiUrl, z, params) // All pages, in case the name is very common
+	if err != nil {
+		Logf("%s\n", utl.Red2(err.Error()))
 	}
 	return result
 }
 
 // Retrieves existing object from Azure by its ID or displayName. This is
 // typically used as preprocessing for operations like renaming, deleting,
-// or updating the object.
-func PreFetchAzureObject(mazType, identifier string, z *Config) AzureObject {
+// or updating the object. Returns a nil object if there is none, and an
+// ErrAmbiguousName error if more than one object has the given name.
+func PreFetchAzureObject(mazType, identifier string, z *Config) (AzureObject, error) {
 	if utl.ValidUuid(identifier) {
-		return GetObjectFromAzureById(mazType, identifier, z)
+		return GetObjectFromAzureById(mazType, identifier, z), nil
 	}
 
 	matchingObjects := GetObjectFromAzureByName(mazType, identifier, z)
 	if len(matchingObjects) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	if len(matchingObjects) > 1 {
@@ -138,100 +154,118 @@ func PreFetchAzureObject(mazType, identifier string, z *Config) AzureObject {
 		for _, x := range matchingObjects {
 			fmt.Printf("  %s  %s\n", x["id"], x["displayName"])
 		}
-		utl.Die("%s. Pry processing by ID instead of name.\n", utl.Red("Aborting"))
+		return nil, newError(ErrAmbiguousName, "found %d %s objects named '%s', try processing by ID "+
+			"instead of name", len(matchingObjects), MazTypeNames[mazType], identifier)
 	}
 
-	return matchingObjects[0]
+	return matchingObjects[0], nil
 }
 
 // Helper function to handle cache initialization with partial delta resume support
 func initializeCacheWithResume(mazType string, z *Config) (*Cache, error) {
-	// First try to resume partial delta
-	tempCache, err := NewCache(mazType, z)
+	cache, err := GetCache(mazType, z)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := tempCache.ResumeFromPartialDelta(mazType); err == nil {
-		// Successfully resumed - create fresh cache
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			return nil, err
-		}
-
-		Logf("Normalize the cache with the partial delta set\n")
-		cache.Normalize(mazType, tempCache.data)
-		return cache, nil
+	// Normalize the loaded cache with the partial delta set, if one was left behind
+	if err := cache.ResumeFromPartialDelta(mazType); err != nil {
+		Logf("Error resuming from partial delta: %v\n", err)
 	}
-
-	// Fall back to normal cache load
-	return GetCache(mazType, z)
+	return cache, nil
 }
 
-// Helper function for filtering cache data
-func filterCacheData(data AzureObjectList, filter string) AzureObjectList {
-	matchingList := AzureObjectList{} // Initialize an empty list for matching items
-	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
-
-	for _, obj := range data {
-		// Extract ID and skip if it is empty or has already been seen
-		id := utl.Str(obj["id"])
-		if id == "" || ids.Exists(id) {
-			continue
-		}
-
-		// Check if the object matches the filter
-		if obj.HasString(filter) {
-			matchingList = append(matchingList, obj) // Add matching object to the list
-			ids.Add(id)                              // Mark this ID as seen
-		}
-	}
-
-	return matchingList
+// Gets all objects of given type, matching on 'filter'. Returns the entire list if filter is empty "".
+func GetMatchingDirObjects(mazType, filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingDirObjectsContext(context.Background(), mazType, filter, force, z)
 }
 
-// Gets all objects of given type, matching on 'filter'. Returns the entire list if filter is empty "".
-func GetMatchingDirObjects(mazType, filter string, force bool, z *Config) AzureObjectList {
+// Same as GetMatchingDirObjects, but refreshes the cache from Azure under the given context.
+func GetMatchingDirObjectsContext(
+	ctx context.Context,
+	mazType, filter string,
+	force bool,
+	z *Config,
+) (AzureObjectList, error) {
 	// If the filter is a UUID, we deliberately treat it as an ID and perform a
 	// quick Azure lookup for the specific object.
 	if utl.ValidUuid(filter) {
 		x := GetObjectFromAzureById(mazType, filter, z)
 		if x != nil {
 			// If found, return a list containing just this object.
-			return AzureObjectList{x}
+			return AzureObjectList{x}, nil
 		}
 	}
 
-	// Initialize cache with resume logic
-	cache, err := initializeCacheWithResume(mazType, z)
+	cache, err := GetDirObjectCacheContext(ctx, mazType, force, z)
 	if err != nil {
-		utl.Die("Cache initialization failed: %v\n", err)
+		return nil, err
 	}
 
-	// Return an empty list if cache is nil and internet is not available
-	internetIsAvailable := utl.IsInternetAvailable()
-	if cache == nil && !internetIsAvailable {
-		return AzureObjectList{} // Return empty list
+	// Filter the objects based on the provided filter
+	var list AzureObjectList
+	if filter == "" {
+		list, err = cache.Objects() // Return all data if no filter is specified
+	} else {
+		list, err = cache.Filter(filter)
+	}
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading %s cache", MazTypeNames[mazType])
 	}
+	return list, nil
+}
 
-	// Determine if cache is empty or outdated and needs to be refreshed from Azure
-	cacheNeedsRefreshing := force || cache.Count() < 1 || cache.Age() == 0 || cache.Age() > ConstMgCacheFileAgePeriod
-	if internetIsAvailable && cacheNeedsRefreshing {
-		RefreshLocalCacheWithAzure(mazType, cache, z) // Call Azure to refresh cache
+// Returns the local cache of directory objects of the given type, refreshing it from Azure
+// first if it is empty or outdated, or if force is true. Unlike GetMatchingDirObjects, this
+// does not read any objects, so they can be looked up with Cache.Lookup() or
+// Cache.FindById().
+func GetDirObjectCache(mazType string, force bool, z *Config) (*Cache, error) {
+	return GetDirObjectCacheContext(context.Background(), mazType, force, z)
+}
+
+// Same as GetDirObjectCache, but refreshes the cache from Azure under the given context.
+func GetDirObjectCacheContext(ctx context.Context, mazType string, force bool, z *Config) (*Cache, error) {
+	// Initialize cache with resume logic
+	cache, err := initializeCacheWithResume(mazType, z)
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "%s cache initialization failed", MazTypeNames[mazType])
 	}
 
-	// Filter the objects based on the provided filter
-	if filter == "" {
-		return cache.data // Return all data if no filter is specified
+	// Determine if cache is empty or outdated and needs to be refreshed from Azure
+	cacheNeedsRefreshing := force || cache.resync || cache.Count() < 1 || cache.Age() == 0 ||
+		cache.Age() > ConstMgCacheFileAgePeriod
+	if cacheNeedsRefreshing && utl.IsInternetAvailable() {
+		// Call Azure to refresh cache
+		if err := RefreshLocalCacheWithAzureContext(ctx, mazType, cache, z); err != nil {
+			return nil, err
+		}
 	}
+	return cache, nil
+}
 
-	return filterCacheData(cache.data, filter)
+// Attributes cached for each directory object type, see RefreshLocalCacheWithAzure().
+var dirObjectSelect = map[string]string{
+	DirectoryUser:     "id,displayName,userPrincipalName,onPremisesSamAccountName",
+	DirectoryGroup:    "id,displayName,description,isAssignableToRole,createdDateTime",
+	Application:       "id,displayName,appId,requiredResourceAccess,passwordCredentials,keyCredentials",
+	ServicePrincipal:  "id,displayName,appId,accountEnabled,appOwnerOrganizationId,passwordCredentials,keyCredentials",
+	DirRoleDefinition: "id,displayName,description,isBuiltIn,isEnabled,templateId",
+	DirRoleAssignment: "id,directoryScopeId,principalId,roleDefinitionId",
 }
 
 // Retrieves all directory objects of given type from Azure and syncs them to local cache.
-// Note that we are updating the cache via its pointer.
-func RefreshLocalCacheWithAzure(mazType string, cache *Cache, z *Config) {
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType]
+// Note that we are updating the cache via its pointer. Users, groups, applications and
+// service principals are synced with delta queries, which only return the changes since the
+// last sync. Role definitions and assignments have no delta function in MS Graph, so they
+// are always fetched in full.
+func RefreshLocalCacheWithAzure(mazType string, cache *Cache, z *Config) error {
+	return RefreshLocalCacheWithAzureContext(context.Background(), mazType, cache, z)
+}
+
+// Same as RefreshLocalCacheWithAzure, but fetches the objects under the given context. An
+// interrupted delta fetch saves the objects it got so far, for the next refresh to resume.
+func RefreshLocalCacheWithAzureContext(ctx context.Context, mazType string, cache *Cache, z *Config) error {
+	apiUrl := z.MgUrl + ApiEndpoint[mazType]
 
 	// Attempt to resume from partial delta
 	if err := cache.ResumeFromPartialDelta(mazType); err != nil {
@@ -239,190 +273,191 @@ func RefreshLocalCacheWithAzure(mazType string, cache *Cache, z *Config) {
 		Logf("Continuing with a normal cache refresh\n")
 	}
 
-	// Use regular pagination for initial sync, delta for updates
-	if cache.Count() == 0 {
-		// Full sync (faster)
-		switch mazType {
-		case DirectoryUser:
-			apiUrl += "?$select=id,displayName,userPrincipalName,onPremisesSamAccountName&$top=999"
-		case DirectoryGroup:
-			apiUrl += "?$select=id,displayName,description,isAssignableToRole,createdDateTime&$top=999"
-		case Application:
-			apiUrl += "?$select=id,displayName,appId,requiredResourceAccess,passwordCredentials&$top=999"
-		case ServicePrincipal:
-			apiUrl += "?$select=id,displayName,appId,accountEnabled,appOwnerOrganizationId,passwordCredentials&$top=999"
-		case DirRoleDefinition:
-			apiUrl += "?$select=id,displayName,description,isBuiltIn,isEnabled,templateId"
-		case DirRoleAssignment:
-			apiUrl += "?$select=id,directoryScopeId,principalId,roleDefinitionId"
-		}
-	} else {
-		// Delta sync (efficient updates)
-		switch mazType {
-		case DirectoryUser:
-			apiUrl += "/delta?$select=id,displayName,userPrincipalName,onPremisesSamAccountName"
-		case DirectoryGroup:
-			apiUrl += "/delta?$select=id,displayName,description,isAssignableToRole,createdDateTime"
-		}
+	// Only add $top for supported object types
+	fullUrl := apiUrl + "?$select=" + dirObjectSelect[mazType]
+	if mazType != DirRoleDefinition && mazType != DirRoleAssignment {
+		fullUrl += "&$top=999"
+	}
+	deltaUrl := ""
+	switch mazType {
+	case DirectoryUser, DirectoryGroup, Application, ServicePrincipal:
+		deltaUrl = apiUrl + "/delta?$select=" + dirObjectSelect[mazType]
+	}
+
+	// Use regular pagination for the initial sync of users and groups, which is faster, and
+	// delta for updates. Applications and service principals start with a delta round right
+	// away, so their very next refresh, such as that of each -apr report, is incremental.
+	apiUrl = fullUrl
+	if deltaUrl != "" && (cache.Count() > 0 || mazType == Application || mazType == ServicePrincipal) {
+		apiUrl = deltaUrl
 	}
 
-	if len(cache.data) < 1 {
+	if cache.Count() < 1 {
 		z.AddMgHeader("Prefer", "return=minimal")
 		z.AddMgHeader("deltaToken", "latest")
 	}
 
+	// A delta link is of no use without the objects it was synced with
+	fullRound := true // Whether all objects are listed, rather than the changes since a delta link
 	deltaLinkMap, err := cache.LoadDeltaLink()
 	if err != nil {
 		// Fall back to full sync if delta token fails
 		Logf("Delta token load failed, falling back to full sync: %v", err)
-		queryParams := "?$select=" + map[string]string{
-			DirectoryUser:     "id,displayName,userPrincipalName,onPremisesSamAccountName",
-			DirectoryGroup:    "id,displayName,description,isAssignableToRole,createdDateTime",
-			Application:       "id,displayName,appId,requiredResourceAccess,passwordCredentials",
-			ServicePrincipal:  "id,displayName,appId,accountEnabled,appOwnerOrganizationId,passwordCredentials",
-			DirRoleDefinition: "id,displayName,description,isBuiltIn,isEnabled,templateId",
-			DirRoleAssignment: "id,directoryScopeId,principalId,roleDefinitionId",
-		}[mazType]
-		// Only add $top for supported object types
-		if mazType != DirRoleDefinition && mazType != DirRoleAssignment {
-			queryParams += "&$top=999"
-		}
-		apiUrl = ConstMgUrl + ApiEndpoint[mazType] + queryParams
-	} else if deltaLinkMap != nil {
-		if deltaLink := utl.Str(deltaLinkMap["@odata.deltaLink"]); deltaLink != "" {
-			apiUrl = deltaLink
-		}
+		apiUrl = fullUrl
+	} else if deltaLink := utl.Str(deltaLinkMap["@odata.deltaLink"]); deltaLink != "" && cache.Count() > 0 {
+		apiUrl = deltaLink
+		fullRound = false
 	}
 
 	Logf("Calling %s delta fetch\n", utl.Cya(MazTypeNames[mazType]))
-	deltaSet, deltaLinkMap := FetchDirObjectsDelta(apiUrl, cache, z)
-
-	// Retry delta token save once before dying
-	if err := cache.SaveDeltaLink(deltaLinkMap); err != nil {
-		Logf("Delta token save failed, retrying once: %v", err)
-		time.Sleep(1 * time.Second)
-		if err := cache.SaveDeltaLink(deltaLinkMap); err != nil {
-			utl.Die("Error saving delta link after retry: %v", err)
+	deltaSet, deltaLinkMap, err := FetchDirObjectsDeltaContext(ctx, apiUrl, cache, z)
+	if err != nil && !fullRound && isDeltaResync(err) {
+		// The delta link expired, or MS Graph reset its sync state, so start over with a full
+		// delta round. Drop the link first, so an interrupted round doesn't run into it again.
+		Logf("%s delta link no longer valid, syncing all objects again: %v\n", MazTypeNames[mazType], err)
+		if err := cache.SaveDeltaLink(AzureObject{}); err != nil {
+			Logf("Error removing %s delta link: %v\n", MazTypeNames[mazType], err)
 		}
+		fullRound = true
+		deltaSet, deltaLinkMap, err = FetchDirObjectsDeltaContext(ctx, deltaUrl, cache, z)
+	}
+	if err != nil {
+		// The partial delta set was saved, and is picked up by the next refresh. Keep the
+		// previous delta link, so that refresh resumes from the same point.
+		return err
 	}
 
-	Logf("Normalize the cache with the normal delta set\n")
-	cache.Normalize(mazType, deltaSet)
-	if err := cache.Save(); err != nil {
-		utl.Die("Error saving cache: %v", err)
+	// A complete full delta round, the one ending with a delta link, lists every current
+	// object but not the ones deleted since the last sync, so it replaces the cache data. So
+	// does the complete listing that resyncs an outdated cache, see GetCache().
+	if fullRound && (deltaLinkMap["@odata.deltaLink"] != nil || cache.resync) {
+		Logf("Resync the cache with the full delta set\n")
+		cache.Resync(mazType, deltaSet)
+	} else {
+		Logf("Normalize the cache with the normal delta set\n")
+		cache.Normalize(mazType, deltaSet)
+	}
+
+	// Retry the save once before giving up
+	if err := cache.SaveWithDeltaLink(deltaLinkMap); err != nil {
+		Logf("Cache and delta token save failed, retrying once: %v", err)
+		time.Sleep(1 * time.Second)
+		if err := cache.SaveWithDeltaLink(deltaLinkMap); err != nil {
+			return wrapError(ErrFile, err, "error saving %s cache and delta link after retry", MazTypeNames[mazType])
+		}
 	}
+	cache.resync = false
+	return nil
 }
 
 // Deletes directory object of given type in Azure, with a confirmation prompt.
-func DeleteDirObject(force bool, id, mazType string, z *Config) {
+func DeleteDirObject(force bool, id, mazType string, z *Config) error {
 	// Note that 'id' may be a UUID or a displayName
 
 	mazTypeName := MazTypeNames[mazType]
-	obj := PreFetchAzureObject(mazType, id, z)
+	obj, err := PreFetchAzureObject(mazType, id, z)
+	if err != nil {
+		return err
+	}
 	if obj == nil {
-		utl.Die("No %s with identifier %s\n", utl.Yel(mazTypeName), utl.Yel(id))
+		return newError(ErrNotFound, "no %s with identifier %s", mazTypeName, id)
 	}
 
 	// Confirmation prompt
 	fmt.Printf("Deleting below %s:\n", utl.Yel(mazTypeName))
-	PrintObject(mazType, obj, z)
+	if err := PrintObject(mazType, obj, z); err != nil {
+		return err
+	}
 	if !force {
 		msg := fmt.Sprintf("%s %s? y/n ", utl.Yel("Delete"), mazTypeName)
-		if utl.PromptMsg(msg) != 'y' {
-			utl.Die("Operation aborted by user.\n")
+		if err := confirmAction(msg); err != nil {
+			return err
 		}
 	}
 
 	// Delete object in Azure
 	id = utl.Str(obj["id"])
-	DeleteDirObjectInAzure(mazType, id, z)
+	return DeleteDirObjectInAzure(mazType, id, z)
 }
 
 // Deletes directory object of given type in Azure, and updates local cache.
 func DeleteDirObjectInAzure(mazType, id string, z *Config) error {
 	mazTypeName := MazTypeNames[mazType]
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "/" + id
-	resp, statCode, _ := ApiDelete(apiUrl, z, nil)
+	apiUrl := z.MgUrl + ApiEndpoint[mazType] + "/" + id
+	resp, statCode, err := ApiDelete(apiUrl, z, nil)
 	if statCode != 204 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error deleting %s", mazTypeName)
 	}
-	if statCode == 204 {
-		fmt.Printf("Successfully %s %s!\n", utl.Gre("DELETED"), mazTypeName)
+	fmt.Printf("Successfully %s %s!\n", utl.Gre("DELETED"), mazTypeName)
 
-		// Also remove from local cache
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			Logf("Failed to get cache for %s: %w\n", mazTypeName, err)
-		}
-		err = cache.Delete(id)
-		if err == nil { // Only save if deletion succeeded
-			err = cache.Save()
-		}
-		if err != nil {
-			Logf("Failed to delete object with ID %s: %w\n", id, err)
-		}
-	} else {
-		fmt.Printf("HTTP %d: Error creating %s: %s\n", statCode, mazTypeName, ApiErrorMsg(resp))
+	// Also remove from local cache
+	cache, err := GetCache(mazType, z)
+	if err != nil {
+		Logf("Failed to get cache for %s: %v\n", mazTypeName, err)
+		return nil
+	}
+	err = cache.Delete(id)
+	if err == nil { // Only save if deletion succeeded
+		err = cache.Save()
+	}
+	if err != nil {
+		Logf("Failed to delete object with ID %s: %v\n", id, err)
 	}
 	return nil
 }
 
 // Creates directory object of given type in Azure, with a confirmation prompt.
-func CreateDirObject(force bool, obj AzureObject, mazType string, z *Config) AzureObject {
+func CreateDirObject(force bool, obj AzureObject, mazType string, z *Config) (AzureObject, error) {
 	// Present confirmation prompt if force isn't set
 	mazTypeName := MazTypeNames[mazType]
 	fmt.Printf("Creating new %s with below attributes:\n", utl.Yel(mazTypeName))
 	utl.PrintYamlColor(obj)
 	if !force {
 		msg := fmt.Sprintf("%s %s ? y/n ", utl.Yel("Create"), mazTypeName)
-		if utl.PromptMsg(msg) != 'y' {
-			utl.Die("Operation aborted by user.\n")
+		if err := confirmAction(msg); err != nil {
+			return nil, err
 		}
 	}
 
 	// Create the object in Azure, and return result
-	azObj := CreateDirObjectInAzure(mazType, obj, z)
-
-	return azObj
+	return CreateDirObjectInAzure(mazType, obj, z)
 }
 
 // Creates directory object of given type in Azure, and updates local cache.
-func CreateDirObjectInAzure(mazType string, obj AzureObject, z *Config) AzureObject {
-	azObj := AzureObject{}
+func CreateDirObjectInAzure(mazType string, obj AzureObject, z *Config) (AzureObject, error) {
 	mazTypeName := MazTypeNames[mazType]
 
 	// Creates object in Azure using obj as payload
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType]
+	apiUrl := z.MgUrl + ApiEndpoint[mazType]
 	payload := obj
-	resp, statCode, _ := ApiPost(apiUrl, z, payload, nil)
+	resp, statCode, err := ApiPost(apiUrl, z, payload, nil)
 	if statCode != 201 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return nil, apiError(err, statCode, resp, "error creating %s", mazTypeName)
 	}
-	if statCode == 201 {
-		azObj = AzureObject(resp) // Cast newly created object to our standard type
-		id := utl.Str(azObj["id"])
-		fmt.Printf("Successfully %s %s with new ID %s\n", utl.Gre("CREATED"), mazTypeName, id)
+	azObj := AzureObject(resp) // Cast newly created object to our standard type
+	id := utl.Str(azObj["id"])
+	fmt.Printf("Successfully %s %s with new ID %s\n", utl.Gre("CREATED"), mazTypeName, id)
 
-		// Upsert object in local cache also
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			Logf("Failed to get cache for %s: %w\n", mazTypeName, err)
-		}
-		err = cache.Upsert(azObj.TrimForCache(mazType))
-		if err != nil {
-			Logf("Failed to upsert object with ID %s: %w\n", id, err)
-		}
-		if err := cache.Save(); err != nil {
-			Logf("Failed to save cache: %v", err)
-		}
-	} else {
-		fmt.Printf("HTTP %d: Error creating %s: %s\n", statCode, mazTypeName, ApiErrorMsg(resp))
+	// Upsert object in local cache also
+	cache, err := GetCache(mazType, z)
+	if err != nil {
+		Logf("Failed to get cache for %s: %v\n", mazTypeName, err)
+		return azObj, nil
 	}
-	return azObj
+	err = cache.Upsert(azObj.TrimForCache(mazType))
+	if err != nil {
+		Logf("Failed to upsert object with ID %s: %v\n", id, err)
+	}
+	if err := cache.Save(); err != nil {
+		Logf("Failed to save cache: %v", err)
+	}
+	return azObj, nil
 }
 
 // Updates directory object of given type in Azure, with a confirmation prompt.
-func UpdateDirObject(force bool, id string, obj AzureObject, mazType string, z *Config) {
+func UpdateDirObject(force bool, id string, obj AzureObject, mazType string, z *Config) error {
 	mazTypeName := MazTypeNames[mazType]
 
 	// Present confirmation prompt if force isn't set
@@ -430,51 +465,49 @@ func UpdateDirObject(force bool, id string, obj AzureObject, mazType string, z *
 	utl.PrintYamlColor(obj)
 	if !force {
 		msg := fmt.Sprintf("%s %s ? y/n ", utl.Yel("Update"), mazTypeName)
-		if utl.PromptMsg(msg) != 'y' {
-			utl.Die("Operation aborted by user.\n")
+		if err := confirmAction(msg); err != nil {
+			return err
 		}
 	}
 
 	// Update the object in Azure
-	UpdateDirObjectInAzure(mazType, id, obj, z)
+	return UpdateDirObjectInAzure(mazType, id, obj, z)
 }
 
 // Updates directory object of given type in Azure, and updates local cache.
 func UpdateDirObjectInAzure(mazType, id string, obj AzureObject, z *Config) error {
 	mazTypeName := MazTypeNames[mazType]
-	apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "/" + id
+	apiUrl := z.MgUrl + ApiEndpoint[mazType] + "/" + id
 	payload := obj
-	resp, statCode, _ := ApiPatch(apiUrl, z, payload, nil)
+	resp, statCode, err := ApiPatch(apiUrl, z, payload, nil)
 	if statCode != 204 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error updating %s", mazTypeName)
 	}
-	if statCode == 204 {
-		fmt.Printf("Successfully %s %s!\n", utl.Gre("UPDATED"), mazTypeName)
+	fmt.Printf("Successfully %s %s!\n", utl.Gre("UPDATED"), mazTypeName)
 
-		// Above API patch call does NOT return the updated object, so to update
-		// the local cache we have to re-use our original item.
-		obj["id"] = id // Ensure it has the id, so local cache update works
+	// Above API patch call does NOT return the updated object, so to update
+	// the local cache we have to re-use our original item.
+	obj["id"] = id // Ensure it has the id, so local cache update works
 
-		// Upsert object in local cache also
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			Logf("Failed to get cache for %s: %w\n", mazTypeName, err)
-		}
-		err = cache.Upsert(obj.TrimForCache(mazType))
-		if err != nil {
-			Logf("Failed to upsert object with ID %s: %w\n", id, err)
-		}
-		if err := cache.Save(); err != nil {
-			Logf("Failed to save cache: %v", err)
-		}
-	} else {
-		fmt.Printf("HTTP %d: Error updating %s: %s\n", statCode, mazTypeName, ApiErrorMsg(resp))
+	// Upsert object in local cache also
+	cache, err := GetCache(mazType, z)
+	if err != nil {
+		Logf("Failed to get cache for %s: %v\n", mazTypeName, err)
+		return nil
+	}
+	err = cache.Upsert(obj.TrimForCache(mazType))
+	if err != nil {
+		Logf("Failed to upsert object with ID %s: %v\n", id, err)
+	}
+	if err := cache.Save(); err != nil {
+		Logf("Failed to save cache: %v", err)
 	}
 	return nil
 }
 
 // Renames directory object of given type in Azure.
-func RenameDirObject(force bool, mazType, from, newName string, z *Config) {
+func RenameDirObject(force bool, mazType, from, newName string, z *Config) error {
 	// Note that 'from' can be ID or displayName
 
 	mazTypeName := MazTypeNames[mazType]
@@ -482,12 +515,15 @@ func RenameDirObject(force bool, mazType, from, newName string, z *Config) {
 	// Only supports renaming DirectoryGroup and DirRoleDefinition
 	// Renaming App/SP is a special case has special function RenameAppSp()
 	if mazType != DirectoryGroup && mazType != DirRoleDefinition {
-		utl.Die("Rename not supported for %s object types\n", utl.Yel(mazTypeName))
+		return newError(ErrValidation, "rename not supported for %s object types", mazTypeName)
 	}
 
-	x := PreFetchAzureObject(mazType, from, z)
+	x, err := PreFetchAzureObject(mazType, from, z)
+	if err != nil {
+		return err
+	}
 	if x == nil {
-		utl.Die("No such %s\n", mazTypeName)
+		return newError(ErrNotFound, "no such %s '%s'", mazTypeName, from)
 	}
 
 	id := utl.Str(x["id"])
@@ -497,18 +533,15 @@ func RenameDirObject(force bool, mazType, from, newName string, z *Config) {
 		oldName := utl.Str(x["displayName"])
 		msg := utl.Yel("Rename "+mazTypeName+" "+id+"\n  from \"") + utl.Blu(oldName) +
 			utl.Yel("\"\n    to \"") + utl.Blu(newName) + utl.Yel("\"\n? y/n ")
-		if utl.PromptMsg(msg) != 'y' {
-			utl.Die("Aborted.\n")
+		if err := confirmAction(msg); err != nil {
+			return err
 		}
 	}
 
 	// Update the object in Azure
 	obj := AzureObject{"displayName": newName}
 	// The obj payload only requires the displayName
-	err := UpdateDirObjectInAzure(mazType, id, obj, z)
-	if err != nil {
-		fmt.Println(err)
-	}
+	return UpdateDirObjectInAzure(mazType, id, obj, z)
 }
 
 // Find JSON object with given ID in slice
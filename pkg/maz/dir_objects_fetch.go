@@ -1,8 +1,12 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -51,7 +55,20 @@ Microsoft’s Implicit Guidance:
 
 // Fetches Azure object changes and returns updates + deltaLink for next query
 // FetchDirObjectsDelta retrieves a full or delta directory object set, returning both the items and the delta link.
-func FetchDirObjectsDelta(apiUrl string, cache *Cache, z *Config) (AzureObjectList, AzureObject) {
+// See FetchDirObjectsDeltaContext to run it under a context, so it can be interrupted.
+func FetchDirObjectsDelta(apiUrl string, cache *Cache, z *Config) (AzureObjectList, AzureObject, error) {
+	return FetchDirObjectsDeltaContext(context.Background(), apiUrl, cache, z)
+}
+
+// Same as FetchDirObjectsDelta, but stops once the given context is cancelled or reaches its
+// deadline. The items fetched so far are then saved to the cache's partial delta file, to be
+// picked up by the next refresh, and the context's error is returned.
+func FetchDirObjectsDeltaContext(
+	ctx context.Context,
+	apiUrl string,
+	cache *Cache,
+	z *Config,
+) (AzureObjectList, AzureObject, error) {
 	deltaSet := AzureObjectList{}
 	deltaLinkMap := AzureObject{}
 	currentUrl := apiUrl
@@ -60,12 +77,25 @@ func FetchDirObjectsDelta(apiUrl string, cache *Cache, z *Config) (AzureObjectLi
 	const saveInterval = 5000 // Save every 5000 items
 	lastSave := 0             // Moved outside the loop
 
-	// Continue fetching until we've processed all pages
-	for currentUrl != "" {
-		// Fetch the current page
-		resp, err := apiGetWithRetry(currentUrl, z, 3)
+	// Fetch pages until there are no more, retrying transient errors on each page
+	getPage := func(ctx context.Context, url string, _ map[string]string) (map[string]interface{}, error) {
+		return apiGetWithRetry(ctx, url, z, 3)
+	}
+	for resp, err := range apiPages(ctx, currentUrl, nil, getPage) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			Logf("Delta fetch stopped after %d items: %v\n", len(deltaSet), ctxErr)
+			if len(deltaSet) > lastSave {
+				if err := cache.SavePartialDelta(deltaSet); err != nil {
+					Logf("WARNING: Failed to save partial delta set: %v\n", err)
+				}
+			}
+			return deltaSet, deltaLinkMap, wrapError(ErrApiCall, ctxErr, "delta fetch interrupted")
+		}
 		if err != nil {
 			Logf("Error fetching %s: %v\n", currentUrl, err)
+			if isDeltaResync(err) {
+				return deltaSet, deltaLinkMap, wrapError(ErrApiCall, err, "delta link no longer valid")
+			}
 			break
 		}
 
@@ -84,20 +114,18 @@ func FetchDirObjectsDelta(apiUrl string, cache *Cache, z *Config) (AzureObjectLi
 			countStr := utl.Cya(utl.ToStr(currentCount))
 			Logf("Processed %s items (current URL: %s)\n", countStr, currentUrl)
 
-			if err := SaveFileBinaryList(cache.partialFilePath, deltaSet, 0600, false); err != nil {
+			if err := cache.SavePartialDelta(deltaSet); err != nil {
 				Logf("WARNING: Failed to save partial delta set: %v\n", err)
 			}
 
 			lastSave = currentCount // Update last save position
 		}
 
-		// Check for delta link first (higher priority than nextLink)
+		// The last page has the delta link instead of a next link
 		if delta := utl.Str(resp["@odata.deltaLink"]); delta != "" {
 			deltaLinkMap["@odata.deltaLink"] = delta
 		}
-
-		// Move to next page if available
-		currentUrl = utl.Str(resp["@odata.nextLink"])
+		currentUrl = nextPageLink(resp) // Only used for logging
 	}
 
 	// Intentionally skipping final partial file save.
@@ -107,14 +135,16 @@ func FetchDirObjectsDelta(apiUrl string, cache *Cache, z *Config) (AzureObjectLi
 
 	countStr := utl.Cya(utl.ToStr(len(deltaSet)))
 	Logf("Completed fetch. Total items: %s\n", countStr)
-	return deltaSet, deltaLinkMap
+	return deltaSet, deltaLinkMap, nil
 }
 
 // Performs an HTTP GET with retry and exponential backoff, up to a maximum number of attempts.
-func apiGetWithRetry(url string, z *Config, maxRetries int) (resp map[string]interface{}, err error) {
+// Throttled responses are already retried by ApiCall, honoring Retry-After, so this mainly
+// covers transient network and server errors during long delta fetches.
+func apiGetWithRetry(ctx context.Context, url string, z *Config, maxRetries int) (resp map[string]interface{}, err error) {
 	var statusCode int
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		resp, statusCode, err = ApiGet(url, z, nil)
+		resp, statusCode, err = ApiCallContext(ctx, "GET", url, z, nil, nil)
 
 		if statusCode >= 200 && statusCode < 300 && err == nil {
 			Logf("HTTP %s - Success (Attempt %d/%d)\n", colorStatus(statusCode), attempt+1, maxRetries)
@@ -127,16 +157,34 @@ func apiGetWithRetry(url string, z *Config, maxRetries int) (resp map[string]int
 			err = fmt.Errorf("unexpected status code: %d", statusCode)
 		}
 		Logf("HTTP %s - Failed (Attempt %d/%d): %v\n", statusStr, attempt+1, maxRetries, err)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isDeltaResync(err) {
+			return nil, err // No point retrying
+		}
 
 		// Exponential backoff
 		if attempt < maxRetries-1 {
 			backoff := time.Second * time.Duration(1<<uint(attempt))
-			time.Sleep(backoff)
+			if err := sleepContext(ctx, backoff); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return nil, fmt.Errorf("after %d attempts: %w", maxRetries, err)
 }
 
+// Error codes MS Graph returns, along with HTTP 410 Gone, when a delta link is no longer valid
+var deltaResyncCodes = []string{"syncStateNotFound", "syncStateInvalid", "resyncRequired"}
+
+// Reports whether the given delta fetch error means the delta link is no longer valid, and all
+// objects have to be synced again with a full delta round.
+func isDeltaResync(err error) bool {
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusGone || slices.ContainsFunc(deltaResyncCodes, apiErr.HasCode)
+}
+
 // Helper function for colored status output
 func colorStatus(code int) string {
 	str := strconv.Itoa(code)
@@ -218,6 +266,12 @@ func getWorkerConfig() (workers, bufSize int) {
 
 // Fetches Azure object changes and returns updates + deltaLink for next query
 func FetchDirObjectsDeltaParallel(apiUrl string, z *Config) (AzureObjectList, AzureObject) {
+	return FetchDirObjectsDeltaParallelContext(context.Background(), apiUrl, z)
+}
+
+// Same as FetchDirObjectsDeltaParallel, but its workers fetch the pages under the given
+// context, and stop once it is cancelled or reaches its deadline.
+func FetchDirObjectsDeltaParallelContext(ctx context.Context, apiUrl string, z *Config) (AzureObjectList, AzureObject) {
 	Logf("Starting directory objects delta fetch\n")
 	deltaSet := AzureObjectList{}
 	deltaLinkMap := AzureObject{}
@@ -241,7 +295,7 @@ func FetchDirObjectsDeltaParallel(apiUrl string, z *Config) (AzureObjectList, Az
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
-			deltaWorker(id, results, z, state)
+			deltaWorker(ctx, id, results, z, state)
 		}(i)
 	}
 
@@ -285,11 +339,11 @@ func FetchDirObjectsDeltaParallel(apiUrl string, z *Config) (AzureObjectList, Az
 
 // Processes a stream of API URLs from the work queue and sends parsed objects to the results
 // channel. Workers follow pagination by enqueueing @odata.nextLink if unseen.
-func deltaWorker(workerID int, results chan<- AzureObject, z *Config, state *deltaSyncState) {
+func deltaWorker(ctx context.Context, workerID int, results chan<- AzureObject, z *Config, state *deltaSyncState) {
 	defer Logf("Worker %02d exiting\n", workerID)
 
 	for url := range state.workQueue {
-		resp, err := apiGetWithRetry(url, z, 3)
+		resp, err := apiGetWithRetry(ctx, url, z, 3)
 		if err != nil {
 			Logf("Worker %02d error: %v\n", workerID, err)
 			state.decrementPending()
@@ -49,25 +49,22 @@ func PrintDirRoleDefinition(x AzureObject, z *Config) {
 		"$filter": "roleDefinitionId eq '" + utl.Str(x["templateId"]) + "'",
 		"$expand": "principal",
 	}
-	apiUrl := ConstMgUrl + "/v1.0/roleManagement/directory/roleAssignments"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+	apiUrl := z.MgUrl + "/v1.0/roleManagement/directory/roleAssignments"
+	assignments, err := ApiGetAll(apiUrl, z, params)
+	if err != nil {
+		Logf("%s\n", utl.Red2(err.Error()))
 	}
-	assignments := utl.Slice(resp["value"])
 	if len(assignments) > 0 {
 		fmt.Printf("%s:\n", utl.Blu("assignments"))
-		for _, item := range assignments {
-			if asgn := utl.Map(item); asgn != nil {
-				principalId := utl.Str(asgn["principalId"])
-				scope := utl.Str(asgn["directoryScopeId"])
-				// TODO: Find out how to get/print the scope displayName?
-				if mPrinc := utl.Map(asgn["principal"]); mPrinc != nil {
-					pName := utl.Str(mPrinc["displayName"])
-					pType := utl.LastElemByDot(utl.Str(mPrinc["@odata.type"]))
-					fmt.Printf("  %-36s  %-50s  %-36s (%s)\n", utl.Gre(scope), utl.Gre(pName),
-						utl.Gre(principalId), utl.Gre(pType))
-				}
+		for _, asgn := range assignments {
+			principalId := utl.Str(asgn["principalId"])
+			scope := utl.Str(asgn["directoryScopeId"])
+			// TODO: Find out how to get/print the scope displayName?
+			if mPrinc := utl.Map(asgn["principal"]); mPrinc != nil {
+				pName := utl.Str(mPrinc["displayName"])
+				pType := utl.LastElemByDot(utl.Str(mPrinc["@odata.type"]))
+				fmt.Printf("  %-36s  %-50s  %-36s (%s)\n", utl.Gre(scope), utl.Gre(pName),
+					utl.Gre(principalId), utl.Gre(pType))
 			}
 		}
 	}
@@ -96,11 +93,10 @@ func AdRolesCountAzure(z *Config) int64 {
 	// we only care about their count it is easier to just call end point
 	// "/v1.0/directoryRoleTemplates" which is a quicker API call and has the accurate count.
 	// It's not clear why this has been made this confusing.
-	apiUrl := ConstMgUrl + "/v1.0/directoryRoleTemplates"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+	apiUrl := z.MgUrl + "/v1.0/directoryRoleTemplates"
+	dirRoles, err := ApiGetAll(apiUrl, z, nil)
+	if err != nil {
+		Logf("%s\n", utl.Red2(err.Error()))
 	}
-	dirRoles := utl.Slice(resp["value"])
 	return int64(len(dirRoles))
 }
@@ -2,6 +2,7 @@ package maz
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/queone/utl"
@@ -21,31 +22,31 @@ func PrintSp(x AzureObject, z *Config) {
 	fmt.Printf("%s: %s\n", utl.Blu("id"), utl.Gre(id))
 	fmt.Printf("%s: %s\n", utl.Blu("appId"), utl.Gre(utl.Str(x["appId"])))
 
+	// Fetch all related objects up front, using as few MS Graph JSON batch calls as possible
+	spPath := ApiEndpoint[ServicePrincipal] + "/" + id
+	batch := ApiBatch([]BatchRequest{
+		{Id: "keyCredentials", Url: spPath + "/keyCredentials"},
+		{Id: "passwordCredentials", Url: spPath + "/passwordCredentials"},
+		{Id: "owners", Url: spPath + "/owners"},
+		{Id: "appRoleAssignedTo", Url: "/beta/servicePrincipals/" + id + "/appRoleAssignedTo"},
+		{Id: "transitiveMemberOf", Url: spPath + "/transitiveMemberOf"},
+		{Id: "oauth2PermissionGrants", Url: "/v1.0/oauth2PermissionGrants",
+			Params: map[string]string{"$filter": "clientId eq '" + id + "'"}},
+		{Id: "appRoleAssignments", Url: spPath + "/appRoleAssignments"},
+		{Id: "customSecurityAttributes", Url: spPath,
+			Params: map[string]string{"$select": "customSecurityAttributes"}},
+	}, z)
+
 	// Print certificates details
-	apiUrl := ConstMgUrl + "/v1.0/servicePrincipals/" + id + "/keyCredentials"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	keyCredentials := utl.Slice(resp["value"])
+	keyCredentials := batch["keyCredentials"].Value()
 	PrintCertificateList(keyCredentials)
 
 	// Print secrets details
-	apiUrl = ConstMgUrl + "/v1.0/servicePrincipals/" + id + "/passwordCredentials"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	passwordCredentials := utl.Slice(resp["value"])
+	passwordCredentials := batch["passwordCredentials"].Value()
 	PrintSecretList(passwordCredentials)
 
 	// Print owners
-	apiUrl = ConstMgUrl + "/v1.0/servicePrincipals/" + id + "/owners"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	owners := utl.Slice(resp["value"])
+	owners := batch["owners"].AllPages(z)
 	PrintOwners(owners)
 
 	// Below loop does 2 things:
@@ -71,17 +72,11 @@ func PrintSp(x AzureObject, z *Config) {
 	}
 
 	// Print app role assignment members and the specific role assigned
-	apiUrl = ConstMgUrl + "/beta/servicePrincipals/" + id + "/appRoleAssignedTo"
-	appRoleAssignedTo := GetAzureAllPages(apiUrl, z)
+	appRoleAssignedTo := batch["appRoleAssignedTo"].AllPages(z)
 	PrintAppRoleAssignmentsSp(roleNameMap, appRoleAssignedTo) // roleNameMap is used here
 
 	// Prints groups and roles it is a member of
-	apiUrl = ConstMgUrl + "/v1.0/servicePrincipals/" + id + "/transitiveMemberOf"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	memberOf := utl.Slice(resp["value"])
+	memberOf := batch["transitiveMemberOf"].AllPages(z)
 	PrintMemberOfs(memberOf)
 
 	// Print API permissions that have been granted admin consent
@@ -93,13 +88,7 @@ func PrintSp(x AzureObject, z *Config) {
 	var apiPerms [][]string = [][]string{}
 
 	// 1st, let us gather any 'Delegated' type permission admin grants
-	params := map[string]string{"$filter": "clientId eq '" + id + "'"}
-	apiUrl = ConstMgUrl + "/v1.0/oauth2PermissionGrants"
-	resp, statCode, _ = ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	oauth2PermissionGrants := utl.Slice(resp["value"])
+	oauth2PermissionGrants := batch["oauth2PermissionGrants"].AllPages(z)
 
 	// IMPORTANT: Please read this carefully -- not as obvious as it seems -- if no admin grants
 	// have been done for any assigned 'Delegated' type permission for this clientId, then above
@@ -107,19 +96,30 @@ func PrintSp(x AzureObject, z *Config) {
 	// that 'clientId' refers to the 'Object ID' of the SP in question. Moreover, the call is
 	// for ALL Delegated permissions in the ENTIRE tenant.
 
+	// 2nd, let us gather any 'Application' type permission admin grants
+	appRoleAssignments := batch["appRoleAssignments"].AllPages(z)
+
+	// IMPORTANT: Again, read this carefully -- not as obvious as it seems -- if no admin grants
+	// have been done for any assigned 'Application' type permission for this SP, then above API
+	// call will return nothing. And again, above is looking *only* for APPLICATION type grants.
+
+	// Get all the API SPs referenced by either type of grant in a single batch
+	var resourceIds []string
+	for _, item := range slices.Concat(oauth2PermissionGrants, appRoleAssignments) {
+		if api := utl.Map(item); api != nil {
+			resourceIds = append(resourceIds, utl.Str(api["resourceId"]))
+		}
+	}
+	resourceSps := GetObjectsFromAzureByIds(ServicePrincipal, resourceIds, z)
+
 	if len(oauth2PermissionGrants) > 0 {
 		// Collate OAuth 2.0 scope permission admin grants
 		for _, item := range oauth2PermissionGrants {
 			if api := utl.Map(item); api != nil {
 				oauthId := utl.Str(api["id"])
 				resourceId := utl.Str(api["resourceId"]) // Get API's SP to get its displayName and claim values
-				apiUrl2 := ConstMgUrl + "/v1.0/servicePrincipals/" + resourceId
-				r2, statCode, _ := ApiGet(apiUrl2, z, nil)
-				if statCode != 200 {
-					Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-				}
 				apiName := "Unknown"
-				if r2["displayName"] != nil {
+				if r2 := resourceSps[resourceId]; r2["displayName"] != nil {
 					apiName = utl.Str(r2["displayName"])
 				}
 				// Collect each Delegated claim value for this permission
@@ -133,18 +133,6 @@ func PrintSp(x AzureObject, z *Config) {
 		}
 	}
 
-	// 2nd, let us gather any 'Application' type permission admin grants
-	apiUrl = ConstMgUrl + "/v1.0/servicePrincipals/" + id + "/appRoleAssignments"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	appRoleAssignments := utl.Slice(resp["value"])
-
-	// IMPORTANT: Again, read this carefully -- not as obvious as it seems -- if no admin grants
-	// have been done for any assigned 'Application' type permission for this SP, then above API
-	// call will return nothing. And again, above is looking *only* for APPLICATION type grants.
-
 	if len(appRoleAssignments) > 0 {
 		// Create temporary map of role Ids to role values
 		roleIdValueMap := make(map[string]string)
@@ -154,18 +142,13 @@ func PrintSp(x AzureObject, z *Config) {
 				resourceId := utl.Str(api["resourceId"]) // Get API's SP, to then fetch the role's claim value
 
 				// Skip processing if this resourceId (this API SP) has already been seen
-				if !uniqueResourceIds.Exists(resourceId) {
+				if uniqueResourceIds.Exists(resourceId) {
 					continue
 				}
 
 				// Map each role ID to its claim value
-				apiUrl2 := ConstMgUrl + "/v1.0/servicePrincipals/" + resourceId
-				resp2, statCode, _ := ApiGet(apiUrl2, z, nil)
-				if statCode != 200 {
-					Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-				}
-				appRoles := utl.Slice(resp2["appRoles"])
-				for item := range appRoles {
+				appRoles := utl.Slice(resourceSps[resourceId]["appRoles"])
+				for _, item := range appRoles {
 					if role := utl.Map(item); role != nil {
 						roleId := utl.Str(role["id"])
 						claim := utl.Str(role["value"])
@@ -239,12 +222,11 @@ func PrintSp(x AzureObject, z *Config) {
 	}
 
 	// Print all Custom Security Attributes for this SP
-	apiUrl = ConstMgUrl + "/v1.0/servicePrincipals/" + id + "?$select=customSecurityAttributes"
-	resp, statCode, _ = ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+	csaResp := batch["customSecurityAttributes"]
+	if csaResp.Status != 200 {
+		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", csaResp.Status, ApiErrorMsg(csaResp.Body))))
 	}
-	customSecurityAttributes := utl.Map(resp["customSecurityAttributes"])
+	customSecurityAttributes := utl.Map(csaResp.Body["customSecurityAttributes"])
 	if customSecurityAttributes != nil {
 		fmt.Printf("%s:\n", utl.Blu("custom_security_attributes"))
 		var csa_list []map[string]string = nil
@@ -331,25 +313,26 @@ func SpsCountLocal(z *Config) (native, others int64) {
 	}
 
 	// Iterate through the cached service principals and classify them
-	for _, obj := range cache.data {
+	cache.Scan(func(obj AzureObject) bool {
 		if utl.Str(obj["appOwnerOrganizationId"]) == z.TenantId { // If owned by current tenant
 			native++
 		} else {
 			others++
 		}
-	}
+		return true
+	})
 
 	return native, others
 }
 
 // Retrieves counts of SPs native to this Azure tenant, and all others.
-func SpsCountAzure(z *Config) (native, others int64) {
+func SpsCountAzure(z *Config) (native, others int64, err error) {
 	// First, get total number of SPs in native tenant
 	z.AddMgHeader("ConsistencyLevel", "eventual")
-	apiUrl := ConstMgUrl + ApiEndpoint[ServicePrincipal] + "/$count"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
+	apiUrl := z.MgUrl + ApiEndpoint[ServicePrincipal] + "/$count"
+	resp, statCode, err := ApiGet(apiUrl, z, nil)
 	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return 0, 0, apiError(err, statCode, resp, "error counting %s objects", MazTypeNames[ServicePrincipal])
 	}
 	all := utl.Int64(resp["value"])
 
@@ -358,14 +341,14 @@ func SpsCountAzure(z *Config) (native, others int64) {
 		"$filter": "appOwnerOrganizationId eq " + z.TenantId,
 		"$count":  "true",
 	}
-	apiUrl = ConstMgUrl + ApiEndpoint[ServicePrincipal]
-	resp, statCode, _ = ApiGet(apiUrl, z, params)
+	apiUrl = z.MgUrl + ApiEndpoint[ServicePrincipal]
+	resp, statCode, err = ApiGet(apiUrl, z, params)
 	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return 0, 0, apiError(err, statCode, resp, "error counting native %s objects", MazTypeNames[ServicePrincipal])
 	}
 	native = utl.Int64(resp["@odata.count"])
 
 	others = all - native
 
-	return native, others
+	return native, others, nil
 }
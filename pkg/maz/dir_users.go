@@ -23,18 +23,18 @@ func PrintUser(obj map[string]interface{}, z *Config) {
 	fmt.Printf("%s: %s\n", utl.Blu("onPremisesSamAccountName"), utl.Gre(utl.Str(obj["onPremisesSamAccountName"])))
 	fmt.Printf("%s: %s\n", utl.Blu("onPremisesDomainName"), utl.Gre(utl.Str(obj["onPremisesDomainName"])))
 
+	// Fetch all related objects up front, using MS Graph JSON batch calls
+	batch := ApiBatch([]BatchRequest{
+		//{Id: "appRoleAssignments", Url: "/v1.0/users/" + id + "/appRoleAssignments"},
+		{Id: "appRoleAssignments", Url: "/beta/users/" + id + "/appRoleAssignments"},
+		{Id: "transitiveMemberOf", Url: ApiEndpoint[DirectoryUser] + "/" + id + "/transitiveMemberOf"},
+	}, z)
+
 	// Print app role assignment members and the specific role assigned
-	//apiUrl := ConstMgUrl + "/v1.0/users/" + id + "/appRoleAssignments"
-	apiUrl := ConstMgUrl + "/beta/users/" + id + "/appRoleAssignments"
-	appRoleAssignments := GetAzureAllPages(apiUrl, z)
+	appRoleAssignments := batch["appRoleAssignments"].AllPages(z)
 	PrintAppRoleAssignmentsOthers(appRoleAssignments, z)
 
 	// Print all groups and roles it is a member of
-	apiUrl = ConstMgUrl + "/v1.0/users/" + id + "/transitiveMemberOf"
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	transitiveMemberOf := utl.Slice(resp["value"])
+	transitiveMemberOf := batch["transitiveMemberOf"].AllPages(z)
 	PrintMemberOfs(transitiveMemberOf)
 }
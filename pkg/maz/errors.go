@@ -0,0 +1,90 @@
+package maz
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/queone/utl"
+)
+
+// Error kinds returned by the library. Errors from the higher level maz functions wrap one
+// of these, so callers can branch on them with errors.Is(err, maz.ErrNotFound).
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAmbiguousName    = errors.New("ambiguous name")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrThrottled        = errors.New("throttled")
+	ErrValidation       = errors.New("validation failed")
+	ErrAborted          = errors.New("aborted by user") // A confirmation prompt was declined
+	ErrConfig           = errors.New("invalid configuration")
+	ErrApiCall          = errors.New("API call failed")
+	ErrFile             = errors.New("file error")
+)
+
+// Error is the error type returned by the library. Its Kind is one of the Err* values
+// above, and Err is the underlying cause, if any. Both are reachable via errors.Is.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Msg + ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+// Helper function to create an Error of the given kind with a formatted message.
+func newError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Helper function to wrap err as an Error of the given kind with a formatted message.
+func wrapError(kind error, err error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+// Returns the error kind matching an unexpected API response status code.
+func apiErrorKind(statCode int) error {
+	switch {
+	case statCode == 400 || statCode == 409 || statCode == 422:
+		return ErrValidation
+	case statCode == 401 || statCode == 403:
+		return ErrPermissionDenied
+	case statCode == 404:
+		return ErrNotFound
+	case isThrottled(statCode):
+		return ErrThrottled
+	}
+	return ErrApiCall
+}
+
+// Returns an error for an unexpected API response, given the error returned by ApiCall.
+// It wraps the call's *ApiError, so callers can get at the API error code and request IDs.
+func apiError(err error, statCode int, resp map[string]interface{}, format string, args ...interface{}) error {
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		if err != nil && statCode == 0 {
+			return wrapError(ErrApiCall, err, format, args...) // The call never got a response
+		}
+		apiErr = NewApiError(statCode, resp, nil) // An unexpected success status, for instance
+	}
+	return wrapError(apiErrorKind(apiErr.StatusCode), apiErr, format, args...)
+}
+
+// Prompts the user with msg, returning ErrAborted unless they answer 'y'.
+func confirmAction(msg string) error {
+	if utl.PromptMsg(msg) != 'y' {
+		return ErrAborted
+	}
+	return nil
+}
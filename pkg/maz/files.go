@@ -6,6 +6,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -22,18 +23,52 @@ func SaveFileBinaryMap(filePath string, data map[string]interface{}, perm os.Fil
 	// Replace the original file atomically by writing to a temporary file first
 	// and renaming it. This ensures the original file remains intact if an error occurs.
 
-	// Step 2: Write to a temporary file
-	tempFilePath := filePath + ".tmp"
-	if err := os.WriteFile(tempFilePath, buf.Bytes(), perm); err != nil {
-		return fmt.Errorf("failed to write data to temporary file: %w", err)
+	// Step 2: Encrypt the data if object cache encryption is on
+	outputData := buf.Bytes()
+	if objectCacheEncryption() {
+		var err error
+		if outputData, err = encryptData(outputData); err != nil {
+			return fmt.Errorf("failed to encrypt data: %w", err)
+		}
 	}
 
-	// Step 3: Replace the original file atomically
-	if err := os.Rename(tempFilePath, filePath); err != nil {
-		return fmt.Errorf("failed to replace original file with new data: %w", err)
+	// Step 3: Write to a temporary file, and replace the original file with it
+	return writeFileAtomic(filePath, outputData, perm)
+}
+
+// Writes data to the given file by way of a uniquely named temporary file in the same
+// directory, which then replaces the file. Concurrent writers, even in other processes,
+// never share a temporary file, and readers always see either the old or the new content.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempFilePath := tempFile.Name()
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFilePath, perm)
+	}
+	if err != nil {
+		os.Remove(tempFilePath)
+		return fmt.Errorf("failed to write data to temporary file: %w", err)
 	}
 
-	return nil
+	// Retry the replacement, which can fail while another process has the file open on Windows
+	const maxRetries = 5
+	for i := 0; i < maxRetries; i++ {
+		if err = os.Rename(tempFilePath, filePath); err == nil {
+			return nil
+		}
+		if i < maxRetries-1 {
+			time.Sleep(time.Duration(i+1) * time.Second) // Exponential backoff
+		}
+	}
+	os.Remove(tempFilePath)
+	return fmt.Errorf("failed to replace old file with new data: %w", err)
 }
 
 // Reads a gob binary file and decodes it into a map[string]interface{}.
@@ -50,16 +85,15 @@ func LoadFileBinaryMap(filePath string) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("file exists but is zero size: %s", filePath)
 	}
 
-	// Step 2: Open the file
-	file, err := os.Open(filePath)
+	// Step 2: Read the file, decrypting it if needed
+	content, err := readMazFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
-	defer file.Close()
 
 	// Step 3: Decode the file content
 	var data AzureObject
-	decoder := gob.NewDecoder(file)
+	decoder := gob.NewDecoder(bytes.NewReader(content))
 	if err := decoder.Decode(&data); err != nil {
 		return nil, fmt.Errorf("failed to decode binary file: %w", err)
 	}
@@ -99,34 +133,18 @@ func SaveFileBinaryList(filePath string, data AzureObjectList, perm os.FileMode,
 	} else {
 		outputData = buf.Bytes()
 	}
+	if objectCacheEncryption() {
+		var err error
+		if outputData, err = encryptData(outputData); err != nil {
+			return fmt.Errorf("failed to encrypt data: %w", err)
+		}
+	}
 
 	// Replace the original file atomically by writing to a temporary file first
 	// and renaming it. This ensures the original file remains intact if an error occurs.
 
-	// Step 3: Write to the file
-	tempFilePath := filePath + ".tmp"
-	if err := os.WriteFile(tempFilePath, outputData, perm); err != nil {
-		return fmt.Errorf("failed to write data to temporary file: %w", err)
-	}
-
-	// // Step 4: Atomic file replacement
-	// if err := os.Rename(tempFilePath, filePath); err != nil {
-	// 	return fmt.Errorf("failed to replace old file with new data: %w", err)
-	// }
-	// Step 4: Atomic file replacement with retry
-	const maxRetries = 5
-	for i := 0; i < maxRetries; i++ {
-		if err := os.Rename(tempFilePath, filePath); err != nil {
-			if i < maxRetries-1 {
-				time.Sleep(time.Duration(i+1) * time.Second) // Exponential backoff
-				continue
-			}
-			return fmt.Errorf("failed to replace old file with new data: %w", err)
-		}
-		break // Success, exit the loop
-	}
-
-	return nil
+	// Step 3: Write to the file, with atomic file replacement
+	return writeFileAtomic(filePath, outputData, perm)
 }
 
 // Reads a gob binary file and decodes it into a slice of AzureObject.
@@ -147,12 +165,12 @@ func LoadFileBinaryList(filePath string, compressed bool) (AzureObjectList, erro
 		return nil, fmt.Errorf("file exists but is zero size: %s", filePath)
 	}
 
-	// Open the file
-	file, err := os.Open(filePath)
+	// Read the file, decrypting it if needed
+	content, err := readMazFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
-	defer file.Close()
+	file := bytes.NewReader(content)
 
 	var data AzureObjectList
 	if compressed {
@@ -1,8 +1,8 @@
 package maz
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"path"
 	"sync"
 	"time"
@@ -11,61 +11,55 @@ import (
 )
 
 // Creates or updates an Azure object by given specfile
-func ApplyObjectBySpecfile(force bool, specfile string, z *Config) {
+func ApplyObjectBySpecfile(force bool, specfile string, z *Config) error {
 	if !utl.FileUsable(specfile) {
-		utl.Die("Specfile %s is missing or empty\n", utl.Yel(specfile))
+		return newError(ErrFile, "specfile %s is missing or empty", specfile)
 	}
 
-	_, mazType, obj := GetObjectFromFile(specfile)
+	_, mazType, obj, err := GetObjectFromFile(specfile)
+	if err != nil {
+		return err
+	}
 	switch mazType {
 	case ResRoleDefinition:
-		UpsertAzureResRoleDefinition(force, obj, z)
+		return UpsertAzureResRoleDefinition(force, obj, z)
 	case ResRoleAssignment:
-		CreateAzureResRoleAssignment(force, obj, z)
+		return CreateAzureResRoleAssignment(force, obj, z)
 	case Application, ServicePrincipal:
-		UpsertAppSp(force, obj, z)
+		return UpsertAppSp(force, obj, z)
 	case DirectoryGroup:
-		UpsertGroup(force, obj, z)
-	default:
-		onlyFor := fmt.Sprintf("%s, %s, %s, and %s/%s combos",
-			utl.Red(ResRoleDefinition), utl.Red(ResRoleAssignment), utl.Red(DirectoryGroup),
-			utl.Red(Application), utl.Red(ServicePrincipal))
-		utl.Die("The current implementation is only for objects %s, but none of these were "+
-			"found in the specfile.\n", onlyFor)
+		return UpsertGroup(force, obj, z)
 	}
-	os.Exit(0)
+	return newError(ErrValidation, "the current implementation is only for objects %s, %s, %s, "+
+		"and %s/%s combos, but none of these were found in the specfile",
+		ResRoleDefinition, ResRoleAssignment, DirectoryGroup, Application, ServicePrincipal)
 }
 
 // Deletes an Azure object by given specfile
-func DeleteObjectBySpecfile(force bool, specfile string, z *Config) {
-	_, mazType, obj := GetObjectFromFile(specfile)
+func DeleteObjectBySpecfile(force bool, specfile string, z *Config) error {
+	_, mazType, obj, err := GetObjectFromFile(specfile)
+	if err != nil {
+		return err
+	}
 	switch mazType {
 	case ResRoleDefinition:
-		DeleteResRoleDefinition(force, obj, z)
+		return DeleteResRoleDefinition(force, obj, z)
 	case ResRoleAssignment:
-		DeleteAzureResRoleAssignment(force, obj, z)
+		return DeleteAzureResRoleAssignment(force, obj, z)
 	case Application, ServicePrincipal:
 		displayName := utl.Str(obj["displayName"])
-		DeleteAppSp(force, displayName, z)
+		return DeleteAppSp(force, displayName, z)
 	case DirectoryGroup, DirRoleDefinition, DirRoleAssignment:
 		displayName := utl.Str(obj["displayName"])
-		DeleteDirObject(force, displayName, mazType, z)
-	default:
-		utl.Die("This option is only available for the following object types:\n"+
-			"  %s  %s\n  %s  %s\n  %s  %s\n  %s  %s\n  %s  %s\n  %s  %s\n  %s  %s\n",
-			utl.Yel(fmt.Sprintf("%-2s", ResRoleDefinition)), MazTypeNames[ResRoleDefinition],
-			utl.Yel(fmt.Sprintf("%-2s", ResRoleAssignment)), MazTypeNames[ResRoleAssignment],
-			utl.Yel(fmt.Sprintf("%-2s", DirectoryGroup)), MazTypeNames[DirectoryGroup],
-			utl.Yel(fmt.Sprintf("%-2s", Application)), MazTypeNames[Application],
-			utl.Yel(fmt.Sprintf("%-2s", ServicePrincipal)), MazTypeNames[ServicePrincipal],
-			utl.Yel(fmt.Sprintf("%-2s", DirRoleDefinition)), MazTypeNames[DirRoleDefinition],
-			utl.Yel(fmt.Sprintf("%-2s", DirRoleAssignment)), MazTypeNames[DirRoleAssignment])
-	}
-	os.Exit(0)
+		return DeleteDirObject(force, displayName, mazType, z)
+	}
+	return newError(ErrValidation, "this option is only available for object types %s, %s, %s, "+
+		"%s, %s, %s and %s", ResRoleDefinition, ResRoleAssignment, DirectoryGroup, Application,
+		ServicePrincipal, DirRoleDefinition, DirRoleAssignment)
 }
 
 // Deletes an Azure object by given Id
-func DeleteObjectById(force bool, targetId string, z *Config) {
+func DeleteObjectById(force bool, targetId string, z *Config) error {
 	list, _ := FindAzureObjectsById(targetId, z)
 
 	// Handle the rare case of multiple objects sharing the same ID
@@ -76,11 +70,11 @@ func DeleteObjectById(force bool, targetId string, z *Config) {
 			mazType := utl.Str(item["maz_type"])
 			fmt.Printf("  %-30s  %s\n", MazTypeNames[mazType], id)
 		}
-		utl.Die("%s\n", utl.Red("Cannot delete by ID. Try deleting by name or specfile instead."))
+		return newError(ErrAmbiguousName, "cannot delete by ID, try deleting by name or specfile instead")
 	}
 
 	if len(list) < 1 {
-		utl.Die("%s\n", utl.Red("Cannot find an object with this ID"))
+		return newError(ErrNotFound, "cannot find an object with ID %s", targetId)
 	}
 
 	// Single out the object
@@ -88,22 +82,20 @@ func DeleteObjectById(force bool, targetId string, z *Config) {
 	mazType := utl.Str(targetObj["maz_type"])
 	switch mazType {
 	case ResRoleDefinition:
-		DeleteResRoleDefinition(force, targetObj, z)
+		return DeleteResRoleDefinition(force, targetObj, z)
 	case ResRoleAssignment:
-		DeleteAzureResRoleAssignment(force, targetObj, z)
+		return DeleteAzureResRoleAssignment(force, targetObj, z)
 	case Application, ServicePrincipal:
-		DeleteAppSp(force, targetId, z)
+		return DeleteAppSp(force, targetId, z)
 	case DirectoryGroup, DirRoleDefinition, DirRoleAssignment:
-		DeleteDirObject(force, targetId, mazType, z)
-	default:
-		msg := fmt.Sprintf("Deleting %s objects by ID is not supported.", MazTypeNames[mazType])
-		utl.Die("%s\n", utl.Red(msg))
+		return DeleteDirObject(force, targetId, mazType, z)
 	}
+	return newError(ErrValidation, "deleting %s objects by ID is not supported", MazTypeNames[mazType])
 }
 
 // Deletes an Azure object by name. Only 4 types of objects are supported: resource
 // role definitions, App & SP pairs, directory groups and role definitions.
-func DeleteObjectByName(force bool, name string, z *Config) {
+func DeleteObjectByName(force bool, name string, z *Config) error {
 	idMap := FindAzureObjectsByName(name, z)
 
 	// Handle the case of multiple objects sharing the same name
@@ -112,11 +104,11 @@ func DeleteObjectByName(force bool, name string, z *Config) {
 		for id, mazType := range idMap {
 			fmt.Printf("  %-38s  %s\n", id, MazTypeNames[mazType])
 		}
-		utl.Die("%s\n", utl.Red("Cannot delete by name. Try deleting by ID or specfile instead."))
+		return newError(ErrAmbiguousName, "cannot delete by name, try deleting by ID or specfile instead")
 	}
 
 	if len(idMap) < 1 {
-		utl.Die("Could not find an object named %s\n", utl.Red(name))
+		return newError(ErrNotFound, "could not find an object named '%s'", name)
 	}
 
 	// Process for the single object with this name
@@ -124,17 +116,17 @@ func DeleteObjectByName(force bool, name string, z *Config) {
 		switch mazType {
 		case ResRoleDefinition:
 			targetObj := GetAzureResRoleDefinitionById(targetId, z)
-			DeleteResRoleDefinition(force, targetObj, z)
+			return DeleteResRoleDefinition(force, targetObj, z)
 		case Application, ServicePrincipal:
-			DeleteAppSp(force, targetId, z)
+			return DeleteAppSp(force, targetId, z)
 		case DirectoryGroup, DirRoleDefinition:
-			DeleteDirObject(force, targetId, mazType, z)
+			return DeleteDirObject(force, targetId, mazType, z)
 		default:
-			msg := fmt.Sprintf("Utility does not support deleting %s objects by name.",
+			return newError(ErrValidation, "utility does not support deleting %s objects by name",
 				MazTypeNames[mazType])
-			utl.Die("%s\n", utl.Red(msg))
 		}
 	}
+	return nil
 }
 
 // Returns a map of id:mazType objects sharing given name. Only 5 types of
@@ -209,8 +201,7 @@ func FindCachedObjectsById(id string, z *Config) AzureObjectList {
 
 			// If there's anything cached, search for the matching ID
 			if count > 0 {
-				if existingObj := cache.data.FindById(id); existingObj != nil {
-					obj := *existingObj
+				if obj := cache.FindById(id); obj != nil {
 					Logf("Found object with ID %s of type: %s\n", id, utl.Mag(mazTypeName))
 					obj["maz_type"] = mazType // Add the type as an extra field
 
@@ -335,97 +326,100 @@ func GetAzureResRoleScopes(z *Config) (scopes []string) {
 // Generic querying function to get Azure objects of any mazType, whose attributes
 // match on given filter string. If the filter is the "" empty string, return ALL
 // of the objects of this particular type. Works accross MS Graph and ARM objects.
-func GetMatchingObjects(mazType, filter string, force bool, z *Config) AzureObjectList {
+func GetMatchingObjects(mazType, filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingObjectsContext(context.Background(), mazType, filter, force, z)
+}
+
+// Same as GetMatchingObjects, but refreshes the cache from Azure under the given context.
+func GetMatchingObjectsContext(
+	ctx context.Context,
+	mazType, filter string,
+	force bool,
+	z *Config,
+) (AzureObjectList, error) {
 	switch mazType {
 	case ResRoleDefinition:
-		return GetMatchingResRoleDefinitions(filter, force, z)
+		return GetMatchingResRoleDefinitionsContext(ctx, filter, force, z)
 	case ResRoleAssignment:
-		return GetMatchingResRoleAssignments(filter, force, z)
+		return GetMatchingResRoleAssignmentsContext(ctx, filter, force, z)
 	case Subscription:
-		return GetMatchingAzureSubscriptions(filter, force, z)
+		return GetMatchingAzureSubscriptionsContext(ctx, filter, force, z)
 	case ManagementGroup:
-		return GetMatchingAzureMgmtGroups(filter, force, z)
+		return GetMatchingAzureMgmtGroupsContext(ctx, filter, force, z)
 	case DirectoryUser, DirectoryGroup, Application,
 		ServicePrincipal, DirRoleDefinition, DirRoleAssignment:
-		return GetMatchingDirObjects(mazType, filter, force, z)
+		return GetMatchingDirObjectsContext(ctx, mazType, filter, force, z)
 	}
-	return nil
+	return nil, nil
 }
 
-// Returns all Azure pages for given API URL call
+// Returns all Azure pages for given API URL call. Errors are logged, and the items fetched
+// before the error are returned. Use ApiGetAll() to get the error instead.
 func GetAzureAllPages(apiUrl string, z *Config) (list []interface{}) {
-	list = nil
-	resp, statCode, _ := ApiGet(apiUrl, z, nil)
-	for {
-		if statCode != 200 {
-			Logf("HTTP %d: Continuing to try...\n", statCode)
-		}
-
-		// Forever loop until there are no more pages
-		thisBatch := utl.Slice(resp["value"])
-		if len(thisBatch) > 0 {
-			list = append(list, thisBatch...) // Continue growing list
-		}
-		nextLink := utl.Str(resp["@odata.nextLink"])
-		if nextLink == "" {
-			break // Break once there is no more pages
+	for obj, err := range ApiItems(apiUrl, z, nil) {
+		if err != nil {
+			Logf("%s\n", utl.Red2(err.Error()))
+			break
 		}
-		resp, statCode, _ = ApiGet(nextLink, z, nil) // Get next batch
+		list = append(list, obj)
 	}
 	return list
 }
 
 // Processes given specfile and returns the format type, the mazType, and the object.
-func GetObjectFromFile(specfile string) (format, mazType string, obj AzureObject) {
+func GetObjectFromFile(specfile string) (format, mazType string, obj AzureObject, err error) {
 	// Load specfile and capture the raw object, the format, and any error
 	rawObj, format, err := utl.LoadFileAuto(specfile)
 	if err != nil {
-		utl.Die("Error loading specfile %s: %v\n", utl.Yel(specfile), err)
+		return "", "", nil, wrapError(ErrFile, err, "error loading specfile %s", specfile)
 	}
 	if format != YamlFormat && format != JsonFormat {
-		utl.Die("Error. File %s is not in YAML format\n", utl.Yel(specfile))
+		return "", "", nil, newError(ErrValidation, "file %s is not in YAML format", specfile)
 	}
 
 	// Attempt to unpack the object
 	specfileObj := utl.Map(rawObj)
 	if specfileObj == nil {
-		utl.Die("Error unpacking the object in specfile %s\n", utl.Yel(specfile))
+		return "", "", nil, newError(ErrValidation, "error unpacking the object in specfile %s", specfile)
 	}
 
 	obj = AzureObject(specfileObj) // Cast to our standard AzureObject type
 
 	// Determine object type
 	if IsResRoleDefinition(obj) {
-		return format, ResRoleDefinition, obj
+		return format, ResRoleDefinition, obj, nil
 	}
 	if IsResRoleAssignment(obj) {
-		return format, ResRoleAssignment, obj
+		return format, ResRoleAssignment, obj, nil
 	}
 	if IsDirGroup(obj) {
-		return format, DirectoryGroup, obj
+		return format, DirectoryGroup, obj, nil
 	}
 	if IsDirAppSp(obj) {
-		return format, Application, obj
+		return format, Application, obj, nil
 	}
-	return format, UnknownObject, obj
+	return format, UnknownObject, obj, nil
 }
 
 // Compares object in specfile to what is in Azure. This is only for certain mazType objects.
-func CompareSpecfileToAzure(specfile string, z *Config) {
+func CompareSpecfileToAzure(specfile string, z *Config) error {
 	if !utl.FileUsable(specfile) {
-		utl.Die("That specfile doesn't exist, or is zero size\n")
+		return newError(ErrFile, "specfile %s doesn't exist, or is zero size", specfile)
 	}
-	format, mazType, obj := GetObjectFromFile(specfile)
-	if format != YamlFormat {
-		utl.Die("Specfile is not in YAML format\n")
+	format, mazType, obj, err := GetObjectFromFile(specfile)
+	if err != nil {
+		return err
 	}
-	if obj == nil {
-		utl.Die("Object in specfile is not valid\n")
+	if format != YamlFormat {
+		return newError(ErrValidation, "specfile %s is not in YAML format", specfile)
 	}
 
 	switch mazType {
 	case ResRoleDefinition:
-		roleName, firstScope := ValidateResRoleDefinitionObject(obj, z)
+		roleName, firstScope, err := ValidateResRoleDefinitionObject(obj, z)
+		if err != nil {
+			return err
+		}
 		_, azureObj := GetAzureResRoleDefinitionByScopeAndName(firstScope, roleName, z)
 		if azureObj == nil {
 			fmt.Printf("Role %s, as defined in specfile, does %s exist in Azure.\n", utl.Mag(roleName), utl.Red("not"))
@@ -434,13 +428,16 @@ func CompareSpecfileToAzure(specfile string, z *Config) {
 			DiffRoleDefinitionSpecfileVsAzure(obj, azureObj)
 		}
 	case ResRoleAssignment:
-		roleDefinitionId, principalId, scope := ValidateResRoleAssignmentObject(obj, z)
+		roleDefinitionId, principalId, scope, err := ValidateResRoleAssignmentObject(obj, z)
+		if err != nil {
+			return err
+		}
 		_, azureObj := GetAzureResRoleAssignmentBy3Args(roleDefinitionId, principalId, scope, z)
 		if azureObj == nil {
 			fmt.Printf("Role assignment defined in specfile does %s exist in Azure.\n", utl.Red("not"))
 		} else {
 			fmt.Printf("Role assignment defined in specfile %s exists in Azure:\n", utl.Gre("already"))
-			PrintResRoleAssignment(azureObj, z)
+			return PrintResRoleAssignment(azureObj, z)
 		}
 	case DirectoryGroup, Application, ServicePrincipal:
 		// Above call to GetObjectFromFile() guarantees below exists
@@ -453,18 +450,18 @@ func CompareSpecfileToAzure(specfile string, z *Config) {
 			fmt.Printf("The %s defined in specfile does %s exist in Azure.\n",
 				MazTypeNames[mazType], utl.Red("not"))
 		} else if count > 1 {
-			fmt.Printf("Found multiple %s named %s. Cannot continue.\n",
-				MazTypeNames[mazType], utl.Red(displayName))
+			return newError(ErrAmbiguousName, "found multiple %s objects named '%s', cannot continue",
+				MazTypeNames[mazType], displayName)
 		} else {
 			fmt.Printf("The %s defined in specfile %s exists in Azure:\n",
 				MazTypeNames[mazType], utl.Gre("already"))
-			PrintObject(mazType, azureObj[0], z)
+			return PrintObject(mazType, azureObj[0], z)
 		}
 	default:
-		utl.Die("This is a %s (%s) specfile, which is not currently supported.\n",
-			MazTypeNames[mazType], utl.Red(mazType))
+		return newError(ErrValidation, "this is a %s (%s) specfile, which is not currently supported",
+			MazTypeNames[mazType], mazType)
 	}
-	os.Exit(0)
+	return nil
 }
 
 // Retrieves Azure object display name, given its mazType and ID
@@ -492,15 +489,45 @@ func GetObjectNameFromId(mazType, targetId string, z *Config) string {
 			}
 		}
 	case DirectoryUser, DirectoryGroup, Application, ServicePrincipal, DirRoleDefinition:
-		z.AddMgHeader("ConsistencyLevel", "eventual")
-		apiUrl := ConstMgUrl + ApiEndpoint[mazType] + "/" + targetId
-		var err error
-		resp, _, err := ApiGet(apiUrl, z, nil)
-		if err != nil {
-			Logf("%v\n", err)
+		return GetObjectNamesFromIds(mazType, []string{targetId}, z)[targetId]
+	}
+	return ""
+}
+
+// Retrieves the display names of the given Azure object IDs, all of the same mazType, as an
+// id:name map. Directory objects are looked up with MS Graph JSON batching.
+func GetObjectNamesFromIds(mazType string, targetIds []string, z *Config) map[string]string {
+	names := make(map[string]string)
+	switch mazType {
+	case DirectoryUser, DirectoryGroup, Application, ServicePrincipal, DirRoleDefinition:
+		for id, obj := range GetObjectsFromAzureByIds(mazType, targetIds, z) {
+			names[id] = utl.Str(obj["displayName"])
 		}
-		if obj := utl.Map(resp); obj != nil {
-			return utl.Str(obj["displayName"])
+	default:
+		for _, id := range targetIds {
+			if name := GetObjectNameFromId(mazType, id, z); name != "" {
+				names[id] = name
+			}
+		}
+	}
+	return names
+}
+
+// Retrieves the name of a principal of unknown type, checking for a group, user, or
+// service principal with the given ID in a single MS Graph JSON batch call.
+func GetPrincipalNameFromId(principalId string, z *Config) string {
+	if principalId == "" {
+		return ""
+	}
+	principalTypes := []string{DirectoryGroup, DirectoryUser, ServicePrincipal}
+	var requests []BatchRequest
+	for _, mazType := range principalTypes {
+		requests = append(requests, BatchRequest{Id: mazType, Url: ApiEndpoint[mazType] + "/" + principalId})
+	}
+	batch := ApiBatch(requests, z)
+	for _, mazType := range principalTypes {
+		if r := batch[mazType]; r.Status == 200 {
+			return utl.Str(r.Body["displayName"])
 		}
 	}
 	return ""
@@ -523,7 +550,7 @@ func GetObjectIdFromName(mazType, targetName string, z *Config) string {
 		}
 	case DirectoryUser, DirectoryGroup, Application, ServicePrincipal, DirRoleDefinition:
 		z.AddMgHeader("ConsistencyLevel", "eventual")
-		apiUrl := ConstMgUrl + ApiEndpoint[mazType]
+		apiUrl := z.MgUrl + ApiEndpoint[mazType]
 		params := map[string]string{
 			"$filter": fmt.Sprintf("displayName eq '%s'", targetName),
 			"$top":    "1",
@@ -544,25 +571,34 @@ func GetObjectIdFromName(mazType, targetName string, z *Config) string {
 }
 
 // Returns an id:name map of the given object type.
-func GetIdNameMap(mazType string, z *Config) map[string]string {
+func GetIdNameMap(mazType string, z *Config) (map[string]string, error) {
 	// Resource (ResRoleAssignment) nor directory (DirRoleAssignment) role
 	// assignments have name, so this doesn't apply to them
 
 	var dirObjects AzureObjectList
+	var err error
 	idNameMap := make(map[string]string)
 
 	// Note false = get from cache. We optimize speed for accuracy.
 	switch mazType {
 	case ResRoleDefinition:
-		dirObjects = GetMatchingResRoleDefinitions("", false, z)
+		dirObjects, err = GetMatchingResRoleDefinitions("", false, z)
 	case Subscription:
-		dirObjects = GetMatchingAzureSubscriptions("", false, z)
+		dirObjects, err = GetMatchingAzureSubscriptions("", false, z)
 	case ManagementGroup:
-		dirObjects = GetMatchingAzureMgmtGroups("", false, z)
+		dirObjects, err = GetMatchingAzureMgmtGroups("", false, z)
 	case DirectoryUser, DirectoryGroup, Application, ServicePrincipal, DirRoleDefinition:
-		dirObjects = GetMatchingDirObjects(mazType, "", false, z)
+		// Directory objects have a top-level displayName, which the cache can map by itself
+		cache, err := GetDirObjectCache(mazType, false, z)
+		if err != nil {
+			return nil, err
+		}
+		return cache.IdNameMap()
 	default:
-		return nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 	for i := range dirObjects {
 		obj := dirObjects[i]
@@ -584,20 +620,21 @@ func GetIdNameMap(mazType string, z *Config) map[string]string {
 			}
 		}
 	}
-	return idNameMap
+	return idNameMap, nil
 }
 
 // Renames Azure object
-func RenameAzureObject(force bool, mazType, currentName, newName string, z *Config) {
+func RenameAzureObject(force bool, mazType, currentName, newName string, z *Config) error {
 	// Missing mazTypes are deliberately unsupported because one, they don't have
 	// display names, or simply because renaming them brings on too many complexities.
 	switch mazType {
 	case ResRoleDefinition:
-		RenameResRoleDefinition(force, currentName, newName, z)
+		return RenameResRoleDefinition(force, currentName, newName, z)
 	case Application, ServicePrincipal:
 		// This renaming is special becase of the relationship between the App and the SP
-		RenameAppSp(force, currentName, newName, z)
+		return RenameAppSp(force, currentName, newName, z)
 	case DirectoryGroup, DirRoleDefinition:
-		RenameDirObject(force, mazType, currentName, newName, z)
+		return RenameDirObject(force, mazType, currentName, newName, z)
 	}
+	return newError(ErrValidation, "renaming %s objects is not supported", MazTypeNames[mazType])
 }
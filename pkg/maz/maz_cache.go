@@ -14,10 +14,11 @@ import (
 
 // Cache type
 type Cache struct {
-	filePath        string
+	store           CacheStore // Objects, in the backend selected by SetCacheBackend()
 	deltaLinkFile   string
 	partialFilePath string // file path for saving in-progress deltaSet
-	data            AzureObjectList
+	lockPath        string // Serializes changes across processes, see lockCache()
+	resync          bool   // Loaded outdated, so to be synced with Azure in full, see GetCache()
 	mu              sync.Mutex
 }
 
@@ -38,12 +39,16 @@ func NewCache(mazType string, z *Config) (*Cache, error) {
 		return nil, fmt.Errorf("invalid object type code: %s", utl.Red(mazType))
 	}
 
-	cacheFile := filepath.Join(MazConfigDir, z.TenantId+suffix+".bin")
+	basePath := filepath.Join(z.cacheDir(), z.TenantId+suffix)
+	store, err := newCacheStore(basePath, mazType, z)
+	if err != nil {
+		return nil, err
+	}
 	return &Cache{
-		filePath:        cacheFile,
-		deltaLinkFile:   cacheFile[:len(cacheFile)-4] + "_link.bin",
-		partialFilePath: cacheFile[:len(cacheFile)-4] + "_partial.bin",
-		data:            AzureObjectList{},
+		store:           store,
+		deltaLinkFile:   basePath + "_link.bin",
+		partialFilePath: basePath + "_partial.bin",
+		lockPath:        basePath + ".lock",
 	}, nil
 }
 
@@ -54,7 +59,26 @@ func GetCache(mazType string, z *Config) (*Cache, error) {
 		return nil, err
 	}
 
-	if err := cache.Load(); err != nil {
+	err = cache.Load()
+	switch {
+	case errors.Is(err, errCacheSchema):
+		// Keep the objects, saved below with the current header, but drop the delta link,
+		// which was synced with other fields, so the next refresh lists every object again
+		Logf("%s\n", utl.Yel(fmt.Sprintf("Resyncing %v", err)))
+		if err := cache.removeSyncFiles(); err != nil {
+			return nil, fmt.Errorf("failed to reset outdated cache: %w", err)
+		}
+		cache.resync = true
+		err = os.ErrNotExist
+	case errors.Is(err, errCacheMismatch) || errors.Is(err, errCacheCorrupt):
+		// Rebuild just this cache, which then gets synced with Azure in full, being empty
+		Logf("%s\n", utl.Yel(fmt.Sprintf("Rebuilding %v", err)))
+		if err := cache.Erase(); err != nil {
+			return nil, fmt.Errorf("failed to remove unusable cache: %w", err)
+		}
+		err = os.ErrNotExist
+	}
+	if err != nil {
 		if os.IsNotExist(err) {
 			// Initialize new cache file
 			if err := cache.Save(); err != nil {
@@ -85,12 +109,23 @@ func ExtractID(obj AzureObject) string {
 	return ""
 }
 
+// Saves the delta set fetched so far, for ResumeFromPartialDelta() to pick up if the fetch
+// does not complete.
+func (c *Cache) SavePartialDelta(deltaSet AzureObjectList) error {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return SaveFileBinaryList(c.partialFilePath, deltaSet, 0600, false)
+}
+
 // Attempts to resume cache normalization from a partial delta set file if available.
 func (c *Cache) ResumeFromPartialDelta(mazType string) error {
 	// If a usable partial file exists, always normalize it into the cache
 	if utl.FileUsable(c.partialFilePath) {
 		Logf("Partial delta set detected - loading from: %s\n", c.partialFilePath)
-		partialSet, err := LoadFileBinaryList(c.partialFilePath, false)
+		partialSet, partialInfo, err := c.loadPartialDelta()
 		if err == nil && len(partialSet) > 0 {
 			Logf("Loaded %d items from partial delta set. Normalizing...\n", len(partialSet))
 
@@ -103,10 +138,10 @@ func (c *Cache) ResumeFromPartialDelta(mazType string) error {
 			}
 
 			// Clean up the partial file once processed
-			if removeErr := os.Remove(c.partialFilePath); removeErr != nil {
+			if removeErr := c.removePartialDelta(partialInfo); removeErr != nil {
 				// Retry once if deletion fails (e.g., transient file lock)
 				time.Sleep(500 * time.Millisecond)
-				removeErr = os.Remove(c.partialFilePath)
+				removeErr = c.removePartialDelta(partialInfo)
 				if removeErr != nil {
 					Logf("Error deleting partial file %s after retry: %v\n", c.partialFilePath, removeErr)
 				}
@@ -118,6 +153,39 @@ func (c *Cache) ResumeFromPartialDelta(mazType string) error {
 	return nil
 }
 
+// Helper function to load the partial delta set under the cache lock, along with the file
+// info needed to remove it later.
+func (c *Cache) loadPartialDelta() (AzureObjectList, os.FileInfo, error) {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Unlock()
+	info, err := os.Stat(c.partialFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	partialSet, err := LoadFileBinaryList(c.partialFilePath, false)
+	return partialSet, info, err
+}
+
+// Helper function to remove the partial delta set file under the cache lock, unless another
+// process has replaced it since it was loaded, or already removed it.
+func (c *Cache) removePartialDelta(loaded os.FileInfo) error {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	info, err := os.Stat(c.partialFilePath)
+	if os.IsNotExist(err) || err == nil && !os.SameFile(info, loaded) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(c.partialFilePath)
+}
+
 // Purges files associated with cache for a given type.
 func PurgeCacheFiles(mazType string, z *Config) error {
 	// Create a minimal Cache instance just for file paths
@@ -131,7 +199,16 @@ func PurgeCacheFiles(mazType string, z *Config) error {
 
 // Deletes files associated with the cache
 func (c *Cache) Erase() error {
-	files := []string{c.filePath, c.deltaLinkFile, c.partialFilePath}
+	if err := c.store.Erase(); err != nil {
+		return fmt.Errorf("failed to erase cache: %w", err)
+	}
+	return c.removeSyncFiles()
+}
+
+// Helper function to remove the delta link, or sync time, and the partial delta set of the
+// cache, so that its next refresh fetches all objects.
+func (c *Cache) removeSyncFiles() error {
+	files := []string{c.deltaLinkFile, c.partialFilePath}
 	for _, f := range files {
 		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to remove %q: %w", f, err)
@@ -140,8 +217,14 @@ func (c *Cache) Erase() error {
 	return nil
 }
 
-// Loads the delta link map from the file, if it exists and is valid.
+// Loads the delta link map from the file, if it exists and is valid. It is read under the
+// cache lock, so it is never one that another process is halfway through saving.
 func (c *Cache) LoadDeltaLink() (AzureObject, error) {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
 	if !utl.FileUsable(c.deltaLinkFile) || utl.FileAge(c.deltaLinkFile) >= (3660*24*27) {
 		// Delta link file is either unusable or expired
 		// Note that deltaLink file age has to be within 30 days (we do 27)
@@ -154,69 +237,188 @@ func (c *Cache) LoadDeltaLink() (AzureObject, error) {
 	return deltaLinkMap, nil
 }
 
+// Saves the cache, and then the delta link map it was synced up to, under one hold of the
+// cache lock, so that other processes never pick up a delta link that is ahead of the cache.
+func (c *Cache) SaveWithDeltaLink(deltaLinkMap AzureObject) error {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.store.Save(); err != nil {
+		return err
+	}
+	return SaveFileBinaryMap(c.deltaLinkFile, deltaLinkMap, 0600)
+}
+
 // Saves the provided delta link map to the file.
 func (c *Cache) SaveDeltaLink(deltaLinkMap AzureObject) error {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 	return SaveFileBinaryMap(c.deltaLinkFile, deltaLinkMap, 0600)
 }
 
+// Returns the start time of the cache's last Resource Graph sync, or the zero time if there
+// is none. Resource caches keep it in the delta link file, so it expires the same way.
+func (c *Cache) LoadSyncTime() (time.Time, error) {
+	deltaLinkMap, err := c.LoadDeltaLink()
+	if err != nil || deltaLinkMap == nil {
+		return time.Time{}, err
+	}
+	syncTime := utl.Str(deltaLinkMap["syncTime"])
+	if syncTime == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, syncTime)
+}
+
+// Saves the start time of a completed Resource Graph sync, for the next sync to only fetch
+// the objects updated since.
+func (c *Cache) SaveSyncTime(syncTime time.Time) error {
+	return c.SaveDeltaLink(AzureObject{"syncTime": syncTime.UTC().Format(time.RFC3339)})
+}
+
 // Load cache from file
 func (c *Cache) Load() error {
-	// TODO: Maybe take 'compressed' boolean option?
-	loadedData, err := LoadFileBinaryList(c.filePath, false) // false = not compressed
-	if err != nil {
-		return err
-	}
-	c.data = loadedData
-	return nil
+	return c.store.Load()
 }
 
-// Save cache to file
+// Save cache to file, under the cache lock
 func (c *Cache) Save() error {
-	// TODO: Maybe take 'compressed' boolean option?
-
-	// Lock during in-memory operations only
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	return SaveFileBinaryList(c.filePath, c.data, 0600, false)
+	return c.store.Save()
 }
 
 // Age returns the age of the cache file in seconds. If the file does not
 // exist or is empty, it returns -1.
 func (c *Cache) Age() int64 {
-	return utl.FileAge(c.filePath)
+	return c.store.Age()
 }
 
 // Count returns the number of entries in the cache.
 func (c *Cache) Count() int64 {
-	return int64(len(c.data))
+	count, err := c.store.Count()
+	if err != nil {
+		Logf("Error counting cache objects: %v\n", err)
+	}
+	return count
+}
+
+// Calls fn with each object in the cache, until it returns false. fn must not change the
+// cache.
+func (c *Cache) Scan(fn func(obj AzureObject) bool) error {
+	return c.store.Scan(fn)
+}
+
+// Returns all objects in the cache. With the bolt backend, this reads the whole cache into
+// memory, so prefer Filter(), Lookup() or FindById() where they do.
+func (c *Cache) Objects() (AzureObjectList, error) {
+	list := AzureObjectList{}
+	err := c.store.Scan(func(obj AzureObject) bool {
+		list = append(list, obj)
+		return true
+	})
+	return list, err
+}
+
+// Returns the objects that have the filter string in any of their attributes, see
+// AzureObject.HasString(). Objects are checked one at a time, so only matches are held in
+// memory.
+func (c *Cache) Filter(filter string) (AzureObjectList, error) {
+	matchingList := AzureObjectList{} // Initialize an empty list for matching items
+	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
+	err := c.store.Scan(func(obj AzureObject) bool {
+		// Skip objects whose ID is empty or has already been seen
+		id := utl.Str(obj["id"])
+		if id != "" && !ids.Exists(id) && obj.HasString(filter) {
+			matchingList = append(matchingList, obj)
+			ids.Add(id)
+		}
+		return true
+	})
+	return matchingList, err
+}
+
+// Returns the objects whose given attribute, "id" or one of the CacheIndexes, equals value,
+// case-insensitively. The bolt backend finds them through its indexes.
+func (c *Cache) Lookup(index, value string) (AzureObjectList, error) {
+	return c.store.Lookup(index, value)
+}
+
+// Returns the object with the given ID, or nil if it is not in the cache.
+func (c *Cache) FindById(id string) AzureObject {
+	obj, err := c.store.Get(id)
+	if err != nil {
+		Logf("Error reading cache object %s: %v\n", id, err)
+	}
+	return obj
+}
+
+// Returns an id:displayName map of the objects in the cache. The bolt backend reads it from
+// its displayName index, without decoding any objects.
+func (c *Cache) IdNameMap() (map[string]string, error) {
+	idNameMap := make(map[string]string)
+	err := c.store.ScanIndex("displayName", func(id, name string) bool {
+		idNameMap[id] = name
+		return true
+	})
+	return idNameMap, err
+}
+
+// Replaces all objects in the cache with the given list, and saves it.
+func (c *Cache) Replace(list AzureObjectList) error {
+	lock, err := lockCache(c.lockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.store.Replace(list); err != nil {
+		return err
+	}
+	return c.store.Save()
 }
 
-// Removes an object by its ID from the in-memory cache.
+// Removes an object by its ID from the cache.
 func (c *Cache) Delete(id string) error {
-	// Note: You must call Save() separately to persist changes to disk.
+	// Note: You must call Save() separately to persist changes to disk with the gob backend.
 
 	// Lock during in-memory operations only
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Attempt to delete the object from the cache data
-	if !c.data.DeleteById(id) {
-		return fmt.Errorf("failed to delete object %s from cache", id)
+	obj, err := c.store.Get(id)
+	if err == nil && obj == nil {
+		err = fmt.Errorf("not found")
+	}
+	if err == nil {
+		err = c.store.Delete(utl.StringSet{ExtractID(obj): struct{}{}})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete object %s from cache: %w", id, err)
 	}
 	return nil
 }
 
 // DeleteById removes a single object
 func (c *Cache) DeleteById(id string) {
-	newData := make(AzureObjectList, 0, len(c.data))
-	for _, obj := range c.data {
-		existingId := ExtractID(obj)
-		if existingId != id {
-			newData = append(newData, obj)
-		}
-	}
-	c.data = newData
+	c.BatchDeleteByIds(utl.StringSet{id: struct{}{}})
 }
 
 func (c *Cache) Upsert(obj AzureObject) error {
@@ -236,28 +438,27 @@ func (c *Cache) Upsert(obj AzureObject) error {
 	}
 
 	// Check if the object already exists in the cache
-	existingObj := c.data.FindById(id) // Use FindById to locate the existing object
+	existingObj, err := c.store.Get(id)
+	if err != nil {
+		return err
+	}
 	if existingObj != nil {
 		Logf("UPDATE cache object %s\n", utl.Mag(id))
-		// Merge the new object into the existing one in place
-		MergeAzureObjects(obj, *existingObj)
+		// Merge the new object into the existing one, and store that
+		MergeAzureObjects(obj, existingObj)
+		obj = existingObj
 	} else {
 		Logf("ADD cache object %s\n", utl.Mag(id))
-		c.data = append(c.data, obj) // Add the new object to the cache
 	}
 
-	return nil
+	return c.store.Put(AzureObjectList{obj})
 }
 
 // BatchDeleteByIds removes multiple objects in one pass (O(n) instead of O(n*m))
 func (c *Cache) BatchDeleteByIds(ids utl.StringSet) {
-	newData := make(AzureObjectList, 0, len(c.data))
-	for _, obj := range c.data {
-		if _, deleted := ids[utl.Str(obj["id"])]; !deleted {
-			newData = append(newData, obj)
-		}
+	if err := c.store.Delete(ids); err != nil {
+		Logf("Error deleting cache objects: %v\n", err)
 	}
-	c.data = newData
 }
 
 // Recursively merges the keys from AzureObject a into b. Existing object b attributes
@@ -279,13 +480,26 @@ func MergeAzureObjects(newObj, existingObj AzureObject) {
 	}
 }
 
-// Merges the deltaSet with the current cache data.
+// Merges the deltaSet with the current cache data. Updated objects are merged into the cached
+// ones, since delta queries may only return the attributes that changed.
 func (c *Cache) Normalize(mazType string, deltaSet AzureObjectList) {
+	c.normalize(deltaSet, false)
+}
+
+// Replaces the current cache data with the deltaSet of a full delta round, which lists every
+// current object, but not the ones deleted since the cache was last synced.
+func (c *Cache) Resync(mazType string, deltaSet AzureObjectList) {
+	c.normalize(deltaSet, true)
+}
+
+// Helper function to merge the deltaSet with the current cache data, or to replace the data
+// with it if full is set.
+func (c *Cache) normalize(deltaSet AzureObjectList, full bool) {
 	Logf("Normalizing cache...\n")
 	start := time.Now()
 
 	// Early Exit for Empty Deltas
-	if len(deltaSet) == 0 {
+	if len(deltaSet) == 0 && !full {
 		Logf("Empty deltaSet received - no changes to process\n")
 		return
 	}
@@ -327,42 +541,13 @@ func (c *Cache) Normalize(mazType string, deltaSet AzureObjectList) {
 	}
 
 	// 3. Sequential upsert
-	if c.Count() == 0 {
-		// Optimized path for initial load
-		// Pre-allocate slice
-		c.data = make(AzureObjectList, 0, len(mergeSet))
-
-		// Bulk append without per-item processing, with proper ID checking
-		for _, obj := range mergeSet {
-			id := ExtractID(obj)
-			if id == "" {
-				Logf("WARNING: object with blank ID not added to cache\n")
-				continue
-			}
-			c.data = append(c.data, obj)
-		}
-	} else {
-		// Fast index for current data
-		existingIndex := make(map[string]int, len(c.data))
-		for i, obj := range c.data {
-			id := ExtractID(obj)
-			if id != "" {
-				existingIndex[id] = i
-			}
-		}
-
-		for _, obj := range mergeSet {
-			id := ExtractID(obj)
-			if id == "" {
-				Logf("WARNING: object with blank ID not processed\n")
-				continue
-			}
-			if idx, exists := existingIndex[id]; exists {
-				c.data[idx] = obj
-			} else {
-				c.data = append(c.data, obj)
-			}
+	if full || c.Count() == 0 {
+		// Optimized path for initial load, without looking for existing objects
+		if err := c.store.Replace(mergeSet); err != nil {
+			Logf("Error adding objects to cache: %v\n", err)
 		}
+	} else if err := c.store.Merge(mergeSet); err != nil {
+		Logf("Error updating objects in cache: %v\n", err)
 	}
 
 	Logf("Normalize completed in %v (%.1f items/sec)\n",
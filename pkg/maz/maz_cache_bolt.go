@@ -0,0 +1,688 @@
+//go:build !(plan9 || js || wasip1)
+
+package maz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/utl"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt store keeps each object gob encoded under its ID in the objects bucket, encrypted
+// like the gob files if MAZ_ENCRYPT_OBJECT_CACHES is set. Each of the CacheIndexes has its own
+// bucket, with keys made of the SHA-256 hash of the lowercase attribute value followed by the
+// object ID, so no attribute values show in the keys, and values holding the attribute value.
+// The meta bucket holds the gob encoded CacheHeader, whose checksum is updated along with each
+// object written, see boltChecksum. bbolt checks the consistency of the database file itself.
+const (
+	boltObjectsBucket = "objects"
+	boltIndexPrefix   = "index_"
+	boltMetaBucket    = "meta"
+	boltHeaderKey     = "header"
+)
+
+// Open bolt databases, shared by the concurrent operations of a process, since a database
+// file can only be opened once at a time. Each operation opens the database, and it is closed
+// once no operation uses it anymore, so other processes only ever wait for the operations in
+// progress, on bbolt's file lock.
+var (
+	boltDbsMu sync.Mutex
+	boltDbs   = make(map[string]*boltDbRef)
+)
+
+type boltDbRef struct {
+	db   *bolt.DB
+	refs int
+}
+
+// Store that writes each object to an embedded bolt key/value database as it changes, and
+// reads objects from it as needed, so that the cache is never held in memory as a whole. The
+// database is only open during each operation, see view() and update().
+type boltCacheStore struct {
+	filePath string
+	header   CacheHeader    // Expected of the database, with its creation time once loaded
+	gobStore *gobCacheStore // Imported on first use, see Load()
+	outdated bool           // Whether the header is to be written again on Save()
+}
+
+// Checksum of the objects of a bolt cache: the XOR of the SHA-256 hashes of each object's ID
+// and stored value, which can be updated as objects are written one at a time, in any order.
+// Toggling an object adds it, and toggling it again removes it.
+type boltChecksum [sha256.Size]byte
+
+// Returns the store of the given bolt database file, which imports the given gob store's cache
+// on first use.
+func newBoltCacheStore(filePath string, header CacheHeader, gobStore *gobCacheStore) (CacheStore, error) {
+	return &boltCacheStore{filePath: filePath, header: header, gobStore: gobStore}, nil
+}
+
+// Opens the database, checking that its header and checksum match the expected ones, or
+// imports the gob cache of the same object type when the database does not exist yet but the
+// gob file does.
+func (s *boltCacheStore) Load() error {
+	if _, err := os.Stat(s.filePath); err == nil {
+		err := s.view(s.checkHeader)
+		s.outdated = errors.Is(err, errCacheSchema)
+		return err
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if !utl.FileUsable(s.gobStore.filePath) {
+		return &os.PathError{Op: "open", Path: s.filePath, Err: os.ErrNotExist}
+	}
+	outdated := s.gobStore.Load()
+	if outdated != nil && !errors.Is(outdated, errCacheSchema) {
+		return fmt.Errorf("failed to import %s: %w", s.gobStore.filePath, outdated)
+	}
+	Logf("Importing %d objects from %s\n", len(s.gobStore.data), utl.Cya(s.gobStore.filePath))
+	err := s.Replace(s.gobStore.data)
+	s.gobStore.data = nil
+	if err != nil {
+		return err
+	}
+	return outdated // Imported with the current header, but still to be synced in full
+}
+
+// Creates the database, with its header, if it does not exist yet, and writes the header again
+// if it was outdated. Changes are written as they are made, so there is nothing else to save.
+func (s *boltCacheStore) Save() error {
+	hasHeader := false
+	err := s.view(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(boltMetaBucket))
+		hasHeader = meta != nil && meta.Get([]byte(boltHeaderKey)) != nil
+		return nil
+	})
+	if err != nil || (hasHeader && !s.outdated) {
+		return err // Only write if the header needs it, since writing updates the file's age
+	}
+	err = s.update(func(tx *bolt.Tx) error {
+		return s.putHeader(tx, boltObjectsChecksum(tx))
+	})
+	if err == nil {
+		s.outdated = false
+	}
+	return err
+}
+
+func (s *boltCacheStore) Count() (count int64, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		count = int64(tx.Bucket([]byte(boltObjectsBucket)).Stats().KeyN)
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltCacheStore) Get(id string) (obj AzureObject, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		obj, err = s.getObject(tx, path.Base(id))
+		return err
+	})
+	return obj, err
+}
+
+func (s *boltCacheStore) Lookup(index, value string) (AzureObjectList, error) {
+	list := AzureObjectList{}
+	if index == "id" {
+		obj, err := s.Get(value)
+		if obj != nil {
+			list = append(list, obj)
+		}
+		return list, err
+	}
+	if !utl.ItemInList(index, CacheIndexes) {
+		// Not indexed, so look at every object
+		err := s.Scan(func(obj AzureObject) bool {
+			if strings.EqualFold(utl.Str(obj[index]), value) {
+				list = append(list, obj)
+			}
+			return true
+		})
+		return list, err
+	}
+	err := s.view(func(tx *bolt.Tx) error {
+		prefix := boltIndexHash(value)
+		c := tx.Bucket([]byte(boltIndexPrefix + index)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			obj, err := s.getObject(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if obj != nil {
+				list = append(list, obj)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltCacheStore) Scan(fn func(obj AzureObject) bool) error {
+	return s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(boltObjectsBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			obj, err := decodeCacheObject(v, s.filePath)
+			if err != nil {
+				return err
+			}
+			if !fn(obj) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Reads only the index, without decoding any objects, if the attribute is one of the
+// CacheIndexes.
+func (s *boltCacheStore) ScanIndex(index string, fn func(id, value string) bool) error {
+	if !utl.ItemInList(index, CacheIndexes) {
+		return s.Scan(func(obj AzureObject) bool {
+			id, value := ExtractID(obj), utl.Str(obj[index])
+			return id == "" || value == "" || fn(id, value)
+		})
+	}
+	return s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(boltIndexPrefix + index)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			value, err := decryptData(v, s.filePath)
+			if err != nil {
+				return err
+			}
+			if !fn(string(k[sha256.Size:]), string(value)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltCacheStore) Put(list AzureObjectList) error {
+	return s.updateObjects(func(tx *bolt.Tx, sum *boltChecksum) error {
+		for _, obj := range list {
+			id := ExtractID(obj)
+			if id == "" {
+				continue
+			}
+			if err := s.deleteObject(tx, id, sum); err != nil {
+				return err
+			}
+			if err := s.putObject(tx, id, obj, sum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltCacheStore) Merge(list AzureObjectList) error {
+	return s.updateObjects(func(tx *bolt.Tx, sum *boltChecksum) error {
+		for _, obj := range list {
+			id := ExtractID(obj)
+			if id == "" {
+				continue
+			}
+			existingObj, err := s.getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if existingObj != nil {
+				MergeAzureObjects(obj, existingObj)
+				obj = existingObj
+				if err := s.deleteObject(tx, id, sum); err != nil {
+					return err
+				}
+			}
+			if err := s.putObject(tx, id, obj, sum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltCacheStore) Delete(ids utl.StringSet) error {
+	return s.updateObjects(func(tx *bolt.Tx, sum *boltChecksum) error {
+		for id := range ids {
+			if err := s.deleteObject(tx, id, sum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replaces all objects in a single transaction, so the database never holds a partial list.
+func (s *boltCacheStore) Replace(list AzureObjectList) error {
+	return s.update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets() {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		var sum boltChecksum
+		for _, obj := range list {
+			if id := ExtractID(obj); id != "" {
+				if err := s.putObject(tx, id, obj, &sum); err != nil {
+					return err
+				}
+			}
+		}
+		return s.putHeader(tx, sum)
+	})
+}
+
+func (s *boltCacheStore) Age() int64 {
+	return utl.FileAge(s.filePath)
+}
+
+// Removes the database, as well as the gob file it would otherwise import again.
+func (s *boltCacheStore) Erase() error {
+	if err := os.Remove(s.filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.header.Created = time.Time{}
+	return s.gobStore.Erase()
+}
+
+// Helper function to check that the database's header matches the expected one, and that
+// its checksum matches the objects. The checksum of an outdated database isn't checked, since
+// its header is written again anyway, see Save().
+func (s *boltCacheStore) checkHeader(tx *bolt.Tx) error {
+	header, err := readBoltHeader(tx)
+	if err != nil {
+		return fmt.Errorf("%w %s: failed to decode header: %v", errCacheCorrupt, s.filePath, err)
+	} else if header == nil {
+		return fmt.Errorf("%w %s: database has no header", errCacheSchema, s.filePath)
+	}
+	if err := header.check(s.header, s.filePath); err != nil {
+		if errors.Is(err, errCacheSchema) {
+			s.header.Created = header.Created
+		}
+		return err
+	}
+	if boltObjectsChecksum(tx).String() != header.Checksum {
+		return fmt.Errorf("%w %s: checksum mismatch", errCacheCorrupt, s.filePath)
+	}
+	s.header.Created = header.Created
+	return nil
+}
+
+// Helper function to write the database's header, with the given checksum of its objects,
+// stamped with the current time if the database is new.
+func (s *boltCacheStore) putHeader(tx *bolt.Tx, sum boltChecksum) error {
+	if s.header.Created.IsZero() {
+		s.header.Created = time.Now().UTC()
+	}
+	header := s.header
+	header.Checksum = sum.String()
+	return writeBoltHeader(tx, header)
+}
+
+// Helper function that returns the object with the given ID, or nil if there is none.
+func (s *boltCacheStore) getObject(tx *bolt.Tx, id string) (AzureObject, error) {
+	data := tx.Bucket([]byte(boltObjectsBucket)).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeCacheObject(data, s.filePath)
+}
+
+// Helper function to write the given object and its index entries, and to add it to the
+// given checksum.
+func (s *boltCacheStore) putObject(tx *bolt.Tx, id string, obj AzureObject, sum *boltChecksum) error {
+	data, err := encodeCacheObject(obj)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(boltObjectsBucket)).Put([]byte(id), data); err != nil {
+		return err
+	}
+	sum.toggle([]byte(id), data)
+	for _, index := range CacheIndexes {
+		value := utl.Str(obj[index])
+		if value == "" {
+			continue
+		}
+		data := []byte(value)
+		if objectCacheEncryption() {
+			if data, err = encryptData(data); err != nil {
+				return err
+			}
+		}
+		key := append(boltIndexHash(value), id...)
+		if err := tx.Bucket([]byte(boltIndexPrefix+index)).Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to remove the object with the given ID, if any, and its index entries, and
+// to remove it from the given checksum.
+func (s *boltCacheStore) deleteObject(tx *bolt.Tx, id string, sum *boltChecksum) error {
+	data := tx.Bucket([]byte(boltObjectsBucket)).Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	obj, err := decodeCacheObject(data, s.filePath)
+	if err != nil {
+		return err
+	}
+	sum.toggle([]byte(id), data)
+	for _, index := range CacheIndexes {
+		if value := utl.Str(obj[index]); value != "" {
+			key := append(boltIndexHash(value), id...)
+			if err := tx.Bucket([]byte(boltIndexPrefix + index)).Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket([]byte(boltObjectsBucket)).Delete([]byte(id))
+}
+
+// Helper function to run fn in a read-only transaction.
+func (s *boltCacheStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := acquireBoltDb(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer releaseBoltDb(s.filePath)
+	return db.View(fn)
+}
+
+// Helper function to run fn in a read-write transaction, which is committed if fn succeeds.
+func (s *boltCacheStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := acquireBoltDb(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer releaseBoltDb(s.filePath)
+	return db.Update(fn)
+}
+
+// Helper function to run fn in a read-write transaction, like update(), and to update the
+// checksum in the database's header with the objects fn writes and removes.
+func (s *boltCacheStore) updateObjects(fn func(tx *bolt.Tx, sum *boltChecksum) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		header, err := readBoltHeader(tx)
+		if err != nil {
+			return fmt.Errorf("%w %s: failed to decode header: %v", errCacheCorrupt, s.filePath, err)
+		} else if header == nil {
+			return fmt.Errorf("%w %s: database has no header", errCacheSchema, s.filePath)
+		}
+		var sum boltChecksum
+		if n, err := hex.Decode(sum[:], []byte(header.Checksum)); err != nil || n != len(sum) {
+			return fmt.Errorf("%w %s: invalid checksum %q", errCacheCorrupt, s.filePath, header.Checksum)
+		}
+		if err := fn(tx, &sum); err != nil {
+			return err
+		}
+		header.Checksum = sum.String()
+		return writeBoltHeader(tx, *header)
+	})
+}
+
+// Returns the open database of the given file, opening it first if this process does not
+// have it open yet. It is created, with its buckets, if it does not exist. Each call must be
+// paired with a releaseBoltDb() call.
+func acquireBoltDb(filePath string) (*bolt.DB, error) {
+	boltDbsMu.Lock()
+	defer boltDbsMu.Unlock()
+	if ref := boltDbs[filePath]; ref != nil {
+		ref.refs++
+		return ref.db, nil
+	}
+
+	db, err := bolt.Open(filePath, 0600, &bolt.Options{Timeout: cacheLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, wrapError(ErrFile, err, "cache %s is in use by another process", filePath)
+	} else if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrVersionMismatch) ||
+		errors.Is(err, bolt.ErrChecksum) {
+		return nil, wrapError(ErrFile, fmt.Errorf("%w: %w", errCacheCorrupt, err), "error opening cache %s", filePath)
+	} else if err != nil {
+		return nil, wrapError(ErrFile, err, "error opening cache %s", filePath)
+	}
+	// Only write if buckets are missing, since writing updates the file's age
+	missing := false
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets() {
+			missing = missing || tx.Bucket([]byte(name)) == nil
+		}
+		return nil
+	})
+	if missing {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range boltBuckets() {
+				if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, wrapError(ErrFile, err, "error setting up cache %s", filePath)
+		}
+	}
+	boltDbs[filePath] = &boltDbRef{db: db, refs: 1}
+	return db, nil
+}
+
+// Releases the database of the given file, closing it if no other caller is using it.
+func releaseBoltDb(filePath string) {
+	boltDbsMu.Lock()
+	defer boltDbsMu.Unlock()
+	ref := boltDbs[filePath]
+	if ref == nil {
+		return
+	}
+	if ref.refs--; ref.refs < 1 {
+		if err := ref.db.Close(); err != nil {
+			Logf("Error closing cache %s: %v\n", filePath, err)
+		}
+		delete(boltDbs, filePath)
+	}
+}
+
+// Encrypts, or with encrypt false decrypts, the object and index values of the given bolt
+// cache, and reports whether any of them changed. Values already in the requested state are
+// left alone. bbolt doesn't clear freed pages, so the values are copied to a new database,
+// which then replaces the old one, leaving no trace of their previous state.
+func migrateBoltCache(filePath string, encrypt bool) (changed bool, err error) {
+	boltDbsMu.Lock()
+	inUse := boltDbs[filePath] != nil
+	boltDbsMu.Unlock()
+	if inUse {
+		return false, fmt.Errorf("cache %s is in use", filePath)
+	}
+	src, err := bolt.Open(filePath, 0600, &bolt.Options{Timeout: cacheLockTimeout, ReadOnly: true})
+	if err != nil {
+		return false, fmt.Errorf("failed to open cache %s: %w", filePath, err)
+	}
+	defer src.Close()
+
+	// Check first, so databases already in the requested state aren't rewritten
+	transform := utl.StringSet{}
+	for _, name := range boltBuckets() {
+		transform.Add(name)
+	}
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if !transform.Exists(string(name)) {
+				return nil
+			}
+			return bucket.ForEach(func(key, value []byte) error {
+				changed = changed || isEncrypted(value) != encrypt
+				return nil
+			})
+		})
+	})
+	if err != nil || !changed {
+		return false, err
+	}
+
+	tmpPath := filePath + ".migrate.tmp"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			err := srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+				dstBucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return srcBucket.ForEach(func(key, value []byte) error {
+					if transform.Exists(string(name)) && isEncrypted(value) != encrypt {
+						if encrypt {
+							value, err = encryptData(value)
+						} else {
+							value, err = decryptData(value, filePath)
+						}
+						if err != nil {
+							return err
+						}
+					}
+					return dstBucket.Put(key, value)
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			// The checksum covers the stored values, which have changed
+			header, err := readBoltHeader(dstTx)
+			if err != nil || header == nil {
+				return err
+			}
+			header.Checksum = boltObjectsChecksum(dstTx).String()
+			return writeBoltHeader(dstTx, *header)
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		src.Close() // Windows can't replace open files
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// Helper function that returns the header of the bolt cache, or nil if it has none.
+func readBoltHeader(tx *bolt.Tx) (*CacheHeader, error) {
+	var data []byte
+	if meta := tx.Bucket([]byte(boltMetaBucket)); meta != nil {
+		data = meta.Get([]byte(boltHeaderKey))
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var header CacheHeader
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// Helper function to write the header of the bolt cache.
+func writeBoltHeader(tx *bolt.Tx, header CacheHeader) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(boltMetaBucket))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(header); err != nil {
+		return fmt.Errorf("failed to encode cache header: %w", err)
+	}
+	return meta.Put([]byte(boltHeaderKey), buf.Bytes())
+}
+
+// Helper function that returns the checksum of all objects of the bolt cache.
+func boltObjectsChecksum(tx *bolt.Tx) (sum boltChecksum) {
+	if objects := tx.Bucket([]byte(boltObjectsBucket)); objects != nil {
+		objects.ForEach(func(key, value []byte) error {
+			sum.toggle(key, value)
+			return nil
+		})
+	}
+	return sum
+}
+
+// Adds the object with the given ID and stored value to the checksum, or removes it if it
+// was added already.
+func (c *boltChecksum) toggle(id, value []byte) {
+	h := sha256.New()
+	h.Write(id)
+	h.Write([]byte{0})
+	h.Write(value)
+	for i, b := range h.Sum(nil) {
+		c[i] ^= b
+	}
+}
+
+func (c boltChecksum) String() string {
+	return hex.EncodeToString(c[:])
+}
+
+// Helper function that returns the names of all buckets of a bolt cache.
+func boltBuckets() []string {
+	names := []string{boltObjectsBucket}
+	for _, index := range CacheIndexes {
+		names = append(names, boltIndexPrefix+index)
+	}
+	return names
+}
+
+// Helper function that returns the index key prefix of the given attribute value.
+func boltIndexHash(value string) []byte {
+	sum := sha256.Sum256([]byte(strings.ToLower(value)))
+	return sum[:]
+}
+
+// Helper function to gob encode a single object, encrypting it if object caches are to be
+// encrypted.
+func encodeCacheObject(obj AzureObject) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(obj); err != nil {
+		return nil, fmt.Errorf("failed to encode object: %w", err)
+	}
+	if objectCacheEncryption() {
+		return encryptData(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// Helper function to decode a single object, decrypting it if needed. The name is that of
+// the file holding it, for error messages.
+func decodeCacheObject(data []byte, name string) (AzureObject, error) {
+	data, err := decryptData(data, name)
+	if err != nil {
+		return nil, err
+	}
+	var obj AzureObject
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("failed to decode object in %s: %w", name, err)
+	}
+	return obj, nil
+}
@@ -0,0 +1,15 @@
+//go:build plan9 || js || wasip1
+
+package maz
+
+import "runtime"
+
+// bbolt doesn't support this OS, so only the gob cache backend is available.
+func newBoltCacheStore(filePath string, header CacheHeader, gobStore *gobCacheStore) (CacheStore, error) {
+	return nil, newError(ErrConfig, "the %s cache backend is not supported on %s", CacheBackendBolt, runtime.GOOS)
+}
+
+// There are no bolt caches to migrate on this OS.
+func migrateBoltCache(filePath string, encrypt bool) (bool, error) {
+	return false, newError(ErrConfig, "the %s cache backend is not supported on %s", CacheBackendBolt, runtime.GOOS)
+}
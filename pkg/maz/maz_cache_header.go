@@ -0,0 +1,174 @@
+package maz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Version of the object cache file layout. Changes to the cached attributes themselves are
+// picked up through the header's field list, see cacheFields(), so this only needs bumping
+// when the layout changes, or cached values change meaning.
+const CacheSchemaVersion = 2 // Version 1 being the headerless gob files of earlier releases
+
+// Start of gob cache files since CacheSchemaVersion 2, which is followed by the length of the
+// gob encoded CacheHeader, the header, and the gob encoded object list.
+var cacheFileMagic = []byte("MAZCACHE")
+
+// Errors of a store's Load() when the cache was written for an earlier schema or other fields,
+// when it holds another tenant's objects or objects of another type, or when its file is
+// damaged. GetCache() keeps the objects of an outdated cache, and has them synced again in
+// full, but removes the others.
+var (
+	errCacheSchema   = errors.New("outdated cache")
+	errCacheMismatch = errors.New("mismatched cache")
+	errCacheCorrupt  = errors.New("corrupt cache")
+)
+
+// CacheHeader describes the content of an object cache, and is stored along with it: at the
+// start of the gob file, or in the meta bucket of the bolt database.
+type CacheHeader struct {
+	SchemaVersion int
+	TenantId      string
+	MazType       string
+	Fields        []string  // Cached object attributes, see cacheFields()
+	Created       time.Time // When the cache was first written
+	Checksum      string    // Hex checksum of the objects, see saveCacheFile() and boltChecksum
+}
+
+// Helper function that returns the header expected of the given tenant's cache of the given
+// object type, without the creation time and checksum.
+func newCacheHeader(tenantId, mazType string) CacheHeader {
+	return CacheHeader{
+		SchemaVersion: CacheSchemaVersion,
+		TenantId:      tenantId,
+		MazType:       mazType,
+		Fields:        cacheFields(mazType),
+	}
+}
+
+// Helper function that returns an errCacheMismatch error if the header is that of another
+// tenant's cache or of another object type, an errCacheSchema error if it is that of an earlier
+// schema or of other fields, or nil if it matches the expected one. The name is that of the
+// file holding the cache, for error messages.
+func (h CacheHeader) check(want CacheHeader, name string) error {
+	switch {
+	case !strings.EqualFold(h.TenantId, want.TenantId):
+		return fmt.Errorf("%w %s: it has objects of tenant %s", errCacheMismatch, name, h.TenantId)
+	case h.MazType != want.MazType:
+		return fmt.Errorf("%w %s: it has objects of type %s", errCacheMismatch, name, h.MazType)
+	case h.SchemaVersion != want.SchemaVersion:
+		return fmt.Errorf("%w %s: it has schema version %d instead of %d", errCacheSchema, name,
+			h.SchemaVersion, want.SchemaVersion)
+	case !slices.Equal(h.Fields, want.Fields):
+		return fmt.Errorf("%w %s: it has other cached fields", errCacheSchema, name)
+	}
+	return nil
+}
+
+// Returns the sorted attributes cached for the given object type: those kept by TrimForCache(),
+// with nested ones as 'properties.roleName', and those selected by RefreshLocalCacheWithAzure().
+func cacheFields(mazType string) []string {
+	fields := utl.StringSet{}
+	probe := AzureObject{"properties": map[string]interface{}{}}
+	for key, value := range probe.TrimForCache(mazType) {
+		if nested, ok := value.(map[string]interface{}); ok {
+			for nestedKey := range nested {
+				fields.Add(key + "." + nestedKey)
+			}
+			continue
+		}
+		fields.Add(key)
+	}
+	if selected := dirObjectSelect[mazType]; selected != "" {
+		for _, field := range strings.Split(selected, ",") {
+			fields.Add(field)
+		}
+	}
+	return slices.Sorted(maps.Keys(fields))
+}
+
+// Writes the given header and objects to the gob cache file, encrypting it if object caches
+// are to be encrypted. The header's checksum is set to that of the encoded objects.
+func saveCacheFile(filePath string, header CacheHeader, data AzureObjectList) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(data); err != nil {
+		return fmt.Errorf("failed to encode data to binary: %w", err)
+	}
+	sum := sha256.Sum256(body.Bytes())
+	header.Checksum = hex.EncodeToString(sum[:])
+	var head bytes.Buffer
+	if err := gob.NewEncoder(&head).Encode(header); err != nil {
+		return fmt.Errorf("failed to encode cache header: %w", err)
+	}
+
+	content := make([]byte, 0, len(cacheFileMagic)+4+head.Len()+body.Len())
+	content = append(content, cacheFileMagic...)
+	content = binary.BigEndian.AppendUint32(content, uint32(head.Len()))
+	content = append(content, head.Bytes()...)
+	content = append(content, body.Bytes()...)
+	if objectCacheEncryption() {
+		var err error
+		if content, err = encryptData(content); err != nil {
+			return fmt.Errorf("failed to encrypt data: %w", err)
+		}
+	}
+	return writeFileAtomic(filePath, content, 0600)
+}
+
+// Reads the header and objects of the given gob cache file, decrypting it if needed. The
+// headerless files of earlier releases are read with a header of schema version 1, for the
+// tenant and type expected of them. Returns an errCacheCorrupt error if the file is truncated,
+// can't be decoded, or its checksum doesn't match.
+func loadCacheFile(filePath string, want CacheHeader) (header CacheHeader, data AzureObjectList, err error) {
+	content, err := readMazFile(filePath)
+	if err != nil {
+		return header, nil, err // Unwrapped, so os.IsNotExist(err) works
+	}
+	corrupt := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w %s: %s", errCacheCorrupt, filePath, fmt.Sprintf(format, args...))
+	}
+	if len(content) == 0 {
+		return header, nil, corrupt("file is empty")
+	}
+	if !bytes.HasPrefix(content, cacheFileMagic) {
+		header = want
+		header.SchemaVersion, header.Fields = 1, nil
+		if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+			return header, nil, corrupt("failed to decode headerless file: %v", err)
+		}
+		return header, data, nil
+	}
+
+	content = content[len(cacheFileMagic):]
+	if len(content) < 4 {
+		return header, nil, corrupt("header is truncated")
+	}
+	headLen := binary.BigEndian.Uint32(content)
+	content = content[4:]
+	if uint64(headLen) > uint64(len(content)) {
+		return header, nil, corrupt("header is truncated")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(content[:headLen])).Decode(&header); err != nil {
+		return header, nil, corrupt("failed to decode header: %v", err)
+	}
+	body := content[headLen:]
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != header.Checksum {
+		return header, nil, corrupt("checksum mismatch")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+		return header, nil, corrupt("failed to decode objects: %v", err)
+	}
+	return header, data, nil
+}
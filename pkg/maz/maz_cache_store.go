@@ -0,0 +1,284 @@
+package maz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Object cache storage backends, see SetCacheBackend()
+const (
+	CacheBackendGob  = "gob"  // Whole cache in memory, rewritten to a gob file on each save
+	CacheBackendBolt = "bolt" // Embedded key/value store, written to per object, with indexes
+)
+
+// Object attributes indexed by the bolt backend, besides the ID each object is stored under.
+// Lookups on them are exact and case-insensitive, see Cache.Lookup().
+var CacheIndexes = []string{"appId", "displayName", "userPrincipalName"}
+
+// CacheStore is the storage of a Cache's objects, keyed by their ID, see ExtractID().
+type CacheStore interface {
+	// Opens the stored cache, with an os.IsNotExist error if there is none. An outdated cache
+	// is opened with an errCacheSchema error, and its objects are kept, to be written with the
+	// current header on the next Save().
+	Load() error
+	// Writes pending changes, if the store keeps any in memory. Called with the cache lock
+	// held, see Cache.Save().
+	Save() error
+	Count() (int64, error)
+	// Returns the object with the given ID, or nil
+	Get(id string) (AzureObject, error)
+	// Returns the objects whose attribute equals value, case-insensitively
+	Lookup(index, value string) (AzureObjectList, error)
+	// Calls fn with each object, until it returns false. fn must not change the store.
+	Scan(fn func(obj AzureObject) bool) error
+	// Calls fn with the ID and attribute value of each object that has one, until it returns
+	// false. fn must not change the store.
+	ScanIndex(index string, fn func(id, value string) bool) error
+	// Adds the objects, replacing those with the same ID
+	Put(list AzureObjectList) error
+	// Adds the objects, merging their attributes into those with the same ID, see
+	// MergeAzureObjects()
+	Merge(list AzureObjectList) error
+	Delete(ids utl.StringSet) error
+	Replace(list AzureObjectList) error
+	// Returns the seconds since the store was last written, see utl.FileAge()
+	Age() int64
+	// Removes the stored cache
+	Erase() error
+}
+
+// Sets the storage backend of the local object caches, CacheBackendGob or CacheBackendBolt.
+// An empty name selects the MAZ_CACHE_BACKEND environment variable's value, and gob if that
+// is not set either. The bolt backend suits large tenants: it writes single objects without
+// rewriting the whole cache, and looks objects up by ID, appId, displayName and
+// userPrincipalName without loading the cache into memory. The first time it is used, it
+// imports the existing gob cache of each object type.
+func (m *Config) SetCacheBackend(name string) *Config {
+	m.CacheBackend = strings.ToLower(name)
+	return m
+}
+
+// Returns the selected object cache backend, see SetCacheBackend().
+func (m *Config) cacheBackend() string {
+	if m.CacheBackend != "" {
+		return m.CacheBackend
+	} else if value := os.Getenv("MAZ_CACHE_BACKEND"); value != "" {
+		return strings.ToLower(value)
+	}
+	return CacheBackendGob
+}
+
+// Helper function that returns the selected backend's store for the cache file with the given
+// path, without its extension, holding objects of the given type.
+func newCacheStore(basePath, mazType string, z *Config) (CacheStore, error) {
+	header := newCacheHeader(z.TenantId, mazType)
+	gobStore := &gobCacheStore{filePath: basePath + ".bin", header: header}
+	switch backend := z.cacheBackend(); backend {
+	case CacheBackendGob:
+		return gobStore, nil
+	case CacheBackendBolt:
+		return newBoltCacheStore(basePath+".db", header, gobStore)
+	default:
+		return nil, newError(ErrConfig, "invalid cache backend '%s', use %s or %s", backend,
+			CacheBackendGob, CacheBackendBolt)
+	}
+}
+
+// Store that keeps the whole cache in memory, and writes it to a gob file on Save(). Since
+// other processes may save the same cache in the meantime, the changes made since it was
+// loaded are kept, and are applied again to the file's latest content when it has changed.
+type gobCacheStore struct {
+	filePath string
+	header   CacheHeader // Expected of the file, with its creation time once loaded or saved
+	data     AzureObjectList
+	pending  []gobCacheChange // Changes since the last load or save
+	fileInfo os.FileInfo      // Of the file as last loaded or saved, if at all
+}
+
+// A change to a gob cache: a replacement of all objects, or objects added and removed.
+type gobCacheChange struct {
+	replace bool
+	merge   bool // Merge the put objects into existing ones, rather than replace them
+	put     AzureObjectList
+	delete  utl.StringSet
+}
+
+// Reads the cache file, checking that its header matches the expected one.
+func (s *gobCacheStore) Load() error {
+	info, _ := os.Stat(s.filePath)
+	header, loadedData, err := loadCacheFile(s.filePath, s.header)
+	if err != nil {
+		return err
+	}
+	err = header.check(s.header, s.filePath)
+	if err != nil && !errors.Is(err, errCacheSchema) {
+		return err
+	}
+	s.header.Created = header.Created
+	s.data, s.pending, s.fileInfo = loadedData, nil, info
+	return err
+}
+
+// Writes the cache, after reloading the file and applying the pending changes to it again,
+// if another process saved it since it was loaded. A reloaded file that turns out corrupt or
+// outdated is overwritten.
+func (s *gobCacheStore) Save() error {
+	if info, err := os.Stat(s.filePath); err == nil && (s.fileInfo == nil ||
+		!info.ModTime().Equal(s.fileInfo.ModTime()) || info.Size() != s.fileInfo.Size()) {
+		header, latest, err := loadCacheFile(s.filePath, s.header)
+		if err == nil {
+			err = header.check(s.header, s.filePath)
+		}
+		switch {
+		case errors.Is(err, errCacheSchema) || errors.Is(err, errCacheMismatch) || errors.Is(err, errCacheCorrupt):
+			Logf("Overwriting changed cache: %v\n", err)
+		case err != nil:
+			return fmt.Errorf("failed to reload changed cache: %w", err)
+		default:
+			Logf("Cache %s changed since it was loaded, applying %d changes to it again\n", s.filePath, len(s.pending))
+			s.data = latest
+			for _, change := range s.pending {
+				s.apply(change)
+			}
+		}
+	}
+	if s.header.Created.IsZero() {
+		s.header.Created = time.Now().UTC()
+	}
+	if err := saveCacheFile(s.filePath, s.header, s.data); err != nil {
+		return err
+	}
+	s.pending = nil
+	s.fileInfo, _ = os.Stat(s.filePath)
+	return nil
+}
+
+func (s *gobCacheStore) Count() (int64, error) {
+	return int64(len(s.data)), nil
+}
+
+func (s *gobCacheStore) Get(id string) (AzureObject, error) {
+	if obj := s.data.FindById(id); obj != nil {
+		return *obj, nil
+	}
+	return nil, nil
+}
+
+func (s *gobCacheStore) Lookup(index, value string) (AzureObjectList, error) {
+	if index == "id" {
+		obj, _ := s.Get(value)
+		if obj == nil {
+			return AzureObjectList{}, nil
+		}
+		return AzureObjectList{obj}, nil
+	}
+	list := AzureObjectList{}
+	for _, obj := range s.data {
+		if strings.EqualFold(utl.Str(obj[index]), value) {
+			list = append(list, obj)
+		}
+	}
+	return list, nil
+}
+
+func (s *gobCacheStore) Scan(fn func(obj AzureObject) bool) error {
+	for _, obj := range s.data {
+		if !fn(obj) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *gobCacheStore) ScanIndex(index string, fn func(id, value string) bool) error {
+	for _, obj := range s.data {
+		id, value := ExtractID(obj), utl.Str(obj[index])
+		if id != "" && value != "" && !fn(id, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *gobCacheStore) Put(list AzureObjectList) error {
+	return s.change(gobCacheChange{put: list})
+}
+
+func (s *gobCacheStore) Merge(list AzureObjectList) error {
+	return s.change(gobCacheChange{merge: true, put: list})
+}
+
+func (s *gobCacheStore) Delete(ids utl.StringSet) error {
+	return s.change(gobCacheChange{delete: ids})
+}
+
+func (s *gobCacheStore) Replace(list AzureObjectList) error {
+	s.pending = nil // Earlier changes no longer matter
+	return s.change(gobCacheChange{replace: true, put: list})
+}
+
+// Helper function to apply the given change, and keep it until the next save.
+func (s *gobCacheStore) change(change gobCacheChange) error {
+	s.apply(change)
+	s.pending = append(s.pending, change)
+	return nil
+}
+
+// Helper function to apply the given change to the cache in memory.
+func (s *gobCacheStore) apply(change gobCacheChange) {
+	if change.replace {
+		s.data = change.put
+		return
+	}
+	if len(change.delete) > 0 {
+		newData := make(AzureObjectList, 0, len(s.data))
+		for _, obj := range s.data {
+			if !change.delete.Exists(ExtractID(obj)) {
+				newData = append(newData, obj)
+			}
+		}
+		s.data = newData
+	}
+	if len(change.put) < 1 {
+		return
+	}
+
+	// Fast index for current data
+	existingIndex := make(map[string]int, len(s.data))
+	for i, obj := range s.data {
+		if id := ExtractID(obj); id != "" {
+			existingIndex[id] = i
+		}
+	}
+	for _, obj := range change.put {
+		id := ExtractID(obj)
+		if idx, exists := existingIndex[id]; exists {
+			if change.merge {
+				MergeAzureObjects(obj, s.data[idx])
+			} else {
+				s.data[idx] = obj
+			}
+		} else {
+			existingIndex[id] = len(s.data)
+			s.data = append(s.data, obj)
+		}
+	}
+}
+
+func (s *gobCacheStore) Age() int64 {
+	return utl.FileAge(s.filePath)
+}
+
+func (s *gobCacheStore) Erase() error {
+	s.data, s.pending, s.fileInfo = AzureObjectList{}, nil, nil
+	s.header.Created = time.Time{}
+	if err := os.Remove(s.filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package maz
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/queone/utl"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Helper function that points the object caches at a temporary directory, and returns a
+// configuration using the given cache backend.
+func newTestCacheConfig(t *testing.T, backend string) *Config {
+	t.Helper()
+	saved := MazConfigDir
+	MazConfigDir = t.TempDir()
+	t.Cleanup(func() { MazConfigDir = saved })
+	t.Setenv("MAZ_ENCRYPT_OBJECT_CACHES", "")
+
+	z := NewConfig().SetCacheBackend(backend)
+	z.TenantId = "00000000-0000-0000-0000-000000000001"
+	return z
+}
+
+// Helper function that returns the given directory users.
+func testUsers(names ...string) AzureObjectList {
+	list := AzureObjectList{}
+	for _, name := range names {
+		list = append(list, AzureObject{"id": "id-" + name, "displayName": "User " + name})
+	}
+	return list
+}
+
+// Helper function to get the cache of the given type, failing the test if it can't.
+func mustGetCache(t *testing.T, mazType string, z *Config) *Cache {
+	t.Helper()
+	cache, err := GetCache(mazType, z)
+	if err != nil {
+		t.Fatalf("GetCache() failed: %v", err)
+	}
+	return cache
+}
+
+func TestCacheBackendParity(t *testing.T) {
+	// What each backend ends up with, after the same changes
+	type outcome struct {
+		Count   int64
+		Object  AzureObject
+		Lookup  AzureObjectList
+		Missing AzureObject
+		Names   map[string]string
+	}
+	outcomes := map[string]outcome{}
+	for _, backend := range []string{CacheBackendGob, CacheBackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			z := newTestCacheConfig(t, backend)
+			cache := mustGetCache(t, DirectoryUser, z)
+			if err := cache.Replace(testUsers("a", "b", "c")); err != nil {
+				t.Fatalf("Replace() failed: %v", err)
+			}
+			if err := cache.Upsert(AzureObject{"id": "id-a", "userPrincipalName": "a@example.com"}); err != nil {
+				t.Fatalf("Upsert() failed: %v", err)
+			}
+			cache.Normalize(DirectoryUser, AzureObjectList{
+				{"id": "id-b", "@removed": map[string]interface{}{"reason": "deleted"}},
+				{"id": "id-d", "displayName": "User d"},
+			})
+			if err := cache.Save(); err != nil {
+				t.Fatalf("Save() failed: %v", err)
+			}
+
+			// Read it all back from the stored cache
+			cache = mustGetCache(t, DirectoryUser, z)
+			lookup, err := cache.Lookup("displayName", "USER D")
+			if err != nil {
+				t.Fatalf("Lookup() failed: %v", err)
+			}
+			names, err := cache.IdNameMap()
+			if err != nil {
+				t.Fatalf("IdNameMap() failed: %v", err)
+			}
+			outcomes[backend] = outcome{
+				Count:   cache.Count(),
+				Object:  cache.FindById("id-a"),
+				Lookup:  lookup,
+				Missing: cache.FindById("id-b"),
+				Names:   names,
+			}
+		})
+	}
+
+	want := outcome{
+		Count:  3,
+		Object: AzureObject{"id": "id-a", "displayName": "User a", "userPrincipalName": "a@example.com"},
+		Lookup: AzureObjectList{{"id": "id-d", "displayName": "User d"}},
+		Names:  map[string]string{"id-a": "User a", "id-c": "User c", "id-d": "User d"},
+	}
+	for backend, got := range outcomes {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s backend got %+v, want %+v", backend, got, want)
+		}
+	}
+}
+
+func TestCacheConcurrentSaves(t *testing.T) {
+	for _, backend := range []string{CacheBackendGob, CacheBackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			z := newTestCacheConfig(t, backend)
+			seed := mustGetCache(t, DirectoryUser, z)
+			if err := seed.Replace(testUsers("seed")); err != nil {
+				t.Fatalf("Replace() failed: %v", err)
+			}
+
+			// Hold the cache lock while the writers start, so that they all contend for it
+			lock, err := lockCache(seed.lockPath)
+			if err != nil {
+				t.Fatalf("lockCache() failed: %v", err)
+			}
+			const writers = 8
+			var ready, done sync.WaitGroup
+			ready.Add(writers)
+			for i := 0; i < writers; i++ {
+				done.Add(1)
+				go func(i int) {
+					defer done.Done()
+					ready.Done()
+					cache, err := NewCache(DirectoryUser, z)
+					if err == nil {
+						err = cache.Load()
+					}
+					if err == nil {
+						err = cache.Upsert(testUsers(fmt.Sprint(i))[0])
+					}
+					if err == nil {
+						err = cache.SaveWithDeltaLink(AzureObject{"@odata.deltaLink": fmt.Sprint(i)})
+					}
+					if err != nil {
+						t.Errorf("writer %d failed: %v", i, err)
+					}
+				}(i)
+			}
+			ready.Wait() // Every writer has started, before any can save
+			lock.Unlock()
+			done.Wait()
+
+			cache := mustGetCache(t, DirectoryUser, z)
+			if got := cache.Count(); got != writers+1 {
+				t.Errorf("cache has %d objects, want %d", got, writers+1)
+			}
+			link, err := cache.LoadDeltaLink()
+			if err != nil || link["@odata.deltaLink"] == nil {
+				t.Errorf("LoadDeltaLink() = %v, %v, want the link of one of the writers", link, err)
+			}
+		})
+	}
+}
+
+func TestBoltCacheNotHeldOpen(t *testing.T) {
+	z := newTestCacheConfig(t, CacheBackendBolt)
+	cache := mustGetCache(t, DirectoryUser, z)
+	if err := cache.Replace(testUsers("a")); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+	if cache.FindById("id-a") == nil {
+		t.Fatal("FindById() found no object")
+	}
+
+	// Another process can open the database while the cache is still in use
+	filePath := cache.store.(*boltCacheStore).filePath
+	db, err := bolt.Open(filePath, 0600, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("cache database is held open between operations: %v", err)
+	}
+	db.Close()
+}
+
+func TestCacheRebuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		spoil func(t *testing.T, filePath string, header CacheHeader)
+		keep  bool // Whether the objects are kept, to be synced again in full
+	}{
+		{"outdated schema", func(t *testing.T, filePath string, header CacheHeader) {
+			header.SchemaVersion = CacheSchemaVersion - 1
+			if err := saveCacheFile(filePath, header, testUsers("a")); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"other fields", func(t *testing.T, filePath string, header CacheHeader) {
+			header.Fields = []string{"id"}
+			if err := saveCacheFile(filePath, header, testUsers("a")); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"headerless file", func(t *testing.T, filePath string, _ CacheHeader) {
+			if err := SaveFileBinaryList(filePath, testUsers("a"), 0600, false); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"other tenant", func(t *testing.T, filePath string, header CacheHeader) {
+			header.TenantId = "00000000-0000-0000-0000-000000000002"
+			if err := saveCacheFile(filePath, header, testUsers("a")); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"other type", func(t *testing.T, filePath string, header CacheHeader) {
+			header.MazType = DirectoryGroup
+			if err := saveCacheFile(filePath, header, testUsers("a")); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"checksum mismatch", func(t *testing.T, filePath string, _ CacheHeader) {
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content[len(content)-1] ^= 0xff
+			if err := os.WriteFile(filePath, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"truncated file", func(t *testing.T, filePath string, _ CacheHeader) {
+			if err := os.WriteFile(filePath, cacheFileMagic[:], 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := newTestCacheConfig(t, CacheBackendGob)
+			cache := mustGetCache(t, DirectoryUser, z)
+			if err := cache.Replace(testUsers("a", "b")); err != nil {
+				t.Fatalf("Replace() failed: %v", err)
+			}
+			if err := cache.SaveDeltaLink(AzureObject{"@odata.deltaLink": "link"}); err != nil {
+				t.Fatalf("SaveDeltaLink() failed: %v", err)
+			}
+			store := cache.store.(*gobCacheStore)
+			tt.spoil(t, store.filePath, store.header)
+
+			cache = mustGetCache(t, DirectoryUser, z)
+			want := int64(0)
+			if tt.keep {
+				want = 1
+			}
+			if got := cache.Count(); got != want || cache.resync != tt.keep {
+				t.Errorf("rebuilt cache has %d objects and resync %v, want %d and %v", got, cache.resync,
+					want, tt.keep)
+			}
+			if link, _ := cache.LoadDeltaLink(); link != nil {
+				t.Errorf("rebuilt cache kept delta link %v", link)
+			}
+			header, _, err := loadCacheFile(store.filePath, store.header)
+			if err != nil || header.check(newCacheHeader(z.TenantId, DirectoryUser), store.filePath) != nil {
+				t.Errorf("rebuilt cache file has header %+v, %v", header, err)
+			}
+		})
+	}
+}
+
+func TestBoltCacheRebuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		spoil func(t *testing.T, store *boltCacheStore)
+		keep  bool // Whether the objects are kept, to be synced again in full
+	}{
+		{"outdated schema", func(t *testing.T, store *boltCacheStore) {
+			store.header.SchemaVersion = CacheSchemaVersion - 1
+			if err := store.update(func(tx *bolt.Tx) error { return store.putHeader(tx, boltChecksum{}) }); err != nil {
+				t.Fatalf("putHeader() failed: %v", err)
+			}
+		}, true},
+		{"other tenant", func(t *testing.T, store *boltCacheStore) {
+			store.header.TenantId = "00000000-0000-0000-0000-000000000002"
+			if err := store.update(func(tx *bolt.Tx) error { return store.putHeader(tx, boltObjectsChecksum(tx)) }); err != nil {
+				t.Fatalf("putHeader() failed: %v", err)
+			}
+		}, false},
+		{"checksum mismatch", func(t *testing.T, store *boltCacheStore) {
+			err := store.update(func(tx *bolt.Tx) error {
+				data, err := encodeCacheObject(testUsers("changed")[0])
+				if err != nil {
+					return err
+				}
+				return tx.Bucket([]byte(boltObjectsBucket)).Put([]byte("id-a"), data)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := newTestCacheConfig(t, CacheBackendBolt)
+			cache := mustGetCache(t, DirectoryUser, z)
+			if err := cache.Replace(testUsers("a", "b", "c")); err != nil {
+				t.Fatalf("Replace() failed: %v", err)
+			}
+
+			// The checksum follows the objects changed one at a time
+			if err := cache.store.Put(testUsers("d")); err != nil {
+				t.Fatalf("Put() failed: %v", err)
+			}
+			if err := cache.store.Merge(AzureObjectList{{"id": "id-b", "userPrincipalName": "b@example.com"}}); err != nil {
+				t.Fatalf("Merge() failed: %v", err)
+			}
+			if err := cache.store.Delete(utl.StringSet{"id-c": {}}); err != nil {
+				t.Fatalf("Delete() failed: %v", err)
+			}
+			if got := mustGetCache(t, DirectoryUser, z).Count(); got != 3 {
+				t.Fatalf("reloaded cache has %d objects, want 3", got)
+			}
+			tt.spoil(t, cache.store.(*boltCacheStore))
+
+			cache = mustGetCache(t, DirectoryUser, z)
+			want := int64(0)
+			if tt.keep {
+				want = 3
+			}
+			if got := cache.Count(); got != want || cache.resync != tt.keep {
+				t.Errorf("rebuilt cache has %d objects and resync %v, want %d and %v", got, cache.resync,
+					want, tt.keep)
+			}
+			if got := mustGetCache(t, DirectoryUser, z); got.resync || got.Count() != want {
+				t.Errorf("rebuilt cache reloads with %d objects and resync %v", got.Count(), got.resync)
+			}
+		})
+	}
+}
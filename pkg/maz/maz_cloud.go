@@ -0,0 +1,221 @@
+package maz
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/queone/utl"
+)
+
+// Named Azure cloud environments. The names match the ones used by the Azure CLI.
+const (
+	AzurePublicCloud  = "AzureCloud"
+	AzureUSGovernment = "AzureUSGovernment"
+	AzureChinaCloud   = "AzureChinaCloud"
+	AzureGermanCloud  = "AzureGermanCloud"
+)
+
+// CloudEnvironment holds the endpoints and token issuers of a single Azure cloud.
+type CloudEnvironment struct {
+	Name        string
+	AuthUrl     string   // Authority base URL, with trailing slash
+	MgUrl       string   // MS Graph API base URL, also the Graph token resource
+	AzUrl       string   // ARM API base URL, also the ARM token resource
+	KeyVaultUrl string   // Key Vault data-plane token resource, see AddKeyVaultApi()
+	LogsUrl     string   // Log Analytics query API base URL and token resource, see AddLogAnalyticsApi()
+	MgAudiences []string // Other 'aud' claim values of MS Graph tokens from this cloud
+	AzAudiences []string // Other 'aud' claim values of ARM tokens from this cloud
+	IssuerHosts []string // Hosts that may appear in the 'iss' claim of tokens from this cloud
+}
+
+var (
+	CloudEnvironments = map[string]CloudEnvironment{
+		AzurePublicCloud: {
+			Name:        AzurePublicCloud,
+			AuthUrl:     ConstAuthUrl,
+			MgUrl:       ConstMgUrl,
+			AzUrl:       ConstAzUrl,
+			KeyVaultUrl: "https://vault.azure.net",
+			LogsUrl:     "https://api.loganalytics.io",
+			MgAudiences: []string{MsGraphAppId},
+			AzAudiences: []string{"https://management.core.windows.net"},
+			IssuerHosts: []string{"sts.windows.net", "login.microsoftonline.com"},
+		},
+		AzureUSGovernment: {
+			Name:        AzureUSGovernment,
+			AuthUrl:     "https://login.microsoftonline.us/",
+			MgUrl:       "https://graph.microsoft.us",
+			AzUrl:       "https://management.usgovcloudapi.net",
+			KeyVaultUrl: "https://vault.usgovcloudapi.net",
+			LogsUrl:     "https://api.loganalytics.us",
+			MgAudiences: []string{"https://dod-graph.microsoft.us"},
+			AzAudiences: []string{"https://management.core.usgovcloudapi.net"},
+			IssuerHosts: []string{"sts.windows.net", "login.microsoftonline.us"},
+		},
+		AzureChinaCloud: {
+			Name:        AzureChinaCloud,
+			AuthUrl:     "https://login.chinacloudapi.cn/",
+			MgUrl:       "https://microsoftgraph.chinacloudapi.cn",
+			AzUrl:       "https://management.chinacloudapi.cn",
+			KeyVaultUrl: "https://vault.azure.cn",
+			LogsUrl:     "https://api.loganalytics.azure.cn",
+			AzAudiences: []string{"https://management.core.chinacloudapi.cn"},
+			IssuerHosts: []string{"sts.chinacloudapi.cn", "login.chinacloudapi.cn"},
+		},
+		AzureGermanCloud: {
+			Name:        AzureGermanCloud,
+			AuthUrl:     "https://login.microsoftonline.de/",
+			MgUrl:       "https://graph.microsoft.de",
+			AzUrl:       "https://management.microsoftazure.de",
+			KeyVaultUrl: "https://vault.microsoftazure.de",
+			AzAudiences: []string{"https://management.core.cloudapi.de"},
+			IssuerHosts: []string{"sts.microsoftonline.de", "login.microsoftonline.de"},
+		},
+	}
+
+	// Short aliases accepted for the cloud setting, all in lowercase
+	cloudAliases = map[string]string{
+		"azurecloud":        AzurePublicCloud,
+		"public":            AzurePublicCloud,
+		"azureusgovernment": AzureUSGovernment,
+		"usgov":             AzureUSGovernment,
+		"azurechinacloud":   AzureChinaCloud,
+		"china":             AzureChinaCloud,
+		"azuregermancloud":  AzureGermanCloud,
+		"germany":           AzureGermanCloud,
+	}
+)
+
+// Well-known MS Graph application ID, which some tokens carry as their 'aud' claim
+const MsGraphAppId = "00000003-0000-0000-c000-000000000000"
+
+// Returns the canonical cloud environment name for the given name or alias. A blank
+// name resolves to the public cloud.
+func ResolveCloudName(name string) (string, error) {
+	if name == "" {
+		return AzurePublicCloud, nil
+	}
+	if canonical, ok := cloudAliases[strings.ToLower(name)]; ok {
+		return canonical, nil
+	}
+	return "", fmt.Errorf("unknown cloud environment %q", name)
+}
+
+// Sets the cloud environment, switching the authority, MS Graph and ARM base URLs to
+// those of the given cloud. Base URLs overridden via SetBaseUrls() are left as is.
+func (m *Config) SetCloud(name string) error {
+	canonical, err := ResolveCloudName(name)
+	if err != nil {
+		return err
+	}
+	prev, env := m.CloudEnv(), CloudEnvironments[canonical]
+	if m.AuthUrl == "" || m.AuthUrl == prev.AuthUrl {
+		m.AuthUrl = env.AuthUrl
+	}
+	if m.MgUrl == "" || m.MgUrl == prev.MgUrl {
+		m.MgUrl = env.MgUrl
+	}
+	if m.AzUrl == "" || m.AzUrl == prev.AzUrl {
+		m.AzUrl = env.AzUrl
+	}
+	m.Cloud = canonical
+	return nil
+}
+
+// Returns the configured cloud environment, defaulting to the public cloud.
+func (m *Config) CloudEnv() CloudEnvironment {
+	if env, ok := CloudEnvironments[m.Cloud]; ok {
+		return env
+	}
+	return CloudEnvironments[AzurePublicCloud]
+}
+
+// Returns the MSAL scope for the ARM API in the configured cloud.
+func (m *Config) AzScope() []string {
+	return []string{m.CloudEnv().AzUrl + "/.default"}
+}
+
+// Returns the MSAL scope for the MS Graph API in the configured cloud.
+func (m *Config) MgScope() []string {
+	return []string{m.CloudEnv().MgUrl + "/.default"}
+}
+
+// Applies the cloud environment setting. The MAZ_CLOUD environment variable has
+// precedence over the given value, which usually comes from the credentials file.
+func setupCloudEnvironment(fileValue string, z *Config) error {
+	name, source := fileValue, "credentials file parameter 'cloud'"
+	if envValue := os.Getenv("MAZ_CLOUD"); envValue != "" {
+		name, source = envValue, "environment variable MAZ_CLOUD"
+	}
+	if err := z.SetCloud(name); err != nil {
+		return wrapError(ErrConfig, err, "the %s is invalid", source)
+	}
+	Logf("Using cloud environment %s\n", utl.Cya(z.Cloud))
+	return nil
+}
+
+// Returns the 'cloud' line for a new credentials file, taken from the MAZ_CLOUD
+// environment variable. The line is omitted for the public cloud.
+func credsFileCloudLine() (string, error) {
+	name, err := ResolveCloudName(os.Getenv("MAZ_CLOUD"))
+	if err != nil {
+		return "", wrapError(ErrConfig, err, "the environment variable MAZ_CLOUD is invalid")
+	}
+	if name == AzurePublicCloud {
+		return "", nil
+	}
+	return fmt.Sprintf("%-14s %s\n", "cloud:", name), nil
+}
+
+// Returns the cloud environment whose ARM or MS Graph audience matches the given
+// 'aud' claim, along with the corresponding API token type.
+func cloudForAudience(aud string) (CloudEnvironment, string, bool) {
+	aud = strings.TrimRight(aud, "/")
+	for _, env := range CloudEnvironments {
+		if aud == env.AzUrl || slices.Contains(env.AzAudiences, aud) {
+			return env, AzApiToken, true
+		}
+		if aud == env.MgUrl || slices.Contains(env.MgAudiences, aud) {
+			return env, MgApiToken, true
+		}
+	}
+	return CloudEnvironment{}, UnknownApiToken, false
+}
+
+// Reports whether the issuer URL belongs to one of the known Azure clouds.
+func isKnownIssuer(iss string) bool {
+	u, err := url.Parse(iss)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, env := range CloudEnvironments {
+		if slices.Contains(env.IssuerHosts, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the scope targets the MS Graph API of any known cloud.
+func isMgScope(scope string) bool {
+	for _, env := range CloudEnvironments {
+		if strings.HasPrefix(scope, env.MgUrl) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the scope targets the ARM API of any known cloud.
+func isAzScope(scope string) bool {
+	for _, env := range CloudEnvironments {
+		if strings.HasPrefix(scope, env.AzUrl) {
+			return true
+		}
+	}
+	return false
+}
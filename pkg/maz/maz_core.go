@@ -21,11 +21,15 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/queone/utl"
@@ -43,7 +47,9 @@ const (
 	UnknownApiToken = "UnknownApiToken"
 
 	ConstAzPowerShellClientId = "1950a258-227b-4e31-a9cf-717495945fc2" // 'Microsoft Azure PowerShell'
-	//ConstAzPowerShellClientId = "04b07795-8ddb-461a-bbee-02f9e1bf7b46" // 'Microsoft Azure CLI'
+	ConstAzCliClientId        = "04b07795-8ddb-461a-bbee-02f9e1bf7b46" // 'Microsoft Azure CLI', see GetTokenFromAzureCli()
+
+	ConstHttpTimeout = 30 // Seconds, default timeout for the shared API HTTP client
 
 	ConstMgCacheFileAgePeriod = 1800  // Half hour
 	ConstAzCacheFileAgePeriod = 86400 // One day
@@ -67,7 +73,8 @@ const (
 )
 
 var (
-	MazConfigDir string // Global configuration directory, see init()
+	MazConfigDir    string // Global configuration directory, see init()
+	mazConfigDirErr error  // Set if MazConfigDir could not be determined
 
 	MazTypes = []string{
 		ResRoleDefinition,
@@ -118,48 +125,83 @@ var (
 		DirRoleAssignment: "/v1.0/roleManagement/directory/roleAssignments",
 	}
 	mazEnvironmentVars = map[string]string{
-		"MAZ_TENANT_ID":     "",
-		"MAZ_USERNAME":      "",
-		"MAZ_INTERACTIVE":   "",
-		"MAZ_CLIENT_ID":     "",
-		"MAZ_CLIENT_SECRET": "",
-		"MAZ_MG_TOKEN":      "",
-		"MAZ_AZ_TOKEN":      "",
+		"MAZ_TENANT_ID":            "",
+		"MAZ_USERNAME":             "",
+		"MAZ_INTERACTIVE":          "",
+		"MAZ_MANAGED_IDENTITY":     "",
+		"MAZ_CLIENT_ID":            "",
+		"MAZ_CLIENT_SECRET":        "",
+		"MAZ_CLIENT_CERT":          "",
+		"MAZ_FEDERATED_TOKEN_FILE": "",
+		"MAZ_MG_TOKEN":             "",
+		"MAZ_AZ_TOKEN":             "",
 	}
 )
 
 // Config holds configuration and credentials for various APIs and the calling programs themselves.
 type Config struct {
-	TenantId     string
-	ClientId     string
-	ClientSecret string
-	Interactive  bool
-	Username     string
+	TenantId                string
+	ClientId                string
+	ClientSecret            string
+	ClientCert              string // PEM or PFX certificate file, used instead of ClientSecret if set
+	ClientCertPassword      string // Password of an encrypted ClientCert, if any
+	FederatedTokenFile      string // OIDC token file for workload identity federation, used instead of ClientCert or ClientSecret if set
+	Interactive             bool
+	ManagedIdentity         bool   // Get tokens from the managed identity endpoint, with ClientId for a user-assigned one
+	ManagedIdentityEndpoint string // Overrides the IMDS token endpoint, see GetTokenByManagedIdentity
+	Username                string
+	Cloud                   string            // Cloud environment name, see CloudEnvironments
+	Profile                 string            // Credentials file profile, see SetProfile()
+	CredentialChain         []string          // Token sources tried in order, see SetCredentialChain()
+	TokenSources            map[string]string // Chain link that produced each token, keyed by AzApiToken or MgApiToken
+	CacheBackend            string            // Object cache storage, see SetCacheBackend()
+	// --- HTTP client and API base URLs, see NewConfig() for defaults
+	HttpClient *http.Client       // Shared by all API and MSAL calls, to reuse connection pools
+	AuthUrl    string             // Authority base URL, with trailing slash
+	MgUrl      string             // MS Graph API base URL, without trailing slash
+	AzUrl      string             // ARM API base URL, without trailing slash
+	Retry      RetryPolicy        // Retrying of throttled API calls, see RetryPolicy
+	Lro        LroPolicy          // Polling of ARM long-running operations, see LroPolicy
+	cassette   *cassetteTransport // Recording or replaying API calls, see UseCassette()
+	// --- Mid-run token refreshing, see refreshApiToken()
+	tokenMu       sync.RWMutex      // Guards the tokens and headers below
+	refreshMu     sync.Mutex        // Serializes token refreshes
+	refreshFailed map[string]string // Tokens that could not be refreshed, by token type
+	refreshing    bool              // Set while refreshing, so no interactive login is attempted
+	refreshClaims string            // Claims challenge to pass to MSAL while refreshing
 	// --- For MS Graph API
 	MgToken   string
 	MgHeaders map[string]string
 	// --- For ARM API
 	AzToken   string
 	AzHeaders map[string]string
-	// --- Add other API token/headers here...
+	// --- For add-on APIs, see AddApi()
+	addOnApis   map[string]string      // Scope of each add-on API, by base URL
+	addOnTokens map[string]*addOnToken // Token and headers of each add-on API scope
 }
 
-// Initialize MazConfigDir to the user's home directory in a cross-platform way.
+// Initialize MazConfigDir to the user's home directory in a cross-platform way. The
+// directory itself is created on first use, see ensureMazConfigDir().
 func init() {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		utl.Die("Could not determine user home directory: %v", err)
+		mazConfigDirErr = wrapError(ErrConfig, err, "could not determine user home directory")
+		return
 	}
-
 	MazConfigDir = filepath.Join(homeDir, ConfigBaseDir)
+}
 
-	// Ensure the configuration directory exists
+// Ensures the configuration directory exists
+func ensureMazConfigDir() error {
+	if mazConfigDirErr != nil {
+		return mazConfigDirErr
+	}
 	if _, err := os.Stat(MazConfigDir); os.IsNotExist(err) {
 		if err := os.Mkdir(MazConfigDir, 0700); err != nil {
-			utl.Die("Failed to create '%s' config directory: %v",
-				utl.Yel(MazConfigDir), err)
+			return wrapError(ErrFile, err, "failed to create '%s' config directory", MazConfigDir)
 		}
 	}
+	return nil
 }
 
 func PrintRuntimeInfo() {
@@ -175,52 +217,104 @@ func PrintRuntimeInfo() {
 // credentials, tokens, and other API-related details for the application.
 func NewConfig() *Config {
 	return &Config{
-		MgHeaders: make(map[string]string),
-		AzHeaders: make(map[string]string),
+		Cloud:        AzurePublicCloud,
+		HttpClient:   &http.Client{Timeout: time.Second * ConstHttpTimeout},
+		AuthUrl:      ConstAuthUrl,
+		MgUrl:        ConstMgUrl,
+		AzUrl:        ConstAzUrl,
+		Retry:        DefaultRetryPolicy(),
+		Lro:          DefaultLroPolicy(),
+		TokenSources: make(map[string]string),
+		MgHeaders:    make(map[string]string),
+		AzHeaders:    make(map[string]string),
+	}
+}
+
+// Sets the HTTP client used for all API and MSAL calls.
+func (m *Config) SetHttpClient(client *http.Client) *Config {
+	m.HttpClient = client
+	return m
+}
+
+// Sets the HTTP transport (RoundTripper) of the shared HTTP client. Useful for pointing
+// the library at a local fake, or for tuning connection pooling.
+func (m *Config) SetHttpTransport(transport http.RoundTripper) *Config {
+	m.httpClient().Transport = transport
+	return m
+}
+
+// Overrides the authority, MS Graph and ARM API base URLs. Blank values are left as is.
+func (m *Config) SetBaseUrls(authUrl, mgUrl, azUrl string) *Config {
+	if authUrl != "" {
+		m.AuthUrl = strings.TrimRight(authUrl, "/") + "/"
+	}
+	if mgUrl != "" {
+		m.MgUrl = strings.TrimRight(mgUrl, "/")
+	}
+	if azUrl != "" {
+		m.AzUrl = strings.TrimRight(azUrl, "/")
+	}
+	return m
+}
+
+// Returns the shared HTTP client, creating the default one if it was never set.
+func (m *Config) httpClient() *http.Client {
+	if m.HttpClient == nil {
+		m.HttpClient = &http.Client{Timeout: time.Second * ConstHttpTimeout}
 	}
+	return m.HttpClient
+}
+
+// Reports whether the authority URL has been overridden from the cloud environment default.
+func (m *Config) hasCustomAuthority() bool {
+	return m.AuthUrl != "" && m.AuthUrl != m.CloudEnv().AuthUrl
 }
 
 // Adds a Microsoft Graph API header.
 func (m *Config) AddMgHeader(key, value string) *Config {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
 	m.MgHeaders[key] = value
 	return m
 }
 
 // Adds an Azure Resource Management API header.
 func (m *Config) AddAzHeader(key, value string) *Config {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
 	m.AzHeaders[key] = value
 	return m
 }
 
-// Deletes current credentials and token files
-func DeleteCurrentCredentials() {
-	utl.RemoveFile(filepath.Join(MazConfigDir, TokenCacheFile))  // Remove token file
-	utl.RemoveFile(filepath.Join(MazConfigDir, CredentialsFile)) // Remove credentials file
-	os.Exit(0)
+// Deletes current credentials and token files, including the token files of all profiles
+func DeleteCurrentCredentials() error {
+	ext := filepath.Ext(TokenCacheFile)
+	profileTokenFiles, _ := filepath.Glob(filepath.Join(MazConfigDir, strings.TrimSuffix(TokenCacheFile, ext)+"_*"+ext))
+	for _, name := range []string{TokenCacheFile, CredentialsFile} {
+		profileTokenFiles = append(profileTokenFiles, filepath.Join(MazConfigDir, name))
+	}
+	for _, file := range profileTokenFiles {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return wrapError(ErrFile, err, "failed to remove %s", filepath.Base(file))
+		}
+	}
+	return nil
 }
 
 // Purges the cache files for given maz object type(s)
-func PurgeMazObjectCacheFiles(mazType string, z *Config) {
-	var hasError bool // Flag to track if any errors occurred
+func PurgeMazObjectCacheFiles(mazType string, z *Config) error {
+	mazTypes := []string{mazType}
 	if mazType == AllMazObjects {
-		for mazType, mazTypeName := range MazTypeNames {
-			hasError = true // Set the flag to true if an error occurs
-			if err := PurgeCacheFiles(mazType, z); err != nil {
-				fmt.Printf("Error removing %s cache files: %v\n", utl.Red(mazTypeName), err)
-			}
-		}
-	} else {
-		if err := PurgeCacheFiles(mazType, z); err != nil {
-			hasError = true
-			fmt.Printf("Error removing %s cache files: %v\n", utl.Red(MazTypeNames[mazType]), err)
-		}
+		mazTypes = MazTypes
 	}
-
-	if hasError {
-		os.Exit(1) // Exit with code 1 if any errors occurred
-	} else {
-		os.Exit(0) // Exit with code 0 if everything was successful
+	var errs []error
+	for _, t := range mazTypes {
+		if err := PurgeCacheFiles(t, z); err != nil {
+			errs = append(errs, wrapError(ErrFile, err, "error removing %s cache files", MazTypeNames[t]))
+		}
 	}
+	return errors.Join(errs...)
 }
 
 // Converts C:\path\to\file to /c/path/to/file for Git Bash display compatibility
@@ -236,7 +330,7 @@ func normalizeFilePath(p string) string {
 }
 
 // Dumps configured login values
-func DumpLoginValues(z *Config) {
+func DumpLoginValues(z *Config) error {
 	fmt.Printf("%s: %s  %s\n", utl.Blu("config_dir"), utl.Gre(MazConfigDir),
 		utl.Gra("# Config and cache directory"))
 
@@ -247,73 +341,182 @@ func DumpLoginValues(z *Config) {
 		"  # 2. Credentials supplied via environment variables have precedence over those\n" +
 		"  #    provided via credentials file.\n" +
 		"  # 3. The MAZ_USERNAME + MAZ_INTERACTIVE combo have priority over the MAZ_CLIENT_ID\n" +
-		"  #    + MAZ_CLIENT_SECRET combination.\n"
+		"  #    + MAZ_CLIENT_SECRET combination. MAZ_CLIENT_CERT, a PEM or PFX certificate file,\n" +
+		"  #    with optional MAZ_CLIENT_CERT_PASSWORD, has priority over MAZ_CLIENT_SECRET.\n" +
+		"  #    MAZ_FEDERATED_TOKEN_FILE, an OIDC token file for workload identity federation, has\n" +
+		"  #    priority over both. AZURE_FEDERATED_TOKEN_FILE is used if none of the 3 are set.\n" +
+		"  # 4. MAZ_MANAGED_IDENTITY=true gets tokens from the Azure managed identity endpoint,\n" +
+		"  #    for the user-assigned identity in MAZ_CLIENT_ID if set. MAZ_MANAGED_IDENTITY_ENDPOINT\n" +
+		"  #    overrides the IMDS endpoint. It has priority over all but the interactive login.\n" +
+		"  # 5. MAZ_CLOUD selects the cloud environment, and overrides the credentials file\n" +
+		"  #    'cloud' parameter. Default is AzureCloud.\n" +
+		"  # 6. MAZ_PROFILE selects the credentials file profile, instead of its default one.\n" +
+		"  # 7. MAZ_CREDENTIAL_CHAIN, e.g. 'env,azurecli,managed_identity,interactive', or 'default'\n" +
+		"  #    for that chain, tries each of those token sources in turn instead of the above login.\n" +
+		"  # 8. MAZ_CACHE_KEY, a passphrase, or MAZ_CACHE_KEYFILE encrypt the token caches and the\n" +
+		"  #    credentials file, and with MAZ_ENCRYPT_OBJECT_CACHES=true the object caches too.\n" +
+		"  # 9. MAZ_CACHE_BACKEND=bolt keeps the object caches in an indexed key/value store,\n" +
+		"  #    instead of the default gob files, for large tenants.\n"
 	fmt.Print(utl.Gra(comment))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_TENANT_ID"), utl.Gre(os.Getenv("MAZ_TENANT_ID")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_USERNAME"), utl.Gre(os.Getenv("MAZ_USERNAME")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_INTERACTIVE"), utl.Mag(os.Getenv("MAZ_INTERACTIVE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MANAGED_IDENTITY"), utl.Mag(os.Getenv("MAZ_MANAGED_IDENTITY")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MANAGED_IDENTITY_ENDPOINT"), utl.Gre(os.Getenv("MAZ_MANAGED_IDENTITY_ENDPOINT")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_ID"), utl.Gre(os.Getenv("MAZ_CLIENT_ID")))
-	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_SECRET"), utl.Gre(os.Getenv("MAZ_CLIENT_SECRET")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_SECRET"), utl.Gre(redactSecret(os.Getenv("MAZ_CLIENT_SECRET"))))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_CERT"), utl.Gre(os.Getenv("MAZ_CLIENT_CERT")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_CERT_PASSWORD"), utl.Gre(redactSecret(os.Getenv("MAZ_CLIENT_CERT_PASSWORD"))))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_FEDERATED_TOKEN_FILE"), utl.Gre(os.Getenv("MAZ_FEDERATED_TOKEN_FILE")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MG_TOKEN"), utl.Gre(os.Getenv("MAZ_MG_TOKEN")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_AZ_TOKEN"), utl.Gre(os.Getenv("MAZ_AZ_TOKEN")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLOUD"), utl.Gre(os.Getenv("MAZ_CLOUD")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_PROFILE"), utl.Gre(os.Getenv("MAZ_PROFILE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CREDENTIAL_CHAIN"), utl.Gre(os.Getenv("MAZ_CREDENTIAL_CHAIN")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CACHE_KEY"), utl.Gre(redactSecret(os.Getenv("MAZ_CACHE_KEY"))))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CACHE_KEYFILE"), utl.Gre(os.Getenv("MAZ_CACHE_KEYFILE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_ENCRYPT_OBJECT_CACHES"), utl.Mag(os.Getenv("MAZ_ENCRYPT_OBJECT_CACHES")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CACHE_BACKEND"), utl.Gre(os.Getenv("MAZ_CACHE_BACKEND")))
+
+	if err := dumpCredentialChain(z); err != nil {
+		return err
+	}
 
 	fmt.Printf("%s:\n", utl.Blu("config_creds_file"))
 	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
 	fmt.Printf("  %s: %s\n", utl.Blu("file_path"), utl.Gre(normalizeFilePath(credsFile)))
-	credsRaw, err := utl.LoadFileYaml(credsFile)
-	if err != nil {
-		utl.Die("  %s\n", utl.Red("Credentials file does not yest exist."))
+	credsRaw, err := loadCredsFile(credsFile)
+	if os.IsNotExist(err) {
+		return newError(ErrFile, "credentials file does not yet exist")
+	} else if err != nil {
+		return err
 	}
-	if creds := utl.Map(credsRaw); creds != nil {
-		fmt.Printf("  %s: %s\n", utl.Blu("tenant_id"), utl.Gre(utl.Str(creds["tenant_id"])))
-		if utl.Bool(creds["interactive"]) {
-			fmt.Printf("  %s: %s\n", utl.Blu("username"), utl.Gre(utl.Str(creds["username"])))
-			fmt.Printf("  %s: %s\n", utl.Blu("interactive"), utl.Mag("true"))
-		} else {
-			fmt.Printf("  %s: %s\n", utl.Blu("client_id"), utl.Gre(utl.Str(creds["client_id"])))
-			fmt.Printf("  %s: %s\n", utl.Blu("client_secret"), utl.Gre(utl.Str(creds["client_secret"])))
+	creds := utl.Map(credsRaw)
+	if creds == nil {
+		return newError(ErrFile, "error reading credentials file")
+	}
+	profiles := utl.Map(creds[profilesKey])
+	if creds, err = selectProfile(creds, z); err != nil {
+		return err
+	}
+	if profiles != nil {
+		fmt.Printf("  %s: %s  %s\n", utl.Blu("profile"), utl.Gre(z.Profile),
+			utl.Gra(fmt.Sprintf("# Of %d profiles, see -idl", len(profiles))))
+	}
+	fmt.Printf("  %s: %s\n", utl.Blu("tenant_id"), utl.Gre(utl.Str(creds["tenant_id"])))
+	if utl.Bool(creds["interactive"]) {
+		fmt.Printf("  %s: %s\n", utl.Blu("username"), utl.Gre(utl.Str(creds["username"])))
+		fmt.Printf("  %s: %s\n", utl.Blu("interactive"), utl.Mag("true"))
+	} else if utl.Bool(creds["managed_identity"]) {
+		fmt.Printf("  %s: %s\n", utl.Blu("managed_identity"), utl.Mag("true"))
+		if clientId := utl.Str(creds["client_id"]); clientId != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_id"), utl.Gre(clientId))
+		}
+		if endpoint := utl.Str(creds["managed_identity_endpoint"]); endpoint != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("managed_identity_endpoint"), utl.Gre(endpoint))
 		}
 	} else {
-		utl.Die("  %s\n", utl.Red("Error reading credentials file."))
+		fmt.Printf("  %s: %s\n", utl.Blu("client_id"), utl.Gre(utl.Str(creds["client_id"])))
+		if tokenFile := utl.Str(creds["federated_token_file"]); tokenFile != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("federated_token_file"), utl.Gre(normalizeFilePath(tokenFile)))
+		} else if cert := utl.Str(creds["client_cert"]); cert != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_cert"), utl.Gre(normalizeFilePath(cert)))
+			if password := utl.Str(creds["client_cert_password"]); password != "" {
+				fmt.Printf("  %s: %s\n", utl.Blu("client_cert_password"), utl.Gre(redactSecret(password)))
+			}
+		} else {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_secret"), utl.Gre(redactSecret(utl.Str(creds["client_secret"]))))
+		}
+	}
+	if cloud := utl.Str(creds["cloud"]); cloud != "" {
+		fmt.Printf("  %s: %s\n", utl.Blu("cloud"), utl.Gre(cloud))
 	}
-	os.Exit(0)
+	if chain := credentialChainValue(creds["credential_chain"]); len(chain) > 0 {
+		fmt.Printf("  %s: %s\n", utl.Blu("credential_chain"), utl.Gre(strings.Join(chain, ", ")))
+	}
+	return nil
+}
+
+// Helper function that returns a placeholder for the given secret if it is set, so that login
+// value dumps show whether it is, but never any part of it.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return partiallyRedactToken("")
 }
 
 // Configure maz credentials file for interactive login
-func ConfigureCredsFileForInterativeLogin(z *Config) {
+func ConfigureCredsFileForInterativeLogin(z *Config) error {
 	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error. TENANT_ID is an invalid UUID.\n")
+		return newError(ErrValidation, "TENANT_ID is an invalid UUID")
 	}
 	content := fmt.Sprintf("%-14s %s\n%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId,
 		"username:", z.Username, "interactive:", "true")
-	if err := os.WriteFile(credsFile, []byte(content), 0600); err != nil { // Write string to file
-		panic(err.Error())
-	}
-	fmt.Printf("Updated %s file\n", utl.Yel(credsFile))
-	os.Exit(0)
+	return writeCredsFile(credsFile, content, z)
 }
 
-// Configure maz credentials file for automated client_id/secret login
-func ConfigureCredsFileForAutomatedLogin(z *Config) {
+// Configure maz credentials file for automated login, with either a client_id/secret or,
+// if z.FederatedTokenFile or z.ClientCert is set, a client_id/federated token or certificate
+func ConfigureCredsFileForAutomatedLogin(z *Config) error {
 	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error. TENANT_ID is an invalid UUID.\n")
+		return newError(ErrValidation, "TENANT_ID is an invalid UUID")
 	}
 	if !utl.ValidUuid(z.ClientId) {
-		utl.Die("Error. CLIENT_ID is an invalid UUID.\n")
+		return newError(ErrValidation, "CLIENT_ID is an invalid UUID")
 	}
-	content := fmt.Sprintf("%-14s %s\n%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId,
-		"client_id:", z.ClientId, "client_secret:", z.ClientSecret)
-	if err := os.WriteFile(credsFile, []byte(content), 0600); err != nil { // Write string to file
-		panic(err.Error())
+	if z.FederatedTokenFile != "" {
+		tokenFile, err := filepath.Abs(z.FederatedTokenFile)
+		if err != nil {
+			return wrapError(ErrFile, err, "invalid federated token file path %s", z.FederatedTokenFile)
+		}
+		if _, err := readFederatedToken(tokenFile); err != nil {
+			return err
+		}
+		content := fmt.Sprintf("%-21s %s\n%-21s %s\n%-21s %s\n", "tenant_id:", z.TenantId,
+			"client_id:", z.ClientId, "federated_token_file:", tokenFile)
+		return writeCredsFile(credsFile, content, z)
+	}
+	if z.ClientCert == "" {
+		content := fmt.Sprintf("%-14s %s\n%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId,
+			"client_id:", z.ClientId, "client_secret:", z.ClientSecret)
+		return writeCredsFile(credsFile, content, z)
+	}
+
+	// Store the absolute certificate path, after making sure it can actually be used
+	certFile, err := filepath.Abs(z.ClientCert)
+	if err != nil {
+		return wrapError(ErrFile, err, "invalid certificate path %s", z.ClientCert)
+	}
+	if _, err := NewCertCredential(certFile, z.ClientCertPassword); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%-21s %s\n%-21s %s\n%-21s %s\n", "tenant_id:", z.TenantId,
+		"client_id:", z.ClientId, "client_cert:", certFile)
+	if z.ClientCertPassword != "" {
+		content += fmt.Sprintf("%-21s %s\n", "client_cert_password:", z.ClientCertPassword)
+	}
+	return writeCredsFile(credsFile, content, z)
+}
+
+// Helper function to write new login values to the credentials file, adding the MAZ_CLOUD
+// setting if any. They go into the selected profile, see saveCredsProfile().
+func writeCredsFile(credsFile, content string, z *Config) error {
+	cloudLine, err := credsFileCloudLine()
+	if err != nil {
+		return err
 	}
-	fmt.Printf("Updated %s file\n", utl.Yel(credsFile))
-	os.Exit(0)
+	return saveCredsProfile(credsFile, content+cloudLine, z)
 }
 
 // Configure variables and API credentials for maz
-func SetupMazCredentials(z *Config) {
+func SetupMazCredentials(z *Config) error {
+	if err := ensureMazConfigDir(); err != nil {
+		return err
+	}
+
 	// For login credentials precedence is given to environment variables
 
 	// Check if credentials have been provided via environment variables
@@ -327,21 +530,22 @@ func SetupMazCredentials(z *Config) {
 		}
 	}
 	if usingEnvVars {
-		SetupMazCredentialsFromEnvVars(z)
-	} else {
-		SetupMazCredentialsFromFile(z)
+		return SetupMazCredentialsFromEnvVars(z)
 	}
+	return SetupMazCredentialsFromFile(z)
 }
 
 // Configure login credentials from OS environment variables
-func SetupMazCredentialsFromEnvVars(z *Config) {
+func SetupMazCredentialsFromEnvVars(z *Config) error {
 	Logf("Using environment variables for login credentials\n")
 	z.TenantId = mazEnvironmentVars["MAZ_TENANT_ID"]
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error: Environment variable MAZ_TENANT_ID '%s' is not a valid UUID. "+
-			"Cannot continue.\n", z.TenantId)
+		return newError(ErrConfig, "environment variable MAZ_TENANT_ID '%s' is not a valid UUID", z.TenantId)
 	}
 	Logf("1. Environment variable MAZ_TENANT_ID is set to %s\n", utl.Cya(z.TenantId))
+	if err := setupCloudEnvironment("", z); err != nil { // Only MAZ_CLOUD applies here
+		return err
+	}
 
 	// Use API login tokens provided via environment variables
 	z.AzToken = mazEnvironmentVars["MAZ_AZ_TOKEN"]
@@ -355,7 +559,7 @@ func SetupMazCredentialsFromEnvVars(z *Config) {
 		Logf("3. Environment variable MAZ_MG_TOKEN appears to have a valid token: Suffix = %s\n",
 			utl.Cya(GetTokenSuffix(z.MgToken)))
 		Logf("Attempting %s login\n", utl.Cya("automated token-based"))
-		return // Return early since we have all creds for this type of login
+		return nil // Return early since we have all creds for this type of login
 	}
 
 	// Assume the 2 API tokens will be acquired using the other variables, so let's check them
@@ -367,54 +571,84 @@ func SetupMazCredentialsFromEnvVars(z *Config) {
 			Logf("3. Environment variable MAZ_USERNAME is set to %s\n", utl.Cya(z.Username))
 			Logf("Attempting %s login\n", utl.Cya("interactive username"))
 		} else {
-			utl.Die("Error: Environment variable MAZ_USERNAME is blank. Cannot continue " +
-				"with interactive login.\n")
+			return newError(ErrConfig, "environment variable MAZ_USERNAME is blank, cannot continue "+
+				"with interactive login")
 		}
+	} else if z.ManagedIdentity = utl.Bool(mazEnvironmentVars["MAZ_MANAGED_IDENTITY"]); z.ManagedIdentity {
+		Logf("2. Environment variable MAZ_MANAGED_IDENTITY is set to %s\n", utl.Cya(z.ManagedIdentity))
+		z.ClientId = utl.Str(mazEnvironmentVars["MAZ_CLIENT_ID"])
+		z.ManagedIdentityEndpoint = os.Getenv("MAZ_MANAGED_IDENTITY_ENDPOINT")
+		return validateManagedIdentity("environment variable MAZ_CLIENT_ID", z)
 	} else {
 		z.ClientId = utl.Str(mazEnvironmentVars["MAZ_CLIENT_ID"])
 		if !utl.ValidUuid(z.ClientId) {
-			utl.Die("Error: The chosen login method appears to be via environment variables, "+
-				"but variable MAZ_CLIENT_ID '%s' is not a valid UUID. Cannot continue.\n", z.ClientId)
+			return newError(ErrConfig, "the chosen login method appears to be via environment variables, "+
+				"but variable MAZ_CLIENT_ID '%s' is not a valid UUID", z.ClientId)
 		}
 		Logf("2. Environment variable MAZ_CLIENT_ID is set to %s\n", utl.Cya(z.ClientId))
+		z.FederatedTokenFile = utl.Str(mazEnvironmentVars["MAZ_FEDERATED_TOKEN_FILE"])
+		if z.FederatedTokenFile != "" {
+			Logf("3. Environment variable MAZ_FEDERATED_TOKEN_FILE is set to %s\n", utl.Cya(z.FederatedTokenFile))
+			Logf("Attempting %s login\n", utl.Cya("automated client_id/federated token"))
+			return nil
+		}
+		z.ClientCert = utl.Str(mazEnvironmentVars["MAZ_CLIENT_CERT"])
+		if z.ClientCert != "" {
+			z.ClientCertPassword = os.Getenv("MAZ_CLIENT_CERT_PASSWORD")
+			Logf("3. Environment variable MAZ_CLIENT_CERT is set to %s\n", utl.Cya(z.ClientCert))
+			Logf("Attempting %s login\n", utl.Cya("automated client_id/certificate"))
+			return nil
+		}
 		z.ClientSecret = utl.Str(mazEnvironmentVars["MAZ_CLIENT_SECRET"])
 		if z.ClientSecret == "" {
-			utl.Die("Error: The chosen login method appears to be via environment variables, " +
-				"but variable MAZ_CLIENT_SECRET is blank. Cannot continue.\n")
+			// Fall back to the token file that Kubernetes workload identity and others provide
+			if z.FederatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); z.FederatedTokenFile != "" {
+				Logf("3. Environment variable AZURE_FEDERATED_TOKEN_FILE is set to %s\n", utl.Cya(z.FederatedTokenFile))
+				Logf("Attempting %s login\n", utl.Cya("automated client_id/federated token"))
+				return nil
+			}
+			return newError(ErrConfig, "the chosen login method appears to be via environment variables, "+
+				"but none of the variables MAZ_FEDERATED_TOKEN_FILE, MAZ_CLIENT_CERT or MAZ_CLIENT_SECRET is set")
 		}
 		Logf("3. Environment variable MAZ_CLIENT_SECRET has a value.\n")
 		Logf("Attempting %s login\n", utl.Cya("automated client_id/secret"))
 	}
+	return nil
 }
 
 // Configure login credentials from credentials file
-func SetupMazCredentialsFromFile(z *Config) {
+func SetupMazCredentialsFromFile(z *Config) error {
 	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
 	Logf("Using credential file %s\n", utl.Cya(credsFile))
 	if !utl.FileUsable(credsFile) {
-		utl.Die("Error: Credential file is missing!\n")
+		return newError(ErrConfig, "credential file %s is missing", credsFile)
 	}
 	Logf("Credential file exists\n")
 
-	credsRaw, err := utl.LoadFileYaml(credsFile)
+	credsRaw, err := loadCredsFile(credsFile)
 	if err != nil {
-		utl.Die("Error: %s\n", err)
+		return err
 	}
 	Logf("Credential file is valid YAML\n")
 
 	creds := utl.Map(credsRaw)
 	if creds == nil {
-		utl.Die("Error: Credential file %s values are not formatted properly.\n",
-			utl.Red(credsFile))
+		return newError(ErrConfig, "credential file %s values are not formatted properly", credsFile)
+	}
+	if creds, err = selectProfile(creds, z); err != nil {
+		return err
 	}
 	Logf("Credential file parameters/values appear to be formatted properly.\n")
 
 	z.TenantId = utl.Str(creds["tenant_id"])
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error: Credential file %s parameter %s (%s) is not a valid UUID.\n",
-			utl.Red(credsFile), utl.Red("tenant_id"), z.TenantId)
+		return newError(ErrConfig, "credential file %s parameter 'tenant_id' (%s) is not a valid UUID",
+			credsFile, z.TenantId)
 	}
 	Logf("1. Credential file parameter 'tenant_id' is set to %s\n", utl.Cya(z.TenantId))
+	if err := setupCloudEnvironment(utl.Str(creds["cloud"]), z); err != nil { // MAZ_CLOUD overrides it, if set
+		return err
+	}
 
 	z.Interactive = utl.Bool(creds["interactive"])
 	if z.Interactive {
@@ -424,87 +658,170 @@ func SetupMazCredentialsFromFile(z *Config) {
 			Logf("3. Credential file parameter 'username' is set to %s\n", utl.Cya(z.Username))
 			Logf("Attempting %s login\n", utl.Cya("interactive username"))
 		} else {
-			utl.Die("Error: Credential file parameter 'username' is blank. Cannot " +
-				"continue with interactive login.\n")
+			return newError(ErrConfig, "credential file parameter 'username' is blank, cannot "+
+				"continue with interactive login")
 		}
+	} else if z.ManagedIdentity = utl.Bool(creds["managed_identity"]); z.ManagedIdentity {
+		Logf("2. Credential file parameter 'managed_identity' is set to %s\n", utl.Cya(z.ManagedIdentity))
+		z.ClientId = utl.Str(creds["client_id"])
+		z.ManagedIdentityEndpoint = utl.Str(creds["managed_identity_endpoint"])
+		return validateManagedIdentity("credential file parameter 'client_id'", z)
 	} else {
 		z.ClientId = utl.Str(creds["client_id"])
 		if !utl.ValidUuid(z.ClientId) {
-			utl.Die("Error: Credential file parameter %s (%s) is not a valid UUID.\n",
-				utl.Red("client_id"), z.ClientId)
+			return newError(ErrConfig, "credential file parameter 'client_id' (%s) is not a valid UUID",
+				z.ClientId)
 		}
 		Logf("2. Credential file parameter 'client_id' is set to %s\n", utl.Cya(z.ClientId))
 
+		z.FederatedTokenFile = utl.Str(creds["federated_token_file"])
+		if z.FederatedTokenFile != "" {
+			Logf("3. Credential file parameter 'federated_token_file' is set to %s\n", utl.Cya(z.FederatedTokenFile))
+			Logf("Attempting %s login\n", utl.Cya("automated client_id/federated token"))
+			return nil
+		}
+		z.ClientCert = utl.Str(creds["client_cert"])
+		if z.ClientCert != "" {
+			z.ClientCertPassword = utl.Str(creds["client_cert_password"])
+			Logf("3. Credential file parameter 'client_cert' is set to %s\n", utl.Cya(z.ClientCert))
+			Logf("Attempting %s login\n", utl.Cya("automated client_id/certificate"))
+			return nil
+		}
 		z.ClientSecret = utl.Str(creds["client_secret"])
 		if z.ClientSecret == "" {
-			utl.Die("Error: Credential file parameter %s is blank. Cannot continue.\n",
-				utl.Red("client_secret"))
+			return newError(ErrConfig, "credential file parameters 'federated_token_file', 'client_cert' and "+
+				"'client_secret' are all blank")
 		}
 		Logf("3. Credential file parameter 'client_secret' has a value.\n")
 		Logf("Attempting %s login\n", utl.Cya("automated client_id/secret"))
 	}
+	return nil
+}
+
+// Helper function to check the optional user-assigned identity client ID, named by source
+func validateManagedIdentity(source string, z *Config) error {
+	if z.ClientId != "" {
+		if !utl.ValidUuid(z.ClientId) {
+			return newError(ErrConfig, "%s (%s) is not a valid UUID", source, z.ClientId)
+		}
+		Logf("3. Using user-assigned managed identity with client ID %s\n", utl.Cya(z.ClientId))
+	}
+	Logf("Attempting %s login\n", utl.Cya("managed identity"))
+	return nil
 }
 
 // Initializes all necessary global variables and acquires and sets all API tokens.
-func SetupApiTokens(z *Config) {
-	SetupMazCredentials(z) // Set up authentication method and required variables
+func SetupApiTokens(z *Config) error {
+	return SetupApiTokensContext(context.Background(), z)
+}
+
+// Same as SetupApiTokens, but acquires the tokens under the given context, which stops
+// waiting for a login once it is cancelled.
+func SetupApiTokensContext(ctx context.Context, z *Config) error {
+	// Replayed calls need no login, and the cassette already set the tenant ID
+	if z.Replaying() {
+		Logf("Replaying cassette, skipping login\n")
+		redacted := "Bearer " + partiallyRedactToken("")
+		z.AddAzHeader("Authorization", redacted).AddAzHeader("Content-Type", "application/json")
+		z.AddMgHeader("Authorization", redacted).AddMgHeader("Content-Type", "application/json")
+		return nil
+	}
+
+	// A credential chain, if configured, is used instead of the single configured login
+	chain, err := z.credentialChain()
+	if err != nil {
+		return err
+	}
+	if len(chain) > 0 {
+		return setupApiTokensByChain(ctx, chain, z)
+	}
+
+	// Set up authentication method and required variables
+	if err := SetupMazCredentials(z); err != nil {
+		return err
+	}
 
 	// This function must initialize ALL service API tokens. A failure to do so for
-	// any any token will result in the program aborting.
+	// any token is returned as an error.
 
 	// Initialize Azure ARM API token
-	SetupAzureArmToken(z)
+	if err := setupAzureArmToken(ctx, z); err != nil {
+		return err
+	}
 
 	// Initialize MS Graph API token
-	SetupMsGraphToken(z)
+	if err := setupMsGraphToken(ctx, z); err != nil {
+		return err
+	}
 
-	// Other API tokens can be initialized here...
+	// Tokens of add-on APIs are acquired on first use, see AddApi()
+	return nil
 }
 
 // Sets up the Azure Resource Management (ARM) API token
-func SetupAzureArmToken(z *Config) {
+func SetupAzureArmToken(z *Config) error {
+	return setupAzureArmToken(context.Background(), z)
+}
+
+// Helper function that sets up the ARM API token under the given context.
+func setupAzureArmToken(ctx context.Context, z *Config) error {
 	// If token is not valid, then lets acquire a new one
 	if _, err := SplitJWT(z.AzToken); err != nil {
 		Logf("AZ token suffix = %s\n", utl.Cya(GetTokenSuffix(z.AzToken)))
-		scope := []string{ConstAzUrl + "/.default"}
+		scope := z.AzScope()
 		// Appending '/.default' allows using all static and consented permissions of the identity
 		// in use. See learn.microsoft.com/en-us/azure/active-directory/develop/msal-v1-app-scopes
 		var err error
-		z.AzToken, err = GetApiToken(scope, z) // Get the Azure ARM token
+		z.AzToken, err = GetApiTokenContext(ctx, scope, z) // Get the Azure ARM token
 		if err != nil {
-			utl.Die("%s: %v\n", utl.Red("Error"), err)
+			return wrapError(ErrPermissionDenied, err, "failed to acquire Azure ARM token")
 		}
 		Logf("AZ token suffix = %s\n", utl.Cya(GetTokenSuffix(z.AzToken)))
 		// Setup the base API headers; token + content type
 		z.AddAzHeader("Authorization", "Bearer "+z.AzToken).AddAzHeader("Content-Type", "application/json")
 	}
+	return nil
 }
 
 // Sets up the Microsoft Graph API token
-func SetupMsGraphToken(z *Config) {
+func SetupMsGraphToken(z *Config) error {
+	return setupMsGraphToken(context.Background(), z)
+}
+
+// Helper function that sets up the MS Graph API token under the given context.
+func setupMsGraphToken(ctx context.Context, z *Config) error {
 	// If token is not valid, then lets acquire a new one
 	if _, err := SplitJWT(z.MgToken); err != nil {
 		Logf("MG token suffix = %s\n", utl.Cya(GetTokenSuffix(z.MgToken)))
-		scope := []string{ConstMgUrl + "/.default"}
+		scope := z.MgScope()
 		var err error
-		z.MgToken, err = GetApiToken(scope, z) // Get the MS Graph token
+		z.MgToken, err = GetApiTokenContext(ctx, scope, z) // Get the MS Graph token
 		if err != nil {
-			utl.Die("%s: %v\n", utl.Red("Error"), err)
+			return wrapError(ErrPermissionDenied, err, "failed to acquire MS Graph token")
 		}
 		Logf("MG token suffix = %s\n", utl.Cya(GetTokenSuffix(z.MgToken)))
 		// Setup the base API headers; token + content type
 		z.AddMgHeader("Authorization", "Bearer "+z.MgToken).AddMgHeader("Content-Type", "application/json")
 	}
+	return nil
 }
 
-// Acquires an access token for the given API scope using one of two different methods
+// Acquires an access token for the given API scope using one of three different methods
 func GetApiToken(scope []string, z *Config) (string, error) {
+	return GetApiTokenContext(context.Background(), scope, z)
+}
+
+// Same as GetApiToken, but acquires the token under the given context.
+func GetApiTokenContext(ctx context.Context, scope []string, z *Config) (string, error) {
 	if z.Interactive {
 		// User has configured the utility to do interactive username popup browser login
-		return GetTokenInteractively(scope, z)
+		return getTokenInteractively(ctx, scope, z)
+	} else if z.ManagedIdentity {
+		// Running on an Azure resource with a managed identity
+		return getTokenByManagedIdentity(ctx, scope, z.ClientId, z, false)
 	} else {
 		// User has configured the utility to do automated client_id/secret login
-		return GetTokenByCredentials(scope, z)
+		return getTokenByCredentials(ctx, scope, z)
 	}
 }
 
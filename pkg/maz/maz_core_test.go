@@ -0,0 +1,114 @@
+package maz
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestDumpLoginValuesRedactsSecrets(t *testing.T) {
+	saved := MazConfigDir
+	MazConfigDir = t.TempDir()
+	t.Cleanup(func() { MazConfigDir = saved })
+	for _, name := range []string{"MAZ_PROFILE", "MAZ_CREDENTIAL_CHAIN", "MAZ_CACHE_KEYFILE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("MAZ_CLIENT_SECRET", "env-client-secret")
+	t.Setenv("MAZ_CLIENT_CERT_PASSWORD", "env-cert-password")
+	t.Setenv("MAZ_CACHE_KEY", "env-cache-key")
+	t.Cleanup(func() { SetEncryptionKey("", "") })
+
+	tests := []struct {
+		name   string
+		creds  string
+		secret string
+	}{
+		{"client secret", "tenant_id: t\nclient_id: c\nclient_secret: file-client-secret\n", "file-client-secret"},
+		{"certificate password", "tenant_id: t\nclient_id: c\nclient_cert: /cert.pfx\nclient_cert_password: file-cert-password\n",
+			"file-cert-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetEncryptionKey("", "") // The credentials file is written in plain text
+			if err := os.WriteFile(filepath.Join(MazConfigDir, CredentialsFile), []byte(tt.creds), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			out := captureStdout(t, func() { err = DumpLoginValues(NewConfig()) })
+			if err != nil {
+				t.Fatalf("DumpLoginValues() failed: %v", err)
+			}
+			for _, secret := range []string{"env-client-secret", "env-cert-password", "env-cache-key", tt.secret} {
+				if strings.Contains(out, secret) {
+					t.Errorf("DumpLoginValues() printed %q", secret)
+				}
+			}
+			if !strings.Contains(out, partiallyRedactToken("")) {
+				t.Error("DumpLoginValues() does not show that the secrets are set")
+			}
+		})
+	}
+}
+
+func TestDumpCredentialChain(t *testing.T) {
+	saved := MazConfigDir
+	MazConfigDir = t.TempDir()
+	t.Cleanup(func() { MazConfigDir = saved })
+	t.Setenv("MAZ_PROFILE", "")
+	t.Setenv("MAZ_CREDENTIAL_CHAIN", ChainEnvTokens)
+	t.Setenv("MAZ_AZ_TOKEN", testExpiringToken("az", time.Hour))
+	t.Setenv("MAZ_MG_TOKEN", testExpiringToken("mg", time.Hour))
+	creds := "tenant_id: 00000000-0000-0000-0000-000000000001\nusername: user@example.com\ninteractive: true\n"
+	if err := os.WriteFile(filepath.Join(MazConfigDir, CredentialsFile), []byte(creds), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dumping the login values only shows the chain, without acquiring any token
+	z := NewConfig()
+	var err error
+	out := captureStdout(t, func() { err = DumpLoginValues(z) })
+	if err != nil {
+		t.Fatalf("DumpLoginValues() failed: %v", err)
+	}
+	if z.AzToken != "" || z.MgToken != "" || len(z.TokenSources) > 0 {
+		t.Errorf("DumpLoginValues() acquired tokens from %v", z.TokenSources)
+	}
+	if !strings.Contains(out, ChainEnvTokens) || strings.Contains(out, "ms_graph_token") {
+		t.Errorf("DumpLoginValues() printed %q, want only the chain links", out)
+	}
+
+	// Printing the sources acquires the tokens first
+	out = captureStdout(t, func() { err = PrintCredentialChainSources(z) })
+	if err != nil {
+		t.Fatalf("PrintCredentialChainSources() failed: %v", err)
+	}
+	if z.TokenSources[AzApiToken] != ChainEnvTokens || z.TokenSources[MgApiToken] != ChainEnvTokens {
+		t.Errorf("PrintCredentialChainSources() recorded sources %v", z.TokenSources)
+	}
+	if !strings.Contains(out, "ms_graph_token") {
+		t.Errorf("PrintCredentialChainSources() printed %q, want the token sources", out)
+	}
+}
@@ -0,0 +1,341 @@
+package maz
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/queone/utl"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Optional encryption at rest of the token caches, the credentials file and, if
+// MAZ_ENCRYPT_OBJECT_CACHES is true, the object cache files. Files are sealed with NaCl
+// secretbox (XSalsa20 and Poly1305), using either a key derived with scrypt from the
+// MAZ_CACHE_KEY passphrase, or the random key in the MAZ_CACHE_KEYFILE file, see
+// GenerateKeyFile(). Encrypted files start with a magic header, so plain files are still
+// read, and get encrypted the next time they are written, or by MigrateMazFiles().
+//
+// Encrypted file layout: magic, key type, scrypt salt (passphrase keys only), nonce, box.
+const (
+	encMagic          = "MAZENC1"
+	encKeyPassphrase  = 'p'
+	encKeyFile        = 'k'
+	encSaltSize       = 16
+	encNonceSize      = 24
+	encKeySize        = 32
+	encScryptN        = 1 << 15
+	encKeyFileComment = "# maz encryption key, keep it secret and do not lose it\n"
+)
+
+// Key material for encrypting and decrypting maz files.
+type fileCipher struct {
+	passphrase string
+	key        *[encKeySize]byte                       // From the key file, if any
+	salt       [encSaltSize]byte                       // Used for all passphrase encrypted writes
+	derived    map[[encSaltSize]byte]*[encKeySize]byte // Passphrase keys by salt, scrypt is slow
+	mu         sync.Mutex
+}
+
+var (
+	mazCipher       *fileCipher
+	mazCipherErr    error
+	mazCipherLoaded bool
+	mazCipherMu     sync.Mutex
+)
+
+// Sets the passphrase or key file used to encrypt and decrypt maz files, overriding the
+// MAZ_CACHE_KEY and MAZ_CACHE_KEYFILE environment variables. The key file has precedence if
+// both are given, and with neither, new files are written unencrypted.
+func SetEncryptionKey(passphrase, keyFile string) error {
+	mazCipherMu.Lock()
+	defer mazCipherMu.Unlock()
+	mazCipher, mazCipherErr = newFileCipher(passphrase, keyFile)
+	mazCipherLoaded = true
+	return mazCipherErr
+}
+
+// Reports whether maz files are written encrypted.
+func EncryptionEnabled() bool {
+	c, err := getFileCipher()
+	return c != nil && err == nil
+}
+
+// Reports whether the object cache files are also written encrypted.
+func objectCacheEncryption() bool {
+	return EncryptionEnabled() && utl.Bool(os.Getenv("MAZ_ENCRYPT_OBJECT_CACHES"))
+}
+
+// Returns the configured cipher, loading it from the environment on first use, or nil if no
+// key is configured.
+func getFileCipher() (*fileCipher, error) {
+	mazCipherMu.Lock()
+	defer mazCipherMu.Unlock()
+	if !mazCipherLoaded {
+		mazCipher, mazCipherErr = newFileCipher(os.Getenv("MAZ_CACHE_KEY"), os.Getenv("MAZ_CACHE_KEYFILE"))
+		mazCipherLoaded = true
+	}
+	return mazCipher, mazCipherErr
+}
+
+// Helper function to set up a cipher from the given passphrase or key file.
+func newFileCipher(passphrase, keyFile string) (*fileCipher, error) {
+	c := &fileCipher{derived: make(map[[encSaltSize]byte]*[encKeySize]byte)}
+	switch {
+	case keyFile != "":
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	case passphrase != "":
+		c.passphrase = passphrase
+		if _, err := io.ReadFull(rand.Reader, c.salt[:]); err != nil {
+			return nil, wrapError(ErrConfig, err, "error generating encryption salt")
+		}
+	default:
+		return nil, nil
+	}
+	return c, nil
+}
+
+// Helper function to read the base64 key from the given key file, ignoring comment lines.
+func readKeyFile(keyFile string) (*[encKeySize]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, wrapError(ErrConfig, err, "error reading encryption key file %s", keyFile)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != encKeySize {
+			return nil, newError(ErrConfig, "encryption key file %s does not hold a base64 %d-byte key", keyFile, encKeySize)
+		}
+		key := new([encKeySize]byte)
+		copy(key[:], raw)
+		return key, nil
+	}
+	return nil, newError(ErrConfig, "encryption key file %s is empty", keyFile)
+}
+
+// Writes a new random encryption key to the given key file, readable by the owner only, for
+// use with MAZ_CACHE_KEYFILE. An existing file is never overwritten.
+func GenerateKeyFile(keyFile string) error {
+	key := make([]byte, encKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return wrapError(ErrConfig, err, "error generating encryption key")
+	}
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return wrapError(ErrFile, err, "error creating encryption key file")
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s%s\n", encKeyFileComment, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return wrapError(ErrFile, err, "error writing encryption key file %s", keyFile)
+	}
+	fmt.Printf("Created encryption key file %s\n", utl.Yel(keyFile))
+	return nil
+}
+
+// Returns the passphrase key for the given salt, deriving it only once.
+func (c *fileCipher) passphraseKey(salt [encSaltSize]byte) (*[encKeySize]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.derived[salt]; ok {
+		return key, nil
+	}
+	raw, err := scrypt.Key([]byte(c.passphrase), salt[:], encScryptN, 8, 1, encKeySize)
+	if err != nil {
+		return nil, wrapError(ErrConfig, err, "error deriving encryption key")
+	}
+	key := new([encKeySize]byte)
+	copy(key[:], raw)
+	c.derived[salt] = key
+	return key, nil
+}
+
+// Reports whether the given file content is encrypted.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encMagic))
+}
+
+// Returns the given data encrypted with the configured key, or as is if there is none.
+func encryptData(data []byte) ([]byte, error) {
+	c, err := getFileCipher()
+	if err != nil || c == nil {
+		return data, err
+	}
+	var nonce [encNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, wrapError(ErrConfig, err, "error generating encryption nonce")
+	}
+
+	out := []byte(encMagic)
+	key := c.key
+	if key != nil {
+		out = append(out, encKeyFile)
+	} else {
+		if key, err = c.passphraseKey(c.salt); err != nil {
+			return nil, err
+		}
+		out = append(out, encKeyPassphrase)
+		out = append(out, c.salt[:]...)
+	}
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, data, &nonce, key), nil
+}
+
+// Returns the given file content decrypted, or as is if it is not encrypted. The name is
+// only used in errors.
+func decryptData(data []byte, name string) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	c, err := getFileCipher()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, newError(ErrConfig, "%s is encrypted, set MAZ_CACHE_KEY or MAZ_CACHE_KEYFILE", name)
+	}
+
+	data = data[len(encMagic):]
+	if len(data) < 1 {
+		return nil, newError(ErrFile, "%s is not a valid encrypted file", name)
+	}
+	keyType, data := data[0], data[1:]
+	var key *[encKeySize]byte
+	switch keyType {
+	case encKeyFile:
+		if c.key == nil {
+			return nil, newError(ErrConfig, "%s is encrypted with a key file, set MAZ_CACHE_KEYFILE", name)
+		}
+		key = c.key
+	case encKeyPassphrase:
+		if c.passphrase == "" {
+			return nil, newError(ErrConfig, "%s is encrypted with a passphrase, set MAZ_CACHE_KEY", name)
+		}
+		if len(data) < encSaltSize {
+			return nil, newError(ErrFile, "%s is not a valid encrypted file", name)
+		}
+		var salt [encSaltSize]byte
+		copy(salt[:], data)
+		data = data[encSaltSize:]
+		if key, err = c.passphraseKey(salt); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, newError(ErrFile, "%s is not a valid encrypted file", name)
+	}
+	if len(data) < encNonceSize {
+		return nil, newError(ErrFile, "%s is not a valid encrypted file", name)
+	}
+	var nonce [encNonceSize]byte
+	copy(nonce[:], data)
+	plain, ok := secretbox.Open(nil, data[encNonceSize:], &nonce, key)
+	if !ok {
+		return nil, newError(ErrConfig, "cannot decrypt %s, wrong key or damaged file", name)
+	}
+	return plain, nil
+}
+
+// Reads the given maz file, decrypting it if needed.
+func readMazFile(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err // Unwrapped, so os.IsNotExist(err) works
+	}
+	return decryptData(data, filePath)
+}
+
+// Writes the given maz file, encrypting it if a key is configured.
+func writeMazFile(filePath string, data []byte, perm os.FileMode) error {
+	data, err := encryptData(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data, perm)
+}
+
+// Encrypts, or with encrypt false decrypts, the existing token caches and credentials file in
+// MazConfigDir in place, as well as the object cache files if MAZ_ENCRYPT_OBJECT_CACHES is
+// true or when decrypting. Files already in the requested state are left alone. The values of
+// bolt cache databases are migrated one by one, see migrateBoltCache().
+func MigrateMazFiles(encrypt bool) error {
+	if encrypt && !EncryptionEnabled() {
+		if _, err := getFileCipher(); err != nil {
+			return err
+		}
+		return newError(ErrConfig, "no encryption key, set MAZ_CACHE_KEY or MAZ_CACHE_KEYFILE")
+	}
+
+	ext := filepath.Ext(TokenCacheFile)
+	patterns := []string{CredentialsFile, strings.TrimSuffix(TokenCacheFile, ext) + "*" + ext}
+	if !encrypt || objectCacheEncryption() {
+		patterns = append(patterns, "*.bin")
+	}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(MazConfigDir, pattern))
+		if err != nil {
+			return wrapError(ErrFile, err, "error listing files in %s", MazConfigDir)
+		}
+		files = append(files, matches...)
+	}
+
+	action, count := "Encrypted", 0
+	if !encrypt {
+		action = "Decrypted"
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return wrapError(ErrFile, err, "error reading %s", file)
+		}
+		if isEncrypted(data) == encrypt {
+			continue
+		}
+		if encrypt {
+			data, err = encryptData(data)
+		} else {
+			data, err = decryptData(data, file)
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(file, data, 0600); err != nil {
+			return wrapError(ErrFile, err, "error replacing %s", file)
+		}
+		fmt.Printf("%s %s\n", action, utl.Yel(normalizeFilePath(file)))
+		count++
+	}
+
+	if !encrypt || objectCacheEncryption() {
+		dbFiles, err := filepath.Glob(filepath.Join(MazConfigDir, "*.db"))
+		if err != nil {
+			return wrapError(ErrFile, err, "error listing files in %s", MazConfigDir)
+		}
+		for _, file := range dbFiles {
+			changed, err := migrateBoltCache(file, encrypt)
+			if err != nil {
+				return wrapError(ErrFile, err, "error migrating %s", file)
+			}
+			if changed {
+				fmt.Printf("%s %s\n", action, utl.Yel(normalizeFilePath(file)))
+				count++
+			}
+		}
+	}
+	fmt.Printf("%s %d files\n", action, count)
+	return nil
+}
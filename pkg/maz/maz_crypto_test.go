@@ -0,0 +1,174 @@
+package maz
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper function that configures the given passphrase or key file for the rest of the test.
+func useTestKey(t *testing.T, passphrase, keyFile string) {
+	t.Helper()
+	if err := SetEncryptionKey(passphrase, keyFile); err != nil {
+		t.Fatalf("SetEncryptionKey() failed: %v", err)
+	}
+	t.Cleanup(func() { SetEncryptionKey("", "") })
+}
+
+// Helper function that generates a key file in a temporary directory.
+func testKeyFile(t *testing.T) string {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "maz.key")
+	if err := GenerateKeyFile(keyFile); err != nil {
+		t.Fatalf("GenerateKeyFile() failed: %v", err)
+	}
+	return keyFile
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plain := []byte(`{"client_secret": "secret-value"}`)
+	tests := []struct {
+		name       string
+		passphrase string
+		keyFile    func(t *testing.T) string
+	}{
+		{"passphrase", "correct horse", func(t *testing.T) string { return "" }},
+		{"key file", "", testKeyFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestKey(t, tt.passphrase, tt.keyFile(t))
+			sealed, err := encryptData(plain)
+			if err != nil {
+				t.Fatalf("encryptData() failed: %v", err)
+			}
+			if !isEncrypted(sealed) || bytes.Contains(sealed, []byte("secret-value")) {
+				t.Fatalf("encryptData() returned %q, want encrypted data", sealed)
+			}
+			again, _ := encryptData(plain)
+			if bytes.Equal(sealed, again) {
+				t.Error("encryptData() reused its nonce")
+			}
+
+			got, err := decryptData(sealed, "test")
+			if err != nil {
+				t.Fatalf("decryptData() failed: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("decryptData() = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	plain := []byte("token cache")
+	seal := func(t *testing.T, passphrase, keyFile string) []byte {
+		t.Helper()
+		useTestKey(t, passphrase, keyFile)
+		sealed, err := encryptData(plain)
+		if err != nil {
+			t.Fatalf("encryptData() failed: %v", err)
+		}
+		return sealed
+	}
+	damaged := func(t *testing.T) []byte {
+		sealed := seal(t, "passphrase", "")
+		sealed[len(sealed)-1] ^= 0xff
+		return sealed
+	}
+
+	tests := []struct {
+		name       string
+		sealed     func(t *testing.T) []byte
+		passphrase string
+		keyFile    func(t *testing.T) string
+		wantErr    string
+	}{
+		{"other passphrase", func(t *testing.T) []byte { return seal(t, "passphrase", "") },
+			"other passphrase", nil, "wrong key"},
+		{"other key file", func(t *testing.T) []byte { return seal(t, "", testKeyFile(t)) },
+			"", testKeyFile, "wrong key"},
+		{"key file data with a passphrase", func(t *testing.T) []byte { return seal(t, "", testKeyFile(t)) },
+			"passphrase", nil, "encrypted with a key file"},
+		{"passphrase data with a key file", func(t *testing.T) []byte { return seal(t, "passphrase", "") },
+			"", testKeyFile, "encrypted with a passphrase"},
+		{"no key", func(t *testing.T) []byte { return seal(t, "passphrase", "") },
+			"", nil, "is encrypted"},
+		{"damaged data", damaged, "passphrase", nil, "wrong key or damaged"},
+		{"truncated data", func(t *testing.T) []byte { return []byte(encMagic) },
+			"passphrase", nil, "not a valid encrypted file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := tt.sealed(t)
+			keyFile := ""
+			if tt.keyFile != nil {
+				keyFile = tt.keyFile(t)
+			}
+			useTestKey(t, tt.passphrase, keyFile)
+
+			got, err := decryptData(sealed, "test")
+			if err == nil {
+				t.Fatalf("decryptData() = %q, want an error", got)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("decryptData() error %q, want one about %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrConfig) && !errors.Is(err, ErrFile) {
+				t.Errorf("decryptData() error %v is neither ErrConfig nor ErrFile", err)
+			}
+		})
+	}
+}
+
+func TestDecryptPlainData(t *testing.T) {
+	useTestKey(t, "passphrase", "")
+	plain := []byte(`{"tenant_id": "t"}`)
+	got, err := decryptData(plain, "test")
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("decryptData() of plain data = %q, %v, want it as is", got, err)
+	}
+}
+
+func TestMigrateMazFiles(t *testing.T) {
+	z := newTestCacheConfig(t, CacheBackendBolt)
+	t.Setenv("MAZ_ENCRYPT_OBJECT_CACHES", "true")
+	credentials := filepath.Join(MazConfigDir, CredentialsFile)
+	plain := []byte("client_secret: secret-value\n")
+	if err := os.WriteFile(credentials, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cache := mustGetCache(t, DirectoryUser, z)
+	if err := cache.Replace(testUsers("secret")); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+
+	useTestKey(t, "", testKeyFile(t))
+	if err := MigrateMazFiles(true); err != nil {
+		t.Fatalf("MigrateMazFiles(true) failed: %v", err)
+	}
+	for _, file := range []string{credentials, cache.store.(*boltCacheStore).filePath} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret-value")) || bytes.Contains(data, []byte("User secret")) {
+			t.Errorf("%s still holds plain values after encrypting", filepath.Base(file))
+		}
+	}
+	cache = mustGetCache(t, DirectoryUser, z)
+	if got := cache.FindById("id-secret"); got == nil {
+		t.Error("encrypted cache lost its objects")
+	}
+
+	if err := MigrateMazFiles(false); err != nil {
+		t.Fatalf("MigrateMazFiles(false) failed: %v", err)
+	}
+	if data, _ := os.ReadFile(credentials); !bytes.Equal(data, plain) {
+		t.Errorf("decrypted credentials file holds %q, want %q", data, plain)
+	}
+}
@@ -0,0 +1,186 @@
+package maz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The object caches are shared by all azm runs of the same user, such as parallel CI jobs,
+// so changes to a cache, its delta link and partial delta files are made under an advisory
+// lock on the cache's lock file: flock on Unix, LockFileEx on Windows. The OS releases these
+// when their process dies, so they never go stale. Where the file system doesn't support
+// them, such as on some network shares, an exclusively created lock file is used instead,
+// which is removed as stale if the process that created it is no longer running, or if it
+// is older than cacheLockStaleAge.
+const (
+	cacheLockTimeout  = 30 * time.Second
+	cacheLockPoll     = 100 * time.Millisecond
+	cacheLockStaleAge = 10 * time.Minute // Far longer than any cache save takes
+)
+
+// Returned by tryLockFile when the file system does not support advisory locks
+var errLockUnsupported = errors.New("file locking not supported")
+
+// Advisory locks don't exclude other goroutines of the same process, so they take turns
+// through a channel per lock file first.
+var (
+	cacheLockTurnsMu sync.Mutex
+	cacheLockTurns   = make(map[string]chan struct{})
+)
+
+// A held cache lock, see lockCache().
+type cacheLock struct {
+	path string
+	file *os.File // The locked file, or nil if an exclusive lock file is held instead
+	turn chan struct{}
+}
+
+// Locks the given lock file, waiting up to cacheLockTimeout for other goroutines and
+// processes holding it. The lock must be released with Unlock().
+func lockCache(lockPath string) (*cacheLock, error) {
+	deadline := time.Now().Add(cacheLockTimeout)
+	cacheLockTurnsMu.Lock()
+	turn := cacheLockTurns[lockPath]
+	if turn == nil {
+		turn = make(chan struct{}, 1)
+		cacheLockTurns[lockPath] = turn
+	}
+	cacheLockTurnsMu.Unlock()
+
+	select {
+	case turn <- struct{}{}:
+	case <-time.After(cacheLockTimeout):
+		return nil, fmt.Errorf("timed out waiting for cache lock %s within this process", lockPath)
+	}
+	l := &cacheLock{path: lockPath, turn: turn}
+	if err := l.acquire(deadline); err != nil {
+		<-turn
+		return nil, err
+	}
+	return l, nil
+}
+
+// Releases the lock.
+func (l *cacheLock) Unlock() {
+	if l.file != nil {
+		if err := unlockFile(l.file); err != nil {
+			Logf("Error unlocking %s: %v\n", l.path, err)
+		}
+		l.file.Close()
+	} else if err := os.Remove(l.path + ".excl"); err != nil {
+		Logf("Error removing %s: %v\n", l.path+".excl", err)
+	}
+	<-l.turn
+}
+
+// Helper function to take the advisory lock, falling back to an exclusive lock file if the
+// file system does not support advisory locks.
+func (l *cacheLock) acquire(deadline time.Time) error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open cache lock %s: %w", l.path, err)
+	}
+	for {
+		locked, err := tryLockFile(f)
+		if errors.Is(err, errLockUnsupported) {
+			f.Close()
+			return l.acquireExclusive(deadline)
+		} else if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to lock %s: %w", l.path, err)
+		}
+		if locked {
+			// Record the holder, to name it to those left waiting
+			f.Truncate(0)
+			f.WriteAt([]byte(lockHolder()), 0)
+			l.file = f
+			return nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return fmt.Errorf("timed out waiting for cache lock %s, held by %s", l.path, readLockHolder(l.path))
+		}
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+// Helper function to take the lock by creating the exclusive lock file, removing it first
+// if it is stale.
+func (l *cacheLock) acquireExclusive(deadline time.Time) error {
+	exclPath := l.path + ".excl"
+	for {
+		f, err := os.OpenFile(exclPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.WriteString(lockHolder())
+			f.Close()
+			return err
+		} else if !os.IsExist(err) {
+			return fmt.Errorf("failed to create cache lock %s: %w", exclPath, err)
+		}
+		if lockIsStale(exclPath) {
+			Logf("Removing stale cache lock %s, held by %s\n", exclPath, readLockHolder(exclPath))
+			os.Remove(exclPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for cache lock %s, held by %s", exclPath, readLockHolder(exclPath))
+		}
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+// Helper function that returns the lock holder record of this process: its PID, host name
+// and the current time.
+func lockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%d %s %d\n", os.Getpid(), host, time.Now().Unix())
+}
+
+// Helper function that returns a readable description of the holder recorded in the given
+// lock file.
+func readLockHolder(lockPath string) string {
+	pid, host, since, ok := parseLockHolder(lockPath)
+	if !ok {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("process %d on %s since %s", pid, host, since.Format(time.RFC3339))
+}
+
+// Helper function to parse the holder record of the given lock file.
+func parseLockHolder(lockPath string) (pid int, host string, since time.Time, ok bool) {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return 0, "", time.Time{}, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, "", time.Time{}, false
+	}
+	pid, errPid := strconv.Atoi(fields[0])
+	unix, errTime := strconv.ParseInt(fields[2], 10, 64)
+	if errPid != nil || errTime != nil {
+		return 0, "", time.Time{}, false
+	}
+	return pid, fields[1], time.Unix(unix, 0), true
+}
+
+// Helper function that reports whether the given exclusive lock file is stale: its process
+// is gone, or it is older than cacheLockStaleAge. A lock file without a holder record yet is
+// only stale once old enough, since its creator may still be writing it.
+func lockIsStale(lockPath string) bool {
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		return false // Already removed, so just try again
+	}
+	if time.Since(info.ModTime()) > cacheLockStaleAge {
+		return true
+	}
+	pid, host, _, ok := parseLockHolder(lockPath)
+	thisHost, _ := os.Hostname()
+	return ok && host == thisHost && !processRunning(pid)
+}
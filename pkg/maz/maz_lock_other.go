@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package maz
+
+import "os"
+
+// Advisory locks are not used on this OS, so the exclusive lock file is used instead.
+func tryLockFile(f *os.File) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// Reports whether a process with the given PID is running on this host. Unknown on this OS,
+// so exclusive lock files are only removed once they are older than cacheLockStaleAge.
+func processRunning(pid int) bool {
+	return true
+}
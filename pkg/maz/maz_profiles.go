@@ -0,0 +1,353 @@
+package maz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/queone/utl"
+	"gopkg.in/yaml.v3"
+)
+
+// Credentials file profiles. A file with a 'profiles' map holds one set of login values per
+// named profile, while a plain file without one is treated as a single unnamed profile.
+//
+//	default_profile: prod
+//	profiles:
+//	  prod:
+//	    tenant_id:     3f050090-20b0-40a0-a060-c05060104010
+//	    client_id:     f1110121-7111-4171-a181-e1614131e181
+//	    client_secret: ...
+//	  dev:
+//	    tenant_id:     9f050090-20b0-40a0-a060-c05060104019
+//	    username:      user1@domain.io
+//	    interactive:   true
+const (
+	DefaultProfile = "default" // Name given to the values of a plain file when adding profiles to it
+
+	profilesKey       = "profiles"
+	defaultProfileKey = "default_profile"
+)
+
+var (
+	profileNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`) // Also used in file names
+
+	// Order of the login parameters in each written profile, any others follow sorted by name
+	credsKeyOrder = []string{
+		"tenant_id", "username", "interactive", "managed_identity", "client_id", "client_secret",
+		"client_cert", "client_cert_password", "federated_token_file", "managed_identity_endpoint", "cloud",
+		"credential_chain",
+	}
+)
+
+// Selects the named credentials file profile, and also keeps its token cache separate from
+// those of other profiles. An empty name selects the MAZ_PROFILE environment variable's
+// profile if set, otherwise the file's default profile.
+func (m *Config) SetProfile(name string) *Config {
+	m.Profile = name
+	return m
+}
+
+// Returns the explicitly selected profile name, from SetProfile or MAZ_PROFILE, if any.
+func (m *Config) selectedProfile() string {
+	if m.Profile != "" {
+		return m.Profile
+	}
+	return os.Getenv("MAZ_PROFILE")
+}
+
+// Returns the token cache file of the selected profile. Without a profile it is the
+// original TokenCacheFile, so single tenant setups keep their cached tokens.
+func (m *Config) tokenCacheFile() string {
+	profile := m.selectedProfile()
+	if profile == "" {
+		return filepath.Join(MazConfigDir, TokenCacheFile)
+	}
+	ext := filepath.Ext(TokenCacheFile)
+	return filepath.Join(MazConfigDir, strings.TrimSuffix(TokenCacheFile, ext)+"_"+profile+ext)
+}
+
+// Helper function to check that the given profile name can be used.
+func validateProfileName(name string) error {
+	if !profileNameRegex.MatchString(name) {
+		return newError(ErrValidation, "invalid profile name '%s', use only letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// Returns the login values of the profile to use from the given credentials file values, and
+// sets z.Profile to its name. Plain files without profiles are returned as is, unless a
+// profile other than DefaultProfile was explicitly selected.
+func selectProfile(creds map[string]interface{}, z *Config) (map[string]interface{}, error) {
+	name := z.selectedProfile()
+	profiles := utl.Map(creds[profilesKey])
+	if profiles == nil {
+		if name != "" && name != DefaultProfile {
+			return nil, newError(ErrConfig, "profile '%s' selected, but the credentials file has no profiles", name)
+		}
+		return creds, nil
+	}
+
+	source := "selected"
+	if name == "" {
+		name = utl.Str(creds[defaultProfileKey])
+		source = "default"
+		if name == "" && len(profiles) == 1 {
+			for k := range profiles {
+				name = k // The one and only profile is the default
+			}
+		}
+		if name == "" {
+			return nil, newError(ErrConfig, "credentials file has several profiles but no '%s', "+
+				"select one with MAZ_PROFILE", defaultProfileKey)
+		}
+	}
+	if err := validateProfileName(name); err != nil {
+		return nil, err
+	}
+	profile := utl.Map(profiles[name])
+	if profile == nil {
+		return nil, newError(ErrNotFound, "profile '%s' is not in the credentials file", name)
+	}
+	Logf("Using %s credential file profile %s\n", source, utl.Cya(name))
+	z.Profile = name
+	return profile, nil
+}
+
+// Loads the credentials file YAML, decrypting it if needed. A missing file returns the
+// unwrapped error, so os.IsNotExist(err) works.
+func loadCredsFile(credsFile string) (interface{}, error) {
+	data, err := readMazFile(credsFile)
+	if err != nil {
+		var mazErr *Error
+		if os.IsNotExist(err) || errors.As(err, &mazErr) {
+			return nil, err
+		}
+		return nil, wrapError(ErrFile, err, "error reading credential file %s", credsFile)
+	}
+	var creds interface{}
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return nil, wrapError(ErrConfig, err, "credential file %s is not valid YAML", credsFile)
+	}
+	return creds, nil
+}
+
+// Helper function to load the credentials file as profiles. A plain file is returned as a
+// single DefaultProfile, with hasProfiles false. A missing file returns no profiles at all.
+func loadCredsProfiles(credsFile string) (defaultName string, profiles map[string]map[string]interface{}, hasProfiles bool, err error) {
+	profiles = make(map[string]map[string]interface{})
+	if !utl.FileExist(credsFile) {
+		return "", profiles, false, nil
+	}
+	credsRaw, err := loadCredsFile(credsFile)
+	if err != nil {
+		return "", nil, false, err
+	}
+	creds := utl.Map(credsRaw)
+	if creds == nil {
+		return "", nil, false, newError(ErrConfig, "credential file %s values are not formatted properly", credsFile)
+	}
+	if rawProfiles, ok := creds[profilesKey]; ok {
+		for name, values := range utl.Map(rawProfiles) {
+			if profile := utl.Map(values); profile != nil {
+				profiles[name] = profile
+			}
+		}
+		return utl.Str(creds[defaultProfileKey]), profiles, true, nil
+	}
+	profiles[DefaultProfile] = creds
+	return DefaultProfile, profiles, false, nil
+}
+
+// Helper function to save the given login values, formatted as a plain credentials file in
+// content, as the selected profile. Without a selected profile, content replaces a plain
+// file as is, or the default profile of a file with profiles. Adding a named profile to a
+// plain file turns its values into the DefaultProfile.
+func saveCredsProfile(credsFile, content string, z *Config) error {
+	defaultName, profiles, hasProfiles, err := loadCredsProfiles(credsFile)
+	if err != nil {
+		return err
+	}
+	name := z.selectedProfile()
+	if name == "" && !hasProfiles {
+		return writeCredsFileContent(credsFile, []byte(content))
+	}
+	if name == "" {
+		name = defaultName
+	}
+	if err := validateProfileName(name); err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+		return wrapError(ErrConfig, err, "invalid login values for profile '%s'", name)
+	}
+	profiles[name] = values
+	if defaultName == "" {
+		defaultName = name // The first profile becomes the default
+	}
+	if err := writeCredsFileContent(credsFile, formatCredsProfiles(defaultName, profiles)); err != nil {
+		return err
+	}
+	fmt.Printf("Saved profile %s\n", utl.Yel(name))
+	return nil
+}
+
+// Helper function to format the given profiles as a credentials file, with aligned values
+// in each profile.
+func formatCredsProfiles(defaultName string, profiles map[string]map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	if defaultName != "" {
+		fmt.Fprintf(&buf, "%s: %s\n", defaultProfileKey, defaultName)
+	}
+	fmt.Fprintf(&buf, "%s:\n", profilesKey)
+	names := slices.Sorted(maps.Keys(profiles))
+	for _, name := range names {
+		values := profiles[name]
+		keys := make([]string, 0, len(values))
+		width := 0
+		for k := range values {
+			keys = append(keys, k)
+			width = max(width, len(k)+1)
+		}
+		slices.SortFunc(keys, func(a, b string) int {
+			ia, ib := slices.Index(credsKeyOrder, a), slices.Index(credsKeyOrder, b)
+			switch {
+			case ia >= 0 && ib >= 0:
+				return ia - ib
+			case ia >= 0:
+				return -1
+			case ib >= 0:
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+		fmt.Fprintf(&buf, "  %s:\n", name)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "    %-*s %s\n", width, k+":", yamlScalar(values[k]))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Helper function to format a single YAML value on one line, quoting it only if needed. Lists
+// such as 'credential_chain' are written in flow style.
+func yamlScalar(v interface{}) string {
+	var node yaml.Node
+	if err := node.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	if node.Kind == yaml.SequenceNode || node.Kind == yaml.MappingNode {
+		node.Style = yaml.FlowStyle
+	}
+	out, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Helper function to write the credentials file, readable by the owner only, and encrypted
+// if a key is configured.
+func writeCredsFileContent(credsFile string, content []byte) error {
+	if err := ensureMazConfigDir(); err != nil {
+		return err
+	}
+	if err := writeMazFile(credsFile, content, 0600); err != nil {
+		return wrapError(ErrFile, err, "failed to write %s", credsFile)
+	}
+	fmt.Printf("Updated %s file\n", utl.Yel(credsFile))
+	return nil
+}
+
+// Lists the credentials file profiles, marking the default one.
+func ListProfiles(z *Config) error {
+	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
+	defaultName, profiles, hasProfiles, err := loadCredsProfiles(credsFile)
+	if err != nil {
+		return err
+	}
+	if len(profiles) < 1 {
+		return newError(ErrFile, "credentials file does not yet exist")
+	}
+	if !hasProfiles {
+		fmt.Print(utl.Gra("# The credentials file has no profiles, below are its login values\n"))
+	}
+	names := slices.Sorted(maps.Keys(profiles))
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+	for _, name := range names {
+		values := profiles[name]
+		marker := " "
+		if name == defaultName {
+			marker = utl.Yel("*")
+		}
+		login := "client_id " + utl.Str(values["client_id"])
+		if utl.Bool(values["interactive"]) {
+			login = "username " + utl.Str(values["username"])
+		} else if utl.Bool(values["managed_identity"]) {
+			login = "managed_identity"
+		}
+		fmt.Printf("%s %s  %s  %s\n", marker, utl.Blu(fmt.Sprintf("%-*s", width, name)),
+			utl.Gre(utl.Str(values["tenant_id"])), utl.Gra(login))
+	}
+	return nil
+}
+
+// Makes the named credentials file profile the default one.
+func SetDefaultProfile(name string) error {
+	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
+	_, profiles, hasProfiles, err := loadCredsProfiles(credsFile)
+	if err != nil {
+		return err
+	}
+	if !hasProfiles {
+		return newError(ErrConfig, "the credentials file has no profiles")
+	}
+	if _, ok := profiles[name]; !ok {
+		return newError(ErrNotFound, "profile '%s' is not in the credentials file", name)
+	}
+	return writeCredsFileContent(credsFile, formatCredsProfiles(name, profiles))
+}
+
+// Removes the named profile from the credentials file, along with its token cache. If it
+// was the default profile, the first remaining one becomes the default.
+func RemoveProfile(name string) error {
+	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
+	defaultName, profiles, hasProfiles, err := loadCredsProfiles(credsFile)
+	if err != nil {
+		return err
+	}
+	if !hasProfiles {
+		return newError(ErrConfig, "the credentials file has no profiles")
+	}
+	if _, ok := profiles[name]; !ok {
+		return newError(ErrNotFound, "profile '%s' is not in the credentials file", name)
+	}
+	delete(profiles, name)
+	if len(profiles) < 1 {
+		return newError(ErrValidation, "'%s' is the only profile, use -tx to delete all login values instead", name)
+	}
+
+	tokenFile := NewConfig().SetProfile(name).tokenCacheFile()
+	if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+		return wrapError(ErrFile, err, "failed to remove %s", tokenFile)
+	}
+	if name == defaultName {
+		defaultName = slices.Sorted(maps.Keys(profiles))[0]
+	}
+	if err := writeCredsFileContent(credsFile, formatCredsProfiles(defaultName, profiles)); err != nil {
+		return err
+	}
+	fmt.Printf("Removed profile %s\n", utl.Yel(name))
+	return nil
+}
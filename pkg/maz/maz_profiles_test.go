@@ -0,0 +1,117 @@
+package maz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelectProfile(t *testing.T) {
+	plain := map[string]interface{}{"tenant_id": "t0", "client_id": "c0"}
+	profiles := func(defaultName string, names ...string) map[string]interface{} {
+		creds := map[string]interface{}{profilesKey: map[string]interface{}{}}
+		for _, name := range names {
+			creds[profilesKey].(map[string]interface{})[name] = map[string]interface{}{"tenant_id": "t-" + name}
+		}
+		if defaultName != "" {
+			creds[defaultProfileKey] = defaultName
+		}
+		return creds
+	}
+
+	tests := []struct {
+		name     string
+		creds    map[string]interface{}
+		selected string
+		env      string
+		want     string // Tenant of the selected profile
+		wantErr  error
+	}{
+		{"plain file", plain, "", "", "t0", nil},
+		{"plain file as default profile", plain, DefaultProfile, "", "t0", nil},
+		{"plain file with named profile", plain, "dev", "", "", ErrConfig},
+		{"default profile", profiles("prod", "dev", "prod"), "", "", "t-prod", nil},
+		{"selected profile", profiles("prod", "dev", "prod"), "dev", "", "t-dev", nil},
+		{"MAZ_PROFILE", profiles("prod", "dev", "prod"), "", "dev", "t-dev", nil},
+		{"selected over MAZ_PROFILE", profiles("prod", "dev", "prod"), "prod", "dev", "t-prod", nil},
+		{"only profile", profiles("", "dev"), "", "", "t-dev", nil},
+		{"no default", profiles("", "dev", "prod"), "", "", "", ErrConfig},
+		{"missing profile", profiles("prod", "prod"), "test", "", "", ErrNotFound},
+		{"invalid name", profiles("prod", "prod"), "../prod", "", "", ErrValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAZ_PROFILE", tt.env)
+			z := NewConfig().SetProfile(tt.selected)
+			got, err := selectProfile(tt.creds, z)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("selectProfile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got["tenant_id"] != tt.want {
+				t.Errorf("selectProfile() = %v, %v, want the values of tenant %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredsProfiles(t *testing.T) {
+	saved := MazConfigDir
+	MazConfigDir = t.TempDir()
+	t.Cleanup(func() { MazConfigDir = saved })
+	t.Setenv("MAZ_PROFILE", "")
+	credsFile := filepath.Join(MazConfigDir, CredentialsFile)
+
+	// Saving without a profile keeps the file plain
+	if err := saveCredsProfile(credsFile, "tenant_id: t0\nclient_id: c0\n", NewConfig()); err != nil {
+		t.Fatalf("saveCredsProfile() failed: %v", err)
+	}
+	if _, _, hasProfiles, err := loadCredsProfiles(credsFile); err != nil || hasProfiles {
+		t.Fatalf("plain file has profiles %v, %v", hasProfiles, err)
+	}
+
+	// Adding a named profile turns the plain values into the default profile
+	if err := saveCredsProfile(credsFile, "tenant_id: t1\nusername: user@example.com\ninteractive: true\n", NewConfig().SetProfile("dev")); err != nil {
+		t.Fatalf("saveCredsProfile() failed: %v", err)
+	}
+	defaultName, profiles, hasProfiles, err := loadCredsProfiles(credsFile)
+	if err != nil || !hasProfiles || defaultName != DefaultProfile || len(profiles) != 2 {
+		t.Fatalf("loadCredsProfiles() = %s, %v, %v, %v", defaultName, profiles, hasProfiles, err)
+	}
+	if profiles[DefaultProfile]["tenant_id"] != "t0" || profiles["dev"]["interactive"] != true {
+		t.Errorf("loadCredsProfiles() returned %v", profiles)
+	}
+
+	if err := SetDefaultProfile("dev"); err != nil {
+		t.Fatalf("SetDefaultProfile() failed: %v", err)
+	}
+	if err := SetDefaultProfile("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetDefaultProfile() of a missing profile = %v, want ErrNotFound", err)
+	}
+
+	// Each profile has its own token cache, which goes along with the profile
+	devTokens := NewConfig().SetProfile("dev").tokenCacheFile()
+	if devTokens == NewConfig().tokenCacheFile() || !strings.Contains(filepath.Base(devTokens), "dev") {
+		t.Errorf("dev profile has token cache %s", devTokens)
+	}
+	if err := os.WriteFile(devTokens, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveProfile("dev"); err != nil {
+		t.Fatalf("RemoveProfile() failed: %v", err)
+	}
+	if _, err := os.Stat(devTokens); !os.IsNotExist(err) {
+		t.Errorf("RemoveProfile() kept the token cache %s", devTokens)
+	}
+	defaultName, profiles, _, _ = loadCredsProfiles(credsFile)
+	if defaultName != DefaultProfile || len(profiles) != 1 {
+		t.Errorf("after RemoveProfile() the default is %s of %v", defaultName, profiles)
+	}
+	if err := RemoveProfile(DefaultProfile); !errors.Is(err, ErrValidation) {
+		t.Errorf("RemoveProfile() of the only profile = %v, want ErrValidation", err)
+	}
+}
@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"time"
@@ -9,25 +10,33 @@ import (
 )
 
 // Prints a status count of all AZ and MG objects that are in Azure, and the local files.
-func PrintCountStatus(z *Config) {
+// Returns the first error from counting the objects in Azure, before printing any counts.
+func PrintCountStatus(z *Config) error {
 	c1Width := 44 // Column 1 width
 	c2Width := 10 // Column 2 width
 	c3Width := 10 // Column 3 width
 	fmt.Printf("%s\n", utl.Gra("# Please wait, enumerating some Azure resources can be slow"))
-	fmt.Print(utl.Whi2(utl.PostSpc("Objects", c1Width)+
+	status := utl.Whi2(utl.PostSpc("Objects", c1Width)+
 		utl.PreSpc("Local", c2Width)+
-		utl.PreSpc("Azure", c3Width)) + "\n")
-	status := utl.Blu(utl.PostSpc("Directory users", c1Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountLocal(DirectoryUser, z), c2Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountAzure(DirectoryUser, z), c3Width)) + "\n"
-	status += utl.Blu(utl.PostSpc("Directory groups", c1Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountLocal(DirectoryGroup, z), c2Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountAzure(DirectoryGroup, z), c3Width)) + "\n"
-	status += utl.Blu(utl.PostSpc("Directory applications", c1Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountLocal(Application, z), c2Width))
-	status += utl.Gre(utl.PreSpc(ObjectCountAzure(Application, z), c3Width)) + "\n"
+		utl.PreSpc("Azure", c3Width)) + "\n"
+	for _, row := range []struct{ mazType, label string }{
+		{DirectoryUser, "Directory users"},
+		{DirectoryGroup, "Directory groups"},
+		{Application, "Directory applications"},
+	} {
+		azureCount, err := ObjectCountAzure(row.mazType, z)
+		if err != nil {
+			return err
+		}
+		status += utl.Blu(utl.PostSpc(row.label, c1Width))
+		status += utl.Gre(utl.PreSpc(ObjectCountLocal(row.mazType, z), c2Width))
+		status += utl.Gre(utl.PreSpc(azureCount, c3Width)) + "\n"
+	}
 	nativeSpsLocal, msSpsLocal := SpsCountLocal(z)
-	nativeSpsAzure, msSpsAzure := SpsCountAzure(z)
+	nativeSpsAzure, msSpsAzure, err := SpsCountAzure(z)
+	if err != nil {
+		return err
+	}
 	status += utl.Blu(utl.PostSpc("Directory service principals (this tenant)", c1Width))
 	status += utl.Gre(utl.PreSpc(nativeSpsLocal, c2Width))
 	status += utl.Gre(utl.PreSpc(nativeSpsAzure, c3Width)) + "\n"
@@ -46,16 +55,30 @@ func PrintCountStatus(z *Config) {
 	status += utl.Gre(utl.PreSpc(daCount, c2Width))
 	status += utl.Gre(utl.PreSpc(daCount, c3Width)) + "\n"
 
+	mgmtGroupCount, err := CountAzureMgmtGroups(z)
+	if err != nil {
+		return err
+	}
 	status += utl.Blu(utl.PostSpc("Resource management groups", c1Width))
 	status += utl.Gre(utl.PreSpc(ObjectCountLocal(ManagementGroup, z), c2Width))
-	status += utl.Gre(utl.PreSpc(CountAzureMgmtGroups(z), c3Width)) + "\n"
+	status += utl.Gre(utl.PreSpc(mgmtGroupCount, c3Width)) + "\n"
 
+	subCount, err := CountAzureSubscriptions(z)
+	if err != nil {
+		return err
+	}
 	status += utl.Blu(utl.PostSpc("Resource subscriptions", c1Width))
 	status += utl.Gre(utl.PreSpc(ObjectCountLocal(Subscription, z), c2Width))
-	status += utl.Gre(utl.PreSpc(CountAzureSubscriptions(z), c3Width)) + "\n"
+	status += utl.Gre(utl.PreSpc(subCount, c3Width)) + "\n"
 
-	customLocal, builtinLocal := CountResRoleDefinitions(false, z) // false = get from cache, not Azure
-	customAzure, builtinAzure := CountResRoleDefinitions(true, z)  // true = get from Azure, not cache
+	customLocal, builtinLocal, err := CountResRoleDefinitions(false, z) // false = get from cache, not Azure
+	if err != nil {
+		return err
+	}
+	customAzure, builtinAzure, err := CountResRoleDefinitions(true, z) // true = get from Azure, not cache
+	if err != nil {
+		return err
+	}
 	status += utl.Blu(utl.PostSpc("Resource role definitions (built-in)", c1Width))
 	status += utl.Gre(utl.PreSpc(builtinLocal, c2Width))
 	status += utl.Gre(utl.PreSpc(builtinAzure, c3Width)) + "\n"
@@ -63,11 +86,16 @@ func PrintCountStatus(z *Config) {
 	status += utl.Gre(utl.PreSpc(customLocal, c2Width))
 	status += utl.Gre(utl.PreSpc(customAzure, c3Width)) + "\n"
 
+	roleAssignmentCount, err := RoleAssignmentsCountAzure(z)
+	if err != nil {
+		return err
+	}
 	status += utl.Blu(utl.PostSpc("Resource role assignments", c1Width))
 	status += utl.Gre(utl.PreSpc(ObjectCountLocal(ResRoleAssignment, z), c2Width))
-	status += utl.Gre(utl.PreSpc(RoleAssignmentsCountAzure(z), c3Width)) + "\n"
+	status += utl.Gre(utl.PreSpc(roleAssignmentCount, c3Width)) + "\n"
 
 	fmt.Print(status)
+	return nil
 }
 
 // Prints this single object of type mazType tersely, with minimal attributes
@@ -127,16 +155,18 @@ func PrintTersely(mazType string, obj AzureObject) {
 }
 
 // Prints object by given ID
-func PrintObjectById(id string, z *Config) {
+func PrintObjectById(id string, z *Config) error {
 	list, err := FindAzureObjectsById(id, z) // Search for this ID under all maz objects types
 	if err != nil {
-		utl.Die("Error: %v\n", err)
+		return err
 	}
 
 	for _, obj := range list {
 		mazType := utl.Str(obj["maz_type"]) // Function FindAzureObjectsById() should have added this field
 		if mazType != "" {
-			PrintObject(mazType, obj, z)
+			if err := PrintObject(mazType, obj, z); err != nil {
+				return err
+			}
 		} else {
 			fmt.Println(utl.Gra("# Unknown object type, but dumping it anyway:"))
 			utl.PrintYamlColor(obj)
@@ -154,15 +184,16 @@ func PrintObjectById(id string, z *Config) {
 			fmt.Println(utl.Red("# WARNING! Multiple objects share this Object Id! This is incredibly rare!"))
 		}
 	}
+	return nil
 }
 
 // Generic print object function
-func PrintObject(mazType string, x AzureObject, z *Config) {
+func PrintObject(mazType string, x AzureObject, z *Config) error {
 	switch mazType {
 	case ResRoleDefinition:
-		PrintResRoleDefinition(x, z)
+		return PrintResRoleDefinition(x, z)
 	case ResRoleAssignment:
-		PrintResRoleAssignment(x, z)
+		return PrintResRoleAssignment(x, z)
 	case Subscription:
 		PrintSubscription(x)
 	case ManagementGroup:
@@ -172,7 +203,7 @@ func PrintObject(mazType string, x AzureObject, z *Config) {
 	case DirectoryGroup:
 		PrintGroup(x, z)
 	case Application:
-		PrintApp(x, z)
+		return PrintApp(x, z)
 	case ServicePrincipal:
 		PrintSp(x, z)
 	case DirRoleDefinition:
@@ -180,6 +211,7 @@ func PrintObject(mazType string, x AzureObject, z *Config) {
 	case DirRoleAssignment:
 		PrintDirRoleAssignment(x, z)
 	}
+	return nil
 }
 
 // Prints appRoleAssignments for given service principal (SP)
@@ -214,6 +246,16 @@ func PrintAppRoleAssignmentsOthers(appRoleAssignments []interface{}, z *Config)
 		return
 	}
 	fmt.Printf("%s:\n", utl.Blu("app_role_assignments"))
+
+	// Get all the SPs where the appRoles are defined in a single batch
+	var resourceIds []string
+	for _, item := range appRoleAssignments {
+		if ara := utl.Map(item); ara != nil {
+			resourceIds = append(resourceIds, utl.Str(ara["resourceId"]))
+		}
+	}
+	resourceSps := GetObjectsFromAzureByIds(ServicePrincipal, resourceIds, z)
+
 	uniqueIds := utl.StringSet{} // Keep track of assignments
 	for _, item := range appRoleAssignments {
 		ara := utl.Map(item)
@@ -236,7 +278,7 @@ func PrintAppRoleAssignmentsOthers(appRoleAssignments []interface{}, z *Config)
 		// We are forced to do this excessive processing for each appRole, because MG Graph does
 		// not appear to have a global registry nor a call to get all SP app roles.
 		roleNameMap := make(map[string]string)
-		x := GetObjectFromAzureById(ServicePrincipal, resourceId, z)
+		x := resourceSps[resourceId]
 		roleNameMap["00000000-0000-0000-0000-000000000000"] = "Default" // Include default app permissions role
 		// But also get all other additional appRoles it may have defined
 		appRoles := utl.Slice(x["appRoles"])
@@ -400,7 +442,13 @@ func PrintStringMapColor(strMap map[string]string) {
 }
 
 // Prints all objects that match on given specifier
-func PrintMatchingObjects(specifier, filter string, z *Config) {
+func PrintMatchingObjects(specifier, filter string, z *Config) error {
+	return PrintMatchingObjectsContext(context.Background(), specifier, filter, z)
+}
+
+// Same as PrintMatchingObjects, but refreshes the cache from Azure under the given context,
+// so that Ctrl-C handlers can interrupt a long sync.
+func PrintMatchingObjectsContext(ctx context.Context, specifier, filter string, z *Config) error {
 	mazType := specifier
 	printJson := mazType[len(mazType)-1] == 'j' // If last char is 'j', then JSON output is required
 	if printJson {
@@ -408,7 +456,10 @@ func PrintMatchingObjects(specifier, filter string, z *Config) {
 	}
 	Logf("Searching for all %s that match on '%s'\n", utl.Cya(MazTypeNames[mazType]), filter)
 
-	matchingObjects := GetMatchingObjects(mazType, filter, false, z) // false = get from cache, not Azure
+	matchingObjects, err := GetMatchingObjectsContext(ctx, mazType, filter, false, z) // false = get from cache, not Azure
+	if err != nil {
+		return err
+	}
 	matchingCount := len(matchingObjects)
 
 	if matchingCount > 1 {
@@ -440,18 +491,22 @@ func PrintMatchingObjects(specifier, filter string, z *Config) {
 		if printJson {
 			utl.PrintJsonColor(singleObj)
 		} else {
-			PrintObject(mazType, singleObj, z) // Print in regular format
+			return PrintObject(mazType, singleObj, z) // Print in regular format
 		}
 	}
+	return nil
 }
 
 // Search and print all locally cached object with given ID
-func PrintCachedObjectsWithId(id string, z *Config) {
+func PrintCachedObjectsWithId(id string, z *Config) error {
 	list := FindCachedObjectsById(id, z)
 	count := len(list)
 	for i, obj := range list {
 		fmt.Printf("%s\n", utl.Gra(fmt.Sprintf("# Object %d of %d with this ID", i+1, count)))
 		mazType := utl.Str(obj["maz_type"])
-		PrintObject(mazType, obj, z)
+		if err := PrintObject(mazType, obj, z); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// The resource caches are synced with Azure Resource Graph queries, rather than by listing
+// each object type under every management group and subscription scope. Role definitions
+// and assignments record when they were last updated, so later syncs only fetch the ones
+// updated since the previous sync, plus the IDs of all current objects to drop the deleted
+// ones. Subscriptions and management groups have no such timestamp, but are few, so they
+// are fetched in full each time, still with a single paged query.
+const (
+	resGraphApiVersion  = "2024-04-01"
+	resGraphPageSize    = 1000             // The most Resource Graph returns per page
+	resGraphSyncOverlap = 10 * time.Minute // Resource Graph picks up changes with some delay
+)
+
+// Resource Graph query and update timestamp attribute of a resource object type.
+type resGraphSource struct {
+	query     string
+	updatedOn string // Attribute holding the time an object was last updated, if any
+}
+
+var resGraphSources = map[string]resGraphSource{
+	ResRoleDefinition: {
+		query: `AuthorizationResources
+			| where type =~ "Microsoft.Authorization/roleDefinitions"`,
+		updatedOn: "properties.updatedOn",
+	},
+	ResRoleAssignment: {
+		query: `AuthorizationResources
+			| where type =~ "Microsoft.Authorization/roleAssignments"`,
+		updatedOn: "properties.updatedOn",
+	},
+	Subscription: {
+		query: `ResourceContainers
+			| where type =~ "Microsoft.Resources/subscriptions"`,
+	},
+	ManagementGroup: {
+		query: `ResourceContainers
+			| where type =~ "Microsoft.Management/managementGroups"`,
+	},
+}
+
+// Runs the given Azure Resource Graph query across the whole tenant, by scoping it to the
+// tenant root management group, and returns all the rows of all its result pages, following
+// their $skipToken. The error of the first page that fails is returned, without any rows.
+func QueryResourceGraph(query string, z *Config) (AzureObjectList, error) {
+	return QueryResourceGraphContext(context.Background(), query, z)
+}
+
+// Same as QueryResourceGraph, but runs the query under the given context.
+func QueryResourceGraphContext(ctx context.Context, query string, z *Config) (AzureObjectList, error) {
+	params := map[string]string{"api-version": resGraphApiVersion}
+	apiUrl := z.AzUrl + "/providers/Microsoft.ResourceGraph/resources"
+	options := map[string]interface{}{"$top": resGraphPageSize, "resultFormat": "objectArray"}
+	payload := map[string]interface{}{
+		"query":            query,
+		"managementGroups": []string{z.TenantId}, // The root group has the tenant's ID
+		"options":          options,
+	}
+
+	list := AzureObjectList{}
+	for page := 1; ; page++ {
+		resp, statCode, err := apiCall(ctx, "POST", apiUrl, z, payload, params, true) // Queries are idempotent
+		if statCode != 200 {
+			return nil, apiError(err, statCode, resp, "Resource Graph query failed on page %d", page)
+		}
+		for _, item := range utl.Slice(resp["data"]) {
+			if obj := utl.Map(item); obj != nil {
+				list = append(list, obj)
+			}
+		}
+		skipToken := utl.Str(resp["$skipToken"])
+		if skipToken == "" {
+			return list, nil
+		}
+		options["$skipToken"] = skipToken
+	}
+}
+
+// Helper function to sync the cache of the given resource object type from Azure Resource
+// Graph. Syncs only fetch the objects updated since the previous sync, whose start time is
+// kept next to the cache file, unless there was none or the cache is empty.
+func syncResObjectsFromGraph(ctx context.Context, mazType string, cache *Cache, z *Config) error {
+	mazTypeName := MazTypeNames[mazType]
+	source := resGraphSources[mazType]
+	start := time.Now()
+
+	var since time.Time
+	if source.updatedOn != "" && cache.Count() > 0 {
+		syncTime, err := cache.LoadSyncTime()
+		if err != nil {
+			Logf("Error loading %s sync time, syncing all objects: %v\n", mazTypeName, err)
+		} else if !syncTime.IsZero() {
+			since = syncTime.Add(-resGraphSyncOverlap)
+		}
+	}
+
+	if since.IsZero() {
+		Logf("Syncing all %s objects from Resource Graph\n", utl.Cya(mazTypeName))
+		list, err := QueryResourceGraphContext(ctx, source.query, z)
+		if err != nil {
+			return err
+		}
+		for i := range list {
+			list[i] = resGraphToArm(mazType, list[i]).TrimForCache(mazType)
+		}
+		if err := cache.Replace(list); err != nil {
+			return wrapError(ErrFile, err, "error saving updated %s cache", mazTypeName)
+		}
+		cache.resync = false
+	} else {
+		Logf("Syncing %s objects updated since %s from Resource Graph\n", utl.Cya(mazTypeName),
+			since.UTC().Format(time.RFC3339))
+		changed, err := QueryResourceGraphContext(ctx, fmt.Sprintf("%s\n| where todatetime(%s) > datetime(%s)",
+			source.query, source.updatedOn, since.UTC().Format(time.RFC3339)), z)
+		if err != nil {
+			return err
+		}
+		current, err := QueryResourceGraphContext(ctx, source.query+"\n| project id", z)
+		if err != nil {
+			return err
+		}
+
+		// Mark the cached objects that no longer exist as removed, like a directory delta set
+		currentIds := utl.StringSet{}
+		for _, obj := range current {
+			currentIds.Add(ExtractID(obj))
+		}
+		deltaSet := AzureObjectList{}
+		for _, obj := range changed {
+			deltaSet = append(deltaSet, resGraphToArm(mazType, obj).TrimForCache(mazType))
+		}
+		err = cache.Scan(func(obj AzureObject) bool {
+			if id := ExtractID(obj); !currentIds.Exists(id) {
+				deltaSet = append(deltaSet, AzureObject{"id": id, "@removed": map[string]interface{}{}})
+			}
+			return true
+		})
+		if err != nil {
+			return wrapError(ErrFile, err, "error reading %s cache", mazTypeName)
+		}
+		cache.Normalize(mazType, deltaSet)
+		if err := cache.Save(); err != nil {
+			return wrapError(ErrFile, err, "error saving updated %s cache", mazTypeName)
+		}
+	}
+
+	if source.updatedOn != "" {
+		if err := cache.SaveSyncTime(start); err != nil {
+			Logf("Error saving %s sync time: %v\n", mazTypeName, err)
+		}
+	}
+	return nil
+}
+
+// Helper function that converts a Resource Graph row to the object the ARM API returns, as
+// far as the cache is concerned. Resource Graph keeps the subscription display name in
+// 'name', and the subscription state and management group tenant elsewhere.
+func resGraphToArm(mazType string, obj AzureObject) AzureObject {
+	switch mazType {
+	case Subscription:
+		obj["displayName"] = obj["name"]
+		if props := utl.Map(obj["properties"]); props != nil {
+			obj["state"] = props["state"]
+		}
+	case ManagementGroup:
+		if props := utl.Map(obj["properties"]); props != nil && props["tenantId"] == nil {
+			props["tenantId"] = obj["tenantId"]
+		}
+	}
+	return obj
+}
@@ -0,0 +1,134 @@
+package maz
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/queone/utl"
+)
+
+// Fake Resource Graph, holding role definitions by ID, and the queries it was sent.
+type fakeResGraph struct {
+	mu      sync.Mutex
+	defs    map[string]AzureObject
+	changed []string // IDs returned by queries for updated objects
+	queries []string
+	failing bool
+}
+
+// Helper function that returns a role definition row, as Resource Graph returns it.
+func testRoleDefinitionRow(id, roleName string) AzureObject {
+	return AzureObject{
+		"id":         id,
+		"name":       id,
+		"type":       "microsoft.authorization/roledefinitions",
+		"properties": map[string]interface{}{"roleName": roleName, "type": "CustomRole", "updatedOn": "2024-01-01T00:00:00Z"},
+	}
+}
+
+// Serves Resource Graph queries one row per page, so every query follows $skipToken.
+func (g *fakeResGraph) serveHTTP(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if r.URL.Path != "/arm/providers/Microsoft.ResourceGraph/resources" || r.Method != "POST" {
+			t.Errorf("unexpected call %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if g.failing {
+			writeJson(w, 400, map[string]interface{}{"error": map[string]interface{}{"code": "BadRequest"}})
+			return
+		}
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		query := utl.Str(payload["query"])
+		page := 0
+		if token := utl.Str(utl.Map(payload["options"])["$skipToken"]); token != "" {
+			fmt.Sscan(token, &page)
+		} else {
+			g.queries = append(g.queries, query)
+		}
+
+		ids := slices.Sorted(maps.Keys(g.defs))
+		if strings.Contains(query, "todatetime(") {
+			ids = g.changed
+		}
+		body := map[string]interface{}{"data": []interface{}{}}
+		if page < len(ids) {
+			row := g.defs[ids[page]]
+			if strings.HasSuffix(query, "| project id") {
+				row = AzureObject{"id": row["id"]}
+			}
+			body["data"] = []interface{}{row}
+			if page+1 < len(ids) {
+				body["$skipToken"] = fmt.Sprint(page + 1)
+			}
+		}
+		writeJson(w, 200, body)
+	}
+}
+
+func TestSyncResObjectsFromGraph(t *testing.T) {
+	newTestCacheConfig(t, CacheBackendGob) // Caches in a temporary directory
+	graph := &fakeResGraph{defs: map[string]AzureObject{
+		"def1": testRoleDefinitionRow("def1", "Role 1"),
+		"def2": testRoleDefinitionRow("def2", "Role 2"),
+		"def3": testRoleDefinitionRow("def3", "Role 3"),
+	}}
+	z := newTestConfig(t, graph.serveHTTP(t))
+	cache := mustGetCache(t, ResRoleDefinition, z)
+	roleNames := func() string {
+		names := []string{}
+		cache.Scan(func(obj AzureObject) bool {
+			names = append(names, ExtractID(obj)+"="+utl.Str(utl.Map(obj["properties"])["roleName"]))
+			return true
+		})
+		slices.Sort(names)
+		return fmt.Sprint(names)
+	}
+
+	// The first sync fetches all objects, across pages
+	if err := syncResObjectsFromGraph(t.Context(), ResRoleDefinition, cache, z); err != nil {
+		t.Fatalf("first sync failed: %v", err)
+	}
+	if got := roleNames(); got != "[def1=Role 1 def2=Role 2 def3=Role 3]" {
+		t.Errorf("first sync cached %s", got)
+	}
+	if syncTime, err := cache.LoadSyncTime(); err != nil || syncTime.IsZero() {
+		t.Errorf("first sync saved sync time %v, %v", syncTime, err)
+	}
+
+	// Later syncs only fetch the updated objects, and drop the deleted ones
+	graph.mu.Lock()
+	delete(graph.defs, "def1")
+	graph.defs["def2"] = testRoleDefinitionRow("def2", "Role 2 renamed")
+	graph.changed = []string{"def2"}
+	graph.queries = nil
+	graph.mu.Unlock()
+	if err := syncResObjectsFromGraph(t.Context(), ResRoleDefinition, cache, z); err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	if got := roleNames(); got != "[def2=Role 2 renamed def3=Role 3]" {
+		t.Errorf("second sync cached %s", got)
+	}
+	if len(graph.queries) != 2 || !strings.Contains(graph.queries[0], "todatetime(properties.updatedOn) > datetime(") {
+		t.Errorf("second sync sent queries %q, want one for updated objects and one for all IDs", graph.queries)
+	}
+
+	// A failed query leaves the cache as it was
+	graph.mu.Lock()
+	graph.failing = true
+	graph.mu.Unlock()
+	if err := syncResObjectsFromGraph(t.Context(), ResRoleDefinition, cache, z); err == nil {
+		t.Error("sync of a failing query returned no error")
+	}
+	if got := roleNames(); got != "[def2=Role 2 renamed def3=Role 3]" {
+		t.Errorf("failed sync left %s", got)
+	}
+}
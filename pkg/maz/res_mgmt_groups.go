@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 
@@ -30,7 +31,10 @@ func GetAzureMgmtGroupsIds(z *Config) (mgmtGroupIds []string) {
 	mgmtGroupIds = nil
 
 	// Optimize performance by using cached management groups; 'false' avoids querying Azure
-	mgmtGroups := GetMatchingAzureMgmtGroups("", false, z)
+	mgmtGroups, err := GetMatchingAzureMgmtGroups("", false, z)
+	if err != nil {
+		Logf("%v\n", err)
+	}
 
 	for i := range mgmtGroups {
 		group := mgmtGroups[i]
@@ -41,43 +45,55 @@ func GetAzureMgmtGroupsIds(z *Config) (mgmtGroupIds []string) {
 }
 
 // Gets all Azure management groups matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingAzureMgmtGroups(filter string, force bool, z *Config) AzureObjectList {
+func GetMatchingAzureMgmtGroups(filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingAzureMgmtGroupsContext(context.Background(), filter, force, z)
+}
+
+// Same as GetMatchingAzureMgmtGroups, but refreshes the cache from Azure under the given context.
+func GetMatchingAzureMgmtGroupsContext(ctx context.Context, filter string, force bool, z *Config) (AzureObjectList, error) {
 	// If the filter is a UUID, we deliberately treat it as an ID and perform a
 	// quick Azure lookup for the specific object.
 	if utl.ValidUuid(filter) {
 		obj := GetAzureMgmtGroupById(filter, z)
 		if obj != nil {
 			// If found, return a list containing just this object.
-			return AzureObjectList{obj}
+			return AzureObjectList{obj}, nil
 		}
 	}
 
 	// Get current cache, or initialize a new cache for this type
 	cache, err := GetCache(ManagementGroup, z)
 	if err != nil {
-		utl.Die("Error: %v\n", err)
+		return nil, wrapError(ErrFile, err, "error loading %s cache", MazTypeNames[ManagementGroup])
 	}
 
 	// Return an empty list if cache is nil and internet is not available
 	internetIsAvailable := utl.IsInternetAvailable()
 	if cache == nil && !internetIsAvailable {
-		return AzureObjectList{} // Return empty list
+		return AzureObjectList{}, nil // Return empty list
 	}
 
 	// Determine if cache is empty or outdated and needs to be refreshed from Azure
-	cacheNeedsRefreshing := force || cache.Count() < 1 || cache.Age() == 0 || cache.Age() > ConstMgCacheFileAgePeriod
+	cacheNeedsRefreshing := force || cache.resync || cache.Count() < 1 || cache.Age() == 0 ||
+		cache.Age() > ConstMgCacheFileAgePeriod
 	if internetIsAvailable && cacheNeedsRefreshing {
-		CacheAzureMgmtGroups(cache, z)
+		if err := CacheAzureMgmtGroupsContext(ctx, cache, z); err != nil {
+			return nil, err
+		}
 	}
 
 	// Filter the objects based on the provided filter
+	objects, err := cache.Objects()
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading %s cache", MazTypeNames[ManagementGroup])
+	}
 	if filter == "" {
-		return cache.data // Return all data if no filter is specified
+		return objects, nil // Return all data if no filter is specified
 	}
 	matchingList := AzureObjectList{} // Initialize an empty list for matching items
 	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
-	for i := range cache.data {
-		obj := cache.data[i]
+	for i := range objects {
+		obj := objects[i]
 		// Extract the ID: use the last part of the "id" path or fall back to the "name" field
 		id := utl.Str(obj["id"])
 		name := utl.Str(obj["name"])
@@ -99,28 +115,31 @@ func GetMatchingAzureMgmtGroups(filter string, force bool, z *Config) AzureObjec
 		}
 	}
 
-	return matchingList
+	return matchingList, nil
 }
 
 // Retrieves all Azure management groups objects in current tenant and saves them to
-// local cache. Note that we are updating the cache via its pointer, so no return value.
-func CacheAzureMgmtGroups(cache *Cache, z *Config) {
-	list := AzureObjectList{} // List of management group objects to cache
+// local cache. Note that we are updating the cache via its pointer, so only an error is returned.
+// They are synced from Resource Graph, and only listed with the ARM API if that fails.
+func CacheAzureMgmtGroups(cache *Cache, z *Config) error {
+	return CacheAzureMgmtGroupsContext(context.Background(), cache, z)
+}
+
+// Same as CacheAzureMgmtGroups, but fetches the objects under the given context. An interrupted
+// fetch leaves the cache as it was.
+func CacheAzureMgmtGroupsContext(ctx context.Context, cache *Cache, z *Config) error {
+	err := syncResObjectsFromGraph(ctx, ManagementGroup, cache, z)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	Logf("Resource Graph sync failed, listing management groups instead: %v\n", err)
 
 	// Get all managements groups from Azure
 	params := map[string]string{"api-version": "2023-04-01"}
-	apiUrl := ConstAzUrl + "/providers/Microsoft.Management/managementGroups"
-	var err error
-	resp, _, err := ApiGet(apiUrl, z, params)
-	if err != nil {
-		Logf("%v\n", err)
-	}
-	mgmtGroups := utl.Slice(resp["value"])
-	for i := range mgmtGroups {
-		obj := mgmtGroups[i]
-		if group := utl.Map(obj); group != nil {
-			list = append(list, group)
-		}
+	apiUrl := z.AzUrl + "/providers/Microsoft.Management/managementGroups"
+	list, err := ApiGetAllContext(ctx, apiUrl, z, params)
+	if err != nil && ctx.Err() == nil {
+		return apiError(err, 0, nil, "error fetching management groups")
 	}
 
 	// Trim and prepare all objects for caching
@@ -129,13 +148,16 @@ func CacheAzureMgmtGroups(cache *Cache, z *Config) {
 		list[i] = list[i].TrimForCache(ManagementGroup)
 	}
 
-	// Update the cache with the entire list of definitions
-	cache.data = list
+	// Don't replace the cache with an incomplete list
+	if err := ctx.Err(); err != nil {
+		return wrapError(ErrApiCall, err, "fetching management groups interrupted")
+	}
 
-	// Save updated cache
-	if err := cache.Save(); err != nil {
-		utl.Die("Error saving updated cache: %s\n", err.Error())
+	// Update the cache with the entire list of definitions
+	if err := cache.Replace(list); err != nil {
+		return wrapError(ErrFile, err, "error saving updated management groups cache")
 	}
+	return nil
 }
 
 // Recursively prints children management groups subscriptions
@@ -171,17 +193,16 @@ func PrintMgmtGroupChildren(indent int, children []interface{}) {
 }
 
 // Prints the current Azure tenant management group tree.
-func PrintAzureMgmtGroupTree(z *Config) {
-	apiUrl := ConstAzUrl + "/providers/Microsoft.Management/managementGroups/" + z.TenantId
+func PrintAzureMgmtGroupTree(z *Config) error {
+	apiUrl := z.AzUrl + "/providers/Microsoft.Management/managementGroups/" + z.TenantId
 	params := map[string]string{
 		"api-version": "2023-04-01",
 		"$expand":     "children",
 		"$recurse":    "true",
 	}
-	var err error
-	resp, _, err := ApiGet(apiUrl, z, params)
-	if err != nil {
-		Logf("%v\n", err)
+	resp, statCode, err := ApiGet(apiUrl, z, params)
+	if statCode != 200 {
+		return apiError(err, statCode, resp, "error getting management group tree")
 	}
 	if props := utl.Map(resp["properties"]); props != nil {
 		// Print top line of hierarchy in blue
@@ -193,6 +214,7 @@ func PrintAzureMgmtGroupTree(z *Config) {
 		children := utl.Slice(props["children"])
 		PrintMgmtGroupChildren(4, children)
 	}
+	return nil
 }
 
 // Gets a specific Azure management group by its stand-alone object UUID or name
@@ -205,7 +227,7 @@ func GetAzureMgmtGroupById(targetId string, z *Config) AzureObject {
 	// Fallback to using the ARM API way if above returns nothing
 
 	params := map[string]string{"api-version": "2023-04-01"}
-	apiUrl := ConstAzUrl + "/providers/Microsoft.Management/managementGroups/" + targetId
+	apiUrl := z.AzUrl + "/providers/Microsoft.Management/managementGroups/" + targetId
 	var err error
 	resp, _, err := ApiGet(apiUrl, z, params)
 	if err != nil {
@@ -217,15 +239,12 @@ func GetAzureMgmtGroupById(targetId string, z *Config) AzureObject {
 }
 
 // Returns count of all subscriptions in current Azure tenant
-func CountAzureMgmtGroups(z *Config) int64 {
+func CountAzureMgmtGroups(z *Config) (int64, error) {
 	params := map[string]string{"api-version": "2023-04-01"}
-	apiUrl := ConstAzUrl + "/providers/Microsoft.Management/managementGroups"
-	var err error
-	resp, _, err := ApiGet(apiUrl, z, params)
+	apiUrl := z.AzUrl + "/providers/Microsoft.Management/managementGroups"
+	mgmtGroups, err := ApiGetAll(apiUrl, z, params)
 	if err != nil {
-		Logf("%v\n", err)
+		return 0, wrapError(ErrApiCall, err, "error counting management groups")
 	}
-	mgmtGroups := utl.Slice(resp["value"])
-	count := len(mgmtGroups)
-	return int64(count)
+	return int64(len(mgmtGroups)), nil
 }
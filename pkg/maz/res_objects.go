@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"strings"
@@ -63,8 +64,8 @@ func GetAzureResObjectById(mazType, targetId string, z *Config) AzureObject {
 
 	// Post the query to the Resource Graph API call
 	params := map[string]string{"api-version": "2024-04-01"}
-	apiUrl := ConstAzUrl + "/providers/Microsoft.ResourceGraph/resources"
-	resp, statCode, _ := ApiPost(apiUrl, z, payload, params)
+	apiUrl := z.AzUrl + "/providers/Microsoft.ResourceGraph/resources"
+	resp, statCode, _ := ApiPostIdempotent(apiUrl, z, payload, params)
 	if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
 	}
@@ -118,8 +119,8 @@ func GetAzureResObjectByName(mazType, targetName string, z *Config) AzureObject
 
 	// Post the query to the Resource Graph API call
 	params := map[string]string{"api-version": "2024-04-01"}
-	apiUrl := ConstAzUrl + "/providers/Microsoft.ResourceGraph/resources"
-	resp, statCode, _ := ApiPost(apiUrl, z, payload, params)
+	apiUrl := z.AzUrl + "/providers/Microsoft.ResourceGraph/resources"
+	resp, statCode, _ := ApiPostIdempotent(apiUrl, z, payload, params)
 	if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
 	}
@@ -144,12 +145,14 @@ func GetAzureResObjectByName(mazType, targetName string, z *Config) AzureObject
 }
 
 // Fetch Azure resources across all role scopes concurrently, using parallel goroutines.
+// Returns an error only if ctx is cancelled, since the list is then incomplete.
 func fetchAzureObjectsAcrossScopes(
+	ctx context.Context,
 	endpointSuffix string,
 	z *Config,
 	params map[string]string,
 	mgroupIdMap, subIdMap map[string]string,
-) AzureObjectList {
+) (AzureObjectList, error) {
 	var (
 		list      = AzureObjectList{}
 		ids       = utl.StringSet{} // Tracks unique object names to prevent duplicates
@@ -165,27 +168,19 @@ func fetchAzureObjectsAcrossScopes(
 		wg.Add(1)
 		go func(scope string) {
 			defer wg.Done()
-
-			apiUrl := ConstAzUrl + scope + endpointSuffix
-			resp, statCode, _ := ApiGet(apiUrl, z, params)
-			if statCode != 200 {
-				Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-				return
-			}
-
-			items := utl.Slice(resp["value"])
-			if items == nil {
-				return // Skip if no items found
+			if ctx.Err() != nil {
+				return // Cancelled, don't start any more calls
 			}
 
+			apiUrl := z.AzUrl + scope + endpointSuffix
 			scopeList := AzureObjectList{}
 			count := 0
 
-			// Process each item in the response
-			for _, obj := range items {
-				objMap := utl.Map(obj)
-				if objMap == nil {
-					continue // Skip if object isn't a map
+			// Process each item across all the response pages
+			for objMap, err := range ApiItemsContext(ctx, apiUrl, z, params) {
+				if err != nil {
+					Logf("%s\n", utl.Red2(err.Error()))
+					break // Keep the items fetched so far
 				}
 				id := utl.Str(objMap["name"])
 
@@ -236,12 +231,16 @@ func fetchAzureObjectsAcrossScopes(
 		list = append(list, partial...)
 	}
 
-	return list
+	if err := ctx.Err(); err != nil {
+		return list, wrapError(ErrApiCall, err, "fetch across scopes interrupted")
+	}
+	return list, nil
 }
 
 // Generate a password expiry report for all Apps and Service Principals in the tenant.
-func PrintPasswordExpiryReport(csvMode bool, daysStr string, z *Config) {
+func PrintPasswordExpiryReport(csvMode bool, daysStr string, z *Config) error {
 	var combinedList AzureObjectList
+	var fetchErr error // First error hit by any of the goroutines below
 
 	// Normalize and parse days
 	if daysStr == "" {
@@ -281,11 +280,14 @@ func PrintPasswordExpiryReport(csvMode bool, daysStr string, z *Config) {
 		// Start a goroutine to query cache/Azure for this type in parallel
 		go func() {
 			defer wg.Done()
-			objs := fetchAndTagDirObjects(mazType, z)
+			objs, err := fetchAndTagDirObjects(mazType, z)
 			// Above helper function avoids the performance hit of locking/unlocking
 			// each if we were to do that here
 			Logf("%-3s count %5s\n", mazType, utl.Mag(utl.ToStr(len(objs))))
 			mu.Lock()
+			if err != nil && fetchErr == nil {
+				fetchErr = err
+			}
 			combinedList = append(combinedList, objs...)
 			mu.Unlock()
 		}()
@@ -293,6 +295,9 @@ func PrintPasswordExpiryReport(csvMode bool, daysStr string, z *Config) {
 
 	wg.Wait() // Wait for all goroutines to finish
 	// ====
+	if fetchErr != nil {
+		return fetchErr
+	}
 
 	Logf("Combined count  %5s\n", utl.Mag(utl.ToStr(len(combinedList))))
 
@@ -317,15 +322,21 @@ func PrintPasswordExpiryReport(csvMode bool, daysStr string, z *Config) {
 			)
 		}
 	}
+	return nil
 }
 
-// Fetch and tag directory objects for the given type in parallel-safe format.
-func fetchAndTagDirObjects(mazType string, z *Config) AzureObjectList {
-	list := GetMatchingDirObjects(mazType, "", true, z)
+// Fetch and tag directory objects for the given type in parallel-safe format. The cache is
+// always refreshed first, which for applications and service principals only fetches the
+// changes since the last refresh.
+func fetchAndTagDirObjects(mazType string, z *Config) (AzureObjectList, error) {
+	list, err := GetMatchingDirObjects(mazType, "", true, z)
+	if err != nil {
+		return nil, err
+	}
 	for _, obj := range list {
 		obj["maz_type"] = mazType
 	}
-	return list
+	return list, nil
 }
 
 // Print details of secrets that are expiring within the specified number of days.
@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"strings"
@@ -11,38 +12,48 @@ import (
 )
 
 // Prints resource role assignment object in YAML-like format
-func PrintResRoleAssignment(obj AzureObject, z *Config) {
+func PrintResRoleAssignment(obj AzureObject, z *Config) error {
 	id := utl.Str(obj["name"])
 	if id == "" {
-		return
+		return nil
 	}
-	fmt.Printf("%s\n", utl.Gra("# Resource role assignment"))
-	fmt.Printf("%s: %s\n", utl.Blu("id"), utl.Gre(id))
 	props := utl.Map(obj["properties"])
 	if props == nil {
-		utl.Die("%s\n", utl.Red("  <Missing properties?>"))
+		return newError(ErrValidation, "resource role assignment %s is missing properties", id)
 	}
-	fmt.Println(utl.Blu("properties") + ":")
 
-	// Get all role definition id:name pairs to print their names as comments
-	roleIdMap := GetIdNameMap(ResRoleDefinition, z)
-	roleDefinitionId := path.Base(utl.Str(props["roleDefinitionId"]))
-	comment := "# Role '" + roleIdMap[roleDefinitionId] + "'"
-	fmt.Printf("  %s: %s  %s\n", utl.Blu("roleDefinitionId"), utl.Gre(roleDefinitionId), utl.Gra(comment))
-
-	// Get all id:name pairs for the principal type, to print their names as comments
+	// Get all role definition, principal and subscription id:name pairs to print their names as comments
+	roleIdMap, err := GetIdNameMap(ResRoleDefinition, z)
+	if err != nil {
+		return err
+	}
 	var principalIdMap map[string]string = nil
 	pType := utl.Str(props["principalType"])
 	switch pType {
 	case "Group":
-		principalIdMap = GetIdNameMap(DirectoryGroup, z) // Get all group id:name pairs
+		principalIdMap, err = GetIdNameMap(DirectoryGroup, z) // Get all group id:name pairs
 	case "User":
-		principalIdMap = GetIdNameMap(DirectoryUser, z) // Get all users id:name pairs
+		principalIdMap, err = GetIdNameMap(DirectoryUser, z) // Get all users id:name pairs
 	case "ServicePrincipal":
-		principalIdMap = GetIdNameMap(ServicePrincipal, z) // Get all SPs id:name pairs
+		principalIdMap, err = GetIdNameMap(ServicePrincipal, z) // Get all SPs id:name pairs
 	default:
 		pType = "UnknownPrincipalType"
 	}
+	if err != nil {
+		return err
+	}
+	subIdMap, err := GetIdNameMap(Subscription, z)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", utl.Gra("# Resource role assignment"))
+	fmt.Printf("%s: %s\n", utl.Blu("id"), utl.Gre(id))
+	fmt.Println(utl.Blu("properties") + ":")
+	roleDefinitionId := path.Base(utl.Str(props["roleDefinitionId"]))
+	comment := "# Role '" + roleIdMap[roleDefinitionId] + "'"
+	fmt.Printf("  %s: %s  %s\n", utl.Blu("roleDefinitionId"), utl.Gre(roleDefinitionId), utl.Gra(comment))
+
 	principalId := utl.Str(props["principalId"])
 	pName := principalIdMap[principalId]
 	if pName == "" {
@@ -51,8 +62,6 @@ func PrintResRoleAssignment(obj AzureObject, z *Config) {
 	comment = "# " + pType + " '" + pName + "'"
 	fmt.Printf("  %s: %s  %s\n", utl.Blu("principalId"), utl.Gre(principalId), utl.Gra(comment))
 
-	// Get all subscription id:name pairs, to print their names as comments
-	subIdMap := GetIdNameMap(Subscription, z)
 	scope := utl.Str(props["scope"])
 	colorKey := utl.Blu("scope")
 	colorValue := utl.Gre(scope)
@@ -65,6 +74,7 @@ func PrintResRoleAssignment(obj AzureObject, z *Config) {
 	} else {
 		fmt.Printf("  %s: %s\n", colorKey, colorValue)
 	}
+	return nil
 }
 
 // Helper function to check if the object is a resource role assignment
@@ -95,32 +105,35 @@ func IsResRoleAssignment(obj AzureObject) bool {
 }
 
 // Prints a human-readable report of all Azure resource role assignments in the tenant
-func PrintResRoleAssignmentReport(z *Config) {
+func PrintResRoleAssignmentReport(z *Config) error {
 	totalStart := time.Now()
 
-	start := time.Now()
-	roleIdMap := GetIdNameMap(ResRoleDefinition, z)
-	Logf("Fetched role definition ID map      in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
-
-	start = time.Now()
-	subIdMap := GetIdNameMap(Subscription, z)
-	Logf("Fetched subscription ID map         in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
-
-	start = time.Now()
-	groupIdMap := GetIdNameMap(DirectoryGroup, z)
-	Logf("Fetched group ID map                in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
-
-	start = time.Now()
-	userIdMap := GetIdNameMap(DirectoryUser, z)
-	Logf("Fetched user ID map                 in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
-
-	start = time.Now()
-	spIdMap := GetIdNameMap(ServicePrincipal, z)
-	Logf("Fetched service principal ID map    in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
+	// Fetch all the id:name maps needed to resolve the attribute names
+	idMaps := make(map[string]map[string]string)
+	for _, m := range []struct{ mazType, label string }{
+		{ResRoleDefinition, "role definition ID map     "},
+		{Subscription, "subscription ID map        "},
+		{DirectoryGroup, "group ID map               "},
+		{DirectoryUser, "user ID map                "},
+		{ServicePrincipal, "service principal ID map   "},
+	} {
+		start := time.Now()
+		idMap, err := GetIdNameMap(m.mazType, z)
+		if err != nil {
+			return err
+		}
+		idMaps[m.mazType] = idMap
+		Logf("Fetched %s in %s ms\n", m.label, utl.Cya(fmt.Sprintf("%6d", time.Since(start).Milliseconds())))
+	}
+	roleIdMap, subIdMap := idMaps[ResRoleDefinition], idMaps[Subscription]
+	groupIdMap, userIdMap, spIdMap := idMaps[DirectoryGroup], idMaps[DirectoryUser], idMaps[ServicePrincipal]
 
 	Logf("Total ID map fetch time             in %s ms\n", utl.Cya(fmt.Sprintf("%6d", time.Since(totalStart).Milliseconds())))
 
-	assignments := GetMatchingResRoleAssignments("", false, z)
+	assignments, err := GetMatchingResRoleAssignments("", false, z)
+	if err != nil {
+		return err
+	}
 
 	for i := range assignments {
 		assignment := assignments[i]
@@ -153,14 +166,15 @@ func PrintResRoleAssignmentReport(z *Config) {
 		fmt.Printf("\"%s\",\"%s\",\"%s\",\"%s\"\n", roleIdMap[roleDefinitionId],
 			principalName, principalType, scope)
 	}
+	return nil
 }
 
 // Checks if object conforms to an Azure resource role assignment format. If it's valid,
 // return the three key values: roleDefinitionId, principalId, and scope.
-func ValidateResRoleAssignmentObject(obj AzureObject, z *Config) (string, string, string) {
+func ValidateResRoleAssignmentObject(obj AzureObject, z *Config) (string, string, string, error) {
 	props := utl.Map(obj["properties"])
 	if props == nil {
-		utl.Die("Error with object's %s map\n", utl.Red("properties"))
+		return "", "", "", newError(ErrValidation, "error with object's properties map")
 	}
 
 	roleDefinitionId := utl.Str(props["roleDefinitionId"])
@@ -169,20 +183,23 @@ func ValidateResRoleAssignmentObject(obj AzureObject, z *Config) (string, string
 	scope := utl.Str(props["scope"])
 
 	if roleDefinitionId == "" || principalId == "" || scope == "" {
-		utl.Die("Specfile is missing required attributes. Need at least:\n\n" +
-			"properties:\n" +
-			"    roleDefinitionId: <UUID or fully_qualified_roleDefinitionId>\n" +
-			"    principalId:      <UUID>\n" +
-			"    scope:            <resource_path_scope>\n\n" +
-			"See utility '-k*' options to create properly formatted sample files.\n")
+		return "", "", "", newError(ErrValidation, "specfile is missing required attributes. Need at least:\n\n"+
+			"properties:\n"+
+			"    roleDefinitionId: <UUID or fully_qualified_roleDefinitionId>\n"+
+			"    principalId:      <UUID>\n"+
+			"    scope:            <resource_path_scope>\n\n"+
+			"See utility '-k*' options to create properly formatted sample files")
 	}
 
-	return roleDefinitionId, principalId, scope
+	return roleDefinitionId, principalId, scope, nil
 }
 
 // Creates an Azure resource role assignment as defined by give object
-func CreateAzureResRoleAssignment(force bool, obj AzureObject, z *Config) {
-	roleDefinitionId, principalId, scope := ValidateResRoleAssignmentObject(obj, z)
+func CreateAzureResRoleAssignment(force bool, obj AzureObject, z *Config) error {
+	roleDefinitionId, principalId, scope, err := ValidateResRoleAssignmentObject(obj, z)
+	if err != nil {
+		return err
+	}
 
 	// Check if role assignment already exists
 	id, _ := GetAzureResRoleAssignmentBy3Args(roleDefinitionId, principalId, scope, z)
@@ -190,16 +207,18 @@ func CreateAzureResRoleAssignment(force bool, obj AzureObject, z *Config) {
 		// Does not exist, let's generate a new UUID to try to create below
 		id = uuid.New().String()
 	} else {
-		utl.Die("This role assignment %s exists with ID %s\n", utl.Yel("already"), utl.Yel(id))
+		return newError(ErrValidation, "this role assignment already exists with ID %s", id)
 	}
 	obj["name"] = id // This, so that it's printable in below prompt
 
 	// Prompt to create
-	PrintResRoleAssignment(obj, z)
+	if err := PrintResRoleAssignment(obj, z); err != nil {
+		return err
+	}
 	if !force {
 		msg := "CREATE above role assignment? y/n"
-		if utl.PromptMsg(utl.Yel(msg)) != 'y' {
-			utl.Die("Aborted.\n")
+		if err := confirmAction(utl.Yel(msg)); err != nil {
+			return err
 		}
 	}
 
@@ -211,129 +230,141 @@ func CreateAzureResRoleAssignment(force bool, obj AzureObject, z *Config) {
 		},
 	}
 	params := map[string]string{"api-version": "2022-04-01"}
-	apiUrl := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments/" + id
-	resp, statCode, _ := ApiPut(apiUrl, z, payload, params)
+	apiUrl := z.AzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments/" + id
+	resp, statCode, err := ApiPutAndWait(apiUrl, z, payload, params)
 	if statCode != 200 && statCode != 201 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error creating role assignment")
 	}
-	if statCode == 200 || statCode == 201 {
-		fmt.Printf("%s\n", utl.Gre("Successfully CREATED role assignment!"))
-		azObj := AzureObject(resp) // Cast newly created assignment object to our standard type
+	fmt.Printf("%s\n", utl.Gre("Successfully CREATED role assignment!"))
+	azObj := AzureObject(resp) // Cast newly created assignment object to our standard type
 
-		// Upsert object in local cache also
-		cache, err := GetCache(ResRoleAssignment, z)
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
+	// Upsert object in local cache also
+	cache, err := GetCache(ResRoleAssignment, z)
+	if err == nil {
 		err = cache.Upsert(azObj.TrimForCache(ResRoleAssignment))
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
-		if err := cache.Save(); err != nil {
-			Logf("Failed to save cache: %v", err)
-		}
-	} else {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		fmt.Printf("%s\n", utl.Red(msg))
 	}
+	if err != nil {
+		return wrapError(ErrFile, err, "role assignment was created, but updating the local cache failed")
+	}
+	if err := cache.Save(); err != nil {
+		Logf("Failed to save cache: %v", err)
+	}
+	return nil
 }
 
 // Deletes an Azure resource role assignment as defined by given object
-func DeleteAzureResRoleAssignment(force bool, obj AzureObject, z *Config) {
-	roleDefinitionId, principalId, scope := ValidateResRoleAssignmentObject(obj, z)
+func DeleteAzureResRoleAssignment(force bool, obj AzureObject, z *Config) error {
+	roleDefinitionId, principalId, scope, err := ValidateResRoleAssignmentObject(obj, z)
+	if err != nil {
+		return err
+	}
 
 	// Check if role assignment exists
 	azureId, _ := GetAzureResRoleAssignmentBy3Args(roleDefinitionId, principalId, scope, z)
 	if azureId == "" {
-		utl.Die("This role assignment does %s exist in Azure\n", utl.Yel("not"))
+		return newError(ErrNotFound, "this role assignment does not exist in Azure")
 	}
 	obj["name"] = azureId // So Print function can print it and we can see it in below prompt
 
 	// Prompt to delete
-	PrintResRoleAssignment(obj, z)
+	if err := PrintResRoleAssignment(obj, z); err != nil {
+		return err
+	}
 	if !force {
 		msg := "DELETE above role assignment? y/n"
-		if utl.PromptMsg(utl.Yel(msg)) != 'y' {
-			utl.Die("Aborted.\n")
+		if err := confirmAction(utl.Yel(msg)); err != nil {
+			return err
 		}
 	}
 
 	// Delete the assignment by scope and 'name' (stand-alone UUID)
 	// See learn.microsoft.com/en-us/rest/api/authorization/role-assignments/delete
 	params := map[string]string{"api-version": "2022-04-01"}
-	apiUrl := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments/" + azureId
-	resp, statCode, _ := ApiDelete(apiUrl, z, params)
-	if statCode != 200 {
+	apiUrl := z.AzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments/" + azureId
+	resp, statCode, err := ApiDeleteAndWait(apiUrl, z, params)
+	if statCode == 204 {
+		// ARM returns 204 No Content when there was no such assignment to delete
+		return newError(ErrNotFound, "role assignment %s was not found in Azure", azureId)
+	} else if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error deleting role assignment")
 	}
-	if statCode == 200 {
-		fmt.Printf("%s\n", utl.Gre("Successfully DELETED role assignment!"))
+	fmt.Printf("%s\n", utl.Gre("Successfully DELETED role assignment!"))
 
-		// Also remove from local cache
-		cache, err := GetCache(ResRoleAssignment, z)
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
+	// Also remove from local cache
+	cache, err := GetCache(ResRoleAssignment, z)
+	if err == nil {
 		err = cache.Delete(azureId)
-		if err == nil { // Only save if deletion succeeded
-			err = cache.Save()
-		}
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
-	} else if statCode == 204 {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		utl.Die("%s\n", utl.Yel(msg))
-	} else {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		utl.Die("%s\n", utl.Red(msg))
 	}
+	if err == nil { // Only save if deletion succeeded
+		err = cache.Save()
+	}
+	if err != nil {
+		return wrapError(ErrFile, err, "role assignment was deleted, but updating the local cache failed")
+	}
+	return nil
 }
 
 // Calculates count of all role assignment objects in Azure
-func RoleAssignmentsCountAzure(z *Config) int64 {
-	list := GetMatchingResRoleAssignments("", false, z) // false = quiet
-	return int64(len(list))
+func RoleAssignmentsCountAzure(z *Config) (int64, error) {
+	list, err := GetMatchingResRoleAssignments("", false, z) // false = quiet
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(list)), nil
 }
 
 // Gets all resource role assignments matching on 'filter'. Return entire list if filter is empty ""
-func GetMatchingResRoleAssignments(filter string, force bool, z *Config) (list AzureObjectList) {
+func GetMatchingResRoleAssignments(filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingResRoleAssignmentsContext(context.Background(), filter, force, z)
+}
+
+// Same as GetMatchingResRoleAssignments, but refreshes the cache from Azure under the given context.
+func GetMatchingResRoleAssignmentsContext(ctx context.Context, filter string, force bool, z *Config) (AzureObjectList, error) {
 	// If the filter is a UUID, we deliberately treat it as an ID and perform a
 	// quick Azure lookup for the specific object.
 	if utl.ValidUuid(filter) {
 		singleAssignment := GetAzureResRoleAssignmentById(filter, z)
 		if singleAssignment != nil {
 			// If found, return a list containing just this object.
-			return AzureObjectList{singleAssignment}
+			return AzureObjectList{singleAssignment}, nil
 		}
 	}
 
 	// Get current cache, or initialize a new cache for this type
 	cache, err := GetCache(ResRoleAssignment, z)
 	if err != nil {
-		utl.Die("Error: %v\n", err)
+		return nil, wrapError(ErrFile, err, "error loading %s cache", MazTypeNames[ResRoleAssignment])
 	}
 
 	// Return an empty list if cache is nil and internet is not available
 	internetIsAvailable := utl.IsInternetAvailable()
 	if cache == nil && !internetIsAvailable {
-		return AzureObjectList{} // Return empty list
+		return AzureObjectList{}, nil // Return empty list
 	}
 
 	// Determine if cache is empty or outdated and needs to be refreshed from Azure
-	cacheNeedsRefreshing := force || cache.Count() < 1 || cache.Age() == 0 || cache.Age() > ConstMgCacheFileAgePeriod
+	cacheNeedsRefreshing := force || cache.resync || cache.Count() < 1 || cache.Age() == 0 ||
+		cache.Age() > ConstMgCacheFileAgePeriod
 	if internetIsAvailable && cacheNeedsRefreshing {
-		CacheAzureResRoleAssignments(cache, z)
+		if err := CacheAzureResRoleAssignmentsContext(ctx, cache, z); err != nil {
+			return nil, err
+		}
 	}
 
 	// Filter the objects based on the provided filter
+	objects, err := cache.Objects()
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading %s cache", MazTypeNames[ResRoleAssignment])
+	}
 	if filter == "" {
-		return cache.data // Return all data if no filter is specified
+		return objects, nil // Return all data if no filter is specified
 	}
 	matchingList := AzureObjectList{} // Initialize an empty list for matching items
 	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
-	for i := range cache.data {
-		assignment := cache.data[i] // No need to cast; should already be AzureObject type
+	for i := range objects {
+		assignment := objects[i] // No need to cast; should already be AzureObject type
 		if assignment == nil {
 			continue // But skip if it is nil for whatever reason
 		}
@@ -359,26 +390,49 @@ func GetMatchingResRoleAssignments(filter string, force bool, z *Config) (list A
 		}
 	}
 
-	return matchingList
+	return matchingList, nil
 }
 
 // Retrieves all Azure resource role assignments in current tenant and saves them
-// to local cache. Note that we are updating the cache via its pointer, so no return values.
-func CacheAzureResRoleAssignments(cache *Cache, z *Config) {
+// to local cache. Note that we are updating the cache via its pointer, so only an error is returned.
+// They are synced from Resource Graph, and only listed scope by scope if that fails.
+func CacheAzureResRoleAssignments(cache *Cache, z *Config) error {
+	return CacheAzureResRoleAssignmentsContext(context.Background(), cache, z)
+}
+
+// Same as CacheAzureResRoleAssignments, but fetches the objects under the given context. An interrupted
+// fetch leaves the cache as it was.
+func CacheAzureResRoleAssignmentsContext(ctx context.Context, cache *Cache, z *Config) error {
+	err := syncResObjectsFromGraph(ctx, ResRoleAssignment, cache, z)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	Logf("Resource Graph sync failed, listing all scopes instead: %v\n", err)
+
 	params := map[string]string{"api-version": "2022-04-01"}
 
 	// Prepare ID name maps for more informative logging
-	mgroupIdMap := GetIdNameMap(ManagementGroup, z)
-	subIdMap := GetIdNameMap(Subscription, z)
+	mgroupIdMap, err := GetIdNameMap(ManagementGroup, z)
+	if err != nil {
+		return err
+	}
+	subIdMap, err := GetIdNameMap(Subscription, z)
+	if err != nil {
+		return err
+	}
 
 	// Fetch all assignments across scopes concurrently using parallel goroutines function
-	allAssignments := fetchAzureObjectsAcrossScopes(
+	allAssignments, err := fetchAzureObjectsAcrossScopes(
+		ctx,
 		"/providers/Microsoft.Authorization/roleAssignments",
 		z,
 		params,
 		mgroupIdMap,
 		subIdMap,
 	)
+	if err != nil {
+		return err // Don't replace the cache with an incomplete list
+	}
 
 	ids := utl.StringSet{}
 	list := AzureObjectList{}
@@ -400,11 +454,10 @@ func CacheAzureResRoleAssignments(cache *Cache, z *Config) {
 		list[i] = list[i].TrimForCache(ResRoleAssignment)
 	}
 
-	cache.data = list
-
-	if err := cache.Save(); err != nil {
-		utl.Die("Error saving updated resource role assignment cache: %v\n", err.Error())
+	if err := cache.Replace(list); err != nil {
+		return wrapError(ErrFile, err, "error saving updated resource role assignment cache")
 	}
+	return nil
 }
 
 // Retrieves Azure resource role assignment by matching on the three values that
@@ -420,26 +473,21 @@ func GetAzureResRoleAssignmentBy3Args(targetRoleDefinitionId, targetPrincipalId,
 		"api-version": "2022-04-01",
 		"$filter":     "principalId eq '" + targetPrincipalId + "'",
 	}
-	apiUrl := ConstAzUrl + targetScope + "/providers/Microsoft.Authorization/roleAssignments"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	assignments := utl.Slice(resp["value"])
-	if len(assignments) > 0 { // Inspect all qualifying assignments for this principalId
-		for i := range assignments {
-			element := assignments[i]
-			assignment := utl.Map(element)             // Try casting object to a map
-			props := utl.Map(assignment["properties"]) // Try casting its properties to a map
-			if assignment == nil || props == nil {
-				continue // Skip this entry if neither is a valid map
-			}
-			// Compare this entry to the target we're looking for
-			id := utl.Str(assignment["name"])
-			roleDefinitionId := path.Base(utl.Str(props["roleDefinitionId"]))
-			if roleDefinitionId == targetRoleDefinitionId {
-				return id, AzureObject(assignment) // If they match, return immediately
-			}
+	apiUrl := z.AzUrl + targetScope + "/providers/Microsoft.Authorization/roleAssignments"
+	for assignment, err := range ApiItems(apiUrl, z, params) { // Inspect all qualifying assignments for this principalId
+		if err != nil {
+			Logf("%s\n", utl.Red2(err.Error()))
+			break
+		}
+		props := utl.Map(assignment["properties"]) // Try casting its properties to a map
+		if props == nil {
+			continue // Skip this entry if it's not a valid map
+		}
+		// Compare this entry to the target we're looking for
+		id := utl.Str(assignment["name"])
+		roleDefinitionId := path.Base(utl.Str(props["roleDefinitionId"]))
+		if roleDefinitionId == targetRoleDefinitionId {
+			return id, AzureObject(assignment) // If they match, return immediately
 		}
 	}
 	return "", nil
@@ -459,7 +507,10 @@ func GetAzureResRoleAssignmentById(targetId string, z *Config) AzureObject {
 	suffix := "/providers/Microsoft.Authorization/roleAssignments/" + targetId
 
 	// Fetch all assignments across scopes concurrently using parallel goroutines function
-	assignments := fetchAzureObjectsAcrossScopes(suffix, z, params, nil, nil)
+	assignments, err := fetchAzureObjectsAcrossScopes(context.Background(), suffix, z, params, nil, nil)
+	if err != nil {
+		Logf("%v\n", err)
+	}
 
 	for _, assignment := range assignments {
 		if id := utl.Str(assignment["name"]); id == targetId {
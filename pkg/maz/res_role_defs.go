@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"path/filepath"
@@ -11,18 +12,18 @@ import (
 )
 
 // Prints resource role definition object in a YAML-like format
-func PrintResRoleDefinition(obj AzureObject, z *Config) {
+func PrintResRoleDefinition(obj AzureObject, z *Config) error {
 	id := utl.Str(obj["name"])
 	if id == "" {
-		return
+		return nil
 	}
 
-	fmt.Printf("%s\n", utl.Gra("# Resource role definition"))
-	fmt.Printf("%s: %s\n", utl.Blu("id"), utl.Gre(id))
 	props := utl.Map(obj["properties"])
 	if props == nil {
-		utl.Die("%s\n", utl.Red("  <Missing properties??>"))
+		return newError(ErrValidation, "resource role definition %s is missing properties", id)
 	}
+	fmt.Printf("%s\n", utl.Gra("# Resource role definition"))
+	fmt.Printf("%s: %s\n", utl.Blu("id"), utl.Gre(id))
 	fmt.Println(utl.Blu("properties") + ":")
 
 	for _, item := range []string{"type", "roleName", "description"} {
@@ -39,7 +40,10 @@ func PrintResRoleDefinition(obj AzureObject, z *Config) {
 		if len(assignableScopes) < 1 {
 			fmt.Println(utl.Red("    <Error: Role 'assignableScopes' slice has no entries?>\n"))
 		} else {
-			subIdMap := GetIdNameMap(Subscription, z) // Get all subscription id:name pairs
+			subIdMap, err := GetIdNameMap(Subscription, z) // Get all subscription id:name pairs
+			if err != nil {
+				return err
+			}
 			for _, item := range assignableScopes {
 				if scope := utl.Str(item); scope != "" {
 					if strings.HasPrefix(scope, "/subscriptions") {
@@ -68,7 +72,7 @@ func PrintResRoleDefinition(obj AzureObject, z *Config) {
 		// Select and focus on the one expected single permission set
 		perms := utl.Map(permissions[0])
 		if perms == nil {
-			utl.Die("%s\n", utl.Red("    <Error. The expected single permission set is empty.>"))
+			return newError(ErrValidation, "resource role definition %s permission set is empty", id)
 		}
 
 		// Print the 4 sets of permissions type
@@ -122,6 +126,7 @@ func PrintResRoleDefinition(obj AzureObject, z *Config) {
 			fmt.Println("[]")
 		}
 	}
+	return nil
 }
 
 // Helper function to check if the object is a resource role definition
@@ -162,53 +167,51 @@ func IsResRoleDefinition(obj AzureObject) bool {
 
 // Validates given object to ensure if conforms to the format of an Azure resource
 // role definition. If it is valid, return the roleName and the firstScope.
-func ValidateResRoleDefinitionObject(obj AzureObject, z *Config) (string, string) {
+func ValidateResRoleDefinitionObject(obj AzureObject, z *Config) (string, string, error) {
 	props := utl.Map(obj["properties"])
 	if props == nil {
-		utl.Die("Error. Object 'properties' is not a map, but a %T\n", obj["properties"])
+		return "", "", newError(ErrValidation, "object 'properties' is not a map, but a %T", obj["properties"])
 	}
 
 	// Check if the object is a definition
 	roleName := utl.Str(props["roleName"])
 	if roleName == "" {
-		utl.Die("Error. Object is not a role definition. Missing %s in properties\n",
-			utl.Red("roleName"))
+		return "", "", newError(ErrValidation, "object is not a role definition, missing roleName in properties")
 	}
 
 	// Validate DEFINITION
 	for _, key := range []string{"description", "assignableScopes"} {
 		if _, exists := props[key]; !exists {
-			utl.Die("Missing required key: properties.%s\n", utl.Red(key))
+			return "", "", newError(ErrValidation, "missing required key: properties.%s", key)
 		}
 	}
 
 	scopes := utl.Slice(props["assignableScopes"])
 	if scopes == nil {
-		utl.Die("Error. Object properties.%s is not a slice\n", utl.Red("assignableScopes"))
+		return "", "", newError(ErrValidation, "object properties.assignableScopes is not a slice")
 	}
 
 	if len(scopes) < 1 {
-		utl.Die("Error. Object properties.%s has no entries\n", utl.Red("assignableScopes"))
+		return "", "", newError(ErrValidation, "object properties.assignableScopes has no entries")
 	}
 
 	firstScope := utl.Str(scopes[0])
 	if !strings.HasPrefix(firstScope, "/") {
-		utl.Die("Error. Object properties.%s entry 0 does not start with '/'\n",
-			utl.Red("assignableScopes"))
+		return "", "", newError(ErrValidation, "object properties.assignableScopes entry 0 does not start with '/'")
 	}
 
 	isMgmtGroupScope := strings.HasPrefix(firstScope, "/providers/Microsoft.Management/managementGroups")
 	isTenantMismatch := filepath.Base(firstScope) != z.TenantId
 	if isMgmtGroupScope && isTenantMismatch {
-		utl.Die("Error. Object assignableScopes entry %s does not match with target tenant ID %s\n",
-			utl.Red(firstScope), utl.Red(z.TenantId))
+		return "", "", newError(ErrValidation, "object assignableScopes entry %s does not match with "+
+			"target tenant ID %s", firstScope, z.TenantId)
 	}
 
-	return roleName, firstScope
+	return roleName, firstScope, nil
 }
 
 // Renames resource role definition
-func RenameResRoleDefinition(force bool, currentName, newName string, z *Config) {
+func RenameResRoleDefinition(force bool, currentName, newName string, z *Config) error {
 	mazTypeName := "resource role definition"
 	// Retrieve the current object
 	var obj AzureObject
@@ -220,12 +223,15 @@ func RenameResRoleDefinition(force bool, currentName, newName string, z *Config)
 			for i := range list {
 				PrintTersely(ResRoleDefinition, list[i])
 			}
-			utl.Die("There are multiple %s with this name. Cannot rename. Try renaming by ID:",
-				utl.Yel(mazTypeName))
+			return newError(ErrAmbiguousName, "there are multiple %s objects named '%s', try renaming by ID",
+				mazTypeName, currentName)
 		} else if len(list) == 1 {
 			obj = list[0]
 		}
 	}
+	if obj == nil {
+		return newError(ErrNotFound, "no %s with identifier '%s'", mazTypeName, currentName)
+	}
 
 	// Get existing object actual id and name
 	id := utl.Str(obj["name"]) // The standalone UUID
@@ -234,13 +240,16 @@ func RenameResRoleDefinition(force bool, currentName, newName string, z *Config)
 
 	// Rename it
 	Logf("Renaming %s %s FROM %s TO %s\n", mazTypeName, id, utl.Yel(existingName), utl.Yel(newName))
-	obj["properties"].(map[string]interface{})["roleName"] = newName // Rename it
-	UpsertAzureResRoleDefinition(force, obj, z)
+	props["roleName"] = newName // Rename it
+	return UpsertAzureResRoleDefinition(force, obj, z)
 }
 
 // Creates or updates an Azure resource role definition as defined by given object
-func UpsertAzureResRoleDefinition(force bool, obj AzureObject, z *Config) {
-	roleName, firstScope := ValidateResRoleDefinitionObject(obj, z)
+func UpsertAzureResRoleDefinition(force bool, obj AzureObject, z *Config) error {
+	roleName, firstScope, err := ValidateResRoleDefinitionObject(obj, z)
+	if err != nil {
+		return err
+	}
 
 	// Ensure required 'type' is set to CustomRole. Below addition with an assertion works because
 	// we have already validated that 'properties' is indeed part of the object's structure.
@@ -266,14 +275,14 @@ func UpsertAzureResRoleDefinition(force bool, obj AzureObject, z *Config) {
 	// Prompt to create/update
 	if action == "UPDATE" {
 		DiffRoleDefinitionSpecfileVsAzure(obj, azureObj)
-	} else {
-		PrintResRoleDefinition(obj, z)
+	} else if err := PrintResRoleDefinition(obj, z); err != nil {
+		return err
 	}
 
 	if !force {
 		msg := fmt.Sprintf("%s above role definition? y/n", action)
-		if utl.PromptMsg(utl.Yel(msg)) != 'y' {
-			utl.Die("Aborted.\n")
+		if err := confirmAction(utl.Yel(msg)); err != nil {
+			return err
 		}
 	}
 
@@ -282,51 +291,52 @@ func UpsertAzureResRoleDefinition(force bool, obj AzureObject, z *Config) {
 	// Call API to create or update definition
 	payload := obj // Obviously using the inputed object as the payload
 	params := map[string]string{"api-version": "2022-04-01"}
-	apiUrl := ConstAzUrl + firstScope + ApiEndpoint[mazType] + "/" + id
-	resp, statCode, _ := ApiPut(apiUrl, z, payload, params)
-	if statCode != 201 {
+	apiUrl := z.AzUrl + firstScope + ApiEndpoint[mazType] + "/" + id
+	resp, statCode, err := ApiPutAndWait(apiUrl, z, payload, params)
+	if statCode != 200 && statCode != 201 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error %s %s", strings.ToLower(action)+"ing", MazTypeNames[mazType])
 	}
-	if statCode == 201 {
-		msg := fmt.Sprintf("Successfully %sD %s!", action, MazTypeNames[mazType])
-		fmt.Printf("%s\n", utl.Gre(msg))
+	msg := fmt.Sprintf("Successfully %sD %s!", action, MazTypeNames[mazType])
+	fmt.Printf("%s\n", utl.Gre(msg))
 
-		// Upsert object in local cache also
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
+	// Upsert object in local cache also
+	cache, err := GetCache(mazType, z)
+	if err == nil {
 		err = cache.Upsert(obj.TrimForCache(mazType))
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
-		if err := cache.Save(); err != nil {
-			Logf("Failed to save cache: %v", err)
-		}
-		Logf("Successfully updated %s cache entry %s\n", MazTypeNames[mazType], id)
-	} else {
-		utl.Die("%s\n", utl.Red(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
 	}
+	if err != nil {
+		return wrapError(ErrFile, err, "%s was saved, but updating the local cache failed", MazTypeNames[mazType])
+	}
+	if err := cache.Save(); err != nil {
+		Logf("Failed to save cache: %v", err)
+	}
+	Logf("Successfully updated %s cache entry %s\n", MazTypeNames[mazType], id)
+	return nil
 }
 
 // Deletes a role definition as defined by given object
-func DeleteResRoleDefinition(force bool, obj AzureObject, z *Config) {
-	roleName, firstScope := ValidateResRoleDefinitionObject(obj, z)
+func DeleteResRoleDefinition(force bool, obj AzureObject, z *Config) error {
+	roleName, firstScope, err := ValidateResRoleDefinitionObject(obj, z)
+	if err != nil {
+		return err
+	}
 
 	// Check if role definition exists
 	id, _ := GetAzureResRoleDefinitionByScopeAndName(firstScope, roleName, z)
 	if !utl.ValidUuid(id) {
-		utl.Die("Role definition %s doesn't exist\n", utl.Red(roleName))
-	} else {
-		obj["name"] = id
+		return newError(ErrNotFound, "role definition '%s' doesn't exist", roleName)
 	}
+	obj["name"] = id
 
 	// Display the role definition and prompt for delete confirmation
-	PrintResRoleDefinition(obj, z)
+	if err := PrintResRoleDefinition(obj, z); err != nil {
+		return err
+	}
 	if !force {
 		msg := "Delete above role definition? y/n"
-		if utl.PromptMsg(utl.Yel(msg)) != 'y' {
-			utl.Die("Aborted.\n")
+		if err := confirmAction(utl.Yel(msg)); err != nil {
+			return err
 		}
 	}
 
@@ -334,42 +344,40 @@ func DeleteResRoleDefinition(force bool, obj AzureObject, z *Config) {
 
 	// Delete the object
 	params := map[string]string{"api-version": "2022-04-01"}
-	apiUrl := ConstAzUrl + firstScope + ApiEndpoint[mazType] + "/" + id
-	resp, statCode, _ := ApiDelete(apiUrl, z, params)
-	if statCode != 200 {
+	apiUrl := z.AzUrl + firstScope + ApiEndpoint[mazType] + "/" + id
+	resp, statCode, err := ApiDeleteAndWait(apiUrl, z, params)
+	if statCode == 204 {
+		// ARM returns 204 No Content when there was no such definition to delete
+		return newError(ErrNotFound, "%s %s was not found in Azure", MazTypeNames[mazType], id)
+	} else if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return apiError(err, statCode, resp, "error deleting %s", MazTypeNames[mazType])
 	}
-	if statCode == 200 {
-		msg := fmt.Sprintf("Successfully DELETED %s!", MazTypeNames[mazType])
-		fmt.Printf("%s\n", utl.Gre(msg))
+	msg := fmt.Sprintf("Successfully DELETED %s!", MazTypeNames[mazType])
+	fmt.Printf("%s\n", utl.Gre(msg))
 
-		// Also remove from local cache
-		cache, err := GetCache(mazType, z)
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
+	// Also remove from local cache
+	cache, err := GetCache(mazType, z)
+	if err == nil {
 		err = cache.Delete(id)
-		if err == nil { // Only save if deletion succeeded
-			err = cache.Save()
-		}
-		if err != nil {
-			utl.Die("Error: %v\n", err)
-		}
-	} else if statCode == 204 {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		utl.Die("%s\n", utl.Yel(msg))
-	} else {
-		msg := fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))
-		utl.Die("%s\n", utl.Red(msg))
 	}
+	if err == nil { // Only save if deletion succeeded
+		err = cache.Save()
+	}
+	if err != nil {
+		return wrapError(ErrFile, err, "%s was deleted, but updating the local cache failed", MazTypeNames[mazType])
+	}
+	return nil
 }
 
 // Counts all role definitions. If fromAzure is true, the definitions are sourced
 // directly from Azure; otherwise, they are read from the local cache. It returns
 // separate counts for custom and built-in roles.
-func CountResRoleDefinitions(fromAzure bool, z *Config) (customCount, builtinCount int64) {
-	customCount, builtinCount = 0, 0
-	definitions := GetMatchingResRoleDefinitions("", fromAzure, z)
+func CountResRoleDefinitions(fromAzure bool, z *Config) (customCount, builtinCount int64, err error) {
+	definitions, err := GetMatchingResRoleDefinitions("", fromAzure, z)
+	if err != nil {
+		return 0, 0, err
+	}
 	for _, role := range definitions {
 		if props := utl.Map(role["properties"]); props != nil {
 			if roleType := utl.Str(props["type"]); roleType != "" {
@@ -381,48 +389,60 @@ func CountResRoleDefinitions(fromAzure bool, z *Config) (customCount, builtinCou
 			}
 		}
 	}
-	return customCount, builtinCount
+	return customCount, builtinCount, nil
 }
 
 // Gets all role definitions matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingResRoleDefinitions(filter string, force bool, z *Config) (list AzureObjectList) {
+func GetMatchingResRoleDefinitions(filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingResRoleDefinitionsContext(context.Background(), filter, force, z)
+}
+
+// Same as GetMatchingResRoleDefinitions, but refreshes the cache from Azure under the given context.
+func GetMatchingResRoleDefinitionsContext(ctx context.Context, filter string, force bool, z *Config) (AzureObjectList, error) {
 	// If the filter is a UUID, we deliberately treat it as an ID and perform a
 	// quick Azure lookup for the specific object.
 	if utl.ValidUuid(filter) {
 		singleRole := GetAzureResRoleDefinitionById(filter, z)
 		if singleRole != nil {
 			// If found, return a list containing just this object.
-			return AzureObjectList{singleRole}
+			return AzureObjectList{singleRole}, nil
 		}
 	}
 
 	// Get current cache, or initialize a new cache for this type
 	cache, err := GetCache(ResRoleDefinition, z)
 	if err != nil {
-		utl.Die("Error: %v\n", err)
+		return nil, wrapError(ErrFile, err, "error loading %s cache", MazTypeNames[ResRoleDefinition])
 	}
 
 	// Return an empty list if cache is nil and internet is not available
 	internetIsAvailable := utl.IsInternetAvailable()
 	if cache == nil && !internetIsAvailable {
-		return AzureObjectList{} // Return empty list
+		return AzureObjectList{}, nil // Return empty list
 	}
 
 	// Determine if cache is empty or outdated and needs to be refreshed from Azure
-	cacheNeedsRefreshing := force || cache.Count() < 1 || cache.Age() == 0 || cache.Age() > ConstMgCacheFileAgePeriod
+	cacheNeedsRefreshing := force || cache.resync || cache.Count() < 1 || cache.Age() == 0 ||
+		cache.Age() > ConstMgCacheFileAgePeriod
 	if internetIsAvailable && cacheNeedsRefreshing {
-		CacheAzureResRoleDefinitions(cache, z)
+		if err := CacheAzureResRoleDefinitionsContext(ctx, cache, z); err != nil {
+			return nil, err
+		}
 	}
 
 	// Filter the objects based on the provided filter
+	objects, err := cache.Objects()
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading %s cache", MazTypeNames[ResRoleDefinition])
+	}
 	if filter == "" {
-		return cache.data // Return all data if no filter is specified
+		return objects, nil // Return all data if no filter is specified
 	}
 	matchingList := AzureObjectList{} // Initialize an empty list for matching items
 	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
 
-	for i := range cache.data {
-		role := cache.data[i]       // Index-based loop seem a bit faster
+	for i := range objects {
+		role := objects[i]          // Index-based loop seem a bit faster
 		id := utl.Str(role["name"]) // Resource role definitions use 'name' as the unique ID
 		if id == "" || ids.Exists(id) {
 			continue // Skip if the ID is empty () or already seen
@@ -434,27 +454,50 @@ func GetMatchingResRoleDefinitions(filter string, force bool, z *Config) (list A
 		}
 	}
 
-	return matchingList
+	return matchingList, nil
 }
 
 // Retrieves all Azure resource role definition objects in current tenant and saves them
-// to local cache. Note that we are updating the cache via its pointer, so no return values.
-func CacheAzureResRoleDefinitions(cache *Cache, z *Config) {
+// to local cache. Note that we are updating the cache via its pointer, so only an error is returned.
+// They are synced from Resource Graph, and only listed scope by scope if that fails.
+func CacheAzureResRoleDefinitions(cache *Cache, z *Config) error {
+	return CacheAzureResRoleDefinitionsContext(context.Background(), cache, z)
+}
+
+// Same as CacheAzureResRoleDefinitions, but fetches the objects under the given context. An interrupted
+// fetch leaves the cache as it was.
+func CacheAzureResRoleDefinitionsContext(ctx context.Context, cache *Cache, z *Config) error {
+	err := syncResObjectsFromGraph(ctx, ResRoleDefinition, cache, z)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	Logf("Resource Graph sync failed, listing all scopes instead: %v\n", err)
+
 	// Prepare ID name maps for more informative logging
-	mgroupIdMap := GetIdNameMap(ManagementGroup, z)
-	subIdMap := GetIdNameMap(Subscription, z)
+	mgroupIdMap, err := GetIdNameMap(ManagementGroup, z)
+	if err != nil {
+		return err
+	}
+	subIdMap, err := GetIdNameMap(Subscription, z)
+	if err != nil {
+		return err
+	}
 
 	// Build API parameters for the role definitions endpoint
 	params := map[string]string{"api-version": "2022-04-01"}
 
 	// Fetch all role definitions across scopes in parallel
-	allDefs := fetchAzureObjectsAcrossScopes(
+	allDefs, err := fetchAzureObjectsAcrossScopes(
+		ctx,
 		"/providers/Microsoft.Authorization/roleDefinitions",
 		z,
 		params,
 		mgroupIdMap,
 		subIdMap,
 	)
+	if err != nil {
+		return err // Don't replace the cache with an incomplete list
+	}
 
 	// Use a set to keep only unique role definition IDs
 	ids := utl.StringSet{}
@@ -474,10 +517,10 @@ func CacheAzureResRoleDefinitions(cache *Cache, z *Config) {
 	}
 
 	// Save the final list of definitions into the cache
-	cache.data = list
-	if err := cache.Save(); err != nil {
-		utl.Die("Error saving updated resource role definitions cache: %v\n", err.Error())
+	if err := cache.Replace(list); err != nil {
+		return wrapError(ErrFile, err, "error saving updated resource role definitions cache")
 	}
+	return nil
 }
 
 // Retrieves resource role definition by scope and name
@@ -486,18 +529,15 @@ func GetAzureResRoleDefinitionByScopeAndName(scope, roleName string, z *Config)
 		"api-version": "2022-04-01",
 		"$filter":     "roleName eq '" + roleName + "'",
 	}
-	apiUrl := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+	apiUrl := z.AzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions"
+	roles, err := ApiGetAll(apiUrl, z, params)
+	if err != nil {
+		Logf("%s\n", utl.Red2(err.Error()))
 	}
-	roles := utl.Slice(resp["value"]) // Cast to a slice
 	if len(roles) == 1 {
 		// rolenNames are all unique within each scope, so a single entry means we found it
-		if role := utl.Map(roles[0]); role != nil {
-			id := utl.Str(role["name"])
-			return id, role
-		}
+		id := utl.Str(roles[0]["name"])
+		return id, roles[0]
 	}
 	return "", nil
 }
@@ -511,13 +551,17 @@ func GetAzureResRoleDefinitionsByName(roleName string, z *Config) AzureObjectLis
 	}
 
 	// Fetch all role definitions across scopes concurrently using parallel goroutines function
-	defs := fetchAzureObjectsAcrossScopes(
+	defs, err := fetchAzureObjectsAcrossScopes(
+		context.Background(),
 		"/providers/Microsoft.Authorization/roleDefinitions",
 		z,
 		params,
 		nil, // no management group ID map needed
 		nil, // no subscription ID map needed
 	)
+	if err != nil {
+		Logf("%v\n", err)
+	}
 
 	return defs
 }
@@ -535,13 +579,17 @@ func GetAzureResRoleDefinitionById(targetId string, z *Config) AzureObject {
 	}
 
 	// Fetch all role definitions across scopes concurrently using parallel goroutines function
-	defs := fetchAzureObjectsAcrossScopes(
+	defs, err := fetchAzureObjectsAcrossScopes(
+		context.Background(),
 		"/providers/Microsoft.Authorization/roleDefinitions",
 		z,
 		params,
 		nil,
 		nil,
 	)
+	if err != nil {
+		Logf("%v\n", err)
+	}
 
 	// Look for the matching role by ID (case-sensitive match)
 	for _, def := range defs {
@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"context"
 	"fmt"
 	"path"
 
@@ -24,7 +25,10 @@ func PrintSubscription(x AzureObject) {
 // Full IDs are commonly used when handling resource role definitions and assignments.
 func GetAzureSubscriptionsIds(z *Config) (ids []string) {
 	ids = nil
-	subscriptions := GetMatchingAzureSubscriptions("", false, z) // false = get from cache, not Azure
+	subscriptions, err := GetMatchingAzureSubscriptions("", false, z) // false = get from cache, not Azure
+	if err != nil {
+		Logf("%v\n", err)
+	}
 	for _, item := range subscriptions {
 		// Skip disabled and legacy subscriptions
 		displayName := utl.Str(item["displayName"])
@@ -38,14 +42,19 @@ func GetAzureSubscriptionsIds(z *Config) (ids []string) {
 }
 
 // Gets all Azure subscriptions matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingAzureSubscriptions(filter string, force bool, z *Config) AzureObjectList {
+func GetMatchingAzureSubscriptions(filter string, force bool, z *Config) (AzureObjectList, error) {
+	return GetMatchingAzureSubscriptionsContext(context.Background(), filter, force, z)
+}
+
+// Same as GetMatchingAzureSubscriptions, but refreshes the cache from Azure under the given context.
+func GetMatchingAzureSubscriptionsContext(ctx context.Context, filter string, force bool, z *Config) (AzureObjectList, error) {
 	// If the filter is a UUID, we deliberately treat it as an ID and perform a
 	// quick Azure lookup for the specific object.
 	if utl.ValidUuid(filter) {
 		x := GetAzureSubscriptionById(filter, z)
 		if x != nil {
 			// If found, return a list containing just this object.
-			return AzureObjectList{x}
+			return AzureObjectList{x}, nil
 		}
 		// If not found, then filter will be used below in obj.HasString(filter)
 	}
@@ -53,31 +62,38 @@ func GetMatchingAzureSubscriptions(filter string, force bool, z *Config) AzureOb
 	// Get current cache, or initialize a new cache for this maz object type
 	cache, err := GetCache(Subscription, z) // Get subscriptions type cache
 	if err != nil {
-		utl.Die("Error: %s\n", err.Error())
+		return nil, wrapError(ErrFile, err, "error loading %s cache", MazTypeNames[Subscription])
 	}
 
 	// Return an empty list if cache is nil and internet is not available
 	internetIsAvailable := utl.IsInternetAvailable()
 	if cache == nil && !internetIsAvailable {
-		return AzureObjectList{} // Return empty list
+		return AzureObjectList{}, nil // Return empty list
 	}
 
 	// Determine if cache is empty or outdated and needs to be refreshed from Azure
-	cacheNeedsRefreshing := force || cache.Count() < 1 || cache.Age() == 0 || cache.Age() > ConstMgCacheFileAgePeriod
+	cacheNeedsRefreshing := force || cache.resync || cache.Count() < 1 || cache.Age() == 0 ||
+		cache.Age() > ConstMgCacheFileAgePeriod
 	if internetIsAvailable && cacheNeedsRefreshing {
-		CacheAzureSubscriptions(cache, z)
+		if err := CacheAzureSubscriptionsContext(ctx, cache, z); err != nil {
+			return nil, err
+		}
 	}
 
 	// Filter the objects based on the provided filter
+	objects, err := cache.Objects()
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading %s cache", MazTypeNames[Subscription])
+	}
 	if filter == "" {
-		return cache.data // Return all data if no filter is specified
+		return objects, nil // Return all data if no filter is specified
 	}
 
 	matchingList := AzureObjectList{} // Initialize an empty list for matching items
 	ids := utl.StringSet{}            // Keep track of unique IDs to eliminate duplicates
 
-	for i := range cache.data {
-		sub := cache.data[i]
+	for i := range objects {
+		sub := objects[i]
 
 		// Extract the ID: use the last part of the "id" path or fall back to the "name" field
 		id := ""
@@ -98,26 +114,30 @@ func GetMatchingAzureSubscriptions(filter string, force bool, z *Config) AzureOb
 			ids.Add(id)                              // Mark this ID as seen
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Retrieves all Azure subscription objects in current tenant and saves them to local
-// cache. Note that we are updating the cache via its pointer, so no return value.
-func CacheAzureSubscriptions(cache *Cache, z *Config) {
-	list := AzureObjectList{} // List of subscription objects to cache
+// cache. Note that we are updating the cache via its pointer, so only an error is returned.
+// They are synced from Resource Graph, and only listed with the ARM API if that fails.
+func CacheAzureSubscriptions(cache *Cache, z *Config) error {
+	return CacheAzureSubscriptionsContext(context.Background(), cache, z)
+}
 
-	params := map[string]string{"api-version": "2024-11-01"}
-	apiUrl := ConstAzUrl + "/subscriptions"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+// Same as CacheAzureSubscriptions, but fetches the objects under the given context. An interrupted
+// fetch leaves the cache as it was.
+func CacheAzureSubscriptionsContext(ctx context.Context, cache *Cache, z *Config) error {
+	err := syncResObjectsFromGraph(ctx, Subscription, cache, z)
+	if err == nil || ctx.Err() != nil {
+		return err
 	}
-	subscriptions := utl.Slice(resp["value"])
-	for i := range subscriptions {
-		obj := subscriptions[i]
-		if subscription := utl.Map(obj); subscription != nil {
-			list = append(list, subscription)
-		}
+	Logf("Resource Graph sync failed, listing subscriptions instead: %v\n", err)
+
+	params := map[string]string{"api-version": "2024-11-01"}
+	apiUrl := z.AzUrl + "/subscriptions"
+	list, err := ApiGetAllContext(ctx, apiUrl, z, params)
+	if err != nil && ctx.Err() == nil {
+		return apiError(err, 0, nil, "error fetching subscriptions")
 	}
 
 	// Trim and prepare all objects for caching
@@ -126,30 +146,29 @@ func CacheAzureSubscriptions(cache *Cache, z *Config) {
 		list[i] = list[i].TrimForCache(Subscription)
 	}
 
-	// Update the cache with the entire list of definitions
-	cache.data = list
+	// Don't replace the cache with an incomplete list
+	if err := ctx.Err(); err != nil {
+		return wrapError(ErrApiCall, err, "fetching subscriptions interrupted")
+	}
 
-	// Save updated cache
-	if err := cache.Save(); err != nil {
-		utl.Die("Error saving updated cache: %s\n", err.Error())
+	// Update the cache with the entire list of definitions
+	if err := cache.Replace(list); err != nil {
+		return wrapError(ErrFile, err, "error saving updated subscriptions cache")
 	}
+	return nil
 }
 
 // Gets a specific Azure subscription object by its nme
 func GetAzureSubscriptionByName(targetName string, z *Config) AzureObject {
 	params := map[string]string{"api-version": "2024-11-01"}
-	apiUrl := ConstAzUrl + "/subscriptions"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
-	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
-	}
-	subscriptions := utl.Slice(resp["value"])
-	for i := range subscriptions {
-		obj := subscriptions[i]
-		if subscription := utl.Map(obj); subscription != nil {
-			if utl.Str(subscription["displayName"]) == targetName {
-				return AzureObject(subscription)
-			}
+	apiUrl := z.AzUrl + "/subscriptions"
+	for subscription, err := range ApiItems(apiUrl, z, params) {
+		if err != nil {
+			Logf("%s\n", utl.Red2(err.Error()))
+			break
+		}
+		if utl.Str(subscription["displayName"]) == targetName {
+			return AzureObject(subscription)
 		}
 	}
 	return nil
@@ -165,7 +184,7 @@ func GetAzureSubscriptionById(targetId string, z *Config) AzureObject {
 	// Fallback to using the ARM API way if above returns nothing
 
 	params := map[string]string{"api-version": "2024-11-01"}
-	apiUrl := ConstAzUrl + "/subscriptions/" + targetId
+	apiUrl := z.AzUrl + "/subscriptions/" + targetId
 	resp, statCode, _ := ApiGet(apiUrl, z, params)
 	if statCode != 200 {
 		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
@@ -176,16 +195,16 @@ func GetAzureSubscriptionById(targetId string, z *Config) AzureObject {
 }
 
 // Returns count of all subscriptions in current Azure tenant
-func CountAzureSubscriptions(z *Config) int64 {
+func CountAzureSubscriptions(z *Config) (int64, error) {
 	params := map[string]string{"api-version": "2024-11-01"}
-	apiUrl := ConstAzUrl + "/subscriptions"
-	resp, statCode, _ := ApiGet(apiUrl, z, params)
+	apiUrl := z.AzUrl + "/subscriptions"
+	resp, statCode, err := ApiGet(apiUrl, z, params)
 	if statCode != 200 {
-		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return 0, apiError(err, statCode, resp, "error counting subscriptions")
 	}
 	if rawCount := utl.Map(resp["count"]); rawCount != nil {
 		count := utl.Int64(rawCount["value"]) // Get int64 value
-		return count
+		return count, nil
 	}
-	return 0
+	return 0, nil
 }
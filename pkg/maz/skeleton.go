@@ -10,10 +10,10 @@ import (
 )
 
 // Returns a file name and object name based on the given mazType and name.
-func generateName(mazType string, names ...string) (fileName, objName string) {
+func generateName(mazType string, names ...string) (fileName, objName string, err error) {
 	// Support function signature variants: if a single name parameter is provided normally,
 	// when calling generateName from the calling code in your switch, you can call:
-	//    fileName, objName := generateName(mazType, name)
+	//    fileName, objName, err := generateName(mazType, name)
 	// where name may be an empty string.
 
 	// If name is empty, it returns the commented-out defaults:
@@ -62,14 +62,14 @@ func generateName(mazType string, names ...string) (fileName, objName string) {
 
 	// If name is empty, return the defaults.
 	if strings.TrimSpace(name) == "" {
-		return defaultFileName, defaultObjName
+		return defaultFileName, defaultObjName, nil
 	}
 
 	// Validate that the input name for objName contains only printable characters.
-	// If any non-printable characters are found, exit with an error.
+	// If any non-printable characters are found, return an error.
 	for _, r := range name {
 		if !unicode.IsPrint(r) {
-			utl.Die("Error: name contains non-printable character: %q\n", r)
+			return "", "", newError(ErrValidation, "name contains non-printable character: %q", r)
 		}
 	}
 
@@ -87,7 +87,7 @@ func generateName(mazType string, names ...string) (fileName, objName string) {
 		objName = name
 	}
 
-	return fileName, objName
+	return fileName, objName, nil
 }
 
 // Replaces spaces and any characters that are not letters, digits, or typical punctuation
@@ -127,15 +127,18 @@ func sanitizeFileName(s string) string {
 }
 
 // Creates specfile skeleton/scaffold files
-func CreateSkeletonFile(mazType, name string) {
+func CreateSkeletonFile(mazType, name string) error {
 	pwd, err := os.Getwd()
 	if err != nil {
-		utl.Die("%s Error getting current working directory.\n", utl.Trace())
+		return wrapError(ErrFile, err, "error getting current working directory")
 	}
-	fileName, objName, fileContent := "", "", []byte("")
+	fileName, objName, err := generateName(mazType, name)
+	if err != nil {
+		return err
+	}
+	fileContent := []byte("")
 	switch mazType {
 	case ResRoleDefinition:
-		fileName, objName = generateName(mazType, name)
 		fileContent = []byte("#\n" +
 			"# Example Azure resource role definition specfile object definition\n" +
 			"#\n" +
@@ -156,7 +159,6 @@ func CreateSkeletonFile(mazType, name string) {
 			"      notDataActions:\n" +
 			"        - Microsoft.CognitiveServices/accounts/LUIS/apps/delete\n")
 	case ResRoleAssignment:
-		fileName, _ = generateName(mazType, name)
 		fileContent = []byte("#\n" +
 			"# Example Azure resource role assignment specfile object definition\n" +
 			"#\n" +
@@ -169,7 +171,6 @@ func CreateSkeletonFile(mazType, name string) {
 			"  roleDefinitionId: 2489dfa4-3333-4444-9999-b04b7a1e4ea6  # Role = \"My Special Role\"\n" +
 			"  scope: /providers/Microsoft.Management/managementGroups/3f550b9f-8888-7777-ad61-111199992222\n")
 	case DirectoryGroup:
-		fileName, objName = generateName(mazType, name)
 		fileContent = []byte("#\n" +
 			"# Example Azure directory group specfile object definition\n" +
 			"#\n" +
@@ -183,7 +184,6 @@ func CreateSkeletonFile(mazType, name string) {
 			"description: Group description\n" +
 			"isAssignableToRole: false\n")
 	case Application:
-		fileName, objName = generateName(mazType, name)
 		fileContent = []byte("#\n" +
 			"# Example Azure App registration & corresponding Service Principal (SP) specfile objects definition\n" +
 			"#\n" +
@@ -201,13 +201,10 @@ func CreateSkeletonFile(mazType, name string) {
 	}
 	specfile := filepath.Join(pwd, fileName)
 	if utl.FileExist(specfile) {
-		utl.Die("Error: File %s already exists.\n", fileName)
+		return newError(ErrValidation, "file %s already exists", fileName)
 	}
-	f, err := os.Create(specfile) // Create the file
-	if err != nil {
-		utl.Die("Error creating file: %s", err)
+	if err := os.WriteFile(specfile, fileContent, 0644); err != nil {
+		return wrapError(ErrFile, err, "error creating file %s", fileName)
 	}
-	defer f.Close()
-	f.Write(fileContent) // Write the content
-	os.Exit(0)
+	return nil
 }
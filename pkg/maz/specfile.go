@@ -11,30 +11,32 @@ import (
 )
 
 // Generates and prints a sanitized specfile name from given specfile or ID
-func GenerateAndPrintSpecfileName(specifier string, z *Config) {
+func GenerateAndPrintSpecfileName(specifier string, z *Config) error {
 	var mazType string
 	var obj AzureObject
+	var err error
 
 	// Determine the specifier type
 	if utl.FileUsable(specifier) {
 		// If it's a specfile, try to get the mazType and object
-		_, mazType, obj = GetObjectFromFile(specifier)
+		if _, mazType, obj, err = GetObjectFromFile(specifier); err != nil {
+			return err
+		}
 	} else if utl.ValidUuid(specifier) {
 		// If it's an ID, get the mazType and object of all matching objects
 		list, _ := FindAzureObjectsById(specifier, z)
 		if len(list) == 0 {
-			utl.Die("There's no object with that ID\n")
+			return newError(ErrNotFound, "there's no object with ID %s", specifier)
 		} else if len(list) > 1 {
-			utl.Die("Too many objects with that ID. This is not supported.\n")
+			return newError(ErrAmbiguousName, "too many objects with ID %s, this is not supported", specifier)
 		}
 		obj = list[0] // Isolate the single object
 		mazType = utl.Str(obj["maz_type"])
 	} else {
-		utl.Die("Invalid specfile or ID\n")
+		return newError(ErrValidation, "invalid specfile or ID: %s", specifier)
 	}
 
 	var specfileName string
-	var err error
 
 	switch mazType {
 	case ResRoleDefinition:
@@ -57,13 +59,7 @@ func GenerateAndPrintSpecfileName(specifier string, z *Config) {
 
 		// Get the name of principal, and sanitize as part2
 		principalId := utl.Str(props["principalId"])
-		principalName := GetObjectNameFromId(DirectoryGroup, principalId, z)
-		if principalName == "" {
-			principalName = GetObjectNameFromId(DirectoryUser, principalId, z)
-		}
-		if principalName == "" {
-			principalName = GetObjectNameFromId(ServicePrincipal, principalId, z)
-		}
+		principalName := GetPrincipalNameFromId(principalId, z)
 		part2 := sanitizePart(principalName)
 		if part2 == "" {
 			part2 = "error"
@@ -86,7 +82,7 @@ func GenerateAndPrintSpecfileName(specifier string, z *Config) {
 		specfileName = fmt.Sprintf("%s_%s.yaml", mazType, part2)
 
 	default:
-		utl.Die("Can't determine object type for this specfile\n")
+		return newError(ErrValidation, "can't determine object type for this specfile")
 	}
 
 	// Print the generated file name
@@ -97,10 +93,11 @@ func GenerateAndPrintSpecfileName(specifier string, z *Config) {
 		fmt.Println("Above file already exists. Content not overwritten.")
 	} else {
 		if err = utl.SaveFileAuto(specfileName, "yaml", obj, false, 0); err != nil {
-			utl.Die("Error saving specfile: %v\n", err)
+			return wrapError(ErrFile, err, "error saving specfile %s", specfileName)
 		}
 		fmt.Println("Above file has been created with the object's content.")
 	}
+	return nil
 }
 
 func sanitizePart(s string) string {
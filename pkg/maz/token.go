@@ -2,6 +2,8 @@ package maz
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,6 +14,7 @@ import (
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
 	"github.com/queone/utl"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 // The MSAL Go library defines the types of cache file, and expect you to roll your own
@@ -27,7 +30,7 @@ type TokenCache struct {
 }
 
 func (t *TokenCache) Replace(ctx context.Context, cache cache.Unmarshaler, hints cache.ReplaceHints) error {
-	data, err := os.ReadFile(t.file)
+	data, err := readMazFile(t.file) // Decrypted if needed, see maz_crypto.go
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil // Return nil if file doesn't exist yet
@@ -45,7 +48,7 @@ func (t *TokenCache) Export(ctx context.Context, cache cache.Marshaler, hints ca
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(t.file, data, 0600)
+	return writeMazFile(t.file, data, 0600) // Encrypted if a key is configured
 }
 
 // ==== Remainining code is part of the maz package ================================================
@@ -66,7 +69,7 @@ func validateTokenCache(cacheAccessor *TokenCache) bool {
 		return false
 	}
 
-	data, err := os.ReadFile(cacheAccessor.file)
+	data, err := readMazFile(cacheAccessor.file)
 	if err != nil {
 		if os.IsNotExist(err) {
 			Logf("Token cache file does not exist: %s\n", cacheAccessor.file)
@@ -95,10 +98,12 @@ func validateTokenCache(cacheAccessor *TokenCache) bool {
 
 // Returns the service API name based on the scope
 func getServiceApiName(scopes []string) string {
-	service := "MS Graph (MG)" // ConstMgUrl
+	service := "MS Graph (MG)" // Any cloud's MgUrl
 	for _, scope := range scopes {
-		if strings.HasPrefix(scope, ConstAzUrl) {
+		if isAzScope(scope) {
 			service = "Azure ARM (AZ)"
+		} else if !isMgScope(scope) {
+			service = scope // An add-on API, see AddApi()
 		}
 	}
 	return service
@@ -106,12 +111,17 @@ func getServiceApiName(scopes []string) string {
 
 // Acquire Azure JWT token with Username via a browser popup window.
 func GetTokenInteractively(scopes []string, z *Config) (token string, err error) {
+	return getTokenInteractively(context.Background(), scopes, z)
+}
+
+// Helper function that acquires the token interactively under the given context.
+func getTokenInteractively(ctx context.Context, scopes []string, z *Config) (token string, err error) {
 	// See github.com/AzureAD/microsoft-authentication-library-for-go/blob/main/apps/public/public.go
-	authorityUrl := ConstAuthUrl + z.TenantId
+	authorityUrl := z.AuthUrl + z.TenantId
 	username := z.Username
 
 	// Set up and validate token cache file and accessor
-	tokenFile := filepath.Join(MazConfigDir, TokenCacheFile)
+	tokenFile := z.tokenCacheFile()
 	cacheAccessor := &TokenCache{tokenFile}
 
 	if !validateTokenCache(cacheAccessor) {
@@ -129,18 +139,21 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 	maxRetries := 3
 	retryDelays := []time.Duration{2 * time.Second, 5 * time.Second, 10 * time.Second}
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		ctx := context.Background()
-
-		// Create new app instance for each attempt
+		// Create new app instance for each attempt. Instance discovery only knows the real
+		// Microsoft authorities, so it is disabled whenever the authority URL is overridden.
 		app, err := public.New(ConstAzPowerShellClientId,
 			public.WithAuthority(authorityUrl),
-			public.WithCache(cacheAccessor))
+			public.WithCache(cacheAccessor),
+			public.WithHTTPClient(z.httpClient()),
+			public.WithInstanceDiscovery(!z.hasCustomAuthority()))
 		if err != nil {
 			Logf("Attempt %d app init failed: %v\n", attempt, err)
 			if attempt == maxRetries {
 				return "", fmt.Errorf("failed to initialize after %d attempts: %w", maxRetries, err)
 			}
-			time.Sleep(retryDelays[attempt-1])
+			if err := sleepContext(ctx, retryDelays[attempt-1]); err != nil {
+				return "", err
+			}
 			continue
 		}
 
@@ -152,7 +165,9 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 			if attempt == maxRetries {
 				return "", fmt.Errorf("account lookup failed after %d attempts: %w", maxRetries, err)
 			}
-			time.Sleep(retryDelays[attempt-1])
+			if err := sleepContext(ctx, retryDelays[attempt-1]); err != nil {
+				return "", err
+			}
 			continue
 		}
 		Logf("Found %d accounts in cache:\n", len(accounts))
@@ -168,19 +183,24 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 			}
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-		defer cancel()
+		// Each attempt gets its own timeout, cancelled as soon as the attempt ends
+		attemptCtx, cancel := context.WithTimeout(ctx, 120*time.Second)
 
 		Logf("First, try getting token from cache (AcquireTokenSilent)\n")
-		result, err := app.AcquireTokenSilent(ctx, scopes, public.WithSilentAccount(targetAccount))
+		silentOptions := []public.AcquireSilentOption{public.WithSilentAccount(targetAccount)}
+		if z.refreshClaims != "" {
+			silentOptions = append(silentOptions, public.WithClaims(z.refreshClaims)) // Bypasses the cached token
+		}
+		result, err := app.AcquireTokenSilent(attemptCtx, scopes, silentOptions...)
 		if err == nil {
+			cancel()
 			token := result.AccessToken // Actual token
 
 			msg := fmt.Sprintf("Successfully got token from cache (attempt %d)", attempt)
 			Logf("%s\n", utl.Cya(msg))
 
 			// Verifying the newly acquired token
-			if valid, err := VerifyAzureJwt(token); valid {
+			if valid, err := verifyTokenForConfig(token, scopes, z); valid {
 				Logf("%s\n", utl.Cya("Token verification passed"))
 				return token, err
 			} else {
@@ -193,9 +213,16 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 			Logf("%s: %v\n", utl.Red2(msg), err)
 		}
 
+		// A mid-run refresh must not stop a long operation to wait for the user
+		if z.refreshing {
+			cancel()
+			return "", fmt.Errorf("silent token refresh failed: %w", err)
+		}
+
 		Logf("Fallback to getting a token interactively from Microsoft identity platform (AcquireTokenInteractive)\n")
-		result, err = app.AcquireTokenInteractive(ctx, scopes)
+		result, err = app.AcquireTokenInteractive(attemptCtx, scopes)
 		if err == nil {
+			cancel()
 			Logf("Successfully acquired token interactively (attempt %d)\n", attempt)
 			return result.AccessToken, nil
 		}
@@ -203,13 +230,16 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 
 		// Final fallback to device code
 		Logf("Fallback to getting a token via device code flow (AcquireTokenByDeviceCode) (attempt %d)\n", attempt)
-		devCode, err := app.AcquireTokenByDeviceCode(ctx, scopes)
+		devCode, err := app.AcquireTokenByDeviceCode(attemptCtx, scopes)
 		if err != nil {
+			cancel()
 			Logf("Device code flow attempt %d failed: %v\n", attempt, err)
 			if attempt == maxRetries {
 				return "", fmt.Errorf("device code flow failed after %d attempts: %w", maxRetries, err)
 			}
-			time.Sleep(retryDelays[attempt-1])
+			if err := sleepContext(ctx, retryDelays[attempt-1]); err != nil {
+				return "", err
+			}
 			continue
 		}
 
@@ -220,7 +250,8 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 		fmt.Printf("\nOpen in browser: %s\n", verificationUri)
 		fmt.Printf("Enter code: %s\n\n", devCode.Result.UserCode)
 
-		result, err = devCode.AuthenticationResult(ctx)
+		result, err = devCode.AuthenticationResult(attemptCtx)
+		cancel()
 		if err == nil {
 			Logf("Successfully acquired token via device code flow (attempt %d)\n", attempt)
 			return result.AccessToken, nil
@@ -228,7 +259,9 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 		Logf("Device code flow attempt %d failed: %v\n", attempt, err)
 
 		if attempt < maxRetries {
-			time.Sleep(retryDelays[attempt-1])
+			if err := sleepContext(ctx, retryDelays[attempt-1]); err != nil {
+				return "", err
+			}
 		}
 	}
 
@@ -236,15 +269,20 @@ func GetTokenInteractively(scopes []string, z *Config) (token string, err error)
 }
 
 // Initiates an Azure JWT token acquisition with provided parameters, using a Client ID plus a
-// Client Secret. This is the 'Confidential' app auth flow and it's documented at
+// Client Secret, or a federated token or certificate if z.FederatedTokenFile or z.ClientCert
+// is set. This is the 'Confidential' app auth flow and it's documented at
 // github.com/AzureAD/microsoft-authentication-library-for-go/blob/dev/apps/confidential/confidential.go
 func GetTokenByCredentials(scopes []string, z *Config) (token string, err error) {
-	authorityUrl := ConstAuthUrl + z.TenantId
+	return getTokenByCredentials(context.Background(), scopes, z)
+}
+
+// Helper function that acquires the token by credentials under the given context.
+func getTokenByCredentials(ctx context.Context, scopes []string, z *Config) (token string, err error) {
+	authorityUrl := z.AuthUrl + z.TenantId
 	clientId := z.ClientId
-	clientSecret := z.ClientSecret
 
 	// Set up and validate token cache file and accessor
-	tokenFile := filepath.Join(MazConfigDir, TokenCacheFile)
+	tokenFile := z.tokenCacheFile()
 	cacheAccessor := &TokenCache{tokenFile}
 
 	if !validateTokenCache(cacheAccessor) {
@@ -256,34 +294,60 @@ func GetTokenByCredentials(scopes []string, z *Config) (token string, err error)
 	Logf("Token cache is valid\n")
 
 	// Initializing the client credential
-	cred, err := confidential.NewCredFromSecret(clientSecret)
+	options := []confidential.Option{
+		confidential.WithCache(cacheAccessor),
+		confidential.WithHTTPClient(z.httpClient()),
+		confidential.WithInstanceDiscovery(!z.hasCustomAuthority()),
+	}
+	var cred confidential.Credential
+	if z.FederatedTokenFile != "" {
+		// The file is read again whenever MSAL needs a new assertion, so rotated tokens are picked up
+		tokenFile := z.FederatedTokenFile
+		cred = confidential.NewCredFromAssertionCallback(
+			func(context.Context, confidential.AssertionRequestOptions) (string, error) {
+				return readFederatedToken(tokenFile)
+			})
+	} else if z.ClientCert != "" {
+		cred, err = NewCertCredential(z.ClientCert, z.ClientCertPassword)
+		// Sending the x5c certificate chain allows subject name + issuer authentication,
+		// so the app registration keeps working when the certificate is renewed
+		options = append(options, confidential.WithX5C())
+	} else {
+		cred, err = confidential.NewCredFromSecret(z.ClientSecret)
+	}
 	if err != nil {
 		Logf("%v\n", err)
 		return "", err
 	}
 
 	// Automated login obviously uses the registered app client_id (App ID)
-	app, err := confidential.New(authorityUrl, clientId, cred, confidential.WithCache(cacheAccessor))
+	app, err := confidential.New(authorityUrl, clientId, cred, options...)
 	if err != nil {
 		Logf("%v\n", err)
 		return "", err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
 	service := getServiceApiName(scopes)
 	Logf("Getting access token for service %s\n", utl.Cya(service))
 
 	Logf("First, try getting token from cache (AcquireTokenSilent)\n")
-	result, err := app.AcquireTokenSilent(ctx, scopes)
+	var silentOptions []confidential.AcquireSilentOption
+	var credentialOptions []confidential.AcquireByCredentialOption
+	if z.refreshClaims != "" {
+		silentOptions = append(silentOptions, confidential.WithClaims(z.refreshClaims)) // Bypasses the cached token
+		credentialOptions = append(credentialOptions, confidential.WithClaims(z.refreshClaims))
+	}
+	result, err := app.AcquireTokenSilent(ctx, scopes, silentOptions...)
 	// Note that a targetAccount is not required; it appears to locate existing cached tokens without it
 	if err == nil {
 		token = result.AccessToken // Actual token
 		Logf("%s\n", utl.Cya("Successfully got token from cache"))
 
 		// Verifying the newly acquired token
-		if valid, err := VerifyAzureJwt(token); valid {
+		if valid, err := verifyTokenForConfig(token, scopes, z); valid {
 			Logf("%s\n", utl.Cya("Token verification passed"))
 			return token, err
 		} else {
@@ -294,7 +358,7 @@ func GetTokenByCredentials(scopes []string, z *Config) (token string, err error)
 	Logf("%s: %v\n", utl.Red("Failed to get token from cache"), err)
 
 	Logf("Fallback to getting a token direct from Microsoft identity platform (AcquireTokenByCredential)\n")
-	result, err = app.AcquireTokenByCredential(ctx, scopes)
+	result, err = app.AcquireTokenByCredential(ctx, scopes, credentialOptions...)
 	if err == nil {
 		Logf("%s\n", utl.Cya("Successfully got token from Microsoft"))
 		return result.AccessToken, nil // Return the token string part
@@ -302,3 +366,48 @@ func GetTokenByCredentials(scopes []string, z *Config) (token string, err error)
 
 	return "", err
 }
+
+// Returns an MSAL client credential for the given PEM or PFX (PKCS#12) certificate file, which
+// must hold the certificate and its RSA private key. The password is only needed for an
+// encrypted PEM key or a password protected PFX file.
+func NewCertCredential(certFile, password string) (confidential.Credential, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return confidential.Credential{}, wrapError(ErrConfig, err, "error reading certificate file %s", certFile)
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.PrivateKey
+	switch strings.ToLower(filepath.Ext(certFile)) {
+	case ".pfx", ".p12":
+		var cert *x509.Certificate
+		var caCerts []*x509.Certificate
+		key, cert, caCerts, err = pkcs12.DecodeChain(data, password)
+		certs = append([]*x509.Certificate{cert}, caCerts...)
+	default:
+		certs, key, err = confidential.CertFromPEM(data, password)
+	}
+	if err != nil {
+		return confidential.Credential{}, wrapError(ErrConfig, err, "error loading certificate file %s", certFile)
+	}
+
+	cred, err := confidential.NewCredFromCert(certs, key)
+	if err != nil {
+		return confidential.Credential{}, wrapError(ErrConfig, err, "unusable certificate file %s", certFile)
+	}
+	return cred, nil
+}
+
+// Reads the OIDC token used as client assertion for workload identity federation. Kubernetes
+// and CI runners rotate the file's token, so it must be read anew for every token request.
+func readFederatedToken(tokenFile string) (string, error) {
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", wrapError(ErrConfig, err, "error reading federated token file %s", tokenFile)
+	}
+	token := strings.TrimSpace(string(data))
+	if _, err := SplitJWT(token); err != nil {
+		return "", wrapError(ErrConfig, err, "federated token file %s has no valid token", tokenFile)
+	}
+	return token, nil
+}
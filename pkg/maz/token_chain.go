@@ -0,0 +1,366 @@
+package maz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
+	"github.com/queone/utl"
+)
+
+// Credential chain links, see SetCredentialChain()
+const (
+	ChainEnvTokens       = "env"              // MAZ_MG_TOKEN and MAZ_AZ_TOKEN environment variables
+	ChainAzureCli        = "azurecli"         // Azure CLI token cache, see GetTokenFromAzureCli()
+	ChainManagedIdentity = "managed_identity" // Managed identity endpoint, see GetTokenByManagedIdentity()
+	ChainInteractive     = "interactive"      // Interactive browser or device code login
+	ChainCredentials     = "credentials"      // The configured maz login, from environment variables or file
+
+	azCliTokenCacheFile = "msal_token_cache.json"
+	azCliProfileFile    = "azureProfile.json"
+)
+
+var (
+	// The chain used when it is set to "default"
+	DefaultCredentialChain = []string{ChainEnvTokens, ChainAzureCli, ChainManagedIdentity, ChainInteractive}
+
+	credentialChainLinks = []string{ChainEnvTokens, ChainAzureCli, ChainManagedIdentity, ChainInteractive, ChainCredentials}
+)
+
+// Sets the credential chain, the token sources SetupApiTokens tries in the given order for
+// each API token, instead of the single configured login method. The token comes from the
+// first link that produces one, and z.TokenSources records which link that was. The links
+// are ChainEnvTokens, ChainAzureCli, ChainManagedIdentity, ChainInteractive and
+// ChainCredentials, or "default" for DefaultCredentialChain. Without a chain, the
+// MAZ_CREDENTIAL_CHAIN environment variable or the credentials file 'credential_chain'
+// parameter is used, if set.
+func (m *Config) SetCredentialChain(links ...string) *Config {
+	m.CredentialChain = links
+	return m
+}
+
+// Returns the credential chain to use, or nil if none is configured.
+func (m *Config) credentialChain() ([]string, error) {
+	if len(m.CredentialChain) > 0 {
+		return parseCredentialChain(m.CredentialChain, "credential chain")
+	}
+	if value := os.Getenv("MAZ_CREDENTIAL_CHAIN"); value != "" {
+		return parseCredentialChain(credentialChainValue(value), "environment variable MAZ_CREDENTIAL_CHAIN")
+	}
+	// The credentials file is optional here, so any issue with it is left to SetupMazCredentials
+	credsRaw, err := loadCredsFile(filepath.Join(MazConfigDir, CredentialsFile))
+	if err != nil {
+		return nil, nil
+	}
+	profile := m.Profile // Only peeking, the profile is selected by SetupMazCredentials
+	creds, err := selectProfile(utl.Map(credsRaw), m)
+	m.Profile = profile
+	if err != nil {
+		return nil, nil
+	}
+	return parseCredentialChain(credentialChainValue(creds["credential_chain"]), "credential file parameter 'credential_chain'")
+}
+
+// Helper function to convert a credential chain setting, either a list or a comma separated
+// string, to a list of link names.
+func credentialChainValue(value interface{}) (links []string) {
+	switch v := value.(type) {
+	case string:
+		links = strings.Split(v, ",")
+	case []interface{}:
+		for _, link := range v {
+			links = append(links, utl.Str(link))
+		}
+	case []string:
+		links = v
+	}
+	return links
+}
+
+// Helper function to validate the given credential chain links, named by source, expanding
+// "default" to DefaultCredentialChain.
+func parseCredentialChain(links []string, source string) ([]string, error) {
+	var chain []string
+	for _, link := range links {
+		link = strings.ToLower(strings.TrimSpace(link))
+		switch {
+		case link == "":
+			continue
+		case link == "default":
+			chain = append(chain, DefaultCredentialChain...)
+		case slices.Contains(credentialChainLinks, link):
+			chain = append(chain, link)
+		default:
+			return nil, newError(ErrConfig, "%s has unknown link '%s', valid ones are: %s, default", source,
+				link, strings.Join(credentialChainLinks, ", "))
+		}
+	}
+	return chain, nil
+}
+
+// Helper function that acquires all API tokens through the given credential chain.
+func setupApiTokensByChain(ctx context.Context, chain []string, z *Config) error {
+	Logf("Using credential chain %s\n", utl.Cya(strings.Join(chain, ", ")))
+
+	// The configured maz login, if any, provides the tenant, as well as the settings of the
+	// managed identity and credentials links
+	loginConfigured := true
+	if err := SetupMazCredentials(z); err != nil {
+		Logf("No usable maz login configured: %v\n", err)
+		loginConfigured = false
+		if !utl.ValidUuid(z.TenantId) {
+			z.TenantId = "" // Taken from the first token instead
+		}
+	}
+	z.AzToken, z.MgToken = "", "" // The env link checks MAZ_AZ_TOKEN and MAZ_MG_TOKEN itself
+
+	var err error
+	if z.AzToken, err = getTokenByChain(ctx, AzApiToken, z.AzScope(), chain, loginConfigured, z); err != nil {
+		return wrapError(ErrPermissionDenied, err, "failed to acquire Azure ARM token")
+	}
+	z.AddAzHeader("Authorization", "Bearer "+z.AzToken).AddAzHeader("Content-Type", "application/json")
+
+	if z.MgToken, err = getTokenByChain(ctx, MgApiToken, z.MgScope(), chain, loginConfigured, z); err != nil {
+		return wrapError(ErrPermissionDenied, err, "failed to acquire MS Graph token")
+	}
+	z.AddMgHeader("Authorization", "Bearer "+z.MgToken).AddMgHeader("Content-Type", "application/json")
+	return nil
+}
+
+// Helper function that tries each credential chain link in turn, until one produces a token
+// for the given scope, and records that link in z.TokenSources under tokenType. The tenant
+// ID is taken from the token if it is not yet known.
+func getTokenByChain(
+	ctx context.Context,
+	tokenType string,
+	scope, chain []string,
+	loginConfigured bool,
+	z *Config,
+) (string, error) {
+	var errs []error
+	for _, link := range chain {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		token, err := getTokenByChainLink(ctx, link, scope, loginConfigured, z)
+		if err != nil {
+			Logf("Credential chain link %s: %v\n", utl.Yel(link), err)
+			errs = append(errs, fmt.Errorf("%s: %w", link, err))
+			continue
+		}
+		Logf("%s from credential chain link %s\n", tokenType, utl.Cya(link))
+		z.TokenSources[tokenType] = link
+		if z.TenantId == "" {
+			if claims, err := decodeTokenClaims(token); err == nil {
+				z.TenantId = utl.Str(claims["tid"])
+			}
+		}
+		return token, nil
+	}
+	return "", errors.Join(errs...)
+}
+
+// Helper function to get a token for the given scope from a single credential chain link.
+func getTokenByChainLink(ctx context.Context, link string, scope []string, loginConfigured bool, z *Config) (string, error) {
+	switch link {
+	case ChainEnvTokens:
+		name := "MAZ_MG_TOKEN"
+		if isAzScope(scope[0]) {
+			name = "MAZ_AZ_TOKEN"
+		} else if !isMgScope(scope[0]) {
+			return "", fmt.Errorf("no environment variable holds a token for %s", scope[0])
+		}
+		token := os.Getenv(name)
+		if _, err := SplitJWT(token); err != nil {
+			return "", fmt.Errorf("environment variable %s: %w", name, err)
+		}
+		return token, nil
+	case ChainAzureCli:
+		return getTokenFromAzureCli(ctx, scope, z)
+	case ChainManagedIdentity:
+		clientId := "" // The configured client ID is only a user-assigned identity in managed identity mode
+		if z.ManagedIdentity {
+			clientId = z.ClientId
+		}
+		return getTokenByManagedIdentity(ctx, scope, clientId, z, true)
+	case ChainInteractive:
+		if z.TenantId == "" {
+			return "", newError(ErrConfig, "no tenant ID for interactive login, set MAZ_TENANT_ID")
+		}
+		return getTokenInteractively(ctx, scope, z)
+	case ChainCredentials:
+		if !loginConfigured {
+			return "", newError(ErrConfig, "no maz login is configured")
+		}
+		return GetApiTokenContext(ctx, scope, z)
+	}
+	return "", newError(ErrConfig, "unknown credential chain link '%s'", link)
+}
+
+// Token cache accessor that never writes back, so the Azure CLI's own cache is left alone.
+type readOnlyTokenCache struct {
+	TokenCache
+}
+
+func (t *readOnlyTokenCache) Export(ctx context.Context, cache cache.Marshaler, hints cache.ExportHints) error {
+	return nil
+}
+
+// Acquires an access token for the given API scope from the MSAL token cache of the Azure CLI,
+// so engineers already logged in with 'az login' need no separate login. The cache is only
+// read, and expired access tokens are refreshed in memory. The account used is the one
+// matching z.Username if set, otherwise the Azure CLI's current account, whose tenant is also
+// used when z.TenantId is not set. AZURE_CONFIG_DIR overrides the ~/.azure directory. Note
+// that the Azure CLI encrypts its cache on Windows, where it cannot be read.
+func GetTokenFromAzureCli(scopes []string, z *Config) (string, error) {
+	return getTokenFromAzureCli(context.Background(), scopes, z)
+}
+
+// Helper function that acquires the Azure CLI token under the given context.
+func getTokenFromAzureCli(ctx context.Context, scopes []string, z *Config) (string, error) {
+	dir := os.Getenv("AZURE_CONFIG_DIR")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", wrapError(ErrConfig, err, "cannot locate the Azure CLI directory")
+		}
+		dir = filepath.Join(homeDir, ".azure")
+	}
+	cacheFile := filepath.Join(dir, azCliTokenCacheFile)
+	if !utl.FileUsable(cacheFile) {
+		return "", newError(ErrConfig, "no Azure CLI token cache %s, use 'az login' first", cacheFile)
+	}
+
+	username, tenantId := azureCliCurrentAccount(dir)
+	if z.Username != "" {
+		username = z.Username
+	}
+	if z.TenantId != "" {
+		tenantId = z.TenantId
+	}
+	if tenantId == "" {
+		tenantId = "organizations"
+	}
+	Logf("Getting access token for service %s from Azure CLI cache %s\n", utl.Cya(getServiceApiName(scopes)),
+		utl.Cya(cacheFile))
+
+	app, err := public.New(ConstAzCliClientId,
+		public.WithAuthority(z.AuthUrl+tenantId),
+		public.WithCache(&readOnlyTokenCache{TokenCache{cacheFile}}),
+		public.WithHTTPClient(z.httpClient()),
+		public.WithInstanceDiscovery(!z.hasCustomAuthority()))
+	if err != nil {
+		return "", wrapError(ErrConfig, err, "error setting up Azure CLI token cache client")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	accounts, err := app.Accounts(ctx)
+	if err != nil {
+		return "", wrapError(ErrFile, err, "error reading Azure CLI token cache %s", cacheFile)
+	}
+	var account *public.Account
+	for i := range accounts {
+		if strings.EqualFold(accounts[i].PreferredUsername, username) || username == "" && len(accounts) == 1 {
+			account = &accounts[i]
+			break
+		}
+	}
+	if account == nil {
+		return "", newError(ErrNotFound, "no Azure CLI account '%s' among the %d cached ones", username, len(accounts))
+	}
+	Logf("Using Azure CLI account %s\n", utl.Cya(account.PreferredUsername))
+
+	silentOptions := []public.AcquireSilentOption{public.WithSilentAccount(*account)}
+	if z.refreshClaims != "" {
+		silentOptions = append(silentOptions, public.WithClaims(z.refreshClaims)) // Bypasses the cached token
+	}
+	result, err := app.AcquireTokenSilent(ctx, scopes, silentOptions...)
+	if err != nil {
+		return "", wrapError(ErrPermissionDenied, err, "no usable Azure CLI token for %s, use 'az login' again",
+			account.PreferredUsername)
+	}
+	return result.AccessToken, nil
+}
+
+// Helper function that returns the user name and tenant ID of the Azure CLI's current account,
+// from the default subscription in its profile file, if it is a user account.
+func azureCliCurrentAccount(dir string) (username, tenantId string) {
+	data, err := os.ReadFile(filepath.Join(dir, azCliProfileFile))
+	if err != nil {
+		return "", ""
+	}
+	var profile struct {
+		Subscriptions []struct {
+			IsDefault bool   `json:"isDefault"`
+			TenantId  string `json:"tenantId"`
+			User      struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"user"`
+		} `json:"subscriptions"`
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // The Azure CLI writes a UTF-8 BOM
+	if err := json.Unmarshal(data, &profile); err != nil {
+		Logf("Error reading Azure CLI profile: %v\n", err)
+		return "", ""
+	}
+	for _, sub := range profile.Subscriptions {
+		if sub.IsDefault && sub.User.Type == "user" {
+			return sub.User.Name, sub.TenantId
+		}
+	}
+	return "", ""
+}
+
+// Helper function that prints the credential chain, if one is configured, and the links that
+// produced the API tokens, if they were already acquired. It never logs in, see
+// PrintCredentialChainSources for that.
+func dumpCredentialChain(z *Config) error {
+	chain, err := z.credentialChain()
+	if err != nil || len(chain) < 1 {
+		return err
+	}
+	printCredentialChain(chain, z)
+	return nil
+}
+
+// Acquires the API tokens through the configured credential chain, then prints the chain and
+// the links that produced each token. Unlike DumpLoginValues, this logs in. A failed login is
+// returned after printing the links that did produce a token, if any.
+func PrintCredentialChainSources(z *Config) error {
+	chain, err := z.credentialChain()
+	if err != nil {
+		return err
+	}
+	if len(chain) < 1 {
+		return newError(ErrConfig, "no credential chain is configured, see MAZ_CREDENTIAL_CHAIN")
+	}
+	err = SetupApiTokens(z)
+	printCredentialChain(chain, z)
+	return err
+}
+
+// Helper function that prints the given credential chain, and the links recorded in
+// z.TokenSources, if any token was acquired yet.
+func printCredentialChain(chain []string, z *Config) {
+	fmt.Printf("%s:\n", utl.Blu("credential_chain"))
+	fmt.Print(utl.Gra("  # Links are tried in this order for each token, the ones that produced them are below\n"))
+	fmt.Printf("  %s: %s\n", utl.Blu("links"), utl.Gre(strings.Join(chain, ", ")))
+	if z.TokenSources[AzApiToken] == "" && z.TokenSources[MgApiToken] == "" {
+		fmt.Print(utl.Gra("  # No tokens acquired yet, see -idc to acquire them and show their links\n"))
+		return
+	}
+	fmt.Printf("  %s: %s\n", utl.Blu("tenant_id"), utl.Gre(z.TenantId))
+	fmt.Printf("  %s: %s\n", utl.Blu("azure_arm_token"), utl.Gre(z.TokenSources[AzApiToken]))
+	fmt.Printf("  %s: %s\n", utl.Blu("ms_graph_token"), utl.Gre(z.TokenSources[MgApiToken]))
+}
@@ -1,51 +1,66 @@
 package maz
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/big"
-	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/queone/utl"
 )
 
 // Decode and validate the given JWT token string, print all decoded fields and final validation status.
-func DecodeAndValidateToken(tokenString string) {
+func DecodeAndValidateToken(tokenString string) error {
+	return decodeAndValidateToken(tokenString, "")
+}
+
+// Decode and validate the given JWT token string like DecodeAndValidateToken, but verify it
+// offline against the signing keys in the given JWKS file.
+func DecodeAndValidateTokenOffline(tokenString, jwksFile string) error {
+	return decodeAndValidateToken(tokenString, jwksFile)
+}
+
+// Helper function to decode, validate and print the token, against the keys in jwksFile if given.
+func decodeAndValidateToken(tokenString, jwksFile string) error {
 	Logf("Decoding and validating the given JWT token string\n")
 	parts, err := SplitJWT(tokenString)
 	if err != nil {
-		utl.Die("Error: %s\n", err)
+		return wrapError(ErrValidation, err, "error decoding token")
+	}
+
+	opts := tokenVerifyOptions{}
+	if jwksFile != "" {
+		if opts.keys, err = loadJwksFile(jwksFile); err != nil {
+			return err
+		}
 	}
 
 	PrintTokenComponents(parts)
 
 	fmt.Printf("%s:\n", utl.Blu("status")) // Token status block
 
-	Logf("Verifying token signature\n")
-	valid, err := VerifyAzureJwt(tokenString)
+	Logf("Verifying token signature and claims\n")
+	_, err = verifyAzureJwt(tokenString, opts)
 	fmt.Printf("  %s: ", utl.Blu("valid")) // Printout will be newlined below
-	if valid {
-		tokenType := GetApiTokenType(parts)
-		if tokenType == MgApiToken {
-			msg := "# Token PASSED iss/tid structure verification. Note, it's not signature verification."
-			fmt.Printf("%s  %s\n", utl.Gre("true"), utl.Gra(msg))
-		} else {
-			fmt.Printf("%s  %s\n", utl.Gre("true"), utl.Gra("# Token PASSED signature verification"))
+	if err == nil {
+		msg := "# Token PASSED signature and claims verification"
+		if jwksFile != "" {
+			msg += " against " + jwksFile
 		}
+		fmt.Printf("%s  %s\n", utl.Gre("true"), utl.Gra(msg))
 	} else {
-		fmt.Printf("%s  %s\n", utl.Red("false"), utl.Gra("# Token FAILED signature verification"))
-		Logf("Token signature verification error: %s", utl.Red(err))
+		fmt.Printf("%s  %s\n", utl.Red("false"), utl.Gra("# Token FAILED verification: "+err.Error()))
+		Logf("Token verification error: %s", utl.Red(err))
+	}
+
+	if err := PrintTokenReport(tokenString, NewConfig()); err != nil {
+		return err
 	}
 
 	os.Stdout.Sync()
-	os.Exit(0)
+	return nil
 }
 
 // Decode and print the header, claims, and signature components of the JWT token.
@@ -93,85 +108,20 @@ func PrintTokenComponents(parts []string) {
 		utl.Gra("# In base64 format"))
 }
 
-// Validate the given Azure or MS Graph JWT token, including key fetching and issuer structure.
+// Validate the signature and claims of the given Azure or MS Graph JWT token, fetching the
+// issuer's signing keys only if they are not yet cached, see verifyAzureJwt().
 func VerifyAzureJwt(tokenString string) (bool, error) {
-	parts, err := SplitJWT(tokenString)
-	if err != nil {
-		return false, fmt.Errorf("invalid token format: %w", err)
-	}
-
-	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
-	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
-
-	var header map[string]interface{}
-	var claims map[string]interface{}
-	json.Unmarshal(headerJSON, &header)
-	json.Unmarshal(claimsJSON, &claims)
-
-	kid, _ := header["kid"].(string)
-	iss, _ := claims["iss"].(string)
-	aud, _ := claims["aud"].(string)
-	tid, _ := claims["tid"].(string)
-
-	jwksURL := fmt.Sprintf("%s/discovery/v2.0/keys", strings.TrimRight(iss, "/"))
-	resp, err := http.Get(jwksURL)
-	if err != nil {
-		return false, fmt.Errorf("failed to fetch JWKS: %w", err)
-	}
-	defer resp.Body.Close()
-
-	var jwks struct {
-		Keys []map[string]interface{} `json:"keys"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
-		return false, fmt.Errorf("failed to decode JWKS: %w", err)
-	}
-
-	var pubKey *rsa.PublicKey
-	for _, key := range jwks.Keys {
-		if key["kid"] == kid {
-			if x5cArr, ok := key["x5c"].([]interface{}); ok && len(x5cArr) > 0 {
-				decodedCert, _ := base64.StdEncoding.DecodeString(x5cArr[0].(string))
-				cert, err := x509.ParseCertificate(decodedCert)
-				if err == nil {
-					pubKey = cert.PublicKey.(*rsa.PublicKey)
-				}
-			} else if nStr, okN := key["n"].(string); okN {
-				nBytes, _ := base64.RawURLEncoding.DecodeString(nStr)
-				eBytes, _ := base64.RawURLEncoding.DecodeString(key["e"].(string))
-				n := new(big.Int).SetBytes(nBytes)
-				e := int(new(big.Int).SetBytes(eBytes).Int64())
-				pubKey = &rsa.PublicKey{N: n, E: e}
-			}
-			break
-		}
-	}
-
-	if pubKey == nil {
-		return false, fmt.Errorf("no matching public key found for KID: %s", kid)
-	}
-
-	tokenType := GetApiTokenType(parts)
-	switch tokenType {
-	case AzApiToken:
-		Logf("Verifying AZ token\n")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return pubKey, nil
-		}, jwt.WithAudience(aud), jwt.WithIssuer(iss))
+	_, err := verifyAzureJwt(tokenString, tokenVerifyOptions{})
+	return err == nil, err
+}
 
-		if err != nil || !token.Valid {
-			return false, fmt.Errorf("signature validation failed: %w", err)
-		}
-		return true, nil
-	case MgApiToken:
-		Logf("Verifying MG token\n")
-		if validateIssuerStructure(iss, tid) {
-			return true, nil
-		}
-		return false, fmt.Errorf("issuer structure or tid validation failed")
-	default:
-		return false, fmt.Errorf("unrecognized or unsupported audience: %s", aud)
-	}
+// Validate the given token like VerifyAzureJwt, also requiring it to be for the configured
+// tenant, and fetching signing keys with the configured HTTP client. Tokens for the scopes of
+// add-on APIs may have any audience, see AddApi().
+func verifyTokenForConfig(tokenString string, scopes []string, z *Config) (bool, error) {
+	addOn := len(scopes) > 0 && !isAzScope(scopes[0]) && !isMgScope(scopes[0])
+	_, err := verifyAzureJwt(tokenString, tokenVerifyOptions{tenantId: z.TenantId, httpClient: z.httpClient(), anyAudience: addOn})
+	return err == nil, err
 }
 
 // Validate whether the issuer URL structure matches the tenant ID.
@@ -180,7 +130,11 @@ func validateIssuerStructure(iss string, tid string) bool {
 	// que.one/azure/ms-token-validation.html and its referenced sources
 	Logf("Validating iss/tid structure\n")
 	if tid == "" || iss == "" {
-		fmt.Println("Missing tid or iss")
+		Logf("Missing tid or iss\n")
+		return false
+	}
+	if !isKnownIssuer(iss) {
+		Logf("Issuer %s is not from a known Azure cloud\n", utl.Red(iss))
 		return false
 	}
 	if strings.Contains(strings.ToLower(iss), "{tenantid}") {
@@ -194,9 +148,29 @@ func validateIssuerStructure(iss string, tid string) bool {
 	}
 	path := strings.Trim(strings.SplitN(iss, "://", 2)[1], "/")
 	segments := strings.Split(path, "/")
+	if len(segments) > 1 && segments[len(segments)-1] == "v2.0" {
+		segments = segments[:len(segments)-1] // v2.0 issuers end in {tid}/v2.0
+	}
 	return len(segments) > 0 && strings.EqualFold(segments[len(segments)-1], tid)
 }
 
+// Returns the claims of the given JWT token, without validating it.
+func decodeTokenClaims(tokenString string) (map[string]interface{}, error) {
+	parts, err := SplitJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	return claims, nil
+}
+
 // Determine whether the JWT is for Azure or Microsoft Graph based on the aud field.
 func GetApiTokenType(parts []string) string {
 	if len(parts) != 3 {
@@ -219,14 +193,9 @@ func GetApiTokenType(parts []string) string {
 		return UnknownApiToken
 	}
 
-	switch aud {
-	case "https://management.azure.com":
-		return AzApiToken
-	case "https://graph.microsoft.com":
-		return MgApiToken
-	default:
-		return UnknownApiToken
-	}
+	// Audiences of all known clouds are recognized, see CloudEnvironments
+	_, tokenType, _ := cloudForAudience(aud)
+	return tokenType
 }
 
 // Return the last 4 characters of the token string, for display/debugging.
@@ -0,0 +1,292 @@
+package maz
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/queone/utl"
+)
+
+// Token signing keys are cached in MazConfigDir, so verifying tokens does not need network
+// access each time. Cached keys are refetched once they are older than jwksCacheTtl, or sooner
+// when a token is signed with an unknown key, as happens when Microsoft rotates its keys. If
+// the refetch fails, cached keys up to jwksCacheMaxAge old are still used.
+const (
+	JwksCacheFile       = "jwks_cache.json"
+	jwksCacheTtl        = 24 * time.Hour
+	jwksCacheMaxAge     = 7 * 24 * time.Hour
+	jwksRefreshInterval = 5 * time.Minute // Minimum time between refetches for unknown kids
+	jwksFetchTimeout    = 30 * time.Second
+	tokenClockSkew      = 5 * time.Minute // Allowed for the exp and nbf claims
+)
+
+// A JSON Web Key Set, as published by the Microsoft identity platform.
+type jwks struct {
+	Keys []map[string]interface{} `json:"keys"`
+}
+
+// Cached JWKS, with the time it was fetched.
+type jwksCacheEntry struct {
+	Fetched time.Time                `json:"fetched"`
+	Keys    []map[string]interface{} `json:"keys"`
+}
+
+var jwksCacheMu sync.Mutex // Serializes reading and updating the JWKS cache file
+
+// Options for verifying a token, see verifyAzureJwt().
+type tokenVerifyOptions struct {
+	tenantId    string       // If a UUID, the token's tid must match it
+	keys        *jwks        // Verify offline against these keys, instead of the issuer's
+	httpClient  *http.Client // For fetching the issuer's keys
+	anyAudience bool         // Accept audiences other than ARM and MS Graph, for add-on APIs
+}
+
+// Verifies the signature and claims of the given Azure or MS Graph access token, and returns
+// its claims. Besides the signature, the token must be unexpired and already valid, have a
+// known Azure cloud issuer matching its tid, a known ARM or MS Graph audience, unless
+// opts.anyAudience is set, and either delegated scopes (scp) or application roles (roles).
+func verifyAzureJwt(tokenString string, opts tokenVerifyOptions) (jwt.MapClaims, error) {
+	parts, err := SplitJWT(tokenString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token format: %w", err)
+	}
+	var header map[string]interface{}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, fmt.Errorf("invalid token header")
+	}
+	claims, err := decodeTokenClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _ := header["kid"].(string)
+	iss, _ := claims["iss"].(string)
+	aud, _ := claims["aud"].(string)
+	tid, _ := claims["tid"].(string)
+
+	// Only trust signing keys from the issuers of known Azure clouds
+	if !isKnownIssuer(iss) {
+		return nil, fmt.Errorf("issuer is not a known Azure cloud issuer: %s", iss)
+	}
+	_, tokenType, ok := cloudForAudience(aud)
+	if !ok && (!opts.anyAudience || aud == "") {
+		return nil, fmt.Errorf("unrecognized or unsupported audience: %s", aud)
+	}
+	if !validateIssuerStructure(iss, tid) {
+		return nil, fmt.Errorf("issuer structure or tid validation failed")
+	}
+	if utl.ValidUuid(opts.tenantId) && !strings.EqualFold(tid, opts.tenantId) {
+		return nil, fmt.Errorf("token tenant %s does not match tenant %s", tid, opts.tenantId)
+	}
+	if !hasScopesOrRoles(claims) {
+		return nil, fmt.Errorf("token has neither scp nor roles claim")
+	}
+
+	var pubKey *rsa.PublicKey
+	if opts.keys != nil {
+		pubKey, err = findJwk(opts.keys.Keys, kid)
+	} else {
+		pubKey, err = getSigningKey(iss, kid, opts.httpClient)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// MS Graph tokens that carry a nonce in their header are signed over the header with the
+	// nonce replaced by its SHA-256 hash, so that is what gets verified
+	candidates := []string{tokenString}
+	if nonce, _ := header["nonce"].(string); tokenType == MgApiToken && nonce != "" {
+		candidates = append([]string{hashTokenNonce(parts, headerJSON, nonce)}, candidates...)
+	}
+
+	Logf("Verifying %s signature and claims\n", tokenType)
+	for _, candidate := range candidates {
+		_, err = jwt.Parse(candidate, func(token *jwt.Token) (interface{}, error) {
+			return pubKey, nil
+		}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(iss), jwt.WithExpirationRequired(),
+			jwt.WithLeeway(tokenClockSkew))
+		if err == nil {
+			return jwt.MapClaims(claims), nil
+		}
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break // Claim errors are the same for every candidate
+		}
+	}
+	return nil, fmt.Errorf("token validation failed: %w", err)
+}
+
+// Helper function that reports whether the claims hold delegated scopes or application roles.
+func hasScopesOrRoles(claims map[string]interface{}) bool {
+	if scp, ok := claims["scp"].(string); ok && strings.TrimSpace(scp) != "" {
+		return true
+	}
+	roles, ok := claims["roles"].([]interface{})
+	return ok && len(roles) > 0
+}
+
+// Helper function that returns the token with the nonce in its header replaced by the
+// base64url encoded SHA-256 hash of the nonce. The header JSON is edited in place, since
+// re-encoding it could change its bytes and break the signature.
+func hashTokenNonce(parts []string, headerJSON []byte, nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	hashed := base64.RawURLEncoding.EncodeToString(sum[:])
+	original, _ := json.Marshal(nonce)
+	replaced, _ := json.Marshal(hashed)
+	header := strings.Replace(string(headerJSON), string(original), string(replaced), 1)
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1] + "." + parts[2]
+}
+
+// Returns the RSA public key with the given kid from the JWKS of the given issuer, using the
+// JWKS cache in MazConfigDir, and fetching the keys with the given HTTP client when needed.
+func getSigningKey(iss, kid string, client *http.Client) (*rsa.PublicKey, error) {
+	jwksUrl := strings.TrimRight(iss, "/") + "/discovery/v2.0/keys"
+
+	jwksCacheMu.Lock()
+	defer jwksCacheMu.Unlock()
+	cache := loadJwksCache()
+	entry := cache[jwksUrl]
+	if entry != nil {
+		age := time.Since(entry.Fetched)
+		key, err := findJwk(entry.Keys, kid)
+		if key != nil && age < jwksCacheTtl {
+			return key, nil
+		}
+		if key == nil && age < jwksRefreshInterval {
+			return nil, err // Just fetched, so the kid is not one of the issuer's
+		}
+	}
+
+	keys, err := fetchJwks(jwksUrl, client)
+	if err != nil {
+		if entry != nil && time.Since(entry.Fetched) < jwksCacheMaxAge {
+			if key, _ := findJwk(entry.Keys, kid); key != nil {
+				Logf("%s, using cached signing keys from %s\n", utl.Red(err), entry.Fetched.Format(time.RFC3339))
+				return key, nil
+			}
+		}
+		return nil, err
+	}
+	cache[jwksUrl] = &jwksCacheEntry{Fetched: time.Now(), Keys: keys.Keys}
+	saveJwksCache(cache)
+	return findJwk(keys.Keys, kid)
+}
+
+// Helper function to fetch the JWKS from the given URL.
+func fetchJwks(jwksUrl string, client *http.Client) (*jwks, error) {
+	Logf("Fetching token signing keys from %s\n", utl.Cya(jwksUrl))
+	if client == nil {
+		client = &http.Client{Timeout: jwksFetchTimeout}
+	}
+	resp, err := client.Get(jwksUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: HTTP %d from %s", resp.StatusCode, jwksUrl)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	return parseJwks(body)
+}
+
+// Helper function to parse a JWKS document.
+func parseJwks(data []byte) (*jwks, error) {
+	var keys jwks
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	if len(keys.Keys) < 1 {
+		return nil, fmt.Errorf("JWKS has no keys")
+	}
+	return &keys, nil
+}
+
+// Loads the JWKS in the given file, such as a copy of an issuer's discovery/v2.0/keys
+// document, for verifying tokens offline.
+func loadJwksFile(filePath string) (*jwks, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, wrapError(ErrFile, err, "error reading JWKS file %s", filePath)
+	}
+	keys, err := parseJwks(data)
+	if err != nil {
+		return nil, wrapError(ErrValidation, err, "invalid JWKS file %s", filePath)
+	}
+	return keys, nil
+}
+
+// Helper function that returns the RSA public key with the given kid from the given keys,
+// taking it from the x5c certificate if there is one, or else from the modulus and exponent.
+func findJwk(keys []map[string]interface{}, kid string) (*rsa.PublicKey, error) {
+	for _, key := range keys {
+		if keyKid, _ := key["kid"].(string); kid == "" || keyKid != kid {
+			continue
+		}
+		if x5c, ok := key["x5c"].([]interface{}); ok && len(x5c) > 0 {
+			certB64, _ := x5c[0].(string)
+			der, err := base64.StdEncoding.DecodeString(certB64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c certificate for KID: %s", kid)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c certificate for KID %s: %w", kid, err)
+			}
+			if pubKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+				return pubKey, nil
+			}
+			return nil, fmt.Errorf("x5c certificate for KID %s has no RSA key", kid)
+		}
+		nStr, _ := key["n"].(string)
+		eStr, _ := key["e"].(string)
+		nBytes, errN := base64.RawURLEncoding.DecodeString(nStr)
+		eBytes, errE := base64.RawURLEncoding.DecodeString(eStr)
+		if nStr == "" || eStr == "" || errN != nil || errE != nil {
+			return nil, fmt.Errorf("invalid RSA key for KID: %s", kid)
+		}
+		n := new(big.Int).SetBytes(nBytes)
+		e := int(new(big.Int).SetBytes(eBytes).Int64())
+		return &rsa.PublicKey{N: n, E: e}, nil
+	}
+	return nil, fmt.Errorf("no matching public key found for KID: %s", kid)
+}
+
+// Helper function to load the JWKS cache, which is empty if the file is missing or unreadable.
+func loadJwksCache() map[string]*jwksCacheEntry {
+	cache := make(map[string]*jwksCacheEntry)
+	if err := readJsonFile(filepath.Join(MazConfigDir, JwksCacheFile), &cache); err != nil && !os.IsNotExist(err) {
+		Logf("Ignoring unreadable JWKS cache: %v\n", err)
+		cache = make(map[string]*jwksCacheEntry)
+	}
+	return cache
+}
+
+// Helper function to save the JWKS cache. Failing to save it is only logged, since the keys
+// can always be fetched again.
+func saveJwksCache(cache map[string]*jwksCacheEntry) {
+	if err := ensureMazConfigDir(); err != nil {
+		Logf("Not caching JWKS: %v\n", err)
+		return
+	}
+	if err := writeJsonFile(filepath.Join(MazConfigDir, JwksCacheFile), cache); err != nil {
+		Logf("Error saving JWKS cache: %v\n", err)
+	}
+}
@@ -0,0 +1,155 @@
+package maz
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testTokenTenant = "00000000-0000-0000-0000-000000000001"
+
+// Helper function that returns a new signing key, and the JWKS publishing it as kid "k1".
+func newTestSigningKey(t *testing.T) (*rsa.PrivateKey, *jwks) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, &jwks{Keys: []map[string]interface{}{{
+		"kid": "k1",
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+}
+
+// Helper function that returns the claims of a valid MS Graph token, with the given changes.
+func testTokenClaims(changes map[string]interface{}) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss": "https://sts.windows.net/" + testTokenTenant + "/",
+		"aud": "https://graph.microsoft.com",
+		"tid": testTokenTenant,
+		"scp": "User.Read",
+		"iat": time.Now().Add(-time.Minute).Unix(),
+		"nbf": time.Now().Add(-time.Minute).Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range changes {
+		claims[name] = value
+	}
+	return claims
+}
+
+// Helper function that signs a token with the given claims and header values.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims, header map[string]interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	for name, value := range header {
+		token.Header[name] = value
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// Helper function that signs a token the way MS Graph does when its header has a nonce: over
+// the header with the SHA-256 hash of the nonce, while the token carries the nonce itself.
+func signTestNonceToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims, nonce string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(nonce))
+	hashed := base64.RawURLEncoding.EncodeToString(sum[:])
+	signed := signTestToken(t, key, claims, map[string]interface{}{"nonce": hashed})
+	parts := strings.Split(signed, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.Replace(string(headerJSON), `"`+hashed+`"`, `"`+nonce+`"`, 1)
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1] + "." + parts[2]
+}
+
+func TestVerifyAzureJwt(t *testing.T) {
+	key, keys := newTestSigningKey(t)
+	otherKey, _ := newTestSigningKey(t)
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr string // Empty if the token is valid
+	}{
+		{"valid token", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(nil), nil)
+		}, ""},
+		{"valid ARM token", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(map[string]interface{}{"aud": "https://management.azure.com/"}), nil)
+		}, ""},
+		{"bad issuer", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(map[string]interface{}{"iss": "https://sts.example.com/" + testTokenTenant + "/"}), nil)
+		}, "issuer"},
+		{"issuer of another tenant", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(map[string]interface{}{"iss": "https://sts.windows.net/00000000-0000-0000-0000-000000000002/"}), nil)
+		}, "issuer structure"},
+		{"bad audience", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(map[string]interface{}{"aud": "https://example.com"}), nil)
+		}, "audience"},
+		{"expired token", func(t *testing.T) string {
+			return signTestToken(t, key, testTokenClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), nil)
+		}, "expired"},
+		{"no scopes or roles", func(t *testing.T) string {
+			claims := testTokenClaims(nil)
+			delete(claims, "scp")
+			return signTestToken(t, key, claims, nil)
+		}, "neither scp nor roles"},
+		{"signed by another key", func(t *testing.T) string {
+			return signTestToken(t, otherKey, testTokenClaims(nil), nil)
+		}, "signature"},
+		{"nonce hash", func(t *testing.T) string {
+			return signTestNonceToken(t, key, testTokenClaims(nil), "graph-nonce")
+		}, ""},
+		{"nonce hash, signed by another key", func(t *testing.T) string {
+			return signTestNonceToken(t, otherKey, testTokenClaims(nil), "graph-nonce")
+		}, "signature"},
+		{"nonce hash, expired token", func(t *testing.T) string {
+			return signTestNonceToken(t, key, testTokenClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), "graph-nonce")
+		}, "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyAzureJwt(tt.token(t), tokenVerifyOptions{tenantId: testTokenTenant, keys: keys})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("verifyAzureJwt() failed: %v", err)
+			case tt.wantErr == "" && claims["tid"] != testTokenTenant:
+				t.Errorf("verifyAzureJwt() returned claims %v", claims)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("verifyAzureJwt() accepted the token, want an error about %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("verifyAzureJwt() error %q, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAzureJwtTenant(t *testing.T) {
+	key, keys := newTestSigningKey(t)
+	token := signTestToken(t, key, testTokenClaims(nil), nil)
+	_, err := verifyAzureJwt(token, tokenVerifyOptions{tenantId: "00000000-0000-0000-0000-000000000002", keys: keys})
+	if err == nil || !strings.Contains(err.Error(), "does not match tenant") {
+		t.Errorf("verifyAzureJwt() error = %v, want a tenant mismatch", err)
+	}
+
+	// Add-on APIs may have other audiences, but only when asked for
+	token = signTestToken(t, key, testTokenClaims(map[string]interface{}{"aud": "api://add-on"}), nil)
+	if _, err := verifyAzureJwt(token, tokenVerifyOptions{tenantId: testTokenTenant, keys: keys, anyAudience: true}); err != nil {
+		t.Errorf("verifyAzureJwt() of add-on API token failed: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package maz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Managed identity endpoints and API versions, see
+// learn.microsoft.com/en-us/entra/identity/managed-identities-azure-resources/how-to-use-vm-token
+// learn.microsoft.com/en-us/azure/app-service/overview-managed-identity#rest-endpoint-reference
+const (
+	ConstImdsTokenUrl           = "http://169.254.169.254/metadata/identity/oauth2/token"
+	imdsApiVersion              = "2018-02-01"
+	identityEndpointVersion     = "2019-08-01"
+	managedIdentityTimeout      = 30 * time.Second
+	managedIdentityProbeTimeout = 3 * time.Second // When trying it as a credential chain link
+	managedIdentityMaxRetries   = 3
+)
+
+// Acquires an access token for the given API scope from the managed identity endpoint of the
+// Azure VM, App Service, Function or container the program runs on. The App Service style
+// IDENTITY_ENDPOINT and IDENTITY_HEADER environment variables are used if set, otherwise the
+// instance metadata service (IMDS). z.ManagedIdentityEndpoint overrides the IMDS endpoint, to
+// test against a local stand-in, and z.ClientId selects a user-assigned identity, if set.
+func GetTokenByManagedIdentity(scopes []string, z *Config) (string, error) {
+	return getTokenByManagedIdentity(context.Background(), scopes, z.ClientId, z, false)
+}
+
+// Helper function that gets the managed identity token, for the user-assigned identity clientId
+// if not empty. When probing, as a credential chain link that may well be running outside
+// Azure, an unreachable endpoint fails fast and errors are not retried, unless an endpoint was
+// explicitly configured.
+func getTokenByManagedIdentity(ctx context.Context, scopes []string, clientId string, z *Config, probe bool) (string, error) {
+	if len(scopes) < 1 {
+		return "", newError(ErrConfig, "no scope given for managed identity token")
+	}
+	// Managed identity endpoints take the v1 resource, rather than the scope
+	resource := strings.TrimSuffix(scopes[0], "/.default")
+	service := getServiceApiName(scopes)
+	Logf("Getting managed identity access token for service %s\n", utl.Cya(service))
+
+	req, err := newManagedIdentityRequest(resource, clientId, z)
+	if err != nil {
+		return "", err
+	}
+
+	timeout, maxRetries := managedIdentityTimeout, managedIdentityMaxRetries
+	if probe && z.ManagedIdentityEndpoint == "" && os.Getenv("IDENTITY_ENDPOINT") == "" {
+		timeout, maxRetries = managedIdentityProbeTimeout, 0
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// IMDS can briefly return 404, 429 or 5xx while an identity is being assigned or updated
+	for attempt := 0; ; attempt++ {
+		resp, err := z.httpClient().Do(req)
+		if err != nil {
+			return "", wrapError(ErrPermissionDenied, err, "managed identity endpoint %s is not reachable", req.URL.Host)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", wrapError(ErrApiCall, err, "error reading managed identity response")
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			var result struct {
+				AccessToken string `json:"access_token"`
+			}
+			if err := json.Unmarshal(body, &result); err != nil || result.AccessToken == "" {
+				return "", newError(ErrApiCall, "managed identity endpoint returned no access token")
+			}
+			Logf("%s\n", utl.Cya("Successfully got managed identity token"))
+			return result.AccessToken, nil
+		}
+
+		retryable := resp.StatusCode == http.StatusNotFound || isThrottled(resp.StatusCode) || resp.StatusCode >= 500
+		if !retryable || attempt >= maxRetries {
+			var errBody map[string]interface{}
+			json.Unmarshal(body, &errBody)
+			return "", wrapError(ErrPermissionDenied, NewApiError(resp.StatusCode, errBody, resp.Header),
+				"managed identity token request failed")
+		}
+		wait := retryDelay(resp.Header, attempt, z.Retry)
+		Logf("HTTP %d from managed identity endpoint, retrying in %s\n", resp.StatusCode, wait)
+		if err := sleepContext(ctx, wait); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Helper function to build the token request for the managed identity endpoint in use.
+func newManagedIdentityRequest(resource, clientId string, z *Config) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("resource", resource)
+	if clientId != "" {
+		params.Set("client_id", clientId) // User-assigned identity
+	}
+
+	endpoint := ConstImdsTokenUrl
+	headers := map[string]string{"Metadata": "true"}
+	params.Set("api-version", imdsApiVersion)
+	if identityEndpoint := os.Getenv("IDENTITY_ENDPOINT"); identityEndpoint != "" && z.ManagedIdentityEndpoint == "" {
+		Logf("Using managed identity endpoint from IDENTITY_ENDPOINT\n")
+		endpoint = identityEndpoint
+		headers = map[string]string{"X-IDENTITY-HEADER": os.Getenv("IDENTITY_HEADER")}
+		params.Set("api-version", identityEndpointVersion)
+	} else if z.ManagedIdentityEndpoint != "" {
+		endpoint = z.ManagedIdentityEndpoint
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, wrapError(ErrConfig, err, "invalid managed identity endpoint %s", endpoint)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	Logf("Managed identity endpoint is %s\n", utl.Cya(fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path)))
+	return req, nil
+}
@@ -0,0 +1,214 @@
+package maz
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// API tokens are refreshed mid-run once they expire within tokenRefreshMargin, the same margin
+// MSAL uses, so a silent acquisition returns a new token rather than the cached one.
+const tokenRefreshMargin = 5 * time.Minute
+
+// Error codes of 401 responses to an expired or revoked token, which are retried once with a
+// refreshed token
+var invalidTokenCodes = []string{"InvalidAuthenticationToken", "ExpiredAuthenticationToken"}
+
+// Returns the type of API token used for the given URL: the scope of a matching add-on API,
+// see AddApi(), else AzApiToken or MgApiToken, or "" for URLs of unknown APIs. The configured
+// base URLs are checked before the cloud's, so that overridden endpoints (e.g. a local fake)
+// get the right token.
+func (m *Config) apiTokenType(apiUrl string) string {
+	m.tokenMu.RLock()
+	scope := m.addOnScope(apiUrl)
+	m.tokenMu.RUnlock()
+	if scope != "" {
+		return scope
+	} else if m.MgUrl != "" && strings.HasPrefix(apiUrl, m.MgUrl) {
+		return MgApiToken
+	} else if m.AzUrl != "" && strings.HasPrefix(apiUrl, m.AzUrl) {
+		return AzApiToken
+	} else if strings.HasPrefix(apiUrl, m.CloudEnv().MgUrl) {
+		return MgApiToken
+	} else if strings.HasPrefix(apiUrl, m.CloudEnv().AzUrl) {
+		return AzApiToken
+	}
+	return ""
+}
+
+// Returns a copy of the headers of the given API token type, safe to use while another
+// goroutine refreshes the token.
+func (m *Config) apiHeaders(tokenType string) map[string]string {
+	m.tokenMu.RLock()
+	defer m.tokenMu.RUnlock()
+	switch tokenType {
+	case MgApiToken:
+		return maps.Clone(m.MgHeaders)
+	case AzApiToken:
+		return maps.Clone(m.AzHeaders)
+	}
+	if t := m.addOnTokens[tokenType]; t != nil {
+		return maps.Clone(t.headers)
+	}
+	return nil
+}
+
+// Returns the current token of the given type.
+func (m *Config) apiToken(tokenType string) string {
+	m.tokenMu.RLock()
+	defer m.tokenMu.RUnlock()
+	switch tokenType {
+	case AzApiToken:
+		return m.AzToken
+	case MgApiToken:
+		return m.MgToken
+	}
+	if t := m.addOnTokens[tokenType]; t != nil {
+		return t.token
+	}
+	return ""
+}
+
+// Sets the token of the given type, along with its Authorization header.
+func (m *Config) setApiToken(tokenType, token string) {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	switch tokenType {
+	case AzApiToken:
+		m.AzToken = token
+		m.AzHeaders["Authorization"] = "Bearer " + token
+	case MgApiToken:
+		m.MgToken = token
+		m.MgHeaders["Authorization"] = "Bearer " + token
+	default:
+		if t := m.addOnTokens[tokenType]; t != nil {
+			t.token = token
+			t.headers["Authorization"] = "Bearer " + token
+		}
+	}
+}
+
+// Reports whether the given token expires within tokenRefreshMargin. Tokens that can't be
+// decoded are left to the API to reject.
+func tokenExpiresSoon(token string) bool {
+	claims, err := decodeTokenClaims(token)
+	if err != nil || claims["exp"] == nil {
+		return false
+	}
+	return time.Until(time.Unix(utl.Int64(claims["exp"]), 0)) < tokenRefreshMargin
+}
+
+// Reports whether a new token of the given type is needed before a call: if it expires soon,
+// or if it is an add-on API token that has not been acquired yet.
+func needsApiToken(tokenType, token string) bool {
+	return token == "" && isAddOnTokenType(tokenType) || tokenExpiresSoon(token)
+}
+
+// Refreshes the token of the given type if it is needed, see needsApiToken(), or, if rejected
+// is not empty, if it is still the token the API just rejected, in which case the optional
+// claims challenge of the response is passed on. Concurrent callers wait for a single refresh,
+// and a token that can't be refreshed is not tried again. Reports whether the token was
+// replaced.
+func (m *Config) refreshApiToken(tokenType, rejected, claims string) (bool, error) {
+	if tokenType == "" || m.Replaying() {
+		return false, nil
+	}
+	if rejected == "" && !needsApiToken(tokenType, m.apiToken(tokenType)) {
+		return false, nil // The usual case, without taking the refresh lock
+	}
+
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+	current := m.apiToken(tokenType)
+	if rejected != "" && current != rejected || rejected == "" && !needsApiToken(tokenType, current) {
+		return true, nil // Another goroutine already refreshed it
+	}
+	failedKey := tokenType // Rejected tokens get one more try, even if they failed to refresh before
+	if rejected != "" {
+		failedKey += "/rejected"
+	}
+	if current != "" && m.refreshFailed[failedKey] == current {
+		return false, nil
+	}
+
+	Logf("Refreshing %s, suffix %s\n", tokenType, utl.Cya(GetTokenSuffix(current)))
+	if rejected != "" && claims == "" {
+		// Without a claims challenge, MSAL would return the cached token, so ask for a token
+		// issued from now on, like a continuous access evaluation challenge does
+		claims = fmt.Sprintf(`{"access_token":{"nbf":{"essential":true,"value":"%d"}}}`, time.Now().Unix())
+	}
+	// The first token of an add-on API is acquired like the initial tokens, but a refresh
+	// must not stop a long operation to wait for the user
+	m.refreshing, m.refreshClaims = current != "", claims
+	token, err := m.acquireApiToken(tokenType)
+	m.refreshing, m.refreshClaims = false, ""
+	if err == nil && token == current {
+		err = fmt.Errorf("got the same token again")
+	}
+	if err != nil {
+		if current == "" {
+			return false, wrapError(ErrPermissionDenied, err, "failed to acquire token for %s", tokenType)
+		}
+		if m.refreshFailed == nil {
+			m.refreshFailed = make(map[string]string)
+		}
+		m.refreshFailed[failedKey] = current
+		return false, wrapError(ErrPermissionDenied, err, "failed to refresh %s", tokenType)
+	}
+	m.setApiToken(tokenType, token)
+	Logf("%s refreshed, new suffix %s\n", tokenType, utl.Cya(GetTokenSuffix(token)))
+	return true, nil
+}
+
+// Helper function that acquires a new token of the given type the way the current one was,
+// through the same credential chain link if a chain is in use. Add-on API tokens are acquired
+// the way the MS Graph token was. It doesn't run under the context of the call that needed
+// the token, since concurrent callers share the refresh.
+func (m *Config) acquireApiToken(tokenType string) (string, error) {
+	scope := m.MgScope()
+	if tokenType == AzApiToken {
+		scope = m.AzScope()
+	} else if isAddOnTokenType(tokenType) {
+		scope = []string{tokenType}
+	}
+	link := m.TokenSources[tokenType]
+	if link == "" && isAddOnTokenType(tokenType) {
+		link = m.TokenSources[MgApiToken]
+	}
+	if link != "" {
+		token, err := getTokenByChainLink(context.Background(), link, scope, true, m)
+		if err == nil {
+			m.TokenSources[tokenType] = link
+		}
+		return token, err
+	}
+	if !m.Interactive && !m.ManagedIdentity && m.ClientId == "" {
+		return "", newError(ErrConfig, "tokens are only given via MAZ_AZ_TOKEN and MAZ_MG_TOKEN, with no login to get more")
+	}
+	return GetApiToken(scope, m)
+}
+
+// Returns the decoded claims challenge of a 401 response, from the claims parameter of its
+// WWW-Authenticate header, or "" if there is none.
+func claimsChallenge(wwwAuthenticate string) string {
+	for _, param := range strings.Split(wwwAuthenticate, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimPrefix(key, "Bearer "), "claims") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			decoded, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		}
+		if err == nil {
+			return string(decoded)
+		}
+	}
+	return ""
+}
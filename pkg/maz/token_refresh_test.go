@@ -0,0 +1,131 @@
+package maz
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper function that returns an unsigned JWT for the given subject, expiring after the
+// given time. Refreshing only looks at its expiry.
+func testExpiringToken(subject string, expiresIn time.Duration) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	return encode(map[string]string{"alg": "none", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": subject, "exp": time.Now().Add(expiresIn).Unix()}) + ".sig"
+}
+
+// Helper function that returns a configuration whose MS Graph token is refreshed from the
+// MAZ_MG_TOKEN environment variable, as the env credential chain link does, and a handler
+// that records the token of each call and accepts only the given token.
+func newRefreshTestConfig(t *testing.T, token, valid string) (*Config, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []string
+	z := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		got := r.Header.Get("Authorization")
+		seen = append(seen, got)
+		if got != "Bearer "+valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="", error="invalid_token"`)
+			writeJson(w, 401, map[string]interface{}{"error": map[string]interface{}{"code": "InvalidAuthenticationToken"}})
+			return
+		}
+		writeJson(w, 200, map[string]interface{}{"id": "u1"})
+	})
+	z.setApiToken(MgApiToken, token)
+	z.TokenSources[MgApiToken] = ChainEnvTokens
+	return z, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestRefreshExpiringToken(t *testing.T) {
+	old, fresh := testExpiringToken("old", time.Minute), testExpiringToken("fresh", time.Hour)
+	t.Setenv("MAZ_MG_TOKEN", fresh)
+	z, seen := newRefreshTestConfig(t, old, fresh)
+
+	if _, statCode, err := ApiGet(z.MgUrl+"/v1.0/users/u1", z, nil); err != nil || statCode != 200 {
+		t.Fatalf("ApiGet() = %d, %v", statCode, err)
+	}
+	if got := seen(); len(got) != 1 || got[0] != "Bearer "+fresh {
+		t.Errorf("calls used tokens %v, want only the refreshed one", got)
+	}
+	if z.MgToken != fresh {
+		t.Error("the refreshed token was not kept")
+	}
+}
+
+func TestRefreshRejectedToken(t *testing.T) {
+	old, fresh := testExpiringToken("old", time.Hour), testExpiringToken("fresh", time.Hour)
+	t.Setenv("MAZ_MG_TOKEN", fresh)
+	z, seen := newRefreshTestConfig(t, old, fresh)
+
+	// Concurrent calls share a single refresh, and are each retried once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, statCode, err := ApiGet(z.MgUrl+"/v1.0/users/u1", z, nil); err != nil || statCode != 200 {
+				t.Errorf("ApiGet() = %d, %v", statCode, err)
+			}
+		}()
+	}
+	wg.Wait()
+	rejected := 0
+	for _, token := range seen() {
+		if token != "Bearer "+fresh {
+			rejected++
+		}
+	}
+	if rejected > 4 || len(seen())-rejected != 4 {
+		t.Errorf("calls used tokens %v, want at most one rejected call each and 4 refreshed ones", seen())
+	}
+}
+
+func TestRefreshFailsOnce(t *testing.T) {
+	old := testExpiringToken("old", time.Hour)
+	t.Setenv("MAZ_MG_TOKEN", old) // The same token again, so the refresh fails
+	z, seen := newRefreshTestConfig(t, old, "other")
+
+	for i := 0; i < 2; i++ {
+		if _, statCode, _ := ApiGet(z.MgUrl+"/v1.0/users/u1", z, nil); statCode != 401 {
+			t.Fatalf("ApiGet() status %d, want the 401", statCode)
+		}
+	}
+	if got := len(seen()); got != 2 {
+		t.Errorf("made %d calls, want 2, without retrying a token that failed to refresh", got)
+	}
+}
+
+func TestClaimsChallenge(t *testing.T) {
+	claims := `{"access_token":{"nbf":{"essential":true,"value":"1700000000"}}}`
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"standard base64", `Bearer realm="", error="insufficient_claims", claims="` +
+			base64.StdEncoding.EncodeToString([]byte(claims)) + `"`, claims},
+		{"base64url", `Bearer error="insufficient_claims", claims="` +
+			base64.RawURLEncoding.EncodeToString([]byte(claims)) + `"`, claims},
+		{"no claims", `Bearer realm="", error="invalid_token"`, ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimsChallenge(tt.header); got != tt.want {
+				t.Errorf("claimsChallenge() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package maz
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Well-known Azure Resource Manager application ID, the resource of AZ tokens
+const AzureResourceManagerAppId = "797f4846-ba00-4fd7-ba43-dac1f8f63013"
+
+// Directory role templates that carry no admin privileges, and are not listed among the
+// tenant's role definitions
+var defaultRoleTemplates = map[string]string{
+	"b79fbf4d-3ef9-4689-8143-76b194e85509": "Default user role",
+}
+
+// Prints an analysis of the given access token: the identity type, the delegated scopes and
+// application roles it carries, with their descriptions, the directory roles in its wids
+// claim, and the time left before it expires. Permissions and role names are looked up in
+// Azure if z has API tokens set up, otherwise only the local object caches are used, with
+// z.TenantId defaulting to the token's tenant.
+func PrintTokenReport(tokenString string, z *Config) error {
+	claims, err := decodeTokenClaims(tokenString)
+	if err != nil {
+		return wrapError(ErrValidation, err, "error decoding token")
+	}
+	online := z.MgToken != ""
+	tid := utl.Str(claims["tid"])
+	if z.TenantId == "" && utl.ValidUuid(tid) {
+		z.TenantId = tid // To find the local cache files
+	}
+
+	fmt.Printf("%s:\n", utl.Blu("analysis"))
+	identityType := tokenIdentityType(claims)
+	fmt.Printf("  %s: %s\n", utl.Blu("identityType"), utl.Gre(identityType))
+	principal := utl.Str(claims["upn"])
+	for _, k := range []string{"unique_name", "preferred_username", "app_displayname", "name"} {
+		if principal == "" {
+			principal = utl.Str(claims[k])
+		}
+	}
+	fmt.Printf("  %s: %s  %s\n", utl.Blu("principal"), utl.Gre(principal), utl.Gra("# oid "+utl.Str(claims["oid"])))
+	client := utl.Str(claims["appid"])
+	if client == "" {
+		client = utl.Str(claims["azp"]) // v2.0 tokens
+	}
+	if name := utl.Str(claims["app_displayname"]); name != "" {
+		client += "  " + utl.Gra("# "+name)
+	}
+	fmt.Printf("  %s: %s\n", utl.Blu("client"), utl.Gre(client))
+	fmt.Printf("  %s: %s\n", utl.Blu("tenant"), utl.Gre(tid))
+	if amr := utl.Slice(claims["amr"]); len(amr) > 0 {
+		methods := []string{}
+		for _, m := range amr {
+			methods = append(methods, utl.Str(m))
+		}
+		fmt.Printf("  %s: %s\n", utl.Blu("authMethods"), utl.Gre(strings.Join(methods, ", ")))
+	}
+
+	exp := time.Unix(utl.Int64(claims["exp"]), 0)
+	if left := time.Until(exp).Round(time.Second); left > 0 {
+		fmt.Printf("  %s: %s  %s\n", utl.Blu("expiresIn"), utl.Gre(left), utl.Gra("# "+UnixDateTimeString(exp.Unix())))
+	} else {
+		fmt.Printf("  %s: %s  %s\n", utl.Blu("expiresIn"), utl.Red("EXPIRED"), utl.Gra(fmt.Sprintf("# %s ago", -left)))
+	}
+
+	// Scopes and roles are permission values of the token's resource, whose service principal
+	// holds their descriptions and IDs
+	aud := utl.Str(claims["aud"])
+	_, tokenType, _ := cloudForAudience(aud)
+	resourceAppId := aud
+	if !utl.ValidUuid(aud) {
+		resourceAppId = map[string]string{MgApiToken: MsGraphAppId, AzApiToken: AzureResourceManagerAppId}[tokenType]
+	}
+	fmt.Printf("  %s: %s  %s\n", utl.Blu("resource"), utl.Gre(aud), utl.Gra("# "+tokenTypeName(tokenType)))
+	var resourceSp AzureObject
+	if online && resourceAppId != "" {
+		resourceSp = getResourceServicePrincipal(resourceAppId, z)
+	}
+
+	scopes := strings.Fields(utl.Str(claims["scp"]))
+	if len(scopes) > 0 {
+		fmt.Printf("  %s:  %s\n", utl.Blu("scopes"), utl.Gra("# Delegated permissions, acting as the signed-in user"))
+		descriptions := permissionDescriptions(resourceSp, "oauth2PermissionScopes", "adminConsentDisplayName")
+		for _, scope := range scopes {
+			printPermission(scope, descriptions)
+		}
+	}
+	var roles []string
+	for _, r := range utl.Slice(claims["roles"]) {
+		roles = append(roles, utl.Str(r))
+	}
+	if len(roles) > 0 {
+		fmt.Printf("  %s:  %s\n", utl.Blu("roles"), utl.Gra("# Application permissions, acting as the app itself"))
+		descriptions := permissionDescriptions(resourceSp, "appRoles", "displayName")
+		for _, role := range roles {
+			printPermission(role, descriptions)
+		}
+	}
+	if len(scopes) < 1 && len(roles) < 1 {
+		fmt.Printf("  %s: %s\n", utl.Blu("permissions"), utl.Red("none, the token carries no scp or roles claim"))
+	}
+
+	// The wids claim holds the template IDs of the directory roles that were active when the
+	// token was issued, including those activated via PIM
+	if wids := utl.Slice(claims["wids"]); len(wids) > 0 {
+		fmt.Printf("  %s:  %s\n", utl.Blu("directoryRoles"), utl.Gra("# Active at token issue, including PIM activations"))
+		names := directoryRoleNames(z, online)
+		for _, w := range wids {
+			templateId := utl.Str(w)
+			name, ok := names[strings.ToLower(templateId)]
+			if !ok {
+				name = "unknown role template, not in the cached directory role definitions"
+			}
+			fmt.Printf("    %s  %s\n", utl.Gre(templateId), utl.Gra("# "+name))
+		}
+		fmt.Printf("  %s\n", utl.Gra("# Roles activated after the token was issued need a new token"))
+	} else if identityType == "user" {
+		fmt.Printf("  %s: %s\n", utl.Blu("directoryRoles"), utl.Gre("none"))
+	}
+	return nil
+}
+
+// Helper function that returns the identity type of the token: user, service principal or
+// managed identity.
+func tokenIdentityType(claims map[string]interface{}) string {
+	if utl.Str(claims["xms_mirid"]) != "" {
+		return "managed identity" // The identity's Azure resource ID
+	}
+	switch utl.Str(claims["idtyp"]) {
+	case "user":
+		return "user"
+	case "app":
+		return "service principal"
+	}
+	if utl.Str(claims["scp"]) != "" {
+		return "user" // Only delegated tokens have scopes
+	}
+	return "service principal"
+}
+
+// Helper function that returns a readable name for the given token type.
+func tokenTypeName(tokenType string) string {
+	switch tokenType {
+	case MgApiToken:
+		return "MS Graph API"
+	case AzApiToken:
+		return "Azure Resource Manager API"
+	}
+	return "unknown API"
+}
+
+// Helper function that fetches the service principal of the given resource application, with
+// the permissions it exposes. Returns nil if it can't be fetched.
+func getResourceServicePrincipal(appId string, z *Config) AzureObject {
+	apiUrl := z.MgUrl + ApiEndpoint[ServicePrincipal] + "(appId='" + appId + "')"
+	params := map[string]string{"$select": "id,appId,displayName,appRoles,oauth2PermissionScopes"}
+	resp, statCode, _ := ApiGet(apiUrl, z, params)
+	if statCode != 200 {
+		Logf("%s\n", utl.Red2(fmt.Sprintf("HTTP %d: %s", statCode, ApiErrorMsg(resp))))
+		return nil
+	}
+	return AzureObject(resp)
+}
+
+// Helper function that maps the permission values exposed by the resource service principal,
+// under the given list attribute, to their ID and the given description attribute.
+func permissionDescriptions(sp AzureObject, listKey, descKey string) map[string]string {
+	descriptions := make(map[string]string)
+	for _, p := range utl.Slice(sp[listKey]) {
+		if perm := utl.Map(p); perm != nil {
+			descriptions[utl.Str(perm["value"])] = utl.Str(perm[descKey]) + " (" + utl.Str(perm["id"]) + ")"
+		}
+	}
+	return descriptions
+}
+
+// Helper function to print a permission value with its description, if known.
+func printPermission(value string, descriptions map[string]string) {
+	if desc, ok := descriptions[value]; ok {
+		fmt.Printf("    %s  %s\n", utl.Gre(value), utl.Gra("# "+desc))
+	} else {
+		fmt.Printf("    %s\n", utl.Gre(value))
+	}
+}
+
+// Helper function that maps the lowercase template IDs of the directory role definitions to
+// their names, from the local cache, refreshing it from Azure first if online.
+func directoryRoleNames(z *Config, online bool) map[string]string {
+	names := make(map[string]string)
+	for id, name := range defaultRoleTemplates {
+		names[id] = name
+	}
+	var roleDefs AzureObjectList
+	if online {
+		list, err := GetMatchingDirObjects(DirRoleDefinition, "", false, z)
+		if err != nil {
+			Logf("%s\n", utl.Red2(err.Error()))
+		}
+		roleDefs = list
+	} else if cache, err := NewCache(DirRoleDefinition, z); err == nil && cache.Load() == nil {
+		roleDefs, _ = cache.Objects()
+	}
+	for _, x := range roleDefs {
+		if templateId := utl.Str(x["templateId"]); templateId != "" {
+			names[strings.ToLower(templateId)] = utl.Str(x["displayName"])
+		}
+	}
+	return names
+}